@@ -0,0 +1,435 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package apiparams holds the parameters for identity manager API
+// endpoints that are not yet defined in gopkg.in/juju/idmclient.v1/params.
+package apiparams
+
+import (
+	"time"
+
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// SetPasswordRequest is a request to set the password of a user of an
+// identity provider that stores passwords in the identity manager. If
+// the user does not exist it will be created.
+type SetPasswordRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/u/:username/password"`
+	Username          params.Username `httprequest:"username,path"`
+	Body              SetPasswordBody `httprequest:",body"`
+}
+
+// SetPasswordBody holds the body of a SetPasswordRequest.
+type SetPasswordBody struct {
+	// IDP holds the name of the identity provider that will hold
+	// the password. This must be specified when creating a new user,
+	// for an existing user it must be empty or match the user's
+	// identity provider.
+	IDP string `json:"idp,omitempty"`
+
+	// Password holds the new password.
+	Password string `json:"password"`
+}
+
+// ReloadRequest is a request to reload the identity manager's
+// configuration. Only the identity providers are reloaded.
+type ReloadRequest struct {
+	httprequest.Route `httprequest:"POST /v1/reload"`
+}
+
+// SSHCertRequest is a request for an OpenSSH user certificate for the
+// given user. The certificate is valid for principals derived from the
+// user's username and groups.
+type SSHCertRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/ssh-cert"`
+	Username          params.Username `httprequest:"username,path"`
+	Body              SSHCertBody     `httprequest:",body"`
+}
+
+// SSHCertBody holds the body of an SSHCertRequest.
+type SSHCertBody struct {
+	// PublicKey holds the public key to be certified, in the format
+	// used by the OpenSSH authorized_keys file.
+	PublicKey string `json:"public-key"`
+
+	// Validity optionally holds the number of seconds for which the
+	// certificate should be valid. The certificate will never be
+	// valid for longer than the maximum configured in the identity
+	// manager.
+	Validity int `json:"validity,omitempty"`
+}
+
+// SSHCertResponse holds the response to an SSHCertRequest.
+type SSHCertResponse struct {
+	// Certificate holds the signed certificate, in the format used
+	// by the OpenSSH authorized_keys file.
+	Certificate string `json:"certificate"`
+
+	// Principals holds the principals for which the certificate is
+	// valid.
+	Principals []string `json:"principals"`
+
+	// ValidBefore holds the time at which the certificate expires.
+	ValidBefore time.Time `json:"valid-before"`
+}
+
+// SSHCAKeyRequest is a request for the public key of the identity
+// manager's SSH certificate authority.
+type SSHCAKeyRequest struct {
+	httprequest.Route `httprequest:"GET /v1/ssh-ca-key"`
+}
+
+// SSHCAKeyResponse holds the response to an SSHCAKeyRequest.
+type SSHCAKeyResponse struct {
+	// PublicKey holds the public key of the certificate authority,
+	// in the format used by the OpenSSH authorized_keys file. This
+	// is suitable for use in the sshd TrustedUserCAKeys file.
+	PublicKey string `json:"public-key"`
+}
+
+// GroupSSHKeysRequest is a request for the SSH keys of every member of
+// a group.
+type GroupSSHKeysRequest struct {
+	httprequest.Route `httprequest:"GET /v1/g/:group/ssh-keys"`
+	Group             string `httprequest:"group,path"`
+}
+
+// GroupSSHKeysResponse holds the response to a GroupSSHKeysRequest.
+type GroupSSHKeysResponse struct {
+	// SSHKeys holds the SSH keys of the members of the group, keyed
+	// by username. Members without any SSH keys are omitted.
+	SSHKeys map[string][]string `json:"ssh-keys"`
+}
+
+// AgentsRequest is a request for the agents owned by a user.
+type AgentsRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/agents"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// AgentsResponse holds the response to an AgentsRequest.
+type AgentsResponse struct {
+	// Agents holds the agents owned by the user, ordered by
+	// username.
+	Agents []Agent `json:"agents"`
+}
+
+// Agent holds the details of an agent.
+type Agent struct {
+	// Username holds the username of the agent.
+	Username params.Username `json:"username"`
+
+	// FullName holds the name given to the agent when it was
+	// created.
+	FullName string `json:"fullname,omitempty"`
+
+	// Groups holds the groups that the agent was created with. The
+	// agent is only a member of those groups of which its owner is
+	// also a member.
+	Groups []string `json:"groups"`
+
+	// PublicKeys holds the public keys with which the agent can
+	// log in.
+	PublicKeys []*bakery.PublicKey `json:"public-keys"`
+
+	// Expires holds the time after which the agent can no longer
+	// log in. It is nil if the agent does not expire.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// LastLogin holds the time that the agent last logged in.
+	LastLogin *time.Time `json:"last-login,omitempty"`
+}
+
+// ModifyAgentPublicKeysRequest is a request to change the public keys
+// of an agent.
+type ModifyAgentPublicKeysRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/public-keys"`
+	Username          params.Username           `httprequest:"username,path"`
+	Body              ModifyAgentPublicKeysBody `httprequest:",body"`
+}
+
+// ModifyAgentPublicKeysBody holds the body of a
+// ModifyAgentPublicKeysRequest. Keys are added before any are removed,
+// the agent must be left with at least one public key.
+type ModifyAgentPublicKeysBody struct {
+	// Add holds the public keys to add to the agent.
+	Add []*bakery.PublicKey `json:"add,omitempty"`
+
+	// Remove holds the public keys to remove from the agent.
+	Remove []*bakery.PublicKey `json:"remove,omitempty"`
+}
+
+// SetAgentExpiryRequest is a request to set the time after which an
+// agent can no longer log in.
+type SetAgentExpiryRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/u/:username/expires"`
+	Username          params.Username    `httprequest:"username,path"`
+	Body              SetAgentExpiryBody `httprequest:",body"`
+}
+
+// SetAgentExpiryBody holds the body of a SetAgentExpiryRequest.
+type SetAgentExpiryBody struct {
+	// Expires holds the new expiry time. If this is the zero time
+	// the agent will no longer expire.
+	Expires time.Time `json:"expires"`
+}
+
+// RemoveUserRequest is a request to remove a user from the identity
+// manager. Administrators can remove any user except the admin user,
+// the owner of an agent can remove that agent.
+type RemoveUserRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/u/:username"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// RenameUserRequest is a request, only allowed to administrators, to
+// change the username of a user. The old username is kept as an alias
+// so that existing references to the user continue to work.
+type RenameUserRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/rename"`
+	Username          params.Username `httprequest:"username,path"`
+	Body              RenameUserBody  `httprequest:",body"`
+}
+
+// RenameUserBody holds the body of a RenameUserRequest.
+type RenameUserBody struct {
+	// Username holds the new username of the user.
+	Username params.Username `json:"username"`
+}
+
+// UserDisabledRequest is a request to find out whether a user has been
+// disabled.
+type UserDisabledRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/disabled"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// UserDisabledResponse holds the response to a UserDisabledRequest.
+type UserDisabledResponse struct {
+	// Disabled holds whether the user has been disabled.
+	Disabled bool `json:"disabled"`
+}
+
+// SetUserDisabledRequest is a request, only allowed to administrators,
+// to disable or re-enable a user. A disabled user cannot log in and any
+// macaroons previously issued to the user are no longer accepted.
+type SetUserDisabledRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/u/:username/disabled"`
+	Username          params.Username     `httprequest:"username,path"`
+	Body              SetUserDisabledBody `httprequest:",body"`
+}
+
+// SetUserDisabledBody holds the body of a SetUserDisabledRequest.
+type SetUserDisabledBody struct {
+	// Disabled holds whether the user should be disabled.
+	Disabled bool `json:"disabled"`
+}
+
+// LinkIdentityRequest is a request to link another identity to a user.
+// The other identity is proved by macaroons obtained by logging in as
+// that identity, typically through a different identity provider. The
+// other identity is merged into the user and removed, after which
+// logging in as it logs in as the user.
+type LinkIdentityRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/link"`
+	Username          params.Username  `httprequest:"username,path"`
+	Body              LinkIdentityBody `httprequest:",body"`
+}
+
+// LinkIdentityBody holds the body of a LinkIdentityRequest.
+type LinkIdentityBody struct {
+	// Macaroons holds macaroons that authenticate the identity to be
+	// linked.
+	Macaroons macaroon.Slice `json:"macaroons"`
+}
+
+// MergeUserRequest is a request, only allowed to administrators, to
+// merge another user into a user. The groups, public keys and extra
+// information of the other user are added to the user, the other user
+// is linked to the user and then removed.
+type MergeUserRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/merge"`
+	Username          params.Username `httprequest:"username,path"`
+	Body              MergeUserBody   `httprequest:",body"`
+}
+
+// MergeUserBody holds the body of a MergeUserRequest.
+type MergeUserBody struct {
+	// Username holds the username of the user to merge.
+	Username params.Username `json:"username"`
+}
+
+// LinkedIdentitiesResponse holds the response to a LinkIdentityRequest
+// or a MergeUserRequest.
+type LinkedIdentitiesResponse struct {
+	// LinkedIdentities holds the provider specific IDs of all the
+	// identities linked to the user.
+	LinkedIdentities []string `json:"linked-identities"`
+}
+
+// TokensRequest is a request for the personal access tokens owned by a
+// user.
+type TokensRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/tokens"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// TokensResponse holds the response to a TokensRequest.
+type TokensResponse struct {
+	Tokens []Token `json:"tokens"`
+}
+
+// Token holds the information about a personal access token. The token
+// itself is only available when it is created.
+type Token struct {
+	// ID holds the identifier of the token, used to revoke it.
+	ID string `json:"id"`
+
+	// Name holds the name given to the token when it was created.
+	Name string `json:"name"`
+
+	// Scopes holds the scopes granted to the token.
+	Scopes []string `json:"scopes"`
+
+	// Created holds the time the token was created.
+	Created time.Time `json:"created"`
+
+	// Expires holds the time the token expires, if it does.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// LastUsed holds the approximate time the token was last used,
+	// if it has been.
+	LastUsed *time.Time `json:"last-used,omitempty"`
+}
+
+// CreateTokenRequest is a request to create a new personal access token
+// owned by a user. Personal access tokens are sent as a bearer token in
+// the Authorization header of a request and allow the operations
+// permitted by their scopes to be performed as that user.
+type CreateTokenRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/tokens"`
+	Username          params.Username `httprequest:"username,path"`
+	Body              CreateTokenBody `httprequest:",body"`
+}
+
+// CreateTokenBody holds the body of a CreateTokenRequest.
+type CreateTokenBody struct {
+	// Name holds the name of the new token.
+	Name string `json:"name"`
+
+	// Scopes holds the scopes granted to the token. Valid scopes
+	// are "read-user", "read-ssh-keys", "write-ssh-keys",
+	// "ssh-cert" and "read-agents". Only tokens with the
+	// "read-user" scope may be used to log in.
+	Scopes []string `json:"scopes"`
+
+	// Expires optionally holds the time the token will expire.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// CreateTokenResponse holds the response to a CreateTokenRequest.
+type CreateTokenResponse struct {
+	// Token holds the new token. It cannot be retrieved again.
+	Token string `json:"token"`
+
+	// Info holds the information about the new token.
+	Info Token `json:"info"`
+}
+
+// RevokeTokenRequest is a request to revoke a personal access token.
+type RevokeTokenRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/u/:username/tokens/:id"`
+	Username          params.Username `httprequest:"username,path"`
+	ID                string          `httprequest:"id,path"`
+}
+
+// LoginStatus holds the status of an interactive login.
+type LoginStatus string
+
+const (
+	// LoginPending indicates that the login has not yet completed.
+	LoginPending LoginStatus = "pending"
+
+	// LoginCompleted indicates that the user has logged in
+	// successfully and the discharge token is waiting to be
+	// collected.
+	LoginCompleted LoginStatus = "completed"
+
+	// LoginFailed indicates that the login failed or was cancelled.
+	LoginFailed LoginStatus = "failed"
+
+	// LoginExpired indicates that the login is no longer known to the
+	// identity manager, either because it has expired or because the
+	// result has already been collected.
+	LoginExpired LoginStatus = "expired"
+)
+
+// LoginStatusResponse holds the response to a login status request.
+type LoginStatusResponse struct {
+	// Status holds the status of the login.
+	Status LoginStatus `json:"status"`
+
+	// Error holds the reason for the failure when Status is
+	// LoginFailed.
+	Error string `json:"error,omitempty"`
+}
+
+// DeviceInteractionMethod is the name of the interaction method used
+// by clients that cannot open a web browser to log in, such as those
+// running on remote machines.
+const DeviceInteractionMethod = "device"
+
+// DeviceInteractionInfo holds the information sent with the device
+// interaction method.
+type DeviceInteractionInfo struct {
+	// DeviceCodeURL holds the URL to which a POST request must be
+	// sent to obtain a user code for the login.
+	DeviceCodeURL string `json:"device-code-url"`
+
+	// LoginStatusURL holds the URL which can be polled to find out
+	// whether the user has logged in.
+	LoginStatusURL string `json:"login-status-url"`
+
+	// WaitTokenURL holds the URL from which the discharge token can
+	// be obtained once the user has logged in.
+	WaitTokenURL string `json:"wait-token-url"`
+}
+
+// DeviceCodeResponse holds the response to a device code request. The
+// field names follow RFC 8628.
+type DeviceCodeResponse struct {
+	// UserCode holds the code that the user must enter at the
+	// verification URI.
+	UserCode string `json:"user_code"`
+
+	// VerificationURI holds the address of the page at which the
+	// user enters the user code.
+	VerificationURI string `json:"verification_uri"`
+
+	// VerificationURIComplete holds the address of the verification
+	// page with the user code already filled in.
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+
+	// ExpiresIn holds the number of seconds for which the user code
+	// is valid.
+	ExpiresIn int `json:"expires_in"`
+
+	// Interval holds the minimum number of seconds that the client
+	// should wait between polling requests.
+	Interval int `json:"interval"`
+}
+
+// ErrTooManyRequests is the error code returned when a client has made
+// too many requests, or too many failed login attempts, and must wait
+// before trying again. The response will include a Retry-After header
+// giving the number of seconds to wait.
+const ErrTooManyRequests params.ErrorCode = "too many requests"
+
+// ErrConflict is the error code returned when a request conflicts with
+// the current state of the resource, for example when cancelling a
+// login that has already completed.
+const ErrConflict params.ErrorCode = "conflict"
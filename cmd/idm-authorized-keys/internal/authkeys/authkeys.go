@@ -0,0 +1,279 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package authkeys implements an OpenSSH AuthorizedKeysCommand that
+// authorizes the SSH keys of the members of identity manager groups.
+package authkeys
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/juju/loggo"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+	"github.com/CanonicalLtd/blues-identity/config"
+)
+
+var logger = loggo.GetLogger("idm-authorized-keys")
+
+// DefaultCacheMaxAge holds the maximum age of cached keys that will be
+// used when no maximum age is configured.
+const DefaultCacheMaxAge = 24 * time.Hour
+
+// ErrUnavailable is the cause of errors returned by a Fetcher when the
+// identity manager cannot be contacted.
+var ErrUnavailable = errgo.New("identity manager unavailable")
+
+// Config holds the configuration of the command.
+type Config struct {
+	// IDMURL holds the URL of the identity manager.
+	IDMURL string `yaml:"idm-url"`
+
+	// AgentFile holds the path of the file containing the details
+	// of the agent used to log in to the identity manager. The agent
+	// must be a member of sshkeygetter@idm.
+	AgentFile string `yaml:"agent-file"`
+
+	// CacheDir holds the directory in which the keys fetched for
+	// each group are cached. If this is empty keys are not cached.
+	CacheDir string `yaml:"cache-dir"`
+
+	// CacheMaxAge holds the maximum age of cached keys that will be
+	// used when the identity manager cannot be contacted. If this is
+	// zero DefaultCacheMaxAge is used.
+	CacheMaxAge config.DurationString `yaml:"cache-max-age"`
+
+	// Timeout holds the maximum time to wait for the identity
+	// manager before falling back to the cache.
+	Timeout config.DurationString `yaml:"timeout"`
+
+	// Accounts maps local account names to the identity manager
+	// groups whose members may log in to that account.
+	Accounts map[string][]string `yaml:"accounts"`
+}
+
+// ReadConfig reads the configuration file at the given path.
+func ReadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read config file")
+	}
+	var conf Config
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, errgo.Notef(err, "cannot parse %q", path)
+	}
+	if conf.IDMURL == "" {
+		return nil, errgo.Newf("missing idm-url in config file")
+	}
+	if conf.AgentFile == "" {
+		return nil, errgo.Newf("missing agent-file in config file")
+	}
+	return &conf, nil
+}
+
+// A Fetcher fetches the SSH keys of the members of a group.
+type Fetcher interface {
+	// GroupSSHKeys returns the SSH keys of each member of the given
+	// group, keyed by username. If the identity manager cannot be
+	// contacted, or does not respond in time, the returned error has
+	// a cause of ErrUnavailable.
+	GroupSSHKeys(ctx context.Context, group string) (map[string][]string, error)
+}
+
+// NewFetcher returns a Fetcher that fetches keys from the identity
+// manager at the given URL, logging in as the agent whose details
+// are held in the given file.
+func NewFetcher(idmURL, agentFile string) (Fetcher, error) {
+	data, err := ioutil.ReadFile(agentFile)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read agent file")
+	}
+	var authInfo agent.AuthInfo
+	if err := json.Unmarshal(data, &authInfo); err != nil {
+		return nil, errgo.Notef(err, "cannot parse agent data from %q", agentFile)
+	}
+	client := httpbakery.NewClient()
+	if err := agent.SetUpAuth(client, &authInfo); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return fetcher{&httprequest.Client{
+		BaseURL: idmURL,
+		Doer:    client,
+	}}, nil
+}
+
+type fetcher struct {
+	client *httprequest.Client
+}
+
+// GroupSSHKeys implements Fetcher.GroupSSHKeys.
+func (f fetcher) GroupSSHKeys(ctx context.Context, group string) (map[string][]string, error) {
+	var resp apiparams.GroupSSHKeysResponse
+	if err := f.client.Call(ctx, &apiparams.GroupSSHKeysRequest{Group: group}, &resp); err != nil {
+		if ctx.Err() != nil || isTransportError(err) {
+			return nil, errgo.WithCausef(err, ErrUnavailable, "")
+		}
+		return nil, errgo.Mask(err)
+	}
+	return resp.SSHKeys, nil
+}
+
+// isTransportError reports whether the given error, or any error it
+// wraps, is an error from making the HTTP request rather than a
+// response from the identity manager.
+func isTransportError(err error) bool {
+	for err != nil {
+		switch err.(type) {
+		case *url.Error, net.Error:
+			return true
+		}
+		w, ok := err.(interface {
+			Underlying() error
+		})
+		if !ok {
+			break
+		}
+		err = w.Underlying()
+	}
+	return false
+}
+
+// A Resolver resolves the SSH keys authorized for a set of groups.
+type Resolver struct {
+	// Fetcher is used to fetch the keys of each group.
+	Fetcher Fetcher
+
+	// CacheDir holds the directory in which fetched keys are
+	// cached. If this is empty keys are not cached.
+	CacheDir string
+
+	// CacheMaxAge holds the maximum age of cached keys that will be
+	// used when the identity manager is unavailable. If this is zero
+	// DefaultCacheMaxAge is used.
+	CacheMaxAge time.Duration
+}
+
+// Keys returns the SSH keys of the members of all the given groups.
+// If the identity manager is unavailable then any cached keys for a
+// group are used instead. Any other error, such as the agent not being
+// allowed to fetch the keys, is returned. Keys are returned sorted by username
+// and without duplicates.
+func (r *Resolver) Keys(ctx context.Context, groups []string) ([]string, error) {
+	members := make(map[string][]string)
+	for _, g := range groups {
+		keys, err := r.groupKeys(ctx, g)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get keys for group %q", g)
+		}
+		for u, k := range keys {
+			members[u] = append(members[u], k...)
+		}
+	}
+	usernames := make([]string, 0, len(members))
+	for u := range members {
+		usernames = append(usernames, u)
+	}
+	sort.Strings(usernames)
+	var keys []string
+	seen := make(map[string]bool)
+	for _, u := range usernames {
+		for _, k := range members[u] {
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// groupKeys returns the keys for the given group, from the identity
+// manager if possible and from the cache otherwise.
+func (r *Resolver) groupKeys(ctx context.Context, group string) (map[string][]string, error) {
+	keys, err := r.Fetcher.GroupSSHKeys(ctx, group)
+	if err == nil {
+		if err := r.writeCache(group, keys); err != nil {
+			logger.Warningf("cannot cache keys for group %q: %s", group, err)
+		}
+		return keys, nil
+	}
+	if r.CacheDir == "" || errgo.Cause(err) != ErrUnavailable {
+		return nil, errgo.Mask(err)
+	}
+	logger.Warningf("cannot fetch keys for group %q, using cache: %s", group, err)
+	keys, cacheErr := r.readCache(group)
+	if cacheErr != nil {
+		logger.Errorf("cannot read cached keys for group %q: %s", group, cacheErr)
+		return nil, errgo.Mask(err)
+	}
+	return keys, nil
+}
+
+func (r *Resolver) cachePath(group string) string {
+	return filepath.Join(r.CacheDir, url.PathEscape(group)+".json")
+}
+
+func (r *Resolver) readCache(group string) (map[string][]string, error) {
+	path := r.cachePath(group)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	maxAge := r.CacheMaxAge
+	if maxAge == 0 {
+		maxAge = DefaultCacheMaxAge
+	}
+	if time.Since(info.ModTime()) > maxAge {
+		return nil, errgo.Newf("cache is older than %v", maxAge)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var keys map[string][]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return keys, nil
+}
+
+// writeCache atomically replaces the cached keys for the given group.
+func (r *Resolver) writeCache(group string, keys map[string][]string) error {
+	if r.CacheDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.MkdirAll(r.CacheDir, 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	f, err := ioutil.TempFile(r.CacheDir, ".tmp")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(os.Rename(f.Name(), r.cachePath(group)))
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package authkeys_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
+
+	"github.com/CanonicalLtd/blues-identity/cmd/idm-authorized-keys/internal/authkeys"
+)
+
+type authkeysSuite struct{}
+
+var _ = gc.Suite(&authkeysSuite{})
+
+// testFetcher is a Fetcher that returns keys from a fixed set of
+// groups. If err is set then it is returned from all requests.
+type testFetcher struct {
+	groups map[string]map[string][]string
+	err    error
+}
+
+func (f *testFetcher) GroupSSHKeys(ctx context.Context, group string) (map[string][]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.groups[group], nil
+}
+
+var testGroups = map[string]map[string][]string{
+	"ops@idm": {
+		"bob":   {"ssh-ed25519 AAAA2 bob"},
+		"alice": {"ssh-ed25519 AAAA1 alice", "ssh-rsa AAAA3 alice"},
+	},
+	"dev@idm": {
+		"alice":   {"ssh-ed25519 AAAA1 alice"},
+		"charlie": {"ssh-ed25519 AAAA4 charlie"},
+	},
+}
+
+func (s *authkeysSuite) TestKeys(c *gc.C) {
+	r := &authkeys.Resolver{
+		Fetcher: &testFetcher{groups: testGroups},
+	}
+	keys, err := r.Keys(context.Background(), []string{"ops@idm", "dev@idm", "none@idm"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, jc.DeepEquals, []string{
+		"ssh-ed25519 AAAA1 alice",
+		"ssh-rsa AAAA3 alice",
+		"ssh-ed25519 AAAA2 bob",
+		"ssh-ed25519 AAAA4 charlie",
+	})
+}
+
+func (s *authkeysSuite) TestKeysFromCache(c *gc.C) {
+	dir := filepath.Join(c.MkDir(), "cache")
+	f := &testFetcher{groups: testGroups}
+	r := &authkeys.Resolver{
+		Fetcher:  f,
+		CacheDir: dir,
+	}
+	keys, err := r.Keys(context.Background(), []string{"ops@idm"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 3)
+
+	f.err = errgo.WithCausef(nil, authkeys.ErrUnavailable, "connection refused")
+	keys2, err := r.Keys(context.Background(), []string{"ops@idm"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys2, jc.DeepEquals, keys)
+
+	// Groups that have never been fetched cannot be resolved.
+	_, err = r.Keys(context.Background(), []string{"dev@idm"})
+	c.Assert(err, gc.ErrorMatches, `cannot get keys for group "dev@idm": connection refused`)
+
+	// The cache is not used when the identity manager refuses the
+	// request.
+	f.err = errgo.New("permission denied")
+	_, err = r.Keys(context.Background(), []string{"ops@idm"})
+	c.Assert(err, gc.ErrorMatches, `cannot get keys for group "ops@idm": permission denied`)
+}
+
+func (s *authkeysSuite) TestKeysCacheDefaultMaxAge(c *gc.C) {
+	dir := c.MkDir()
+	f := &testFetcher{groups: testGroups}
+	r := &authkeys.Resolver{
+		Fetcher:  f,
+		CacheDir: dir,
+	}
+	_, err := r.Keys(context.Background(), []string{"ops@idm"})
+	c.Assert(err, gc.IsNil)
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(files, gc.HasLen, 1)
+	old := time.Now().Add(-authkeys.DefaultCacheMaxAge - time.Hour)
+	err = os.Chtimes(filepath.Join(dir, files[0].Name()), old, old)
+	c.Assert(err, gc.IsNil)
+
+	f.err = errgo.WithCausef(nil, authkeys.ErrUnavailable, "connection refused")
+	_, err = r.Keys(context.Background(), []string{"ops@idm"})
+	c.Assert(err, gc.ErrorMatches, `cannot get keys for group "ops@idm": connection refused`)
+}
+
+func (s *authkeysSuite) TestFetcherErrors(c *gc.C) {
+	dir := c.MkDir()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		httprequest.WriteJSON(w, http.StatusForbidden, params.Error{
+			Code:    params.ErrForbidden,
+			Message: "permission denied",
+		})
+	}))
+	defer srv.Close()
+	agentFile := filepath.Join(dir, "agent.json")
+	data, err := json.Marshal(agent.AuthInfo{
+		Key: bakery.MustGenerateKey(),
+		Agents: []agent.Agent{{
+			URL:      srv.URL,
+			Username: "keys@idm",
+		}},
+	})
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(agentFile, data, 0600)
+	c.Assert(err, gc.IsNil)
+
+	f, err := authkeys.NewFetcher(srv.URL, agentFile)
+	c.Assert(err, gc.IsNil)
+	_, err = f.GroupSSHKeys(context.Background(), "ops@idm")
+	c.Assert(err, gc.ErrorMatches, `.*permission denied`)
+	c.Assert(errgo.Cause(err), gc.Not(gc.Equals), authkeys.ErrUnavailable)
+
+	srv.Close()
+	_, err = f.GroupSSHKeys(context.Background(), "ops@idm")
+	c.Assert(errgo.Cause(err), gc.Equals, authkeys.ErrUnavailable)
+}
+
+func (s *authkeysSuite) TestKeysCacheExpired(c *gc.C) {
+	dir := c.MkDir()
+	f := &testFetcher{groups: testGroups}
+	r := &authkeys.Resolver{
+		Fetcher:     f,
+		CacheDir:    dir,
+		CacheMaxAge: time.Hour,
+	}
+	_, err := r.Keys(context.Background(), []string{"ops@idm"})
+	c.Assert(err, gc.IsNil)
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(files, gc.HasLen, 1)
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(filepath.Join(dir, files[0].Name()), old, old)
+	c.Assert(err, gc.IsNil)
+
+	f.err = errgo.WithCausef(nil, authkeys.ErrUnavailable, "connection refused")
+	_, err = r.Keys(context.Background(), []string{"ops@idm"})
+	c.Assert(err, gc.ErrorMatches, `cannot get keys for group "ops@idm": connection refused`)
+}
+
+func (s *authkeysSuite) TestKeysNoCache(c *gc.C) {
+	r := &authkeys.Resolver{
+		Fetcher: &testFetcher{err: errgo.WithCausef(nil, authkeys.ErrUnavailable, "connection refused")},
+	}
+	_, err := r.Keys(context.Background(), []string{"ops@idm"})
+	c.Assert(err, gc.ErrorMatches, `cannot get keys for group "ops@idm": connection refused`)
+}
+
+var readConfigTests = []struct {
+	about       string
+	config      string
+	expect      *authkeys.Config
+	expectError string
+}{{
+	about: "valid config",
+	config: `
+idm-url: https://idm.example.com
+agent-file: /etc/idm-authorized-keys/agent.json
+cache-dir: /var/cache/idm-authorized-keys
+cache-max-age: 24h
+timeout: 5s
+accounts:
+  deploy: [ops@idm]
+  root: [admins@idm, ops@idm]
+`,
+	expect: &authkeys.Config{
+		IDMURL:    "https://idm.example.com",
+		AgentFile: "/etc/idm-authorized-keys/agent.json",
+		CacheDir:  "/var/cache/idm-authorized-keys",
+		Accounts: map[string][]string{
+			"deploy": {"ops@idm"},
+			"root":   {"admins@idm", "ops@idm"},
+		},
+	},
+}, {
+	about:       "missing idm-url",
+	config:      "agent-file: agent.json\n",
+	expectError: `missing idm-url in config file`,
+}, {
+	about:       "missing agent-file",
+	config:      "idm-url: https://idm.example.com\n",
+	expectError: `missing agent-file in config file`,
+}}
+
+func (s *authkeysSuite) TestReadConfig(c *gc.C) {
+	dir := c.MkDir()
+	for i, test := range readConfigTests {
+		c.Logf("test %d. %s", i, test.about)
+		path := filepath.Join(dir, "config.yaml")
+		err := ioutil.WriteFile(path, []byte(test.config), 0600)
+		c.Assert(err, gc.IsNil)
+		conf, err := authkeys.ReadConfig(path)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		// The durations are checked separately to keep the
+		// expected values simple.
+		c.Assert(conf.CacheMaxAge.Duration, gc.Equals, 24*time.Hour)
+		c.Assert(conf.Timeout.Duration, gc.Equals, 5*time.Second)
+		conf.CacheMaxAge.Duration = 0
+		conf.Timeout.Duration = 0
+		c.Assert(conf, jc.DeepEquals, test.expect)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/loggo"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/cmd/idm-authorized-keys/internal/authkeys"
+)
+
+// defaultTimeout holds the time to wait for the identity manager when
+// no timeout is configured. sshd does not wait indefinitely for an
+// AuthorizedKeysCommand, so this is kept short.
+const defaultTimeout = 10 * time.Second
+
+var configPath = flag.String("config", "/etc/idm-authorized-keys/config.yaml", "path of the configuration file")
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// Only warnings and errors are logged, to standard error, which
+	// sshd sends to its own log.
+	loggo.GetLogger("").SetLogLevel(loggo.WARNING)
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [options] <account>\n", filepath.Base(os.Args[0]))
+	fmt.Fprint(os.Stderr, `
+Print the SSH keys of the identity manager users who may log in to the
+given local account, one per line. This is intended to be used as the
+sshd AuthorizedKeysCommand, for example:
+
+	AuthorizedKeysCommand /usr/bin/idm-authorized-keys %u
+	AuthorizedKeysCommandUser idm-keys
+
+The configuration file maps each account to the identity manager groups
+whose members may log in to it. Accounts that are not configured have
+no keys.
+
+`)
+	flag.PrintDefaults()
+}
+
+func run(account string) error {
+	conf, err := authkeys.ReadConfig(*configPath)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	groups := conf.Accounts[account]
+	if len(groups) == 0 {
+		return nil
+	}
+	fetcher, err := authkeys.NewFetcher(conf.IDMURL, conf.AgentFile)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	timeout := conf.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r := &authkeys.Resolver{
+		Fetcher:     fetcher,
+		CacheDir:    conf.CacheDir,
+		CacheMaxAge: conf.CacheMaxAge.Duration,
+	}
+	keys, err := r.Keys(ctx, groups)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, k := range keys {
+		fmt.Println(k)
+	}
+	return nil
+}
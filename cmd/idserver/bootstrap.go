@@ -0,0 +1,79 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
+
+	"github.com/CanonicalLtd/blues-identity/config"
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+// bootstrapAdmin creates a new key pair for the admin user, stores its
+// public key in the given store and writes an agent file containing the
+// key pair to the given path. This allows an identity server to be
+// administered without a shared admin password.
+func bootstrapAdmin(conf *config.Config, st store.Store, path string) error {
+	if conf.AdminAgentPublicKey != nil {
+		return errgo.Newf("admin-agent-public-key is already configured")
+	}
+	key, err := bakery.GenerateKey()
+	if err != nil {
+		return errgo.Notef(err, "cannot generate key")
+	}
+	data, err := json.MarshalIndent(&agent.AuthInfo{
+		Key: key,
+		Agents: []agent.Agent{{
+			URL:      conf.Location,
+			Username: auth.AdminUsername,
+		}},
+	}, "", "\t")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	data = append(data, '\n')
+	// Write the agent file before storing the key so that the key
+	// is never stored without the agent file that uses it.
+	if err := writeNewFile(path, data); err != nil {
+		return errgo.Notef(err, "cannot write agent file")
+	}
+	ctx, close := st.Context(context.Background())
+	defer close()
+	if err := auth.BootstrapAdminAgent(ctx, st, &key.Public); err != nil {
+		os.Remove(path)
+		if errgo.Cause(err) == auth.ErrAdminAgentExists {
+			return errgo.Newf("admin agent already exists, cannot bootstrap")
+		}
+		return errgo.Notef(err, "cannot store admin public key")
+	}
+	fmt.Printf("created admin agent %s in %s\n", auth.AdminUsername, path)
+	return nil
+}
+
+// writeNewFile writes data to a new file at the given path, which is
+// readable only by its owner. It is an error if the file already exists.
+func writeNewFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return errgo.Mask(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return errgo.Mask(err)
+	}
+	return nil
+}
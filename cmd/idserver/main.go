@@ -10,12 +10,15 @@ import (
 	"html/template"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/juju/loggo"
 	_ "github.com/lib/pq"
+	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/mgorootkeystore"
@@ -31,17 +34,26 @@ import (
 	_ "github.com/CanonicalLtd/blues-identity/idp/google"
 	_ "github.com/CanonicalLtd/blues-identity/idp/keystone"
 	_ "github.com/CanonicalLtd/blues-identity/idp/ldap"
+	_ "github.com/CanonicalLtd/blues-identity/idp/static"
 	"github.com/CanonicalLtd/blues-identity/idp/usso"
 	_ "github.com/CanonicalLtd/blues-identity/idp/usso/ussodischarge"
 	"github.com/CanonicalLtd/blues-identity/idp/usso/ussooauth"
+	_ "github.com/CanonicalLtd/blues-identity/idp/webauthn"
+	"github.com/CanonicalLtd/blues-identity/internal/logging"
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
+	"github.com/CanonicalLtd/blues-identity/meeting/redispubsub"
 	"github.com/CanonicalLtd/blues-identity/mgostore"
 	"github.com/CanonicalLtd/blues-identity/sqlstore"
+	"github.com/CanonicalLtd/blues-identity/store"
 )
 
 var (
 	logger        = loggo.GetLogger("idserver")
 	loggingConfig = flag.String("logging-config", "", "specify log levels for modules e.g. <root>=TRACE")
 	resourcePath  = flag.String("resource-path", "", "specify the path for resource files")
+	bootstrap     = flag.String("bootstrap-admin", "", "create the first admin agent, write its details to the given file and exit")
+	checkConfig   = flag.Bool("check-config", false, "check the configuration file and exit")
 )
 
 func main() {
@@ -75,6 +87,16 @@ func serve(confPath string) error {
 	if err != nil {
 		return errgo.Notef(err, "cannot read config file %q", confPath)
 	}
+	if *checkConfig {
+		fmt.Printf("%s: configuration OK (%d identity providers)\n", confPath, len(conf.IdentityProviders))
+		return nil
+	}
+
+	if conf.LogFormat == "json" {
+		if _, err := loggo.ReplaceDefaultWriter(logging.NewJSONWriter(os.Stderr)); err != nil {
+			return errgo.Notef(err, "cannot set log writer")
+		}
+	}
 
 	if conf.HTTPProxy != "" {
 		os.Setenv("HTTP_PROXY", conf.HTTPProxy)
@@ -83,18 +105,34 @@ func serve(confPath string) error {
 		os.Setenv("NO_PROXY", conf.NoProxy)
 	}
 
+	if conf.OTLPEndpoint != "" {
+		logger.Infof("exporting traces to %s", conf.OTLPEndpoint)
+		shutdown, err := tracing.Setup(context.Background(), tracing.Params{
+			Endpoint: conf.OTLPEndpoint,
+			Insecure: conf.OTLPInsecure,
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer func() {
+			if err := shutdown(context.Background()); err != nil {
+				logger.Errorf("cannot flush traces: %s", err)
+			}
+		}()
+	}
+
 	switch {
 	case conf.MongoAddr != "":
-		return serveMgoServer(conf)
+		return serveMgoServer(confPath, conf)
 	case conf.PostgresConnectionString != "":
-		return servePostgresServer(conf)
+		return servePostgresServer(confPath, conf)
 	default:
 		// This should be detected when reading the config earlier
 		return errgo.Newf("no database configured")
 	}
 }
 
-func serveMgoServer(conf *config.Config) error {
+func serveMgoServer(confPath string, conf *config.Config) error {
 	logger.Infof("connecting to mongo")
 	session, err := mgo.Dial(conf.MongoAddr)
 	if err != nil {
@@ -107,8 +145,8 @@ func serveMgoServer(conf *config.Config) error {
 		return errgo.Notef(err, "cannot initialise database")
 	}
 	defer database.Close()
-	return serveIdentity(conf, identity.ServerParams{
-		Store:             database.Store(),
+	return serveIdentity(confPath, conf, identity.ServerParams{
+		Store:             instrumentStore(database.Store(), "mongodb"),
 		ProviderDataStore: database.ProviderDataStore(),
 		MeetingStore:      database.MeetingStore(),
 		RootKeyStore: database.BakeryRootKeyStore(mgorootkeystore.Policy{
@@ -118,7 +156,7 @@ func serveMgoServer(conf *config.Config) error {
 	})
 }
 
-func servePostgresServer(conf *config.Config) error {
+func servePostgresServer(confPath string, conf *config.Config) error {
 	logger.Infof("connecting to postgresql")
 	db, err := sql.Open("postgres", conf.PostgresConnectionString)
 	if err != nil {
@@ -131,25 +169,32 @@ func servePostgresServer(conf *config.Config) error {
 	defer database.Close()
 	rootkeys := postgresrootkeystore.NewRootKeys(db, "rootkeys", 1000)
 	defer rootkeys.Close()
-	return serveIdentity(conf, identity.ServerParams{
-		Store:             database.Store(),
+	params := identity.ServerParams{
+		Store:             instrumentStore(database.Store(), "postgres"),
 		ProviderDataStore: database.ProviderDataStore(),
 		MeetingStore:      database.MeetingStore(),
 		RootKeyStore: rootkeys.NewStore(postgresrootkeystore.Policy{
 			ExpiryDuration: 365 * 24 * time.Hour,
 		}),
-	})
+	}
+	if conf.RendezvousTransport == "postgres" {
+		params.MeetingPubSub = database.MeetingPubSub(conf.PostgresConnectionString)
+	}
+	return serveIdentity(confPath, conf, params)
 }
 
-func serveIdentity(conf *config.Config, params identity.ServerParams) error {
-	logger.Infof("setting up the identity server")
-	params.IdentityProviders = defaultIDPs
-	if len(conf.IdentityProviders) > 0 {
-		params.IdentityProviders = make([]idp.IdentityProvider, len(conf.IdentityProviders))
-		for i, idp := range conf.IdentityProviders {
-			params.IdentityProviders[i] = idp.IdentityProvider
-		}
+// instrumentStore wraps the given store so that its operations are
+// recorded in both metrics and traces.
+func instrumentStore(s store.Store, backend string) store.Store {
+	return tracing.InstrumentStore(monitoring.InstrumentStore(s, backend), backend)
+}
+
+func serveIdentity(confPath string, conf *config.Config, params identity.ServerParams) error {
+	if *bootstrap != "" {
+		return bootstrapAdmin(conf, params.Store, *bootstrap)
 	}
+	logger.Infof("setting up the identity server")
+	params.IdentityProviders = identityProviders(conf)
 
 	// If a resource path is specified on the commandline, it takes precedence
 	// over the one in the config.
@@ -170,6 +215,8 @@ func serveIdentity(conf *config.Config, params identity.ServerParams) error {
 
 	params.AuthUsername = conf.AuthUsername
 	params.AuthPassword = conf.AuthPassword
+	params.AuthPasswordHash = conf.AuthPasswordHash
+	params.AdminGroups = conf.AdminGroups
 	params.Key = &bakery.KeyPair{
 		Private: *conf.PrivateKey,
 		Public:  *conf.PublicKey,
@@ -177,18 +224,62 @@ func serveIdentity(conf *config.Config, params identity.ServerParams) error {
 	params.WaitTimeout = conf.WaitTimeout.Duration
 	params.Location = conf.Location
 	params.PrivateAddr = conf.PrivateAddr
+	switch conf.RendezvousTransport {
+	case "redis":
+		ps := redispubsub.New(redispubsub.Params{
+			Addr:     conf.RedisAddr,
+			Password: conf.RedisPassword,
+		})
+		defer ps.Close()
+		params.MeetingPubSub = ps
+	case "postgres":
+		if params.MeetingPubSub == nil {
+			return errgo.Newf("postgres rendezvous-transport requires a postgres database")
+		}
+	}
 	params.DebugTeams = conf.DebugTeams
 	params.AdminAgentPublicKey = conf.AdminAgentPublicKey
-	srv, err := identity.NewServer(
+	params.TOTPKey = (*[32]byte)(conf.TOTPKey)
+	params.TOTPIssuer = conf.TOTPIssuer
+	params.TOTPRequiredGroups = conf.TOTPRequiredGroups
+	params.WebAuthnRPID = conf.WebAuthnRPID
+	params.WebAuthnAttestationRoots, err = conf.WebAuthnAttestationRootPool()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	params.WebAuthnRequiredGroups = conf.WebAuthnRequiredGroups
+	params.IPRateLimit = conf.RateLimitIP
+	params.IPRateBurst = conf.RateLimitIPBurst
+	params.UserRateLimit = conf.RateLimitUser
+	params.UserRateBurst = conf.RateLimitUserBurst
+	params.MaxFailedLogins = conf.MaxFailedLogins
+	params.FailedLoginLockout = conf.FailedLoginLockout.Duration
+	params.TrustedProxies, err = conf.TrustedProxyNets()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	params.SSHCAKey, err = conf.SSHCASigner()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	params.SSHCertValidity = conf.SSHCertValidity.Duration
+	params.MaxAgentDepth = conf.MaxAgentDepth
+	var srv identity.HandlerCloser
+	params.Reload = func() error {
+		return reloadIdentityProviders(confPath, srv)
+	}
+	srv, err = identity.NewServer(
 		params,
 		identity.V1,
 		identity.Debug,
 		identity.Discharger,
+		identity.Admin,
 	)
 	if err != nil {
 		return errgo.Notef(err, "cannot create new server at %q", conf.APIAddr)
 	}
 	defer srv.Close()
+	go reloadOnSIGHUP(confPath, srv)
 
 	// Cast the Server to an http.Handler so that it can be
 	// optionally wrapped by the logging handler below.
@@ -201,8 +292,13 @@ func serveIdentity(conf *config.Config, params identity.ServerParams) error {
 			MaxBackups: 3,
 			MaxAge:     28, //days
 		}
-		server = handlers.CombinedLoggingHandler(accesslog, server)
+		if conf.LogFormat == "json" {
+			server = logging.AccessLogHandler(accesslog, server)
+		} else {
+			server = handlers.CombinedLoggingHandler(accesslog, server)
+		}
 	}
+	server = logging.RequestIDHandler(server, params.TrustedProxies)
 
 	logger.Infof("starting the identity server")
 
@@ -218,7 +314,56 @@ func serveIdentity(conf *config.Config, params identity.ServerParams) error {
 	return httpServer.ListenAndServe()
 }
 
-var defaultIDPs = []idp.IdentityProvider{
-	usso.IdentityProvider,
-	ussooauth.IdentityProvider,
+// identityProviders returns the identity providers specified in the
+// given configuration.
+func identityProviders(conf *config.Config) []idp.IdentityProvider {
+	if len(conf.IdentityProviders) == 0 {
+		return defaultIDPs()
+	}
+	idps := make([]idp.IdentityProvider, len(conf.IdentityProviders))
+	for i, idp := range conf.IdentityProviders {
+		idps[i] = idp.IdentityProvider
+	}
+	return idps
+}
+
+// reloadIdentityProviders reads the configuration file at the given
+// path and replaces the identity providers used by srv with those
+// specified in it. If the configuration is not valid the identity
+// providers are left unchanged. Only the identity providers are
+// reloaded, changes to any other settings require a restart.
+func reloadIdentityProviders(confPath string, srv identity.HandlerCloser) error {
+	conf, err := config.Read(confPath)
+	if err != nil {
+		return errgo.Notef(err, "cannot read config file %q", confPath)
+	}
+	if err := srv.ReloadIdentityProviders(identityProviders(conf)); err != nil {
+		return errgo.Mask(err)
+	}
+	logger.Infof("reloaded identity providers from %q", confPath)
+	return nil
+}
+
+// reloadOnSIGHUP reloads the identity providers used by srv from the
+// configuration file at the given path whenever the process receives
+// SIGHUP.
+func reloadOnSIGHUP(confPath string, srv identity.HandlerCloser) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := reloadIdentityProviders(confPath, srv); err != nil {
+			logger.Errorf("cannot reload identity providers: %s", err)
+		}
+	}
+}
+
+// defaultIDPs returns the identity providers that are used when none
+// are configured. New instances are returned each time so that
+// reloading doesn't reinitialise identity providers that are still in
+// use.
+func defaultIDPs() []idp.IdentityProvider {
+	return []idp.IdentityProvider{
+		usso.NewIdentityProvider(),
+		ussooauth.NewIdentityProvider(),
+	}
 }
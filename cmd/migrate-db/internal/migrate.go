@@ -44,15 +44,16 @@ type Source interface {
 func Copy(ctx context.Context, dst store.Store, src Source) error {
 	var failed bool
 	update := store.Update{
-		store.Username:      store.Set,
-		store.Name:          store.Set,
-		store.Email:         store.Set,
-		store.Groups:        store.Set,
-		store.PublicKeys:    store.Set,
-		store.LastLogin:     store.Set,
-		store.LastDischarge: store.Set,
-		store.ProviderInfo:  store.Set,
-		store.ExtraInfo:     store.Set,
+		store.Username:          store.Set,
+		store.Name:              store.Set,
+		store.Email:             store.Set,
+		store.Groups:            store.Set,
+		store.PublicKeys:        store.Set,
+		store.LastLogin:         store.Set,
+		store.LastDischarge:     store.Set,
+		store.ProviderInfo:      store.Set,
+		store.ExtraInfo:         store.Set,
+		store.LinkedProviderIDs: store.Set,
 	}
 	for src.Next() {
 		identity := src.Identity()
@@ -0,0 +1,129 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+)
+
+type agentsCommand struct {
+	userCommand
+
+	out cmd.Output
+}
+
+func newAgentsCommand() cmd.Command {
+	return &agentsCommand{}
+}
+
+var agentsDoc = `
+The agents command lists the agents owned by a user. If no user is
+specified then the agents owned by the currently authenticated user are
+listed.
+
+    user-admin agents
+    user-admin agents -a admin.agent -u bob --format yaml
+`
+
+func (c *agentsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "agents",
+		Purpose: "list agents",
+		Doc:     agentsDoc,
+	}
+}
+
+func (c *agentsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.userCommand.SetFlags(f)
+
+	c.out.AddFlags(f, "tab", map[string]cmd.Formatter{
+		"yaml": cmd.FormatYaml,
+		"json": cmd.FormatJson,
+		"tab":  formatAgentsTab,
+	})
+}
+
+func (c *agentsCommand) Init(args []string) error {
+	if c.username != "" && c.email != "" {
+		return errgo.New("both username and email specified, please specify either username or email")
+	}
+	return errgo.Mask(c.idmCommand.Init(args))
+}
+
+func (c *agentsCommand) Run(ctxt *cmd.Context) error {
+	ctx := context.Background()
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var username params.Username
+	if c.username != "" || c.email != "" {
+		username, err = c.lookupUser(ctxt)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	} else {
+		resp, err := client.WhoAmI(ctx, &params.WhoAmIRequest{})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		username = params.Username(resp.User)
+	}
+	var resp apiparams.AgentsResponse
+	if err := client.Client.Call(ctx, &apiparams.AgentsRequest{
+		Username: username,
+	}, &resp); err != nil {
+		return errgo.Mask(err)
+	}
+	agents := make([]agentInfo, len(resp.Agents))
+	for i, a := range resp.Agents {
+		agents[i] = agentInfo{
+			Username:   string(a.Username),
+			Name:       a.FullName,
+			Groups:     a.Groups,
+			PublicKeys: a.PublicKeys,
+			Expires:    timeString(a.Expires),
+			LastLogin:  timeString(a.LastLogin),
+		}
+	}
+	return c.out.Write(ctxt, agents)
+}
+
+// agentInfo represents an agent in the output of the agents command.
+type agentInfo struct {
+	Username   string              `json:"username" yaml:"username"`
+	Name       string              `json:"name,omitempty" yaml:"name,omitempty"`
+	Groups     []string            `json:"groups" yaml:"groups"`
+	PublicKeys []*bakery.PublicKey `json:"public-keys" yaml:"public-keys"`
+	Expires    string              `json:"expires" yaml:"expires"`
+	LastLogin  string              `json:"last-login" yaml:"last-login"`
+}
+
+func formatAgentsTab(writer io.Writer, value interface{}) error {
+	agents, ok := value.([]agentInfo)
+	if !ok {
+		return errgo.Newf("unexpected value %T", value)
+	}
+	tw := tabwriter.NewWriter(writer, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "USERNAME\tNAME\tEXPIRES\tLAST-LOGIN")
+	for _, a := range agents {
+		name := a.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.Username, name, a.Expires, a.LastLogin)
+	}
+	return errgo.Mask(tw.Flush())
+}
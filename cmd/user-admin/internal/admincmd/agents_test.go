@@ -0,0 +1,111 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+)
+
+type agentsSuite struct {
+	commandSuite
+}
+
+var _ = gc.Suite(&agentsSuite{})
+
+func (s *agentsSuite) TestAgents(c *gc.C) {
+	var username params.Username
+	expires := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	runf := s.RunServer(c, &handler{
+		whoAmI: func(*params.WhoAmIRequest) (*params.WhoAmIResponse, error) {
+			return &params.WhoAmIResponse{User: "bob"}, nil
+		},
+		agents: func(r *apiparams.AgentsRequest) (*apiparams.AgentsResponse, error) {
+			username = r.Username
+			return &apiparams.AgentsResponse{
+				Agents: []apiparams.Agent{{
+					Username:   "a-1@idm",
+					FullName:   "build agent",
+					Groups:     []string{"g1"},
+					PublicKeys: []*bakery.PublicKey{},
+					Expires:    &expires,
+				}, {
+					Username:   "a-2@idm",
+					Groups:     []string{},
+					PublicKeys: []*bakery.PublicKey{},
+				}},
+			}, nil
+		},
+	})
+	stdout := CheckSuccess(c, runf, "agents", "-a", "admin.agent")
+	c.Assert(username, gc.Equals, params.Username("bob"))
+	c.Assert(stdout, gc.Equals, `
+USERNAME NAME        EXPIRES              LAST-LOGIN
+a-1@idm  build agent 2018-03-01T12:00:00Z never
+a-2@idm  -           never                never
+`[1:])
+}
+
+func (s *agentsSuite) TestAgentsForUser(c *gc.C) {
+	var username params.Username
+	runf := s.RunServer(c, &handler{
+		agents: func(r *apiparams.AgentsRequest) (*apiparams.AgentsResponse, error) {
+			username = r.Username
+			return &apiparams.AgentsResponse{
+				Agents: []apiparams.Agent{{
+					Username:   "a-1@idm",
+					Groups:     []string{"g1"},
+					PublicKeys: []*bakery.PublicKey{},
+				}},
+			}, nil
+		},
+	})
+	stdout := CheckSuccess(c, runf, "agents", "-a", "admin.agent", "-u", "alice", "--format", "yaml")
+	c.Assert(username, gc.Equals, params.Username("alice"))
+	c.Assert(stdout, gc.Equals, `
+- username: a-1@idm
+  groups:
+  - g1
+  public-keys: []
+  expires: never
+  last-login: never
+`[1:])
+}
+
+type rmAgentSuite struct {
+	commandSuite
+}
+
+var _ = gc.Suite(&rmAgentSuite{})
+
+func (s *rmAgentSuite) TestRmAgent(c *gc.C) {
+	var removed []params.Username
+	runf := s.RunServer(c, &handler{
+		removeUser: func(r *apiparams.RemoveUserRequest) error {
+			removed = append(removed, r.Username)
+			return nil
+		},
+	})
+	CheckNoOutput(c, runf, "rm-agent", "-a", "admin.agent", "a-1@idm", "a-2@idm")
+	c.Assert(removed, gc.DeepEquals, []params.Username{"a-1@idm", "a-2@idm"})
+}
+
+func (s *rmAgentSuite) TestRmAgentError(c *gc.C) {
+	runf := s.RunServer(c, &handler{
+		removeUser: func(r *apiparams.RemoveUserRequest) error {
+			return params.ErrForbidden
+		},
+	})
+	CheckError(c, 1, `cannot remove a-1@idm: Delete .*: forbidden`, runf, "rm-agent", "-a", "admin.agent", "a-1@idm")
+}
+
+func (s *rmAgentSuite) TestUsage(c *gc.C) {
+	CheckError(c, 2, `no agent specified`, s.Run, "rm-agent")
+	CheckError(c, 2, `"bob" is not an agent username`, s.Run, "rm-agent", "bob")
+}
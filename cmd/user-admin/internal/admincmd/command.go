@@ -23,6 +23,8 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+	"github.com/CanonicalLtd/blues-identity/devicelogin"
 	"github.com/CanonicalLtd/blues-identity/version"
 )
 
@@ -48,10 +50,14 @@ func New() cmd.Command {
 		Version: version.VersionInfo.Version,
 	})
 	supercmd.Register(newAddGroupCommand())
+	supercmd.Register(newAgentsCommand())
 	supercmd.Register(newPutAgentCommand())
 	supercmd.Register(newFindCommand())
 	supercmd.Register(newRemoveGroupCommand())
+	supercmd.Register(newRmAgentCommand())
+	supercmd.Register(newSetPasswordCommand())
 	supercmd.Register(newShowCommand())
+	supercmd.Register(newSSHCertCommand())
 	return supercmd
 }
 
@@ -61,8 +67,9 @@ func New() cmd.Command {
 type idmCommand struct {
 	cmd.CommandBase
 
-	url       string
-	agentFile string
+	url         string
+	agentFile   string
+	deviceLogin bool
 
 	// mu protects the fields below it.
 	mu     sync.Mutex
@@ -74,6 +81,7 @@ func (c *idmCommand) SetFlags(f *gnuflag.FlagSet) {
 	f.StringVar(&c.url, "idm-url", "", "URL of the identity server (defaults to $IDM_URL)")
 	f.StringVar(&c.agentFile, "a", "", "name of file containing agent login details")
 	f.StringVar(&c.agentFile, "agent", "", "")
+	f.BoolVar(&c.deviceLogin, "device-login", false, "log in by entering a code in a web browser, which may be on another machine")
 }
 
 // Client creates a new idmclient.Client using the parameters specified
@@ -85,6 +93,14 @@ func (c *idmCommand) Client(ctxt *cmd.Context) (*idmclient.Client, error) {
 		return c.client, nil
 	}
 	bClient := httpbakery.NewClient()
+	if c.deviceLogin {
+		bClient.AddInteractor(devicelogin.Interactor{
+			Prompt: func(resp *apiparams.DeviceCodeResponse) error {
+				fmt.Fprintf(ctxt.Stderr, "To log in, visit %s and enter the code %s\n", resp.VerificationURI, resp.UserCode)
+				return nil
+			},
+		})
+	}
 	bClient.AddInteractor(httpbakery.WebBrowserInteractor{})
 	var err error
 	bClient.Client.Jar, err = cookiejar.New(&cookiejar.Options{
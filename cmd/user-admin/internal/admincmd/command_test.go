@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"net/http"
 	"path/filepath"
+	"strings"
 
 	"github.com/juju/cmd"
 	"github.com/juju/testing"
@@ -20,6 +21,7 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 
+	"github.com/CanonicalLtd/blues-identity/apiparams"
 	"github.com/CanonicalLtd/blues-identity/cmd/user-admin/internal/admincmd"
 )
 
@@ -28,12 +30,17 @@ type commandSuite struct {
 
 	Dir string
 
+	// Stdin holds the data that will be available on standard input
+	// to commands run with Run.
+	Stdin string
+
 	command cmd.Command
 }
 
 func (s *commandSuite) SetUpTest(c *gc.C) {
 	s.IsolationSuite.SetUpTest(c)
 	s.Dir = c.MkDir()
+	s.Stdin = ""
 	s.command = admincmd.New()
 }
 
@@ -61,7 +68,7 @@ func (s *commandSuite) Run(args ...string) (code int, stdout, stderr string) {
 	errbuf := new(bytes.Buffer)
 	ctxt := &cmd.Context{
 		Dir:    s.Dir,
-		Stdin:  bytes.NewReader(nil),
+		Stdin:  strings.NewReader(s.Stdin),
 		Stdout: outbuf,
 		Stderr: errbuf,
 	}
@@ -139,11 +146,16 @@ func (srv *server) newHandler(p httprequest.Params) (*handler, context.Context,
 }
 
 type handler struct {
-	modifyGroups func(*params.ModifyUserGroupsRequest) error
-	queryUsers   func(*params.QueryUsersRequest) ([]string, error)
-	createAgent  func(*params.CreateAgentRequest) (*params.CreateAgentResponse, error)
-	user         func(*params.UserRequest) (*params.User, error)
-	whoAmI       func(*params.WhoAmIRequest) (*params.WhoAmIResponse, error)
+	modifyGroups   func(*params.ModifyUserGroupsRequest) error
+	queryUsers     func(*params.QueryUsersRequest) ([]string, error)
+	createAgent    func(*params.CreateAgentRequest) (*params.CreateAgentResponse, error)
+	user           func(*params.UserRequest) (*params.User, error)
+	whoAmI         func(*params.WhoAmIRequest) (*params.WhoAmIResponse, error)
+	setPassword    func(*apiparams.SetPasswordRequest) error
+	sshCert        func(*apiparams.SSHCertRequest) (*apiparams.SSHCertResponse, error)
+	agents         func(*apiparams.AgentsRequest) (*apiparams.AgentsResponse, error)
+	removeUser     func(*apiparams.RemoveUserRequest) error
+	setAgentExpiry func(*apiparams.SetAgentExpiryRequest) error
 }
 
 func (h *handler) ModifyGroups(req *params.ModifyUserGroupsRequest) error {
@@ -166,6 +178,26 @@ func (h *handler) WhoAmI(p *params.WhoAmIRequest) (*params.WhoAmIResponse, error
 	return h.whoAmI(p)
 }
 
+func (h *handler) SetPassword(p *apiparams.SetPasswordRequest) error {
+	return h.setPassword(p)
+}
+
+func (h *handler) SSHCert(p *apiparams.SSHCertRequest) (*apiparams.SSHCertResponse, error) {
+	return h.sshCert(p)
+}
+
+func (h *handler) Agents(p *apiparams.AgentsRequest) (*apiparams.AgentsResponse, error) {
+	return h.agents(p)
+}
+
+func (h *handler) RemoveUser(p *apiparams.RemoveUserRequest) error {
+	return h.removeUser(p)
+}
+
+func (h *handler) SetAgentExpiry(p *apiparams.SetAgentExpiryRequest) error {
+	return h.setAgentExpiry(p)
+}
+
 func (srv *server) checkLogin(ctx context.Context, req *http.Request) error {
 	_, authErr := srv.bakery.Checker.Auth(httpbakery.RequestMacaroons(req)...).Allow(context.TODO(), identchecker.LoginOp)
 	derr, ok := errgo.Cause(authErr).(*bakery.DischargeRequiredError)
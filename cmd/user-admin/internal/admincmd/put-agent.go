@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/juju/cmd"
 	"github.com/juju/gnuflag"
@@ -16,6 +17,7 @@ import (
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 
+	"github.com/CanonicalLtd/blues-identity/apiparams"
 	"github.com/CanonicalLtd/blues-identity/internal/auth"
 )
 
@@ -26,6 +28,7 @@ type putAgentCommand struct {
 	agentFullName string
 	admin         bool
 	publicKey     *bakery.PublicKey
+	expires       time.Duration
 }
 
 func newPutAgentCommand() cmd.Command {
@@ -47,6 +50,9 @@ as the currently authenticated user is a member of those groups.
 A new key will be generated unless a key is specified with the -k
 flag or a key is found in the agent file (see below).
 
+If the --expires flag is specified, the agent will not be able to log
+in once that length of time has passed.
+
 If the --agent-file flag is specified, the specified file will be updated with
 the new agent information, otherwise the new agent information will be
 printed to the standard output. Note when the -k flag is specified,
@@ -70,6 +76,7 @@ func (c *putAgentCommand) SetFlags(f *gnuflag.FlagSet) {
 	f.StringVar(&c.agentFile, "agent-file", "", "")
 	f.BoolVar(&c.admin, "admin", false, "generate an agent file for the admin user; does not contact the identity manager service")
 	f.StringVar(&c.agentFullName, "name", "", "name of agent")
+	f.DurationVar(&c.expires, "expires", 0, "length of time after which the agent can no longer log in")
 }
 
 func (c *putAgentCommand) Init(args []string) error {
@@ -77,6 +84,12 @@ func (c *putAgentCommand) Init(args []string) error {
 	if c.agentFile != "" && c.publicKey != nil {
 		return errgo.Newf("cannot specify public key and an agent file")
 	}
+	if c.expires < 0 {
+		return errgo.Newf("invalid expiry time %v", c.expires)
+	}
+	if c.admin && c.expires != 0 {
+		return errgo.Newf("cannot specify an expiry time for the admin agent")
+	}
 	return errgo.Mask(c.idmCommand.Init(nil))
 }
 
@@ -125,6 +138,18 @@ func (c *putAgentCommand) Run(cmdctx *cmd.Context) error {
 			return errgo.Mask(err)
 		}
 		username = resp.Username
+		if c.expires > 0 {
+			// The expiry time is not part of the idmclient API
+			// so the request is made directly.
+			if err := client.Client.Call(ctx, &apiparams.SetAgentExpiryRequest{
+				Username: username,
+				Body: apiparams.SetAgentExpiryBody{
+					Expires: time.Now().Add(c.expires),
+				},
+			}, nil); err != nil {
+				return errgo.Notef(err, "cannot set expiry time of agent %s", username)
+			}
+		}
 	}
 	if agents != nil {
 		if agents.Key == nil {
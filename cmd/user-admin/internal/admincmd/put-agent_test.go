@@ -6,6 +6,7 @@ package admincmd_test
 import (
 	"encoding/json"
 	"path/filepath"
+	"time"
 
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
@@ -13,6 +14,7 @@ import (
 	"gopkg.in/juju/idmclient.v1/params"
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 
+	"github.com/CanonicalLtd/blues-identity/apiparams"
 	"github.com/CanonicalLtd/blues-identity/cmd/user-admin/internal/admincmd"
 )
 
@@ -38,6 +40,14 @@ var putAgentUsageTests = []struct {
 	about:       "invalid public key",
 	args:        []string{"-k", "xxx", "bob"},
 	expectError: `invalid value "xxx" for flag -k: wrong length for key, got 2 want 32`,
+}, {
+	about:       "negative expiry time",
+	args:        []string{"--expires", "-1h", "bob"},
+	expectError: `invalid expiry time -1h0m0s`,
+}, {
+	about:       "expiry time for admin agent",
+	args:        []string{"--admin", "--expires", "1h"},
+	expectError: `cannot specify an expiry time for the admin agent`,
 }}
 
 func (s *putAgentSuite) TestUsage(c *gc.C) {
@@ -154,3 +164,23 @@ func (s *putAgentSuite) TestPutAgentWithAdminFlag(c *gc.C) {
 	c.Assert(agents[0].Username, gc.Equals, "admin@idm")
 	c.Assert(agents[0].URL, gc.Equals, idmclient.Production)
 }
+
+func (s *putAgentSuite) TestPutAgentWithExpiry(c *gc.C) {
+	var expiryReq *apiparams.SetAgentExpiryRequest
+	runf := s.RunServer(c, &handler{
+		createAgent: func(req *params.CreateAgentRequest) (*params.CreateAgentResponse, error) {
+			return &params.CreateAgentResponse{
+				Username: "a-foo@idm",
+			}, nil
+		},
+		setAgentExpiry: func(req *apiparams.SetAgentExpiryRequest) error {
+			expiryReq = req
+			return nil
+		},
+	})
+	CheckSuccess(c, runf, "put-agent", "-a", "admin.agent", "--expires", "24h")
+	c.Assert(expiryReq, gc.NotNil)
+	c.Assert(expiryReq.Username, gc.Equals, params.Username("a-foo@idm"))
+	d := time.Until(expiryReq.Body.Expires)
+	c.Assert(d > 23*time.Hour && d <= 24*time.Hour, gc.Equals, true, gc.Commentf("expires in %v", d))
+}
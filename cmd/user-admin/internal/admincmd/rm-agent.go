@@ -0,0 +1,70 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"strings"
+
+	"github.com/juju/cmd"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+)
+
+type rmAgentCommand struct {
+	idmCommand
+
+	usernames []params.Username
+}
+
+func newRmAgentCommand() cmd.Command {
+	return &rmAgentCommand{}
+}
+
+var rmAgentDoc = `
+The rm-agent command removes the specified agents from the identity
+server. Agents can be removed by their owner or by an administrator.
+
+    user-admin rm-agent a-0123456789abcdef@idm
+`
+
+func (c *rmAgentCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "rm-agent",
+		Args:    "<username>...",
+		Purpose: "remove agents",
+		Doc:     rmAgentDoc,
+	}
+}
+
+func (c *rmAgentCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errgo.New("no agent specified")
+	}
+	for _, arg := range args {
+		if !strings.HasSuffix(arg, "@idm") {
+			return errgo.Newf("%q is not an agent username", arg)
+		}
+		c.usernames = append(c.usernames, params.Username(arg))
+	}
+	return errgo.Mask(c.idmCommand.Init(nil))
+}
+
+func (c *rmAgentCommand) Run(ctxt *cmd.Context) error {
+	ctx := context.Background()
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, username := range c.usernames {
+		if err := client.Client.Call(ctx, &apiparams.RemoveUserRequest{
+			Username: username,
+		}, nil); err != nil {
+			return errgo.Notef(err, "cannot remove %s", username)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+)
+
+type setPasswordCommand struct {
+	userCommand
+
+	idp string
+}
+
+func newSetPasswordCommand() cmd.Command {
+	return &setPasswordCommand{}
+}
+
+var setPasswordDoc = `
+The set-password command sets the password of a user of an identity
+provider that stores passwords in the identity server, such as the
+static identity provider. Setting a password also unlocks an account
+that has been locked because of too many failed logins.
+
+If the user does not already exist it is created, in which case the
+identity provider must be specified with the --idp flag.
+
+The new password is read from standard input. When standard input is a
+terminal the password is prompted for without being echoed.
+
+To create the user bob in the identity provider named static:
+    user-admin set-password --idp static -u bob
+
+To reset the password of the user with the email address
+bob@example.com:
+    user-admin set-password -e bob@example.com
+`
+
+func (c *setPasswordCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "set-password",
+		Purpose: "set the password of a user",
+		Doc:     setPasswordDoc,
+	}
+}
+
+func (c *setPasswordCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.userCommand.SetFlags(f)
+
+	f.StringVar(&c.idp, "idp", "", "name of the identity provider in which to create the user")
+}
+
+func (c *setPasswordCommand) Init(args []string) error {
+	return errgo.Mask(c.userCommand.Init(args))
+}
+
+func (c *setPasswordCommand) Run(ctxt *cmd.Context) error {
+	ctx := context.Background()
+	username, err := c.lookupUser(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	password, err := readPassword(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// The set password endpoint is not part of the idmclient API so
+	// the request is made directly.
+	err = client.Client.Call(ctx, &apiparams.SetPasswordRequest{
+		Username: username,
+		Body: apiparams.SetPasswordBody{
+			IDP:      c.idp,
+			Password: password,
+		},
+	}, nil)
+	return errgo.Mask(err)
+}
+
+// readPassword reads a new password from the command's standard input.
+// If standard input is a terminal the user is prompted to enter the
+// password twice.
+func readPassword(ctxt *cmd.Context) (string, error) {
+	if f, ok := ctxt.Stdin.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(ctxt.Stderr, "password: ")
+		p1, err := terminal.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(ctxt.Stderr)
+		if err != nil {
+			return "", errgo.Mask(err)
+		}
+		fmt.Fprint(ctxt.Stderr, "confirm password: ")
+		p2, err := terminal.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(ctxt.Stderr)
+		if err != nil {
+			return "", errgo.Mask(err)
+		}
+		if string(p1) != string(p2) {
+			return "", errgo.New("passwords do not match")
+		}
+		return string(p1), nil
+	}
+	password, err := bufio.NewReader(ctxt.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return "", errgo.New("no password specified")
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return "", errgo.New("no password specified")
+	}
+	return password, nil
+}
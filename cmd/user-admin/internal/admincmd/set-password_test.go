@@ -0,0 +1,100 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+)
+
+type setPasswordSuite struct {
+	commandSuite
+}
+
+var _ = gc.Suite(&setPasswordSuite{})
+
+func (s *setPasswordSuite) TestSetPassword(c *gc.C) {
+	var req *apiparams.SetPasswordRequest
+	runf := s.RunServer(c, &handler{
+		setPassword: func(r *apiparams.SetPasswordRequest) error {
+			req = r
+			return nil
+		},
+	})
+	s.Stdin = "bob's password\n"
+	CheckNoOutput(c, runf, "set-password", "-a", "admin.agent", "-u", "bob")
+	c.Assert(req, gc.NotNil)
+	c.Assert(req.Username, gc.Equals, params.Username("bob"))
+	c.Assert(req.Body, gc.Equals, apiparams.SetPasswordBody{
+		Password: "bob's password",
+	})
+}
+
+func (s *setPasswordSuite) TestSetPasswordCreateUser(c *gc.C) {
+	var req *apiparams.SetPasswordRequest
+	runf := s.RunServer(c, &handler{
+		setPassword: func(r *apiparams.SetPasswordRequest) error {
+			req = r
+			return nil
+		},
+	})
+	s.Stdin = "bob's password"
+	CheckNoOutput(c, runf, "set-password", "-a", "admin.agent", "--idp", "static", "-u", "bob")
+	c.Assert(req, gc.NotNil)
+	c.Assert(req.Body, gc.Equals, apiparams.SetPasswordBody{
+		IDP:      "static",
+		Password: "bob's password",
+	})
+}
+
+func (s *setPasswordSuite) TestSetPasswordForEmail(c *gc.C) {
+	var username params.Username
+	runf := s.RunServer(c, &handler{
+		queryUsers: func(req *params.QueryUsersRequest) ([]string, error) {
+			if req.Email == "bob@example.com" {
+				return []string{"bob"}, nil
+			}
+			return []string{}, nil
+		},
+		setPassword: func(r *apiparams.SetPasswordRequest) error {
+			username = r.Username
+			return nil
+		},
+	})
+	s.Stdin = "bob's password\n"
+	CheckNoOutput(c, runf, "set-password", "-a", "admin.agent", "-e", "bob@example.com")
+	c.Assert(username, gc.Equals, params.Username("bob"))
+}
+
+func (s *setPasswordSuite) TestSetPasswordNoPassword(c *gc.C) {
+	runf := s.RunServer(c, &handler{
+		setPassword: func(r *apiparams.SetPasswordRequest) error {
+			c.Errorf("unexpected call to set password")
+			return nil
+		},
+	})
+	CheckError(c, 1, `no password specified`, runf, "set-password", "-a", "admin.agent", "-u", "bob")
+}
+
+func (s *setPasswordSuite) TestSetPasswordError(c *gc.C) {
+	runf := s.RunServer(c, &handler{
+		setPassword: func(r *apiparams.SetPasswordRequest) error {
+			return params.ErrBadRequest
+		},
+	})
+	s.Stdin = "bob's password\n"
+	CheckError(c, 1, `Put .*/v1/u/bob/password: bad request`, runf, "set-password", "-a", "admin.agent", "-u", "bob")
+}
+
+func (s *setPasswordSuite) TestSetPasswordNoUser(c *gc.C) {
+	CheckError(
+		c,
+		2,
+		`no user specified, please specify either username or email`,
+		s.Run,
+		"set-password", "-a", "admin.agent",
+	)
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+)
+
+type sshCertCommand struct {
+	userCommand
+
+	publicKeyFile string
+	out           string
+	validity      time.Duration
+}
+
+func newSSHCertCommand() cmd.Command {
+	return &sshCertCommand{}
+}
+
+var sshCertDoc = `
+The ssh-cert command obtains an SSH user certificate, signed by the
+identity server, for the given public key file. The certificate allows
+the user to log in to SSH servers that trust the identity server's
+certificate authority as their username, or as any of the groups of
+which they are a member.
+
+If no user is specified then the certificate is obtained for the
+currently authenticated user. The certificate is written alongside the
+public key in the file used by OpenSSH, for example the certificate for
+~/.ssh/id_ed25519.pub is written to ~/.ssh/id_ed25519-cert.pub. Use
+the -o flag to write it elsewhere, or "-o -" to write it to standard
+output.
+
+    user-admin ssh-cert ~/.ssh/id_ed25519.pub
+    user-admin ssh-cert -a admin.agent -u bob --validity 10m bob.pub
+`
+
+func (c *sshCertCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "ssh-cert",
+		Args:    "<public key file>",
+		Purpose: "obtain an SSH certificate",
+		Doc:     sshCertDoc,
+	}
+}
+
+func (c *sshCertCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.userCommand.SetFlags(f)
+
+	f.StringVar(&c.out, "o", "", "file in which to write the certificate")
+	f.StringVar(&c.out, "output", "", "")
+	f.DurationVar(&c.validity, "validity", 0, "length of time for which the certificate is valid (defaults to the server's maximum)")
+}
+
+func (c *sshCertCommand) Init(args []string) error {
+	if len(args) != 1 {
+		return errgo.New("public key file must be specified")
+	}
+	c.publicKeyFile = args[0]
+	if c.validity < 0 {
+		return errgo.Newf("invalid validity %v", c.validity)
+	}
+	if c.username != "" && c.email != "" {
+		return errgo.New("both username and email specified, please specify either username or email")
+	}
+	return errgo.Mask(c.idmCommand.Init(nil))
+}
+
+func (c *sshCertCommand) Run(ctxt *cmd.Context) error {
+	ctx := context.Background()
+	publicKey, err := ioutil.ReadFile(ctxt.AbsPath(c.publicKeyFile))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var username params.Username
+	if c.username != "" || c.email != "" {
+		username, err = c.lookupUser(ctxt)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	} else {
+		resp, err := client.WhoAmI(ctx, &params.WhoAmIRequest{})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		username = params.Username(resp.User)
+	}
+	// The SSH certificate endpoint is not part of the idmclient API
+	// so the request is made directly.
+	var resp apiparams.SSHCertResponse
+	err = client.Client.Call(ctx, &apiparams.SSHCertRequest{
+		Username: username,
+		Body: apiparams.SSHCertBody{
+			PublicKey: string(publicKey),
+			Validity:  int(c.validity / time.Second),
+		},
+	}, &resp)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	cert := resp.Certificate + "\n"
+	out := c.out
+	if out == "" {
+		out = strings.TrimSuffix(c.publicKeyFile, ".pub") + "-cert.pub"
+	}
+	if out == "-" {
+		_, err := fmt.Fprint(ctxt.Stdout, cert)
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(ioutil.WriteFile(ctxt.AbsPath(out), []byte(cert), 0644))
+}
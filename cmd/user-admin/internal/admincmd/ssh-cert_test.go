@@ -0,0 +1,73 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+)
+
+type sshCertSuite struct {
+	commandSuite
+}
+
+var _ = gc.Suite(&sshCertSuite{})
+
+const testSSHPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKtLR8f4ZBGRAbd7wh6yXQcvGGhbe9ScjKGDvhPTThYk bob@example.com\n"
+
+func (s *sshCertSuite) TestSSHCert(c *gc.C) {
+	err := ioutil.WriteFile(filepath.Join(s.Dir, "id_ed25519.pub"), []byte(testSSHPublicKey), 0644)
+	c.Assert(err, gc.Equals, nil)
+	var req *apiparams.SSHCertRequest
+	runf := s.RunServer(c, &handler{
+		whoAmI: func(*params.WhoAmIRequest) (*params.WhoAmIResponse, error) {
+			return &params.WhoAmIResponse{User: "bob"}, nil
+		},
+		sshCert: func(r *apiparams.SSHCertRequest) (*apiparams.SSHCertResponse, error) {
+			req = r
+			return &apiparams.SSHCertResponse{
+				Certificate: "ssh-ed25519-cert-v01@openssh.com AAAA",
+				Principals:  []string{"bob"},
+				ValidBefore: time.Now().Add(time.Hour),
+			}, nil
+		},
+	})
+	CheckNoOutput(c, runf, "ssh-cert", "-a", "admin.agent", "--validity", "10m", "id_ed25519.pub")
+	c.Assert(req, gc.NotNil)
+	c.Assert(req.Username, gc.Equals, params.Username("bob"))
+	c.Assert(req.Body, gc.Equals, apiparams.SSHCertBody{
+		PublicKey: testSSHPublicKey,
+		Validity:  600,
+	})
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, "id_ed25519-cert.pub"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, "ssh-ed25519-cert-v01@openssh.com AAAA\n")
+}
+
+func (s *sshCertSuite) TestSSHCertForUserToStdout(c *gc.C) {
+	err := ioutil.WriteFile(filepath.Join(s.Dir, "bob.pub"), []byte(testSSHPublicKey), 0644)
+	c.Assert(err, gc.Equals, nil)
+	var username params.Username
+	runf := s.RunServer(c, &handler{
+		sshCert: func(r *apiparams.SSHCertRequest) (*apiparams.SSHCertResponse, error) {
+			username = r.Username
+			return &apiparams.SSHCertResponse{
+				Certificate: "ssh-ed25519-cert-v01@openssh.com AAAA",
+			}, nil
+		},
+	})
+	stdout := CheckSuccess(c, runf, "ssh-cert", "-a", "admin.agent", "-u", "alice", "-o", "-", "bob.pub")
+	c.Assert(stdout, gc.Equals, "ssh-ed25519-cert-v01@openssh.com AAAA\n")
+	c.Assert(username, gc.Equals, params.Username("alice"))
+}
+
+func (s *sshCertSuite) TestSSHCertNoPublicKey(c *gc.C) {
+	CheckError(c, 2, `public key file must be specified`, s.Run, "ssh-cert")
+}
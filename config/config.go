@@ -6,13 +6,19 @@ package config
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/juju/loggo"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/yaml.v2"
@@ -29,6 +35,7 @@ type Config struct {
 	APIAddr                  string             `yaml:"api-addr"`
 	AuthUsername             string             `yaml:"auth-username"`
 	AuthPassword             string             `yaml:"auth-password"`
+	AuthPasswordHash         string             `yaml:"auth-password-hash"`
 	Location                 string             `yaml:"location"`
 	AccessLog                string             `yaml:"access-log"`
 	MaxMgoSessions           int                `yaml:"max-mgo-sessions"`
@@ -44,6 +51,114 @@ type Config struct {
 	ResourcePath             string             `yaml:"resource-path"`
 	HTTPProxy                string             `yaml:"http-proxy"`
 	NoProxy                  string             `yaml:"no-proxy"`
+
+	// TOTPKey holds the key used to encrypt TOTP secrets. If this is
+	// not set TOTP two-factor authentication is disabled.
+	TOTPKey *SecretKey `yaml:"totp-key"`
+
+	// TOTPIssuer holds the issuer name that is shown in users'
+	// authenticator applications.
+	TOTPIssuer string `yaml:"totp-issuer"`
+
+	// TOTPRequiredGroups holds the groups whose members must enrol
+	// in, and use, TOTP two-factor authentication when logging in.
+	TOTPRequiredGroups []string `yaml:"totp-required-groups"`
+
+	// WebAuthnRPID holds the WebAuthn relying party ID used for
+	// security keys. This must be the host name of the location, or
+	// a parent domain of it. If this is not set security keys cannot
+	// be used as a second authentication factor.
+	WebAuthnRPID string `yaml:"webauthn-rp-id"`
+
+	// WebAuthnAttestationRoots holds PEM encoded root certificates
+	// of the authenticator manufacturers that are trusted. If this
+	// is set only security keys with an attestation certificate
+	// issued by one of these roots can be registered.
+	WebAuthnAttestationRoots string `yaml:"webauthn-attestation-roots"`
+
+	// WebAuthnRequiredGroups holds the groups whose members must
+	// register, and use, a security key when logging in.
+	WebAuthnRequiredGroups []string `yaml:"webauthn-required-groups"`
+
+	// RendezvousTransport holds the transport that identity servers
+	// sharing a database use to pass login rendezvous requests
+	// between each other. This is one of "http", the default, which
+	// requires each server to be reachable at its private-addr,
+	// "redis" or "postgres".
+	RendezvousTransport string `yaml:"rendezvous-transport"`
+
+	// RedisAddr holds the host:port address of the Redis server used
+	// by the redis rendezvous transport.
+	RedisAddr string `yaml:"redis-addr"`
+
+	// RedisPassword holds the password used to authenticate to the
+	// Redis server, if one is required.
+	RedisPassword string `yaml:"redis-password"`
+
+	// OTLPEndpoint holds the host:port address of an OpenTelemetry
+	// collector to which traces are exported using OTLP over HTTP.
+	// If this is not set tracing is disabled.
+	OTLPEndpoint string `yaml:"otlp-endpoint"`
+
+	// OTLPInsecure specifies that traces should be exported to the
+	// OTLPEndpoint using plain HTTP rather than HTTPS.
+	OTLPInsecure bool `yaml:"otlp-insecure"`
+
+	// LogFormat holds the format of the server log and access log.
+	// This is either "text", the default, or "json", in which case
+	// each log entry is written as a JSON object on a single line.
+	LogFormat string `yaml:"log-format"`
+
+	// RateLimitIP holds the average number of authentication requests
+	// per second allowed from a single IP address. If this is zero
+	// requests are not limited by IP address.
+	RateLimitIP float64 `yaml:"rate-limit-ip"`
+
+	// RateLimitIPBurst holds the number of authentication requests
+	// that may be made from a single IP address in quick succession.
+	RateLimitIPBurst int `yaml:"rate-limit-ip-burst"`
+
+	// RateLimitUser holds the average number of authentication
+	// requests per second allowed for a single username. If this is
+	// zero requests are not limited by username.
+	RateLimitUser float64 `yaml:"rate-limit-user"`
+
+	// RateLimitUserBurst holds the number of authentication requests
+	// that may be made for a single username in quick succession.
+	RateLimitUserBurst int `yaml:"rate-limit-user-burst"`
+
+	// MaxFailedLogins holds the number of consecutive failed password
+	// logins after which a username is locked out. If this is zero
+	// usernames are never locked out.
+	MaxFailedLogins int `yaml:"max-failed-logins"`
+
+	// FailedLoginLockout holds the length of time for which a
+	// username is locked out after too many failed logins.
+	FailedLoginLockout DurationString `yaml:"failed-login-lockout"`
+
+	// TrustedProxies holds the addresses, or networks in CIDR
+	// notation, of the proxies that are trusted to report the
+	// address of the client in the X-Forwarded-For header.
+	TrustedProxies []string `yaml:"trusted-proxies"`
+
+	// AdminGroups holds the groups whose members have full
+	// administrative access to the identity server.
+	AdminGroups []string `yaml:"admin-groups"`
+
+	// SSHCAKey holds the private key of the SSH certificate
+	// authority, in PEM or OpenSSH format, used to sign SSH user
+	// certificates. If this is not set SSH certificates cannot be
+	// issued.
+	SSHCAKey string `yaml:"ssh-ca-key"`
+
+	// SSHCertValidity holds the maximum length of time for which
+	// issued SSH certificates are valid.
+	SSHCertValidity DurationString `yaml:"ssh-cert-validity"`
+
+	// MaxAgentDepth holds the maximum length of a chain of agents,
+	// each created by the previous one. If this is zero agents
+	// cannot create other agents.
+	MaxAgentDepth int `yaml:"max-agent-depth"`
 }
 
 func (c *Config) TLSConfig() *tls.Config {
@@ -63,6 +178,60 @@ func (c *Config) TLSConfig() *tls.Config {
 	}
 }
 
+// WebAuthnAttestationRootPool returns a certificate pool containing the
+// configured WebAuthn attestation roots. If there are no attestation
+// roots configured then a nil pool is returned.
+func (c *Config) WebAuthnAttestationRootPool() (*x509.CertPool, error) {
+	if c.WebAuthnAttestationRoots == "" {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(c.WebAuthnAttestationRoots)) {
+		return nil, errgo.Newf("no certificates found in webauthn-attestation-roots")
+	}
+	return pool, nil
+}
+
+// TrustedProxyNets returns the networks of the configured trusted
+// proxies. A single address is returned as a network containing only
+// that address.
+func (c *Config) TrustedProxyNets() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range c.TrustedProxies {
+		if ip := net.ParseIP(p); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, errgo.Newf("invalid trusted-proxies entry %q", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// SSHCASigner returns a signer for the configured SSH certificate
+// authority key. If there is no key configured then a nil signer is
+// returned.
+func (c *Config) SSHCASigner() (ssh.Signer, error) {
+	if c.SSHCAKey == "" {
+		return nil, nil
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(c.SSHCAKey))
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid ssh-ca-key")
+	}
+	return signer, nil
+}
+
 func (c *Config) validate() error {
 	var missing []string
 	if c.MongoAddr == "" && c.PostgresConnectionString == "" {
@@ -71,14 +240,22 @@ func (c *Config) validate() error {
 	if c.APIAddr == "" {
 		missing = append(missing, "api-addr")
 	}
-	if c.AuthUsername == "" {
-		missing = append(missing, "auth-username")
-	}
 	if strings.Contains(c.AuthUsername, ":") {
 		return fmt.Errorf("invalid user name %q (contains ':')", c.AuthUsername)
 	}
-	if c.AuthPassword == "" {
-		missing = append(missing, "auth-password")
+	switch {
+	case c.AuthUsername != "" && c.AuthPassword == "" && c.AuthPasswordHash == "":
+		missing = append(missing, "auth-password or auth-password-hash")
+	case c.AuthUsername == "" && (c.AuthPassword != "" || c.AuthPasswordHash != ""):
+		missing = append(missing, "auth-username")
+	}
+	if c.AuthPassword != "" && c.AuthPasswordHash != "" {
+		return errgo.Newf("auth-password and auth-password-hash cannot both be specified")
+	}
+	if c.AuthPasswordHash != "" {
+		if _, err := bcrypt.Cost([]byte(c.AuthPasswordHash)); err != nil {
+			return errgo.Notef(err, "invalid auth-password-hash")
+		}
 	}
 	if c.PrivateKey == nil {
 		missing = append(missing, "private-key")
@@ -93,16 +270,93 @@ func (c *Config) validate() error {
 	if c.MaxMgoSessions == 0 {
 		missing = append(missing, "max-mgo-sessions")
 	}
-	if c.PrivateAddr == "" {
-		missing = append(missing, "private-addr")
+	switch c.RendezvousTransport {
+	case "", "http":
+		if c.PrivateAddr == "" {
+			missing = append(missing, "private-addr")
+		}
+	case "redis":
+		if c.RedisAddr == "" {
+			missing = append(missing, "redis-addr")
+		}
+	case "postgres":
+		if c.PostgresConnectionString == "" {
+			return errgo.Newf("postgres rendezvous-transport specified without postgres-connection-string")
+		}
+	default:
+		return errgo.Newf("invalid rendezvous-transport %q", c.RendezvousTransport)
+	}
+	switch c.LogFormat {
+	case "", "text", "json":
+	default:
+		return errgo.Newf("invalid log-format %q", c.LogFormat)
+	}
+	if c.RateLimitIP < 0 || c.RateLimitUser < 0 || c.RateLimitIPBurst < 0 || c.RateLimitUserBurst < 0 {
+		return errgo.Newf("rate limits must not be negative")
+	}
+	if c.MaxFailedLogins < 0 {
+		return errgo.Newf("invalid max-failed-logins %d", c.MaxFailedLogins)
 	}
 	if len(missing) != 0 {
 		return errgo.Newf("missing fields %s in config file", strings.Join(missing, ", "))
 	}
+	if len(c.TOTPRequiredGroups) > 0 && c.TOTPKey == nil {
+		return errgo.Newf("totp-required-groups specified without totp-key")
+	}
+	if c.WebAuthnRPID == "" {
+		if len(c.WebAuthnRequiredGroups) > 0 {
+			return errgo.Newf("webauthn-required-groups specified without webauthn-rp-id")
+		}
+		if c.WebAuthnAttestationRoots != "" {
+			return errgo.Newf("webauthn-attestation-roots specified without webauthn-rp-id")
+		}
+	}
+	if _, err := c.WebAuthnAttestationRootPool(); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := c.SSHCASigner(); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := c.TrustedProxyNets(); err != nil {
+		return errgo.Mask(err)
+	}
+	if c.SSHCertValidity.Duration < 0 {
+		return errgo.Newf("invalid ssh-cert-validity %v", c.SSHCertValidity.Duration)
+	}
+	if c.MaxAgentDepth < 0 {
+		return errgo.Newf("invalid max-agent-depth %d", c.MaxAgentDepth)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errgo.Newf("tls-cert and tls-key must be specified together")
+	}
+	if c.TLSCert != "" {
+		if _, err := tls.X509KeyPair([]byte(c.TLSCert), []byte(c.TLSKey)); err != nil {
+			return errgo.Notef(err, "invalid tls-cert or tls-key")
+		}
+	}
+	names := make(map[string]bool)
+	for _, idp := range c.IdentityProviders {
+		name := idp.Name()
+		if names[name] {
+			return errgo.Newf("duplicate identity provider name %q", name)
+		}
+		names[name] = true
+	}
 	return nil
 }
 
 // Read reads an identity configuration file from the given path.
+//
+// Any value in the file may be given as a reference to an environment
+// variable or a file, rather than literally, by using a mapping with a
+// single "env" or "file" key. For example:
+//
+//	auth-password: {env: IDENTITY_AUTH_PASSWORD}
+//	private-key: {file: /run/secrets/identity-private-key}
+//
+// Relative file names are resolved relative to the directory holding
+// the configuration file. Any trailing newlines are removed from
+// file contents.
 func Read(path string) (*Config, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -113,6 +367,10 @@ func Read(path string) (*Config, error) {
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot read %q", path)
 	}
+	data, err = expandReferences(data, filepath.Dir(path))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse %q", path)
+	}
 	var conf Config
 	err = yaml.Unmarshal(data, &conf)
 	if err != nil {
@@ -124,6 +382,106 @@ func Read(path string) (*Config, error) {
 	return &conf, nil
 }
 
+// expandReferences replaces all environment variable and file
+// references in the given YAML document with the values they refer to.
+// Relative file names are resolved relative to dir.
+func expandReferences(data []byte, dir string) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	doc, changed, err := expandValue(doc, dir)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if !changed {
+		return data, nil
+	}
+	data, err = yaml.Marshal(doc)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return data, nil
+}
+
+// expandValue expands any references in the given value, as decoded by
+// yaml.Unmarshal, and reports whether any were found.
+func expandValue(v interface{}, dir string) (_ interface{}, changed bool, _ error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		if s, ok, err := resolveReference(v, dir); ok || err != nil {
+			return scalarValue(s), ok, errgo.Mask(err)
+		}
+		for k, elem := range v {
+			elem, elemChanged, err := expandValue(elem, dir)
+			if err != nil {
+				return nil, false, errgo.Notef(err, "%v", k)
+			}
+			v[k] = elem
+			changed = changed || elemChanged
+		}
+	case []interface{}:
+		for i, elem := range v {
+			elem, elemChanged, err := expandValue(elem, dir)
+			if err != nil {
+				return nil, false, errgo.Notef(err, "[%d]", i)
+			}
+			v[i] = elem
+			changed = changed || elemChanged
+		}
+	}
+	return v, changed, nil
+}
+
+// resolveReference returns the value referred to by m if it is an
+// environment variable or file reference. If it is not a reference then
+// false is returned.
+func resolveReference(m map[interface{}]interface{}, dir string) (string, bool, error) {
+	if len(m) != 1 {
+		return "", false, nil
+	}
+	if name, ok := m["env"].(string); ok {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", false, errgo.Newf("environment variable %q not set", name)
+		}
+		return value, true, nil
+	}
+	if name, ok := m["file"].(string); ok {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", false, errgo.Mask(err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+	return "", false, nil
+}
+
+// scalarValue returns the value of s when it is parsed as a YAML
+// scalar, so that a reference can be used for a numeric or boolean
+// parameter. If s is not a scalar, or would not be written back as the
+// same text (for example "0123", which parses as 83), it is returned
+// unchanged as a string.
+func scalarValue(s string) interface{} {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	switch v.(type) {
+	case int, int64, uint64, float64, bool:
+	default:
+		return s
+	}
+	data, err := yaml.Marshal(v)
+	if err != nil || strings.TrimSuffix(string(data), "\n") != s {
+		return s
+	}
+	return v
+}
+
 // DurationString holds a duration that marshals and
 // unmarshals as a friendly string.
 type DurationString struct {
@@ -139,6 +497,26 @@ func (dp *DurationString) UnmarshalText(data []byte) error {
 	return nil
 }
 
+// SecretKey holds a 32 byte symmetric key that marshals and unmarshals
+// as a base64 string.
+type SecretKey [32]byte
+
+func (k *SecretKey) UnmarshalText(data []byte) error {
+	buf, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(buf) != len(k) {
+		return errgo.Newf("wrong length for key, got %d want %d", len(buf), len(k))
+	}
+	copy(k[:], buf)
+	return nil
+}
+
+func (k SecretKey) MarshalText() ([]byte, error) {
+	return []byte(base64.StdEncoding.EncodeToString(k[:])), nil
+}
+
 // IdentityProvider represents a configured idp.IdentityProvider
 type IdentityProvider struct {
 	idp.IdentityProvider
@@ -4,8 +4,15 @@
 package config_test
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -51,6 +58,8 @@ private-addr: localhost
 debug-teams:
  - yellow
  - cloud-green
+admin-groups:
+ - idm-admins
 tls-cert: |
   -----BEGIN CERTIFICATE-----
   MIIDLDCCAhQCCQDVXrWn1thP6DANBgkqhkiG9w0BAQsFADBYMQswCQYDVQQGEwJH
@@ -102,6 +111,13 @@ tls-key: |
 resource-path: /resources
 http-proxy: http://proxy.example.com:3128
 no-proxy: localhost,.example.com
+totp-key: MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=
+totp-issuer: Candid
+totp-required-groups:
+ - admin@idm
+webauthn-rp-id: foo.com
+webauthn-required-groups:
+ - ops@idm
 `
 
 func (s *configSuite) readConfig(c *gc.C, content string) (*config.Config, error) {
@@ -131,6 +147,9 @@ func (s *configSuite) TestRead(c *gc.C) {
 	err = key.Private.UnmarshalText([]byte("8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow="))
 	c.Assert(err, gc.IsNil)
 
+	var totpKey config.SecretKey
+	copy(totpKey[:], "0123456789abcdef0123456789abcdef")
+
 	var adminPubKey bakery.PublicKey
 	err = adminPubKey.UnmarshalText([]byte("dUnC8p9p3nygtE2h92a47Ooq0rXg0fVSm3YBWou5/UQ="))
 	c.Assert(err, gc.IsNil)
@@ -162,11 +181,17 @@ func (s *configSuite) TestRead(c *gc.C) {
 				},
 			},
 		}},
-		PrivateAddr:  "localhost",
-		DebugTeams:   []string{"yellow", "cloud-green"},
-		ResourcePath: "/resources",
-		HTTPProxy:    "http://proxy.example.com:3128",
-		NoProxy:      "localhost,.example.com",
+		PrivateAddr:            "localhost",
+		DebugTeams:             []string{"yellow", "cloud-green"},
+		AdminGroups:            []string{"idm-admins"},
+		ResourcePath:           "/resources",
+		HTTPProxy:              "http://proxy.example.com:3128",
+		NoProxy:                "localhost,.example.com",
+		TOTPKey:                &totpKey,
+		TOTPIssuer:             "Candid",
+		TOTPRequiredGroups:     []string{"admin@idm"},
+		WebAuthnRPID:           "foo.com",
+		WebAuthnRequiredGroups: []string{"ops@idm"},
 	})
 }
 
@@ -178,7 +203,7 @@ func (s *configSuite) TestReadErrorNotFound(c *gc.C) {
 
 func (s *configSuite) TestReadErrorEmpty(c *gc.C) {
 	cfg, err := s.readConfig(c, "")
-	c.Assert(err, gc.ErrorMatches, "missing fields mongo-addr or postgres-connection-string, api-addr, auth-username, auth-password, private-key, public-key, location, max-mgo-sessions, private-addr in config file")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-addr or postgres-connection-string, api-addr, private-key, public-key, location, max-mgo-sessions, private-addr in config file")
 	c.Assert(cfg, gc.IsNil)
 }
 
@@ -188,6 +213,291 @@ func (s *configSuite) TestReadErrorInvalidYAML(c *gc.C) {
 	c.Assert(cfg, gc.IsNil)
 }
 
+func (s *configSuite) TestInvalidTOTPKey(c *gc.C) {
+	cfg, err := s.readConfig(c, `
+totp-key: MDEyMzQ1Njc4OWFiY2RlZg==
+`)
+	c.Assert(err, gc.ErrorMatches, `cannot parse ".*": wrong length for key, got 16 want 32`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *configSuite) TestWebAuthnAttestationRoots(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	conf, err := s.readConfig(c, testConfig)
+	c.Assert(err, gc.IsNil)
+	pool, err := conf.WebAuthnAttestationRootPool()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pool, gc.IsNil)
+
+	// Use the TLS certificate as an attestation root.
+	conf.WebAuthnAttestationRoots = conf.TLSCert
+	pool, err = conf.WebAuthnAttestationRootPool()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pool.Subjects(), gc.HasLen, 1)
+}
+
+func (s *configSuite) TestInvalidWebAuthnAttestationRoots(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, testConfig+`
+webauthn-attestation-roots: not a certificate
+`)
+	c.Assert(err, gc.ErrorMatches, `no certificates found in webauthn-attestation-roots`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *configSuite) TestWebAuthnRequiredGroupsWithoutRPID(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, strings.Replace(testConfig, "webauthn-rp-id: foo.com\n", "", 1))
+	c.Assert(err, gc.ErrorMatches, `webauthn-required-groups specified without webauthn-rp-id`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *configSuite) TestRendezvousTransportRedis(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	conf, err := s.readConfig(c, strings.Replace(testConfig, "private-addr: localhost\n", "", 1)+`
+rendezvous-transport: redis
+redis-addr: localhost:6379
+redis-password: secret
+`)
+	c.Assert(err, gc.IsNil)
+	c.Assert(conf.RendezvousTransport, gc.Equals, "redis")
+	c.Assert(conf.RedisAddr, gc.Equals, "localhost:6379")
+	c.Assert(conf.RedisPassword, gc.Equals, "secret")
+}
+
+func (s *configSuite) TestRendezvousTransportRedisWithoutAddr(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, testConfig+`
+rendezvous-transport: redis
+`)
+	c.Assert(err, gc.ErrorMatches, `missing fields redis-addr in config file`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *configSuite) TestRendezvousTransportPostgresWithoutPostgres(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, testConfig+`
+rendezvous-transport: postgres
+`)
+	c.Assert(err, gc.ErrorMatches, `postgres rendezvous-transport specified without postgres-connection-string`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *configSuite) TestInvalidRendezvousTransport(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, testConfig+`
+rendezvous-transport: carrier-pigeon
+`)
+	c.Assert(err, gc.ErrorMatches, `invalid rendezvous-transport "carrier-pigeon"`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *configSuite) TestInvalidLogFormat(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, testConfig+`
+log-format: xml
+`)
+	c.Assert(err, gc.ErrorMatches, `invalid log-format "xml"`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *configSuite) TestInvalidMaxFailedLogins(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, testConfig+`
+max-failed-logins: -1
+`)
+	c.Assert(err, gc.ErrorMatches, `invalid max-failed-logins -1`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *configSuite) TestTrustedProxies(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, testConfig+`
+trusted-proxies:
+ - 10.0.0.0/8
+ - 192.0.2.1
+ - 2001:db8::1
+`)
+	c.Assert(err, gc.Equals, nil)
+	nets, err := cfg.TrustedProxyNets()
+	c.Assert(err, gc.Equals, nil)
+	var ss []string
+	for _, n := range nets {
+		ss = append(ss, n.String())
+	}
+	c.Assert(ss, jc.DeepEquals, []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128"})
+}
+
+func (s *configSuite) TestInvalidTrustedProxies(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, testConfig+`
+trusted-proxies:
+ - proxy.example.com
+`)
+	c.Assert(err, gc.ErrorMatches, `invalid trusted-proxies entry "proxy.example.com"`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *configSuite) TestInvalidMaxAgentDepth(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, testConfig+`
+max-agent-depth: -1
+`)
+	c.Assert(err, gc.ErrorMatches, `invalid max-agent-depth -1`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *configSuite) TestSSHCAKey(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, gc.IsNil)
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	cfg, err := s.readConfig(c, testConfig+`
+ssh-cert-validity: 10m
+ssh-ca-key: |
+  `+strings.Replace(strings.TrimSpace(string(keyPEM)), "\n", "\n  ", -1)+"\n")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cfg.SSHCertValidity.Duration, gc.Equals, 10*time.Minute)
+	signer, err := cfg.SSHCASigner()
+	c.Assert(err, gc.IsNil)
+	c.Assert(signer.PublicKey().Type(), gc.Equals, "ssh-rsa")
+}
+
+func (s *configSuite) TestInvalidSSHCAKey(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, testConfig+`
+ssh-ca-key: not a key
+`)
+	c.Assert(err, gc.ErrorMatches, `invalid ssh-ca-key: .*`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+var authCredentialsTests = []struct {
+	about       string
+	credentials string
+	expectError string
+}{{
+	about: "no admin credentials",
+}, {
+	about: "password hash",
+	credentials: `
+auth-username: myuser
+auth-password-hash: $2a$04$X9KhHk7xXsYwaSqlCk4douTxyx0BGhfkMvDzqbPkEgxW7CjF1p/zS
+`,
+}, {
+	about: "password without username",
+	credentials: `
+auth-password: mypasswd
+`,
+	expectError: `missing fields auth-username in config file`,
+}, {
+	about: "username without password",
+	credentials: `
+auth-username: myuser
+`,
+	expectError: `missing fields auth-password or auth-password-hash in config file`,
+}, {
+	about: "password and password hash",
+	credentials: `
+auth-username: myuser
+auth-password: mypasswd
+auth-password-hash: $2a$04$X9KhHk7xXsYwaSqlCk4douTxyx0BGhfkMvDzqbPkEgxW7CjF1p/zS
+`,
+	expectError: `auth-password and auth-password-hash cannot both be specified`,
+}, {
+	about: "invalid password hash",
+	credentials: `
+auth-username: myuser
+auth-password-hash: mypasswd
+`,
+	expectError: `invalid auth-password-hash: .*`,
+}}
+
+func (s *configSuite) TestAuthCredentials(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	for i, test := range authCredentialsTests {
+		c.Logf("test %d. %s", i, test.about)
+		conf := strings.Replace(testConfig, "auth-username: myuser\nauth-password: mypasswd\n", strings.TrimPrefix(test.credentials, "\n"), 1)
+		cfg, err := s.readConfig(c, conf)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			c.Assert(cfg, gc.IsNil)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (s *configSuite) TestReadReferences(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	s.PatchEnvironment("IDENTITY_TEST_PASSWORD", "envpasswd")
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "keystone-url"), []byte("http://example.com/secret\n"), 0600)
+	c.Assert(err, gc.IsNil)
+	content := strings.Replace(testConfig, "auth-password: mypasswd", "auth-password: {env: IDENTITY_TEST_PASSWORD}", 1)
+	content = strings.Replace(content, "url: http://example.com/keystone", "url: {file: keystone-url}", 1)
+	err = ioutil.WriteFile(filepath.Join(dir, "config.yaml"), []byte(content), 0600)
+	c.Assert(err, gc.IsNil)
+	conf, err := config.Read(filepath.Join(dir, "config.yaml"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(conf.AuthPassword, gc.Equals, "envpasswd")
+	c.Assert(conf.IdentityProviders[1].IdentityProvider.(IdentityProvider).Params["url"], gc.Equals, "http://example.com/secret")
+}
+
+func (s *configSuite) TestReadScalarReferences(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	s.PatchEnvironment("IDENTITY_TEST_SESSIONS", "300")
+	s.PatchEnvironment("IDENTITY_TEST_PASSWORD", "0123")
+	content := strings.Replace(testConfig, "max-mgo-sessions: 10", "max-mgo-sessions: {env: IDENTITY_TEST_SESSIONS}", 1)
+	content = strings.Replace(content, "auth-password: mypasswd", "auth-password: {env: IDENTITY_TEST_PASSWORD}", 1)
+	conf, err := s.readConfig(c, content)
+	c.Assert(err, gc.IsNil)
+	c.Assert(conf.MaxMgoSessions, gc.Equals, 300)
+	c.Assert(conf.AuthPassword, gc.Equals, "0123")
+}
+
+func (s *configSuite) TestReadReferenceErrors(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	s.PatchEnvironment("IDENTITY_NOT_SET", "")
+	os.Unsetenv("IDENTITY_NOT_SET")
+	cfg, err := s.readConfig(c, strings.Replace(testConfig, "auth-password: mypasswd", "auth-password: {env: IDENTITY_NOT_SET}", 1))
+	c.Assert(err, gc.ErrorMatches, `cannot parse ".*": auth-password: environment variable "IDENTITY_NOT_SET" not set`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, strings.Replace(testConfig, "url: http://example.com/keystone", "url: {file: no-such-file}", 1))
+	c.Assert(err, gc.ErrorMatches, `cannot parse ".*": identity-providers: \[1\]: url: open .*no-such-file: no such file or directory`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *configSuite) TestDuplicateIDPName(c *gc.C) {
+	config.RegisterIDP("usso", testIdentityProvider)
+	config.RegisterIDP("keystone", testIdentityProvider)
+	cfg, err := s.readConfig(c, strings.Replace(testConfig, "name: ks1", "name: usso", 1))
+	c.Assert(err, gc.ErrorMatches, `duplicate identity provider name "usso"`)
+	c.Assert(cfg, gc.IsNil)
+}
+
 func (s *configSuite) TestUnrecognisedIDP(c *gc.C) {
 	cfg, err := s.readConfig(c, `
 identity-providers:
@@ -202,6 +512,15 @@ type IdentityProvider struct {
 	Params map[string]string
 }
 
+// Name implements idp.IdentityProvider.Name by returning the configured
+// name, or the type if there is no name.
+func (idp IdentityProvider) Name() string {
+	if name := idp.Params["name"]; name != "" {
+		return name
+	}
+	return idp.Params["type"]
+}
+
 func testIdentityProvider(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
 	idp := IdentityProvider{
 		IdentityProvider: nil,
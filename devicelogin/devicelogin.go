@@ -0,0 +1,121 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package devicelogin provides an httpbakery.Interactor that logs in to
+// the identity manager by asking the user to enter a short code in a
+// web browser, which need not be running on the same machine.
+package devicelogin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+)
+
+// defaultInterval holds the polling interval used if the identity
+// manager does not specify one.
+const defaultInterval = 5 * time.Second
+
+// Interactor is an httpbakery.Interactor that performs device logins.
+type Interactor struct {
+	// Prompt is called to tell the user where to log in and the code
+	// to enter. If this is nil, instructions are written to
+	// os.Stderr.
+	Prompt func(resp *apiparams.DeviceCodeResponse) error
+}
+
+var _ httpbakery.Interactor = Interactor{}
+
+// Kind implements httpbakery.Interactor.Kind.
+func (i Interactor) Kind() string {
+	return apiparams.DeviceInteractionMethod
+}
+
+// deviceCodeRequest is the request sent to obtain a user code.
+type deviceCodeRequest struct {
+	httprequest.Route `httprequest:"POST"`
+}
+
+// Interact implements httpbakery.Interactor.Interact.
+func (i Interactor) Interact(ctx context.Context, client *httpbakery.Client, location string, ierr *httpbakery.Error) (*httpbakery.DischargeToken, error) {
+	var info apiparams.DeviceInteractionInfo
+	if err := ierr.InteractionMethod(apiparams.DeviceInteractionMethod, &info); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(httpbakery.ErrInteractionMethodNotFound))
+	}
+	// The interaction URLs don't require authorization, so use the
+	// underlying HTTP client.
+	cl := &httprequest.Client{
+		Doer: client.Client,
+	}
+	var resp apiparams.DeviceCodeResponse
+	if err := cl.CallURL(ctx, info.DeviceCodeURL, &deviceCodeRequest{}, &resp); err != nil {
+		return nil, errgo.Notef(err, "cannot get user code")
+	}
+	prompt := i.Prompt
+	if prompt == nil {
+		prompt = defaultPrompt
+	}
+	if err := prompt(&resp); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	interval := time.Duration(resp.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	deadline := time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	for {
+		var status apiparams.LoginStatusResponse
+		if err := cl.Get(ctx, info.LoginStatusURL, &status); err != nil {
+			return nil, errgo.Notef(err, "cannot get login status")
+		}
+		switch status.Status {
+		case apiparams.LoginCompleted:
+			return waitForToken(ctx, cl, info.WaitTokenURL)
+		case apiparams.LoginFailed:
+			return nil, errgo.Newf("login failed: %s", status.Error)
+		case apiparams.LoginExpired:
+			return nil, errgo.Newf("login expired")
+		}
+		if time.Now().After(deadline) {
+			return nil, errgo.Newf("timed out waiting for login")
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, errgo.Mask(ctx.Err())
+		}
+	}
+}
+
+// waitForToken collects the discharge token for a completed login.
+func waitForToken(ctx context.Context, cl *httprequest.Client, url string) (*httpbakery.DischargeToken, error) {
+	var resp httpbakery.WaitTokenResponse
+	if err := cl.Get(ctx, url, &resp); err != nil {
+		return nil, errgo.Notef(err, "cannot get discharge token")
+	}
+	value := []byte(resp.Token)
+	if resp.Token64 != "" {
+		var err error
+		value, err = base64.StdEncoding.DecodeString(resp.Token64)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid discharge token")
+		}
+	}
+	return &httpbakery.DischargeToken{
+		Kind:  resp.Kind,
+		Value: value,
+	}, nil
+}
+
+func defaultPrompt(resp *apiparams.DeviceCodeResponse) error {
+	_, err := fmt.Fprintf(os.Stderr, "To log in, visit %s and enter the code %s\n", resp.VerificationURI, resp.UserCode)
+	return errgo.Mask(err)
+}
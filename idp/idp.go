@@ -7,6 +7,7 @@ package idp
 import (
 	"html/template"
 	"net/http"
+	"time"
 
 	"golang.org/x/net/context"
 	"gopkg.in/macaroon-bakery.v2/bakery"
@@ -35,6 +36,41 @@ type VisitCompleter interface {
 	Failure(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, err error)
 }
 
+// A LoginLimiter is used by identity providers that check passwords to
+// limit the rate of login attempts, protecting against brute-force
+// attacks. Failed logins are counted separately for each client, so
+// that one client cannot lock a user out of all others.
+type LoginLimiter interface {
+	// Allow returns an error if an attempt by the client that made
+	// the given request to log in as the given user should be
+	// refused.
+	Allow(ctx context.Context, req *http.Request, username string) error
+
+	// LoginFailed records a failed login attempt for the given user
+	// by the client that made the given request.
+	LoginFailed(ctx context.Context, req *http.Request, username string)
+
+	// LoginSucceeded records a successful login for the given user
+	// by the client that made the given request.
+	LoginSucceeded(ctx context.Context, req *http.Request, username string)
+
+	// Unlock clears the record of failed login attempts for the
+	// given user by all clients, for example when their password
+	// has been reset.
+	Unlock(ctx context.Context, username string)
+}
+
+// A LockoutPolicy may be implemented by an identity provider that
+// configures its own limits for failed logins rather than using those
+// of the identity server.
+type LockoutPolicy interface {
+	// LockoutPolicy returns the number of failed login attempts
+	// from a client after which a user is locked out, and the length
+	// of time for which they are locked out. If maxFailures is zero
+	// the identity server's limits are used.
+	LockoutPolicy() (maxFailures int, duration time.Duration)
+}
+
 // InitParams are passed to the identity provider to initialise it.
 type InitParams struct {
 	// Store contains the identity store being used in the identity
@@ -67,6 +103,13 @@ type InitParams struct {
 
 	// Template contains the templates loaded in the identity server.
 	Template *template.Template
+
+	// LoginLimiter is the LoginLimiter that the identity provider
+	// should use to limit password login attempts. If the identity
+	// provider implements LockoutPolicy then the limiter uses its
+	// limits. It may be nil, in which case login attempts are not
+	// limited.
+	LoginLimiter LoginLimiter
 }
 
 // IdentityProvider is the interface that is satisfied by all identity providers.
@@ -118,3 +161,59 @@ type IdentityProvider interface {
 	// TODO define what happens when the identity doesn't exist.
 	GetGroups(ctx context.Context, id *store.Identity) (groups []string, err error)
 }
+
+type multiFactorKey struct{}
+
+// ContextWithMultiFactor returns a context that records that the user
+// has been authenticated with more than one factor, for example using a
+// security key that verifies the user with a PIN or biometric. An
+// identity provider that passes such a context to
+// VisitCompleter.Success will not have the user challenged for a
+// second factor.
+func ContextWithMultiFactor(ctx context.Context) context.Context {
+	return context.WithValue(ctx, multiFactorKey{}, true)
+}
+
+// IsMultiFactor reports whether the given context was created with
+// ContextWithMultiFactor.
+func IsMultiFactor(ctx context.Context) bool {
+	v, _ := ctx.Value(multiFactorKey{}).(bool)
+	return v
+}
+
+// PasswordSetter is implemented by identity providers that store
+// passwords for their users in the identity server.
+type PasswordSetter interface {
+	// SetPassword sets the password for the user with the given
+	// username, creating the user if they do not already exist. Any
+	// lockout caused by failed login attempts is also removed. If the
+	// username or password is not acceptable to the identity provider
+	// then an error with a cause of params.ErrBadRequest is returned.
+	SetPassword(ctx context.Context, username, password string) error
+}
+
+// GroupCache is implemented by identity providers that cache the groups
+// of their identities in their KeyValueStore, which is shared by every
+// identity server using the same database.
+type GroupCache interface {
+	// CachedGroups returns the groups of the given identity from the
+	// cache without contacting the identity provider. If there are
+	// no unexpired cached groups for the identity then false is
+	// returned.
+	CachedGroups(ctx context.Context, id *store.Identity) ([]string, bool)
+}
+
+// ChooserInfo is implemented by interactive identity providers that
+// supply additional information for the page on which a user chooses
+// the identity provider to log in with.
+type ChooserInfo interface {
+	// IconURL returns the URL of an icon to show with the identity
+	// provider, or "" if there is no icon.
+	IconURL() string
+
+	// EmailDomains returns the email domains of the users that log
+	// in with the identity provider. A user that enters an email
+	// address in one of these domains on the chooser page will be
+	// sent to this identity provider.
+	EmailDomains() []string
+}
@@ -104,6 +104,15 @@ func (s *Suite) AssertLoginNotComplete(c *gc.C) {
 	c.Assert(s.visitCompleter.called, gc.Equals, false)
 }
 
+// AssertMultiFactor asserts that the login test resulted in a successful
+// login for which the identity provider reported that the user was
+// authenticated with more than one factor (see
+// idp.ContextWithMultiFactor).
+func (s *Suite) AssertMultiFactor(c *gc.C) {
+	c.Assert(s.visitCompleter.called, gc.Equals, true)
+	c.Assert(s.visitCompleter.multiFactor, gc.Equals, true)
+}
+
 // AssertUser asserts that the specified user is stored in the store.
 // It returns the stored identity.
 func (s *Suite) AssertUser(c *gc.C, id *store.Identity) *store.Identity {
@@ -122,10 +131,11 @@ type visitCompleter struct {
 	called      bool
 	dischargeID string
 	id          *store.Identity
+	multiFactor bool
 	err         error
 }
 
-func (l *visitCompleter) Success(_ context.Context, _ http.ResponseWriter, _ *http.Request, dischargeID string, id *store.Identity) {
+func (l *visitCompleter) Success(ctx context.Context, _ http.ResponseWriter, _ *http.Request, dischargeID string, id *store.Identity) {
 	if l.called {
 		l.c.Error("login completion method called more that once")
 		return
@@ -133,6 +143,7 @@ func (l *visitCompleter) Success(_ context.Context, _ http.ResponseWriter, _ *ht
 	l.called = true
 	l.dischargeID = dischargeID
 	l.id = id
+	l.multiFactor = idp.IsMultiFactor(ctx)
 }
 
 func (l *visitCompleter) Failure(_ context.Context, _ http.ResponseWriter, _ *http.Request, dischargeID string, err error) {
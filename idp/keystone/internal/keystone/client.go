@@ -9,6 +9,8 @@ import (
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
 )
 
 const subjectTokenHeader = "X-Subject-Token"
@@ -27,6 +29,7 @@ func NewClient(url string) *Client {
 	return &Client{
 		client: httprequest.Client{
 			BaseURL:        url,
+			Doer:           tracing.NewHTTPClient(),
 			UnmarshalError: unmarshalError,
 		},
 	}
@@ -72,16 +72,30 @@ func (idp *userpassIdentityProvider) Handle(ctx context.Context, w http.Response
 		return
 	}
 	m := frm.(map[string]interface{})
+	username := m["username"].(string)
+	limiter := idp.initParams.LoginLimiter
+	if limiter != nil {
+		if err := limiter.Allow(ctx, req, username); err != nil {
+			idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+			return
+		}
+	}
 	user, err := idp.doLogin(ctx, keystone.Auth{
 		PasswordCredentials: &keystone.PasswordCredentials{
-			Username: m["username"].(string),
+			Username: username,
 			Password: m["password"].(string),
 		},
 	})
 	if err != nil {
+		if limiter != nil && errgo.Cause(err) == params.ErrUnauthorized {
+			limiter.LoginFailed(ctx, req, username)
+		}
 		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), errgo.Notef(err, "cannot validate form"))
 		return
 	}
+	if limiter != nil {
+		limiter.LoginSucceeded(ctx, req, username)
+	}
 	if strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix) == "/interact" {
 		dt, err := idp.initParams.DischargeTokenCreator.DischargeToken(ctx, idputil.DischargeID(req), user)
 		if err != nil {
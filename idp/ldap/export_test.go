@@ -4,6 +4,9 @@
 package ldap
 
 import (
+	"github.com/juju/utils/clock"
+	"golang.org/x/net/context"
+
 	"github.com/CanonicalLtd/blues-identity/idp"
 )
 
@@ -15,3 +18,13 @@ func SetLDAP(p idp.IdentityProvider, dialer LDAPDialer) {
 		return dialer(netw, addr)
 	}
 }
+
+func SetClock(p idp.IdentityProvider, c clock.Clock) {
+	p.(*identityProvider).clock = c
+}
+
+func SyncGroups(ctx context.Context, p idp.IdentityProvider) error {
+	return p.(*identityProvider).syncGroups(ctx)
+}
+
+var LDAPSchemaResponse = ldapSchemaResponse
@@ -9,25 +9,47 @@ import (
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/juju/loggo"
+	"github.com/juju/schema"
+	"github.com/juju/utils/clock"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/environschema.v1"
 	"gopkg.in/juju/idmclient.v1/params"
 	"gopkg.in/ldap.v2"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/form"
 
 	"github.com/CanonicalLtd/blues-identity/config"
 	"github.com/CanonicalLtd/blues-identity/idp"
 	"github.com/CanonicalLtd/blues-identity/idp/idputil"
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
 	"github.com/CanonicalLtd/blues-identity/store"
 )
 
+var logger = loggo.GetLogger("identity.idp.ldap")
+
+const (
+	// defaultGroupSyncActivePeriod is the period used when
+	// GroupSyncActivePeriod is not specified.
+	defaultGroupSyncActivePeriod = 24 * time.Hour
+
+	// defaultFailedLoginWindow is the window used when
+	// MaxFailedLogins is specified without FailedLoginWindow.
+	defaultFailedLoginWindow = 10 * time.Minute
+)
+
 func init() {
 	config.RegisterIDP("ldap", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
 		var p Params
@@ -58,6 +80,16 @@ type Params struct {
 	// identity provider will be tagged (not including the @ separator).
 	Domain string `yaml:"domain"`
 
+	// Icon contains the URL of an icon that is shown with the
+	// identity provider on the login page.
+	Icon string `yaml:"icon"`
+
+	// EmailDomains contains the email domains of the users of this
+	// identity provider. Users that enter an email address in one of
+	// these domains on the login page are sent to this identity
+	// provider.
+	EmailDomains []string `yaml:"email-domains"`
+
 	// URL contains an LDAP URL indicating the server to connect to.
 	URL string `yaml:"url"`
 
@@ -86,6 +118,46 @@ type Params struct {
 	// the user id being searched for - e.g.
 	//    (&(objectClass=groupOfNames)(member={{.User}}))
 	GroupQueryFilter string `yaml:"group-query-filter"`
+
+	// NestedGroupDepth is the number of levels of nested groups that
+	// will be followed when determining the groups a user is a member
+	// of. Nested groups are found by searching with GroupQueryFilter
+	// with .User set to the DN of each group found at the previous
+	// level. If this is zero only the groups that directly contain
+	// the user are returned.
+	NestedGroupDepth int `yaml:"nested-group-depth"`
+
+	// GroupCacheTTL holds the length of time for which the groups
+	// found for a user are cached. If this is zero the LDAP server
+	// will be queried every time the groups are required.
+	GroupCacheTTL config.DurationString `yaml:"group-cache-ttl"`
+
+	// GroupSyncInterval holds the interval at which the cached
+	// groups of recently active users are refreshed in the
+	// background. If this is zero no background refresh will be
+	// performed. This may only be set when GroupCacheTTL is set.
+	GroupSyncInterval config.DurationString `yaml:"group-sync-interval"`
+
+	// GroupSyncActivePeriod holds the length of time since a user
+	// last logged in or discharged a macaroon for which that user is
+	// considered recently active by the background group sync. If
+	// this is zero a period of 24 hours will be used.
+	GroupSyncActivePeriod config.DurationString `yaml:"group-sync-active-period"`
+
+	// MaxFailedLogins holds the maximum number of failed login
+	// attempts that are allowed for a username from a client within
+	// FailedLoginWindow. Once the limit has been reached further
+	// login attempts for that username from that client will be
+	// refused without contacting the LDAP server until the window
+	// has passed. If this is zero the identity server's limits are
+	// used.
+	MaxFailedLogins int `yaml:"max-failed-logins"`
+
+	// FailedLoginWindow holds the length of time over which failed
+	// logins are counted, and for which a username is locked out
+	// once the limit has been reached. If this is zero a window of
+	// 10 minutes will be used.
+	FailedLoginWindow config.DurationString `yaml:"failed-login-window"`
 }
 
 // UserQueryAttrs defines how user attributes are mapped to attributes in the
@@ -142,9 +214,25 @@ func NewIdentityProvider(p Params) (idp.IdentityProvider, error) {
 	if _, err = ldap.CompileFilter(testFilter); err != nil {
 		return nil, errgo.Notef(err, "invalid 'group-query-filter' config parameter")
 	}
+	if p.NestedGroupDepth < 0 {
+		return nil, errgo.Newf("invalid 'nested-group-depth' config parameter %d", p.NestedGroupDepth)
+	}
+	if p.GroupSyncInterval.Duration > 0 && p.GroupCacheTTL.Duration <= 0 {
+		return nil, errgo.Newf("'group-sync-interval' config parameter specified without 'group-cache-ttl'")
+	}
+	if p.GroupSyncActivePeriod.Duration == 0 {
+		p.GroupSyncActivePeriod.Duration = defaultGroupSyncActivePeriod
+	}
+	if p.MaxFailedLogins < 0 {
+		return nil, errgo.Newf("invalid 'max-failed-logins' config parameter %d", p.MaxFailedLogins)
+	}
+	if p.FailedLoginWindow.Duration == 0 {
+		p.FailedLoginWindow.Duration = defaultFailedLoginWindow
+	}
 
 	idp := &identityProvider{
 		params:                   p,
+		clock:                    clock.WallClock,
 		dialLDAP:                 dialLDAP,
 		userQueryAttrs:           userQueryAttrs,
 		groupQueryFilterTemplate: groupQueryFilterTemplate,
@@ -182,6 +270,7 @@ func NewIdentityProvider(p Params) (idp.IdentityProvider, error) {
 type identityProvider struct {
 	params     Params
 	initParams idp.InitParams
+	clock      clock.Clock
 
 	dialLDAP  func(network, addr string) (ldapConn, error)
 	network   string
@@ -208,6 +297,16 @@ func (idp *identityProvider) Description() string {
 	return idp.params.Description
 }
 
+// IconURL implements idp.ChooserInfo.IconURL.
+func (idp *identityProvider) IconURL() string {
+	return idp.params.Icon
+}
+
+// EmailDomains implements idp.ChooserInfo.EmailDomains.
+func (idp *identityProvider) EmailDomains() []string {
+	return idp.params.EmailDomains
+}
+
 // Interactive implements idp.IdentityProvider.Interactive.
 func (*identityProvider) Interactive() bool {
 	return true
@@ -216,6 +315,9 @@ func (*identityProvider) Interactive() bool {
 // Init implements idp.IdentityProvider.Init.
 func (idp *identityProvider) Init(ctx context.Context, params idp.InitParams) error {
 	idp.initParams = params
+	if idp.params.GroupSyncInterval.Duration > 0 {
+		go idp.syncGroupsLoop(ctx)
+	}
 	return nil
 }
 
@@ -224,21 +326,79 @@ func (idp *identityProvider) URL(dischargeID string) string {
 	return idputil.URL(idp.initParams.URLPrefix, "/login", dischargeID)
 }
 
-// URL implements idp.IdentityProvider.SetInteraction.
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
 func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+	ierr.SetInteraction(form.InteractionMethod, form.InteractionInfo{
+		URL: idputil.URL(idp.initParams.URLPrefix, "/interact", dischargeID),
+	})
 }
 
 //  GetGroups implements idp.IdentityProvider.GetGroups.
 func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Identity) ([]string, error) {
-	conn, err := idp.dial()
+	if idp.params.GroupCacheTTL.Duration <= 0 {
+		groups, err := idp.searchGroups(ctx, identity.ProviderID)
+		return groups, errgo.Mask(err)
+	}
+	if groups, ok := idp.cachedGroups(ctx, identity.ProviderID); ok {
+		return groups, nil
+	}
+	groups, err := idp.refreshGroups(ctx, identity.ProviderID)
+	return groups, errgo.Mask(err)
+}
+
+// CachedGroups implements idp.GroupCache.CachedGroups. Groups are only
+// cached when a group-cache-ttl is configured, and are kept up to date
+// for recently active users by the background group sync.
+func (idp *identityProvider) CachedGroups(ctx context.Context, identity *store.Identity) ([]string, bool) {
+	if idp.params.GroupCacheTTL.Duration <= 0 {
+		return nil, false
+	}
+	return idp.cachedGroups(ctx, identity.ProviderID)
+}
+
+// searchGroups searches the LDAP server for the groups of which the
+// given identity is a member, following nested groups up to the
+// configured depth.
+func (idp *identityProvider) searchGroups(ctx context.Context, id store.ProviderIdentity) ([]string, error) {
+	conn, err := idp.dial(ctx)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	defer conn.Close()
 
-	_, uid := identity.ProviderID.Split()
+	_, uid := id.Split()
+	groups := []string{}
+	seen := map[string]bool{uid: true}
+	members := []string{uid}
+	for depth := 0; len(members) > 0 && depth <= idp.params.NestedGroupDepth; depth++ {
+		var next []string
+		for _, member := range members {
+			entries, err := idp.searchMemberOf(conn, member)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			for _, entry := range entries {
+				if entry == nil || seen[entry.DN] {
+					continue
+				}
+				seen[entry.DN] = true
+				next = append(next, entry.DN)
+				if len(entry.Attributes) == 0 || len(entry.Attributes[0].Values) == 0 {
+					continue
+				}
+				groups = append(groups, entry.Attributes[0].Values[0])
+			}
+		}
+		members = next
+	}
+	return groups, nil
+}
+
+// searchMemberOf returns the entries for the groups that directly
+// contain the given member.
+func (idp *identityProvider) searchMemberOf(conn ldapConn, member string) ([]*ldap.Entry, error) {
 	filter, err := renderTemplate(
-		idp.groupQueryFilterTemplate, groupQueryArg{User: ldap.EscapeFilter(uid)})
+		idp.groupQueryFilterTemplate, groupQueryArg{User: ldap.EscapeFilter(member)})
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -254,17 +414,121 @@ func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Iden
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	return res.Entries, nil
+}
 
-	groups := []string{}
-	for _, entry := range res.Entries {
-		if entry == nil || len(entry.Attributes) == 0 || len(entry.Attributes[0].Values) == 0 {
-			continue
+// groupCacheEntry is the value stored in the KeyValueStore for a
+// cached set of groups.
+type groupCacheEntry struct {
+	Groups  []string  `json:"groups"`
+	Expires time.Time `json:"expires"`
+}
+
+// groupCacheKey returns the KeyValueStore key used to cache the groups
+// of the given identity.
+func groupCacheKey(id store.ProviderIdentity) string {
+	return "groups:" + string(id)
+}
+
+// cachedGroups returns the cached groups for the given identity. If
+// there is no unexpired cache entry then false is returned.
+func (idp *identityProvider) cachedGroups(ctx context.Context, id store.ProviderIdentity) ([]string, bool) {
+	kv := idp.initParams.KeyValueStore
+	ctx, close := kv.Context(ctx)
+	defer close()
+	buf, err := kv.Get(ctx, groupCacheKey(id))
+	if err != nil {
+		if errgo.Cause(err) != store.ErrNotFound {
+			logger.Warningf("cannot get cached groups for %q: %s", id, err)
 		}
-		groups = append(groups, entry.Attributes[0].Values[0])
+		return nil, false
+	}
+	var entry groupCacheEntry
+	if err := json.Unmarshal(buf, &entry); err != nil {
+		logger.Warningf("invalid cached groups for %q: %s", id, err)
+		return nil, false
+	}
+	if !idp.clock.Now().Before(entry.Expires) {
+		return nil, false
+	}
+	return entry.Groups, true
+}
+
+// refreshGroups searches the LDAP server for the groups of the given
+// identity and updates the cache with the result.
+func (idp *identityProvider) refreshGroups(ctx context.Context, id store.ProviderIdentity) ([]string, error) {
+	groups, err := idp.searchGroups(ctx, id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	entry := groupCacheEntry{
+		Groups:  groups,
+		Expires: idp.clock.Now().Add(idp.params.GroupCacheTTL.Duration),
+	}
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	kv := idp.initParams.KeyValueStore
+	ctx, close := kv.Context(ctx)
+	defer close()
+	if err := kv.Set(ctx, groupCacheKey(id), buf, entry.Expires); err != nil {
+		// The groups are still valid even if they couldn't be
+		// cached.
+		logger.Warningf("cannot cache groups for %q: %s", id, err)
 	}
 	return groups, nil
 }
 
+// syncGroupsLoop periodically refreshes the cached groups of recently
+// active users until the given context is done.
+func (idp *identityProvider) syncGroupsLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-idp.clock.After(idp.params.GroupSyncInterval.Duration):
+		}
+		if err := idp.syncGroups(ctx); err != nil {
+			logger.Errorf("cannot sync groups: %s", err)
+		}
+	}
+}
+
+// syncGroups refreshes the cached groups for every identity from this
+// identity provider that has logged in or discharged a macaroon within
+// the configured active period.
+func (idp *identityProvider) syncGroups(ctx context.Context) error {
+	ctx, close := idp.initParams.Store.Context(ctx)
+	defer close()
+
+	since := idp.clock.Now().Add(-idp.params.GroupSyncActivePeriod.Duration)
+	ref := store.Identity{
+		LastLogin:     since,
+		LastDischarge: since,
+	}
+	ids := make(map[store.ProviderIdentity]bool)
+	for _, f := range []store.Field{store.LastLogin, store.LastDischarge} {
+		var filter store.Filter
+		filter[f] = store.GreaterThanOrEqual
+		identities, err := idp.initParams.Store.FindIdentities(ctx, &ref, filter, nil, 0, 0)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, id := range identities {
+			if id.ProviderID.Provider() == idp.params.Name {
+				ids[id.ProviderID] = true
+			}
+		}
+	}
+	for id := range ids {
+		if _, err := idp.refreshGroups(ctx, id); err != nil {
+			logger.Warningf("cannot refresh groups for %q: %s", id, err)
+		}
+	}
+	return nil
+}
+
 // Handle implements idp.IdentityProvider.Handle.
 func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	switch strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix) {
@@ -272,6 +536,10 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 		if err := idp.handleLogin(ctx, w, req); err != nil {
 			idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
 		}
+	case "/interact":
+		if err := idp.handleInteract(ctx, w, req); err != nil {
+			idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+		}
 	}
 }
 
@@ -282,7 +550,7 @@ func (idp *identityProvider) handleLogin(ctx context.Context, w http.ResponseWri
 	case "GET":
 		return errgo.Mask(idp.initParams.Template.ExecuteTemplate(w, "login-form", nil))
 	case "POST":
-		id, err := idp.loginUser(ctx, req.Form.Get("username"), req.Form.Get("password"))
+		id, err := idp.loginUser(ctx, req, req.Form.Get("username"), req.Form.Get("password"))
 		if err != nil {
 			return err
 		}
@@ -291,24 +559,110 @@ func (idp *identityProvider) handleLogin(ctx context.Context, w http.ResponseWri
 	}
 }
 
-func (idp *identityProvider) loginUser(ctx context.Context, username, password string) (*store.Identity, error) {
-	conn, err := idp.dial()
+// handleInteract handles the httpbakery form interaction method. A
+// GET request returns the form schema and a POST request logs the user
+// in and returns a discharge token.
+func (idp *identityProvider) handleInteract(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		httprequest.WriteJSON(w, http.StatusOK, ldapSchemaResponse)
+		return nil
+	}
+	var lr form.LoginRequest
+	if err := httprequest.Unmarshal(idputil.RequestParams(ctx, w, req), &lr); err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "cannot unmarshal login request")
+	}
+	frm, err := ldapFieldsChecker.Coerce(lr.Body.Form, nil)
+	if err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "cannot validate form")
+	}
+	m := frm.(map[string]interface{})
+	id, err := idp.loginUser(ctx, req, m["username"].(string), m["password"].(string))
+	if err != nil {
+		return err
+	}
+	dt, err := idp.initParams.DischargeTokenCreator.DischargeToken(ctx, idputil.DischargeID(req), id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	httprequest.WriteJSON(w, http.StatusOK, form.LoginResponse{
+		Token: dt,
+	})
+	return nil
+}
+
+var ldapSchemaResponse = form.SchemaResponse{
+	Schema: ldapFields,
+}
+
+var ldapFields = environschema.Fields{
+	"username": environschema.Attr{
+		Description: "username",
+		Type:        environschema.Tstring,
+		Mandatory:   true,
+	},
+	"password": environschema.Attr{
+		Description: "password",
+		Type:        environschema.Tstring,
+		Mandatory:   true,
+		Secret:      true,
+	},
+}
+
+var ldapFieldsChecker = schema.FieldMap(mustValidationSchema(ldapFields))
+
+func mustValidationSchema(fields environschema.Fields) (schema.Fields, schema.Defaults) {
+	f, d, err := fields.ValidationSchema()
+	if err != nil {
+		panic(err)
+	}
+	return f, d
+}
+
+// LockoutPolicy implements idp.LockoutPolicy.LockoutPolicy.
+func (idp *identityProvider) LockoutPolicy() (maxFailures int, duration time.Duration) {
+	return idp.params.MaxFailedLogins, idp.params.FailedLoginWindow.Duration
+}
+
+// loginUser logs in the given user with the given password. Attempts
+// are limited by the login limiter, against which the outcome is
+// recorded for the client that made the given request.
+func (idp *identityProvider) loginUser(ctx context.Context, req *http.Request, username, password string) (*store.Identity, error) {
+	if password == "" {
+		// Many LDAP servers treat a bind with an empty password
+		// as an unauthenticated bind, which succeeds for any DN.
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "no password specified")
+	}
+	limiter := idp.initParams.LoginLimiter
+	if limiter != nil {
+		if err := limiter.Allow(ctx, req, username); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
+	conn, err := idp.dial(ctx)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	defer conn.Close()
 
 	dn, err := idp.resolveUsername(conn, username)
+	if err == nil {
+		err = conn.Bind(dn, password)
+	}
 	if err != nil {
+		if limiter != nil {
+			limiter.LoginFailed(ctx, req, username)
+		}
 		return nil, errgo.Mask(err)
 	}
-	return idp.loginDN(ctx, conn, dn, password)
+	if limiter != nil {
+		limiter.LoginSucceeded(ctx, req, username)
+	}
+	return idp.loginDN(ctx, conn, dn)
 }
 
-func (idp *identityProvider) loginDN(ctx context.Context, conn ldapConn, dn, password string) (*store.Identity, error) {
-	if err := conn.Bind(dn, password); err != nil {
-		return nil, errgo.Mask(err)
-	}
+// loginDN updates the identity for the given DN, to which the given
+// connection must be bound.
+func (idp *identityProvider) loginDN(ctx context.Context, conn ldapConn, dn string) (*store.Identity, error) {
 	req := &ldap.SearchRequest{
 		BaseDN:       dn,
 		Scope:        ldap.ScopeBaseObject,
@@ -371,12 +725,16 @@ func (idp *identityProvider) resolveUsername(conn ldapConn, username string) (st
 }
 
 // dial establishes a connection to the LDAP server and binds as the
-// search user (if specified).
-func (idp *identityProvider) dial() (ldapConn, error) {
+// search user (if specified). Operations on the returned connection are
+// recorded as spans in the trace from the given context.
+func (idp *identityProvider) dial(ctx context.Context) (ldapConn, error) {
+	_, span := tracing.StartSpan(ctx, "ldap.Dial", attribute.String("net.peer.name", idp.address))
 	conn, err := idp.dialLDAP(idp.network, idp.address)
+	tracing.EndSpan(span, err)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	conn = tracedConn{conn, ctx}
 	if err = conn.StartTLS(&idp.tlsConfig); err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -404,6 +762,35 @@ func dialLDAP(network, addr string) (ldapConn, error) {
 	return c, nil
 }
 
+// tracedConn is an ldapConn that records a span for each LDAP
+// operation. LDAP has no means of carrying trace context to the server,
+// so these spans only show the time spent waiting for it.
+type tracedConn struct {
+	ldapConn
+	ctx context.Context
+}
+
+func (c tracedConn) StartTLS(config *tls.Config) error {
+	_, span := tracing.StartSpan(c.ctx, "ldap.StartTLS")
+	err := c.ldapConn.StartTLS(config)
+	tracing.EndSpan(span, err)
+	return err
+}
+
+func (c tracedConn) Bind(username, password string) error {
+	_, span := tracing.StartSpan(c.ctx, "ldap.Bind")
+	err := c.ldapConn.Bind(username, password)
+	tracing.EndSpan(span, err)
+	return err
+}
+
+func (c tracedConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	_, span := tracing.StartSpan(c.ctx, "ldap.Search", attribute.String("ldap.base_dn", req.BaseDN))
+	res, err := c.ldapConn.Search(req)
+	tracing.EndSpan(span, err)
+	return res, err
+}
+
 // ldapConn represents the subset of ldap connection methods used
 // by the provider. It is defined so that it can be replaced for testing.
 type ldapConn interface {
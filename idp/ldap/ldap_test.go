@@ -4,17 +4,26 @@
 package ldap_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/juju/testing"
+	"github.com/juju/testing/httptesting"
 	"golang.org/x/net/context"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/form"
 
+	"github.com/CanonicalLtd/blues-identity/config"
 	"github.com/CanonicalLtd/blues-identity/idp"
 	"github.com/CanonicalLtd/blues-identity/idp/idptest"
 	"github.com/CanonicalLtd/blues-identity/idp/ldap"
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
 	"github.com/CanonicalLtd/blues-identity/store"
 )
 
@@ -22,10 +31,22 @@ type ldapSuite struct {
 	idptest.Suite
 
 	ldapDialer *mockLDAPDialer
+	clock      *testing.Clock
+	limiter    *ratelimit.Limiter
 }
 
 var _ = gc.Suite(&ldapSuite{})
 
+func (s *ldapSuite) SetUpTest(c *gc.C) {
+	s.Suite.SetUpTest(c)
+	s.clock = testing.NewClock(time.Now())
+	kv, err := s.ProviderDataStore.KeyValueStore(s.Ctx, "ratelimit")
+	c.Assert(err, gc.IsNil)
+	s.limiter = ratelimit.New(kv, ratelimit.Params{
+		Clock: s.clock,
+	})
+}
+
 var newTests = []struct {
 	about       string
 	params      ldap.Params
@@ -116,6 +137,28 @@ var newTests = []struct {
 		GroupQueryFilter: "(invalid=",
 	},
 	expectError: `invalid 'group-query-filter' config parameter.*`,
+}, {
+	about: "negative nested group depth",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://localhost",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+		NestedGroupDepth: -1,
+	},
+	expectError: `invalid 'nested-group-depth' config parameter -1`,
+}, {
+	about: "group sync without cache",
+	params: ldap.Params{
+		Name:              "ldap",
+		URL:               "ldap://localhost",
+		UserQueryFilter:   "(userAttr=val)",
+		UserQueryAttrs:    ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter:  "(groupAttr=val)",
+		GroupSyncInterval: config.DurationString{Duration: time.Minute},
+	},
+	expectError: `'group-sync-interval' config parameter specified without 'group-cache-ttl'`,
 }}
 
 func (s *ldapSuite) getSampleLdapDB() ldapDB {
@@ -153,10 +196,23 @@ func (s *ldapSuite) setupIdp(c *gc.C, params ldap.Params, db ldapDB) idp.Identit
 	c.Assert(err, gc.IsNil)
 	s.ldapDialer = newMockLDAPDialer(db)
 	ldap.SetLDAP(i, s.ldapDialer.Dial)
-	i.Init(context.TODO(), s.InitParams(c, "https://example.com/test"))
+	i.Init(context.TODO(), s.initParams(c, i))
 	return i
 }
 
+// resetIdp re-initializes the given identity provider so that another
+// login attempt can be made in the same test.
+func (s *ldapSuite) resetIdp(c *gc.C, i idp.IdentityProvider) {
+	err := i.Init(context.TODO(), s.initParams(c, i))
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *ldapSuite) initParams(c *gc.C, i idp.IdentityProvider) idp.InitParams {
+	params := s.InitParams(c, "https://example.com/test")
+	params.LoginLimiter = ratelimit.NewLoginLimiter(s.limiter, i)
+	return params
+}
+
 func (s *ldapSuite) makeLoginRequest(c *gc.C, i idp.IdentityProvider, username, password string) *httptest.ResponseRecorder {
 	req, err := http.NewRequest("POST", "/login",
 		strings.NewReader(
@@ -225,6 +281,33 @@ func (s *ldapSuite) TestURL(c *gc.C) {
 	c.Assert(i.URL("1"), gc.Equals, "https://example.com/test/login?id=1")
 }
 
+func (s *ldapSuite) makeInteractRequest(c *gc.C, i idp.IdentityProvider, username, password string) *httptest.ResponseRecorder {
+	body, err := json.Marshal(form.LoginBody{
+		Form: map[string]interface{}{
+			"username": username,
+			"password": password,
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	req, err := http.NewRequest("POST", "/interact?id=1", bytes.NewReader(body))
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	req.ParseForm()
+	rr := httptest.NewRecorder()
+	i.Handle(context.TODO(), rr, req)
+	return rr
+}
+
+func (s *ldapSuite) TestSetInteraction(c *gc.C) {
+	i := s.setupIdp(c, s.getSampleParams(), s.getSampleLdapDB())
+	ierr := httpbakery.NewInteractionRequiredError(nil, nil)
+	i.SetInteraction(ierr, "1")
+	var info form.InteractionInfo
+	err := ierr.InteractionMethod(form.InteractionMethod, &info)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(info.URL, gc.Equals, "https://example.com/test/interact?id=1")
+}
+
 func (s *ldapSuite) TestHandle(c *gc.C) {
 	params := s.getSampleParams()
 	params.Domain = "ldap"
@@ -354,3 +437,248 @@ func (s *ldapSuite) TestHandleFailedLogin(c *gc.C) {
 	s.makeLoginRequest(c, i, "user1", "wrong")
 	s.AssertLoginFailureMatches(c, `Login failure`)
 }
+
+var nestedGroupDocs = []ldapDoc{{
+	"dn":          {"cn=group1,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group1"},
+	"member":      {"uid=user1,ou=users,dc=example,dc=com"},
+}, {
+	"dn":          {"cn=group2,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group2"},
+	"member":      {"cn=group1,ou=groups,dc=example,dc=com"},
+}, {
+	"dn":          {"cn=group3,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group3"},
+	"member": {
+		"cn=group2,ou=groups,dc=example,dc=com",
+		"cn=group4,ou=groups,dc=example,dc=com",
+	},
+}, {
+	"dn":          {"cn=group4,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group4"},
+	"member":      {"cn=group3,ou=groups,dc=example,dc=com"},
+}}
+
+var nestedGroupTests = []struct {
+	about        string
+	depth        int
+	expectGroups []string
+}{{
+	about:        "no nesting",
+	depth:        0,
+	expectGroups: []string{"group1"},
+}, {
+	about:        "one level",
+	depth:        1,
+	expectGroups: []string{"group1", "group2"},
+}, {
+	about:        "depth limited",
+	depth:        2,
+	expectGroups: []string{"group1", "group2", "group3"},
+}, {
+	about:        "cycle",
+	depth:        10,
+	expectGroups: []string{"group1", "group2", "group3", "group4"},
+}}
+
+func (s *ldapSuite) TestGetGroupsNested(c *gc.C) {
+	sampleDB := append(s.getSampleLdapDB(), nestedGroupDocs...)
+	identity := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:   "user1",
+	}
+	for i, test := range nestedGroupTests {
+		c.Logf("test %d. %s", i, test.about)
+		params := s.getSampleParams()
+		params.NestedGroupDepth = test.depth
+		ip := s.setupIdp(c, params, sampleDB)
+		groups, err := ip.GetGroups(s.Ctx, identity)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(groups, gc.DeepEquals, test.expectGroups)
+	}
+}
+
+func (s *ldapSuite) TestGetGroupsCached(c *gc.C) {
+	clock := testing.NewClock(time.Now())
+	params := s.getSampleParams()
+	params.GroupCacheTTL = config.DurationString{Duration: time.Minute}
+	sampleDB := append(s.getSampleLdapDB(), nestedGroupDocs...)
+	i := s.setupIdp(c, params, sampleDB)
+	ldap.SetClock(i, clock)
+	identity := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:   "user1",
+	}
+	_, ok := i.(idp.GroupCache).CachedGroups(s.Ctx, identity)
+	c.Assert(ok, gc.Equals, false)
+	groups, err := i.GetGroups(s.Ctx, identity)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.DeepEquals, []string{"group1"})
+	c.Assert(s.ldapDialer.conns, gc.HasLen, 1)
+	groups, ok = i.(idp.GroupCache).CachedGroups(s.Ctx, identity)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(groups, gc.DeepEquals, []string{"group1"})
+
+	// Change the groups in the directory, the cached groups should
+	// still be returned.
+	s.ldapDialer.db = append(s.ldapDialer.db, ldapDoc{
+		"dn":          {"cn=group5,ou=groups,dc=example,dc=com"},
+		"objectClass": {"groupOfNames"},
+		"cn":          {"group5"},
+		"member":      {"uid=user1,ou=users,dc=example,dc=com"},
+	})
+	groups, err = i.GetGroups(s.Ctx, identity)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.DeepEquals, []string{"group1"})
+	c.Assert(s.ldapDialer.conns, gc.HasLen, 1)
+
+	// Once the cache entry has expired the directory is queried
+	// again.
+	clock.Advance(time.Minute)
+	groups, err = i.GetGroups(s.Ctx, identity)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.DeepEquals, []string{"group1", "group5"})
+	c.Assert(s.ldapDialer.conns, gc.HasLen, 2)
+}
+
+func (s *ldapSuite) TestSyncGroups(c *gc.C) {
+	now := time.Now()
+	clock := testing.NewClock(now)
+	params := s.getSampleParams()
+	params.GroupCacheTTL = config.DurationString{Duration: time.Hour}
+	params.GroupSyncActivePeriod = config.DurationString{Duration: time.Hour}
+	sampleDB := append(s.getSampleLdapDB(), nestedGroupDocs...)
+	i := s.setupIdp(c, params, sampleDB)
+	ldap.SetClock(i, clock)
+
+	identities := []store.Identity{{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:   "user1",
+		LastLogin:  now.Add(-time.Minute),
+	}, {
+		ProviderID:    store.MakeProviderIdentity("test", "uid=user2,ou=users,dc=example,dc=com"),
+		Username:      "user2",
+		LastDischarge: now.Add(-2 * time.Hour),
+	}, {
+		ProviderID: store.MakeProviderIdentity("other", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:   "user1-other",
+		LastLogin:  now.Add(-time.Minute),
+	}}
+	for _, id := range identities {
+		id := id
+		err := s.Store.UpdateIdentity(s.Ctx, &id, store.Update{
+			store.Username:      store.Set,
+			store.LastLogin:     store.Set,
+			store.LastDischarge: store.Set,
+		})
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	err := ldap.SyncGroups(s.Ctx, i)
+	c.Assert(err, gc.Equals, nil)
+	// Only the recently active user from this provider is synced.
+	c.Assert(s.ldapDialer.conns, gc.HasLen, 1)
+
+	// The groups are served from the cache without querying the
+	// directory.
+	groups, err := i.GetGroups(s.Ctx, &identities[0])
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.DeepEquals, []string{"group1"})
+	c.Assert(s.ldapDialer.conns, gc.HasLen, 1)
+}
+
+func (s *ldapSuite) TestHandleInteractSchema(c *gc.C) {
+	i := s.setupIdp(c, s.getSampleParams(), s.getSampleLdapDB())
+	req, err := http.NewRequest("GET", "/interact?id=1", nil)
+	c.Assert(err, gc.Equals, nil)
+	req.ParseForm()
+	rr := httptest.NewRecorder()
+	i.Handle(context.TODO(), rr, req)
+	s.AssertLoginNotComplete(c)
+	httptesting.AssertJSONResponse(c, rr, http.StatusOK, ldap.LDAPSchemaResponse)
+}
+
+func (s *ldapSuite) TestHandleInteract(c *gc.C) {
+	params := s.getSampleParams()
+	params.Domain = "ldap"
+	i := s.setupIdp(c, params, s.getSampleLdapDB())
+	rr := s.makeInteractRequest(c, i, "user1", "pass1")
+	s.AssertLoginNotComplete(c)
+	httptesting.AssertJSONResponse(c, rr, http.StatusOK, form.LoginResponse{
+		Token: &httpbakery.DischargeToken{
+			Kind:  "test",
+			Value: []byte("user1@ldap"),
+		},
+	})
+	s.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity(
+			"test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username: "user1@ldap",
+	})
+}
+
+func (s *ldapSuite) TestHandleInteractFailedLogin(c *gc.C) {
+	i := s.setupIdp(c, s.getSampleParams(), s.getSampleLdapDB())
+	s.makeInteractRequest(c, i, "user1", "wrong")
+	s.AssertLoginFailureMatches(c, `Login failure`)
+}
+
+func (s *ldapSuite) TestHandleEmptyPassword(c *gc.C) {
+	i := s.setupIdp(c, s.getSampleParams(), s.getSampleLdapDB())
+	s.makeLoginRequest(c, i, "user1", "")
+	s.AssertLoginFailureMatches(c, `no password specified`)
+	s.resetIdp(c, i)
+	s.makeInteractRequest(c, i, "user1", "")
+	s.AssertLoginFailureMatches(c, `no password specified`)
+}
+
+func (s *ldapSuite) TestHandleInteractNoUsername(c *gc.C) {
+	i := s.setupIdp(c, s.getSampleParams(), s.getSampleLdapDB())
+	body, err := json.Marshal(form.LoginBody{
+		Form: map[string]interface{}{
+			"password": "pass1",
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	req, err := http.NewRequest("POST", "/interact?id=1", bytes.NewReader(body))
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	req.ParseForm()
+	rr := httptest.NewRecorder()
+	i.Handle(context.TODO(), rr, req)
+	s.AssertLoginFailureMatches(c, `cannot validate form: username: expected string, got nothing`)
+}
+
+func (s *ldapSuite) TestFailedLoginLimit(c *gc.C) {
+	params := s.getSampleParams()
+	params.MaxFailedLogins = 2
+	params.FailedLoginWindow = config.DurationString{Duration: time.Minute}
+	i := s.setupIdp(c, params, s.getSampleLdapDB())
+
+	for j := 0; j < 2; j++ {
+		s.resetIdp(c, i)
+		s.makeInteractRequest(c, i, "user1", "wrong")
+		s.AssertLoginFailureMatches(c, `Login failure`)
+	}
+
+	// The limit has been reached, so even the correct password is
+	// refused.
+	s.resetIdp(c, i)
+	s.makeInteractRequest(c, i, "user1", "pass1")
+	s.AssertLoginFailureMatches(c, `too many failed login attempts for "user1", try again later`)
+
+	// Other users are unaffected.
+	s.resetIdp(c, i)
+	s.makeInteractRequest(c, i, "user2", "pass2")
+	s.AssertLoginNotComplete(c)
+
+	// Once the window has passed the user can log in again.
+	s.clock.Advance(time.Minute)
+	s.resetIdp(c, i)
+	s.makeLoginRequest(c, i, "user1", "pass1")
+	s.AssertLoginSuccess(c, "user1")
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/CanonicalLtd/blues-identity/idp"
 	"github.com/CanonicalLtd/blues-identity/idp/idputil"
 	"github.com/CanonicalLtd/blues-identity/idp/idputil/secret"
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
 	"github.com/CanonicalLtd/blues-identity/store"
 )
 
@@ -59,6 +60,16 @@ type OpenIDConnectParams struct {
 	// identity provider will be tagged (not including the @ separator).
 	Domain string `yaml:"domain"`
 
+	// Icon contains the URL of an icon that is shown with the
+	// identity provider on the login page.
+	Icon string `yaml:"icon"`
+
+	// EmailDomains contains the email domains of the users of this
+	// identity provider. Users that enter an email address in one of
+	// these domains on the login page are sent to this identity
+	// provider.
+	EmailDomains []string `yaml:"email-domains"`
+
 	// Issuer is the OpenID connect issuer for the identity provider.
 	// Discovery will be performed for this issuer.
 	Issuer string `yaml:"issuer"`
@@ -93,6 +104,10 @@ type openidConnectIdentityProvider struct {
 	provider   *oidc.Provider
 	config     *oauth2.Config
 	codec      *secret.Codec
+
+	// client holds the HTTP client used for requests to the OpenID
+	// provider, it propagates the trace context of the request.
+	client *http.Client
 }
 
 // Name implements idp.IdentityProvider.Name.
@@ -110,6 +125,16 @@ func (idp *openidConnectIdentityProvider) Description() string {
 	return idp.params.Description
 }
 
+// IconURL implements idp.ChooserInfo.IconURL.
+func (idp *openidConnectIdentityProvider) IconURL() string {
+	return idp.params.Icon
+}
+
+// EmailDomains implements idp.ChooserInfo.EmailDomains.
+func (idp *openidConnectIdentityProvider) EmailDomains() []string {
+	return idp.params.EmailDomains
+}
+
 // Interactive implements idp.IdentityProvider.Interactive.
 func (*openidConnectIdentityProvider) Interactive() bool {
 	return true
@@ -119,8 +144,9 @@ func (*openidConnectIdentityProvider) Interactive() bool {
 // the issuer and set up the identity provider.
 func (idp *openidConnectIdentityProvider) Init(ctx context.Context, params idp.InitParams) error {
 	idp.initParams = params
+	idp.client = tracing.NewHTTPClient()
 	var err error
-	idp.provider, err = oidc.NewProvider(ctx, idp.params.Issuer)
+	idp.provider, err = oidc.NewProvider(oidc.ClientContext(ctx, idp.client), idp.params.Issuer)
 	if err != nil {
 		return errgo.Mask(err)
 	}
@@ -186,6 +212,7 @@ func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.R
 	if dischargeID != req.Form.Get("state") {
 		return dischargeID, errgo.WithCausef(nil, params.ErrBadRequest, "invalid session")
 	}
+	ctx = oidc.ClientContext(ctx, idp.client)
 	tok, err := idp.config.Exchange(ctx, req.Form.Get("code"))
 	if err != nil {
 		return dischargeID, errgo.Mask(err)
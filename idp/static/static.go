@@ -0,0 +1,400 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package static contains an identity provider that authenticates users
+// with passwords stored in the identity server itself. Users and their
+// passwords are managed by an administrator, for example using the
+// user-admin set-password command.
+package static
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/schema"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/environschema.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/form"
+
+	"github.com/CanonicalLtd/blues-identity/config"
+	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/idp/idputil"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+var logger = loggo.GetLogger("identity.idp.static")
+
+const (
+	// defaultMaxFailedLogins is the number of consecutive failed
+	// logins after which an account is locked when MaxFailedLogins
+	// is not specified.
+	defaultMaxFailedLogins = 5
+
+	// defaultLockoutDuration is the length of time for which an
+	// account is locked when LockoutDuration is not specified.
+	defaultLockoutDuration = 15 * time.Minute
+
+	// minPasswordLength is the minimum length of a password that
+	// can be set.
+	minPasswordLength = 8
+)
+
+// passwordKey is the ProviderInfo key used to store the password hash
+// of an identity.
+const passwordKey = "password"
+
+// dummyHash is compared against the password given for an unknown user
+// so that a failed login takes the same time whether or not the user
+// exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func init() {
+	config.RegisterIDP("static", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
+		var p Params
+		if err := unmarshal(&p); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal static parameters")
+		}
+		idp, err := NewIdentityProvider(p)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return idp, nil
+	})
+}
+
+type Params struct {
+	// Name is the name that will be given to the identity provider.
+	// If this is not set then "static" will be used.
+	Name string `yaml:"name"`
+
+	// Description is the description that will be used with the
+	// identity provider. If this is not set then Name will be used.
+	Description string `yaml:"description"`
+
+	// Domain is the domain with which all identities created by this
+	// identity provider will be tagged (not including the @ separator).
+	Domain string `yaml:"domain"`
+
+	// MaxFailedLogins holds the number of failed login attempts
+	// from a client within LockoutDuration after which an account is
+	// locked for that client. If this is zero a limit of 5 will be
+	// used.
+	MaxFailedLogins int `yaml:"max-failed-logins"`
+
+	// LockoutDuration holds the length of time for which failed
+	// logins are counted, and for which an account remains locked
+	// after too many failed logins. If this is zero 15 minutes will
+	// be used. Setting a new password also unlocks the account.
+	LockoutDuration config.DurationString `yaml:"lockout-duration"`
+}
+
+// NewIdentityProvider creates a new static identity provider.
+func NewIdentityProvider(p Params) (idp.IdentityProvider, error) {
+	if p.Name == "" {
+		p.Name = "static"
+	}
+	if p.Description == "" {
+		p.Description = p.Name
+	}
+	if p.MaxFailedLogins < 0 {
+		return nil, errgo.Newf("invalid 'max-failed-logins' config parameter %d", p.MaxFailedLogins)
+	}
+	if p.MaxFailedLogins == 0 {
+		p.MaxFailedLogins = defaultMaxFailedLogins
+	}
+	if p.LockoutDuration.Duration < 0 {
+		return nil, errgo.Newf("invalid 'lockout-duration' config parameter %s", p.LockoutDuration.Duration)
+	}
+	if p.LockoutDuration.Duration == 0 {
+		p.LockoutDuration.Duration = defaultLockoutDuration
+	}
+	return &identityProvider{
+		params: p,
+	}, nil
+}
+
+type identityProvider struct {
+	params     Params
+	initParams idp.InitParams
+}
+
+// Name implements idp.IdentityProvider.Name.
+func (idp *identityProvider) Name() string {
+	return idp.params.Name
+}
+
+// Domain implements idp.IdentityProvider.Domain.
+func (idp *identityProvider) Domain() string {
+	return idp.params.Domain
+}
+
+// Description implements idp.IdentityProvider.Description.
+func (idp *identityProvider) Description() string {
+	return idp.params.Description
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*identityProvider) Interactive() bool {
+	return true
+}
+
+// LockoutPolicy implements idp.LockoutPolicy.LockoutPolicy.
+func (idp *identityProvider) LockoutPolicy() (maxFailures int, duration time.Duration) {
+	return idp.params.MaxFailedLogins, idp.params.LockoutDuration.Duration
+}
+
+// Init implements idp.IdentityProvider.Init.
+func (idp *identityProvider) Init(ctx context.Context, params idp.InitParams) error {
+	idp.initParams = params
+	return nil
+}
+
+// URL implements idp.IdentityProvider.URL.
+func (idp *identityProvider) URL(dischargeID string) string {
+	return idputil.URL(idp.initParams.URLPrefix, "/login", dischargeID)
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
+func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+	ierr.SetInteraction(form.InteractionMethod, form.InteractionInfo{
+		URL: idputil.URL(idp.initParams.URLPrefix, "/interact", dischargeID),
+	})
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups. All of the groups
+// of a static user are stored in the identity server, so the identity
+// provider never adds any.
+func (*identityProvider) GetGroups(context.Context, *store.Identity) ([]string, error) {
+	return nil, nil
+}
+
+// SetPassword implements idp.PasswordSetter.SetPassword.
+func (idp *identityProvider) SetPassword(ctx context.Context, username, password string) error {
+	name, err := idp.localName(username)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if len(password) < minPasswordLength {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	id := store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, name),
+		Username:   username,
+		ProviderInfo: map[string][]string{
+			passwordKey: {string(hash)},
+		},
+	}
+	if err := idp.initParams.Store.UpdateIdentity(ctx, &id, store.Update{
+		store.Username:     store.Set,
+		store.ProviderInfo: store.Set,
+	}); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername))
+	}
+	// Setting a new password unlocks the account.
+	if limiter := idp.initParams.LoginLimiter; limiter != nil {
+		limiter.Unlock(ctx, name)
+	}
+	logger.Infof("password set for %s", username)
+	return nil
+}
+
+// localName returns the name within the identity provider of the user
+// with the given username.
+func (idp *identityProvider) localName(username string) (string, error) {
+	name := username
+	if idp.params.Domain != "" {
+		suffix := "@" + idp.params.Domain
+		if !strings.HasSuffix(username, suffix) {
+			return "", errgo.WithCausef(nil, params.ErrBadRequest, "invalid username %q, must be in domain %q", username, idp.params.Domain)
+		}
+		name = strings.TrimSuffix(username, suffix)
+	}
+	if name == "" || strings.Contains(name, "@") || idputil.ReservedUsernames[name] {
+		return "", errgo.WithCausef(nil, params.ErrBadRequest, "invalid username %q", username)
+	}
+	return name, nil
+}
+
+// Handle implements idp.IdentityProvider.Handle.
+func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	switch strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix) {
+	case "/login":
+		if err := idp.handleLogin(ctx, w, req); err != nil {
+			idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+		}
+	case "/interact":
+		if err := idp.handleInteract(ctx, w, req); err != nil {
+			idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+		}
+	default:
+		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), errgo.WithCausef(nil, params.ErrNotFound, "path %q not found", req.URL.Path))
+	}
+}
+
+// loginFormParams holds the parameters passed to the "login-form"
+// template.
+type loginFormParams struct {
+	// Action holds the URL to which the form must be posted.
+	Action string
+
+	// Error holds any error from a previous attempt.
+	Error string
+}
+
+func (idp *identityProvider) handleLogin(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	switch req.Method {
+	default:
+		return errgo.WithCausef(nil, params.ErrBadRequest, "unsupported method %q", req.Method)
+	case "GET":
+		return errgo.Mask(idp.writeLoginForm(w, req, ""))
+	case "POST":
+		username := req.Form.Get("username")
+		if err := idp.allowLogin(ctx, req, username); err != nil {
+			logger.Infof("login refused: %s", err)
+			return errgo.Mask(idp.writeLoginForm(w, req, "Too many login attempts, try again later."))
+		}
+		id, err := idp.loginUser(ctx, req, username, req.Form.Get("password"))
+		if errgo.Cause(err) == params.ErrUnauthorized {
+			logger.Infof("login failed: %s", err)
+			return errgo.Mask(idp.writeLoginForm(w, req, "Invalid username or password."))
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		idp.initParams.VisitCompleter.Success(ctx, w, req, idputil.DischargeID(req), id)
+		return nil
+	}
+}
+
+func (idp *identityProvider) writeLoginForm(w http.ResponseWriter, req *http.Request, errMsg string) error {
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	return errgo.Mask(idp.initParams.Template.ExecuteTemplate(w, "login-form", loginFormParams{
+		Action: idp.URL(idputil.DischargeID(req)),
+		Error:  errMsg,
+	}))
+}
+
+// handleInteract handles the httpbakery form interaction method. A
+// GET request returns the form schema and a POST request logs the user
+// in and returns a discharge token.
+func (idp *identityProvider) handleInteract(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		httprequest.WriteJSON(w, http.StatusOK, schemaResponse)
+		return nil
+	}
+	var lr form.LoginRequest
+	if err := httprequest.Unmarshal(idputil.RequestParams(ctx, w, req), &lr); err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "cannot unmarshal login request")
+	}
+	frm, err := fieldsChecker.Coerce(lr.Body.Form, nil)
+	if err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "cannot validate form")
+	}
+	m := frm.(map[string]interface{})
+	username := m["username"].(string)
+	if err := idp.allowLogin(ctx, req, username); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	id, err := idp.loginUser(ctx, req, username, m["password"].(string))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	dt, err := idp.initParams.DischargeTokenCreator.DischargeToken(ctx, idputil.DischargeID(req), id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	httprequest.WriteJSON(w, http.StatusOK, form.LoginResponse{
+		Token: dt,
+	})
+	return nil
+}
+
+var schemaResponse = form.SchemaResponse{
+	Schema: fields,
+}
+
+var fields = environschema.Fields{
+	"username": environschema.Attr{
+		Description: "username",
+		Type:        environschema.Tstring,
+		Mandatory:   true,
+	},
+	"password": environschema.Attr{
+		Description: "password",
+		Type:        environschema.Tstring,
+		Mandatory:   true,
+		Secret:      true,
+	},
+}
+
+var fieldsChecker = schema.FieldMap(mustValidationSchema(fields))
+
+func mustValidationSchema(fields environschema.Fields) (schema.Fields, schema.Defaults) {
+	f, d, err := fields.ValidationSchema()
+	if err != nil {
+		panic(err)
+	}
+	return f, d
+}
+
+// allowLogin returns an error if the login limiter refuses an attempt
+// by the client that made the given request to log in as the given
+// user.
+func (idp *identityProvider) allowLogin(ctx context.Context, req *http.Request, username string) error {
+	if limiter := idp.initParams.LoginLimiter; limiter != nil {
+		return errgo.Mask(limiter.Allow(ctx, req, username), errgo.Any)
+	}
+	return nil
+}
+
+// loginUser checks the given password for the given user. The outcome
+// is recorded with the login limiter against the client that made the
+// given request. If the login fails an error with a cause of
+// params.ErrUnauthorized is returned.
+func (idp *identityProvider) loginUser(ctx context.Context, req *http.Request, username, password string) (*store.Identity, error) {
+	id, err := idp.checkPassword(ctx, username, password)
+	limiter := idp.initParams.LoginLimiter
+	switch {
+	case limiter == nil:
+	case err == nil:
+		limiter.LoginSucceeded(ctx, req, username)
+	case errgo.Cause(err) == params.ErrUnauthorized:
+		limiter.LoginFailed(ctx, req, username)
+	}
+	return id, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+}
+
+// checkPassword checks the given password for the given user. If the
+// password is wrong, or there is no such user, an error with a cause of
+// params.ErrUnauthorized is returned.
+func (idp *identityProvider) checkPassword(ctx context.Context, username, password string) (*store.Identity, error) {
+	id := store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, username),
+	}
+	if err := idp.initParams.Store.Identity(ctx, &id); err != nil {
+		if errgo.Cause(err) != store.ErrNotFound {
+			return nil, errgo.Mask(err)
+		}
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid username or password")
+	}
+	var hash []byte
+	if v := id.ProviderInfo[passwordKey]; len(v) > 0 {
+		hash = []byte(v[0])
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid username or password")
+	}
+	return &id, nil
+}
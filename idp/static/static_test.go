@@ -0,0 +1,381 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package static_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/testing"
+	"github.com/juju/testing/httptesting"
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/form"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CanonicalLtd/blues-identity/config"
+	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/idp/idptest"
+	"github.com/CanonicalLtd/blues-identity/idp/static"
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+type staticSuite struct {
+	idptest.Suite
+
+	clock   *testing.Clock
+	limiter *ratelimit.Limiter
+	idp     idp.IdentityProvider
+}
+
+var _ = gc.Suite(&staticSuite{})
+
+func (s *staticSuite) SetUpSuite(c *gc.C) {
+	s.Suite.SetUpSuite(c)
+	s.Template = template.Must(template.New("").Parse(
+		`{{define "login-form"}}{{.Action}}|{{.Error}}{{end}}`,
+	))
+}
+
+func (s *staticSuite) SetUpTest(c *gc.C) {
+	s.Suite.SetUpTest(c)
+	s.clock = testing.NewClock(time.Now())
+	kv, err := s.ProviderDataStore.KeyValueStore(s.Ctx, "ratelimit")
+	c.Assert(err, gc.Equals, nil)
+	s.limiter = ratelimit.New(kv, ratelimit.Params{
+		Clock: s.clock,
+	})
+	s.idp = s.setupIdp(c, static.Params{
+		Name: "test",
+	})
+	s.setPassword(c, s.idp, "bob", "bob's password")
+}
+
+func (s *staticSuite) setupIdp(c *gc.C, params static.Params) idp.IdentityProvider {
+	i, err := static.NewIdentityProvider(params)
+	c.Assert(err, gc.Equals, nil)
+	s.resetIdp(c, i)
+	return i
+}
+
+// resetIdp re-initializes the given identity provider so that another
+// login attempt can be made in the same test.
+func (s *staticSuite) resetIdp(c *gc.C, i idp.IdentityProvider) {
+	params := s.InitParams(c, "https://example.com/test")
+	params.LoginLimiter = ratelimit.NewLoginLimiter(s.limiter, i)
+	err := i.Init(context.TODO(), params)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *staticSuite) setPassword(c *gc.C, i idp.IdentityProvider, username, password string) {
+	err := i.(idp.PasswordSetter).SetPassword(context.TODO(), username, password)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *staticSuite) makeLoginRequest(c *gc.C, i idp.IdentityProvider, username, password string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/login?id=1",
+		strings.NewReader(
+			url.Values{
+				"username": {username},
+				"password": {password},
+			}.Encode(),
+		),
+	)
+	c.Assert(err, gc.Equals, nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ParseForm()
+	rr := httptest.NewRecorder()
+	i.Handle(context.TODO(), rr, req)
+	return rr
+}
+
+func (s *staticSuite) makeInteractRequest(c *gc.C, i idp.IdentityProvider, username, password string) *httptest.ResponseRecorder {
+	body, err := json.Marshal(form.LoginBody{
+		Form: map[string]interface{}{
+			"username": username,
+			"password": password,
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	req, err := http.NewRequest("POST", "/interact?id=1", bytes.NewReader(body))
+	c.Assert(err, gc.Equals, nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.ParseForm()
+	rr := httptest.NewRecorder()
+	i.Handle(context.TODO(), rr, req)
+	return rr
+}
+
+func (s *staticSuite) TestConfig(c *gc.C) {
+	configYaml := `
+identity-providers:
+ - type: static
+   domain: example
+   lockout-duration: 10m
+`
+	var conf config.Config
+	err := yaml.Unmarshal([]byte(configYaml), &conf)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(conf.IdentityProviders, gc.HasLen, 1)
+	c.Assert(conf.IdentityProviders[0].Name(), gc.Equals, "static")
+	c.Assert(conf.IdentityProviders[0].Domain(), gc.Equals, "example")
+}
+
+func (s *staticSuite) TestNewIdentityProviderInvalidMaxFailedLogins(c *gc.C) {
+	_, err := static.NewIdentityProvider(static.Params{
+		MaxFailedLogins: -1,
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid 'max-failed-logins' config parameter -1`)
+}
+
+func (s *staticSuite) TestName(c *gc.C) {
+	c.Assert(s.idp.Name(), gc.Equals, "test")
+}
+
+func (s *staticSuite) TestDescription(c *gc.C) {
+	c.Assert(s.idp.Description(), gc.Equals, "test")
+}
+
+func (s *staticSuite) TestInteractive(c *gc.C) {
+	c.Assert(s.idp.Interactive(), gc.Equals, true)
+}
+
+func (s *staticSuite) TestURL(c *gc.C) {
+	c.Assert(s.idp.URL("1"), gc.Equals, "https://example.com/test/login?id=1")
+}
+
+func (s *staticSuite) TestSetInteraction(c *gc.C) {
+	ierr := httpbakery.NewInteractionRequiredError(nil, nil)
+	s.idp.SetInteraction(ierr, "1")
+	var info form.InteractionInfo
+	err := ierr.InteractionMethod(form.InteractionMethod, &info)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(info.URL, gc.Equals, "https://example.com/test/interact?id=1")
+}
+
+func (s *staticSuite) TestSetPassword(c *gc.C) {
+	id := s.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	})
+	c.Assert(id.ProviderInfo["password"], gc.HasLen, 1)
+	c.Assert(id.ProviderInfo["password"][0], gc.Not(gc.Equals), "bob's password")
+}
+
+func (s *staticSuite) TestSetPasswordWithDomain(c *gc.C) {
+	i := s.setupIdp(c, static.Params{
+		Name:   "test",
+		Domain: "example",
+	})
+	s.setPassword(c, i, "alice@example", "alice's password")
+	s.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice@example",
+	})
+	s.makeLoginRequest(c, i, "alice", "alice's password")
+	s.AssertLoginSuccess(c, "alice@example")
+}
+
+var setPasswordErrorTests = []struct {
+	about       string
+	domain      string
+	username    string
+	password    string
+	expectError string
+}{{
+	about:       "short password",
+	username:    "alice",
+	password:    "secret",
+	expectError: `password must be at least 8 characters`,
+}, {
+	about:       "wrong domain",
+	domain:      "example",
+	username:    "alice@other",
+	password:    "alice's password",
+	expectError: `invalid username "alice@other", must be in domain "example"`,
+}, {
+	about:       "no domain",
+	domain:      "example",
+	username:    "alice",
+	password:    "alice's password",
+	expectError: `invalid username "alice", must be in domain "example"`,
+}, {
+	about:       "domain not allowed",
+	username:    "alice@example",
+	password:    "alice's password",
+	expectError: `invalid username "alice@example"`,
+}, {
+	about:       "reserved username",
+	username:    "admin",
+	password:    "admin's password",
+	expectError: `invalid username "admin"`,
+}}
+
+func (s *staticSuite) TestSetPasswordError(c *gc.C) {
+	for i, test := range setPasswordErrorTests {
+		c.Logf("test %d. %s", i, test.about)
+		p := s.setupIdp(c, static.Params{
+			Name:   "test",
+			Domain: test.domain,
+		})
+		err := p.(idp.PasswordSetter).SetPassword(context.TODO(), test.username, test.password)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	}
+}
+
+func (s *staticSuite) TestHandleGet(c *gc.C) {
+	req, err := http.NewRequest("GET", "/login?id=1", nil)
+	c.Assert(err, gc.Equals, nil)
+	req.ParseForm()
+	rr := httptest.NewRecorder()
+	s.idp.Handle(context.TODO(), rr, req)
+	s.AssertLoginNotComplete(c)
+	c.Assert(rr.Code, gc.Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), gc.Equals, "https://example.com/test/login?id=1|")
+}
+
+func (s *staticSuite) TestHandleLogin(c *gc.C) {
+	s.makeLoginRequest(c, s.idp, "bob", "bob's password")
+	s.AssertLoginSuccess(c, "bob")
+}
+
+func (s *staticSuite) TestHandleLoginWrongPassword(c *gc.C) {
+	rr := s.makeLoginRequest(c, s.idp, "bob", "wrong")
+	s.AssertLoginNotComplete(c)
+	c.Assert(rr.Code, gc.Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), gc.Equals, "https://example.com/test/login?id=1|Invalid username or password.")
+}
+
+func (s *staticSuite) TestHandleLoginUnknownUser(c *gc.C) {
+	rr := s.makeLoginRequest(c, s.idp, "alice", "bob's password")
+	s.AssertLoginNotComplete(c)
+	c.Assert(rr.Body.String(), gc.Equals, "https://example.com/test/login?id=1|Invalid username or password.")
+}
+
+func (s *staticSuite) TestHandleInteractGet(c *gc.C) {
+	req, err := http.NewRequest("GET", "/interact?id=1", nil)
+	c.Assert(err, gc.Equals, nil)
+	req.ParseForm()
+	rr := httptest.NewRecorder()
+	s.idp.Handle(context.TODO(), rr, req)
+	httptesting.AssertJSONResponse(c, rr, http.StatusOK, static.SchemaResponse)
+}
+
+func (s *staticSuite) TestHandleInteract(c *gc.C) {
+	rr := s.makeInteractRequest(c, s.idp, "bob", "bob's password")
+	s.AssertLoginNotComplete(c)
+	httptesting.AssertJSONResponse(c, rr, http.StatusOK, form.LoginResponse{
+		Token: &httpbakery.DischargeToken{
+			Kind:  "test",
+			Value: []byte("bob"),
+		},
+	})
+}
+
+func (s *staticSuite) TestHandleInteractFailedLogin(c *gc.C) {
+	s.makeInteractRequest(c, s.idp, "bob", "wrong")
+	s.AssertLoginFailureMatches(c, `invalid username or password`)
+}
+
+func (s *staticSuite) TestLockout(c *gc.C) {
+	i := s.setupIdp(c, static.Params{
+		Name:            "test",
+		MaxFailedLogins: 2,
+		LockoutDuration: config.DurationString{Duration: time.Minute},
+	})
+
+	for j := 0; j < 2; j++ {
+		s.resetIdp(c, i)
+		s.makeInteractRequest(c, i, "bob", "wrong")
+		s.AssertLoginFailureMatches(c, `invalid username or password`)
+	}
+
+	// The limit has been reached, so even the correct password is
+	// refused.
+	s.resetIdp(c, i)
+	s.makeInteractRequest(c, i, "bob", "bob's password")
+	s.AssertLoginFailureMatches(c, `too many failed login attempts for "bob", try again later`)
+
+	s.resetIdp(c, i)
+	rr := s.makeLoginRequest(c, i, "bob", "bob's password")
+	s.AssertLoginNotComplete(c)
+	c.Assert(rr.Body.String(), gc.Equals, "https://example.com/test/login?id=1|Too many login attempts, try again later.")
+
+	// Once the lockout has expired the user can log in again.
+	s.clock.Advance(time.Minute)
+	s.resetIdp(c, i)
+	s.makeLoginRequest(c, i, "bob", "bob's password")
+	s.AssertLoginSuccess(c, "bob")
+}
+
+func (s *staticSuite) TestDefaultLockoutDuration(c *gc.C) {
+	i := s.setupIdp(c, static.Params{
+		Name:            "test",
+		MaxFailedLogins: 1,
+	})
+
+	s.makeInteractRequest(c, i, "bob", "wrong")
+	s.AssertLoginFailureMatches(c, `invalid username or password`)
+
+	s.clock.Advance(14 * time.Minute)
+	s.resetIdp(c, i)
+	s.makeInteractRequest(c, i, "bob", "bob's password")
+	s.AssertLoginFailureMatches(c, `too many failed login attempts for "bob", try again later`)
+
+	s.clock.Advance(time.Minute)
+	s.resetIdp(c, i)
+	s.makeLoginRequest(c, i, "bob", "bob's password")
+	s.AssertLoginSuccess(c, "bob")
+}
+
+func (s *staticSuite) TestPasswordSetUnlocks(c *gc.C) {
+	i := s.setupIdp(c, static.Params{
+		Name:            "test",
+		MaxFailedLogins: 1,
+	})
+	s.makeInteractRequest(c, i, "bob", "wrong")
+	s.AssertLoginFailureMatches(c, `invalid username or password`)
+
+	s.resetIdp(c, i)
+	s.makeInteractRequest(c, i, "bob", "bob's password")
+	s.AssertLoginFailureMatches(c, `too many failed login attempts for "bob", try again later`)
+
+	// Setting a new password unlocks the account.
+	s.setPassword(c, i, "bob", "bob's new password")
+	s.resetIdp(c, i)
+	s.makeLoginRequest(c, i, "bob", "bob's new password")
+	s.AssertLoginSuccess(c, "bob")
+}
+
+func (s *staticSuite) TestSuccessfulLoginResetsFailures(c *gc.C) {
+	i := s.setupIdp(c, static.Params{
+		Name:            "test",
+		MaxFailedLogins: 2,
+	})
+	s.makeInteractRequest(c, i, "bob", "wrong")
+	s.AssertLoginFailureMatches(c, `invalid username or password`)
+
+	s.resetIdp(c, i)
+	s.makeLoginRequest(c, i, "bob", "bob's password")
+	s.AssertLoginSuccess(c, "bob")
+
+	s.resetIdp(c, i)
+	s.makeInteractRequest(c, i, "bob", "wrong")
+	s.AssertLoginFailureMatches(c, `invalid username or password`)
+
+	s.resetIdp(c, i)
+	s.makeLoginRequest(c, i, "bob", "bob's password")
+	s.AssertLoginSuccess(c, "bob")
+}
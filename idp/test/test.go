@@ -43,9 +43,19 @@ type Params struct {
 	// provider.
 	Domain string
 
+	// Icon contains the URL returned by IconURL.
+	Icon string
+
+	// EmailDomains contains the domains returned by EmailDomains.
+	EmailDomains []string
+
 	// GetGroups contains function that if set will be called by
 	// GetGroups to obtain the groups to return.
 	GetGroups func(*store.Identity) ([]string, error)
+
+	// CachedGroups contains a function that if set will be called
+	// by CachedGroups to obtain the groups to return.
+	CachedGroups func(*store.Identity) ([]string, bool)
 }
 
 // NewIdentityProvider creates an idp.IdentityProvider that can be used
@@ -76,6 +86,16 @@ func (*identityProvider) Description() string {
 	return "Test"
 }
 
+// IconURL implements idp.ChooserInfo.IconURL.
+func (idp *identityProvider) IconURL() string {
+	return idp.params.Icon
+}
+
+// EmailDomains implements idp.ChooserInfo.EmailDomains.
+func (idp *identityProvider) EmailDomains() []string {
+	return idp.params.EmailDomains
+}
+
 // Interactive specifies that this identity provider is interactive.
 func (*identityProvider) Interactive() bool {
 	return true
@@ -108,6 +128,15 @@ func (idp *identityProvider) GetGroups(_ context.Context, id *store.Identity) ([
 	return f(id)
 }
 
+// CachedGroups implements idp.GroupCache.CachedGroups.
+func (idp *identityProvider) CachedGroups(_ context.Context, id *store.Identity) ([]string, bool) {
+	f := idp.params.CachedGroups
+	if f == nil {
+		return nil, false
+	}
+	return f(id)
+}
+
 // Handle handles the login process.
 func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	id, err := idp.handle(ctx, w, req)
@@ -35,21 +35,29 @@ var logger = loggo.GetLogger("identity.idp.usso")
 
 func init() {
 	config.RegisterIDP("usso", func(func(interface{}) error) (idp.IdentityProvider, error) {
-		return IdentityProvider, nil
+		return NewIdentityProvider(), nil
 	})
 }
 
 // IdentityProvider is an idp.IdentityProvider that provides
+// authentication via Ubuntu SSO. As it can only be initialised once,
+// servers that reload their identity providers should use
+// NewIdentityProvider instead.
+var IdentityProvider = NewIdentityProvider()
+
+// NewIdentityProvider creates a new idp.IdentityProvider that provides
 // authentication via Ubuntu SSO.
-var IdentityProvider idp.IdentityProvider = &identityProvider{
-	discoveryCache: openid.NewSimpleDiscoveryCache(),
-	groupCache:     cache.New(10 * time.Minute),
-	groupMonitor: prometheus.NewSummary(prometheus.SummaryOpts{
-		Namespace: "blues_identity",
-		Subsystem: "launchpad",
-		Name:      "get_launchpad_groups",
-		Help:      "The duration of launchpad login, /people, and super_teams_collection_link requests.",
-	}),
+func NewIdentityProvider() idp.IdentityProvider {
+	return &identityProvider{
+		discoveryCache: openid.NewSimpleDiscoveryCache(),
+		groupCache:     cache.New(10 * time.Minute),
+		groupMonitor: prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace: "blues_identity",
+			Subsystem: "launchpad",
+			Name:      "get_launchpad_groups",
+			Help:      "The duration of launchpad login, /people, and super_teams_collection_link requests.",
+		}),
+	}
 }
 
 const (
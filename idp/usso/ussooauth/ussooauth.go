@@ -29,13 +29,21 @@ import (
 
 func init() {
 	config.RegisterIDP("usso_oauth", func(func(interface{}) error) (idp.IdentityProvider, error) {
-		return IdentityProvider, nil
+		return NewIdentityProvider(), nil
 	})
 }
 
 // IdentityProvider is an idp.IdentityProvider that provides
+// authentication via Ubuntu SSO using OAuth. As it can only be
+// initialised once, servers that reload their identity providers
+// should use NewIdentityProvider instead.
+var IdentityProvider = NewIdentityProvider()
+
+// NewIdentityProvider creates a new idp.IdentityProvider that provides
 // authentication via Ubuntu SSO using OAuth.
-var IdentityProvider idp.IdentityProvider = &identityProvider{}
+func NewIdentityProvider() idp.IdentityProvider {
+	return &identityProvider{}
+}
 
 const (
 	ussoURL = "https://login.ubuntu.com"
@@ -0,0 +1,362 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package webauthn is an identity provider that allows users to log in
+// without a password using a security key that they have previously
+// registered.
+//
+// Security keys are registered when a user is asked for a second
+// authentication factor after logging in with another identity
+// provider. The security key must verify the user (for example with a
+// PIN or biometric) to be used with this identity provider, so no
+// further factor is required.
+package webauthn
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/blues-identity/config"
+	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/idp/idputil"
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+var logger = loggo.GetLogger("identity.idp.webauthn")
+
+// loginStateDuration is the length of time for which a login attempt
+// remains valid.
+const loginStateDuration = 10 * time.Minute
+
+func init() {
+	config.RegisterIDP("webauthn", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
+		var p Params
+		if err := unmarshal(&p); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal webauthn parameters")
+		}
+		return NewIdentityProvider(p), nil
+	})
+}
+
+type Params struct {
+	// Name is the name that will be given to the identity provider.
+	// If this is not set then "webauthn" will be used.
+	Name string `yaml:"name"`
+
+	// Description is the description that will be used with the
+	// identity provider. If this is not set then "Security Key"
+	// will be used.
+	Description string `yaml:"description"`
+
+	// RPID holds the WebAuthn relying party ID. This must be the
+	// same as the relying party ID with which the security keys
+	// were registered. If this is not set then the host name of the
+	// identity server's location will be used.
+	RPID string `yaml:"rp-id"`
+}
+
+// NewIdentityProvider creates a new webauthn identity provider.
+func NewIdentityProvider(p Params) idp.IdentityProvider {
+	if p.Name == "" {
+		p.Name = "webauthn"
+	}
+	if p.Description == "" {
+		p.Description = "Security Key"
+	}
+	return &identityProvider{
+		params: p,
+	}
+}
+
+type identityProvider struct {
+	params     Params
+	initParams idp.InitParams
+	config     *webauthn.Config
+}
+
+// Name implements idp.IdentityProvider.Name.
+func (idp *identityProvider) Name() string {
+	return idp.params.Name
+}
+
+// Domain implements idp.IdentityProvider.Domain. The webauthn identity
+// provider does not create identities so it has no domain.
+func (*identityProvider) Domain() string {
+	return ""
+}
+
+// Description implements idp.IdentityProvider.Description.
+func (idp *identityProvider) Description() string {
+	return idp.params.Description
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*identityProvider) Interactive() bool {
+	return true
+}
+
+// Init implements idp.IdentityProvider.Init.
+func (idp *identityProvider) Init(ctx context.Context, params idp.InitParams) error {
+	idp.initParams = params
+	config, err := webauthn.NewConfig(params.URLPrefix, idp.params.RPID, idp.params.Description)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	idp.config = config
+	return nil
+}
+
+// URL implements idp.IdentityProvider.URL.
+func (idp *identityProvider) URL(dischargeID string) string {
+	return idputil.URL(idp.initParams.URLPrefix, "/login", dischargeID)
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction. Security
+// keys can only be used from a web browser so there is no non-interactive
+// login method.
+func (*identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups. The webauthn
+// identity provider does not create identities so it never provides
+// any groups.
+func (*identityProvider) GetGroups(context.Context, *store.Identity) ([]string, error) {
+	return nil, nil
+}
+
+// Handle implements idp.IdentityProvider.Handle.
+func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	switch strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix) {
+	case "/login":
+		if err := idp.handleLogin(ctx, w, req); err != nil {
+			idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), err)
+		}
+	default:
+		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), errgo.WithCausef(nil, params.ErrNotFound, "path %q not found", req.URL.Path))
+	}
+}
+
+// loginParams holds the parameters passed to the "webauthn-login"
+// template.
+type loginParams struct {
+	// Action holds the URL to which the form must be posted.
+	Action string
+
+	// DischargeID holds the discharge ID of the login. This must be
+	// included in any form sent to Action with the GET method.
+	DischargeID string
+
+	// State holds the login state that must be posted with the
+	// response.
+	State string
+
+	// Username holds the username that the user entered, if any.
+	Username string
+
+	// Options holds the JSON encoded options that must be passed to
+	// navigator.credentials.get.
+	Options string
+
+	// Error holds any error from a previous attempt.
+	Error string
+}
+
+// loginState holds the state of a login attempt between the login page
+// being shown and the response from the security key being posted.
+type loginState struct {
+	Options  *webauthn.RequestOptions `json:"options"`
+	Username string                   `json:"username,omitempty"`
+	Expires  time.Time                `json:"expires"`
+}
+
+func (idp *identityProvider) handleLogin(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	switch req.Method {
+	default:
+		return errgo.WithCausef(nil, params.ErrBadRequest, "unsupported method %q", req.Method)
+	case "GET":
+		return errgo.Mask(idp.writeLoginPage(ctx, w, req, req.Form.Get("username"), ""))
+	case "POST":
+		id, err := idp.login(ctx, req.Form.Get("state"), req.Form.Get("response"))
+		if errgo.Cause(err) == params.ErrUnauthorized {
+			logger.Infof("security key login failed: %s", err)
+			return errgo.Mask(idp.writeLoginPage(ctx, w, req, "", "Login failed."))
+		}
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		idp.initParams.VisitCompleter.Success(contextWithMultiFactor(ctx), w, req, idputil.DischargeID(req), id)
+		return nil
+	}
+}
+
+// writeLoginPage starts a new login attempt and writes the login page.
+// If username is specified then only the security keys registered for
+// that user may be used, otherwise the security key must be able to
+// identify the user itself.
+func (idp *identityProvider) writeLoginPage(ctx context.Context, w http.ResponseWriter, req *http.Request, username, errMsg string) error {
+	var creds []webauthn.Credential
+	if username != "" {
+		id := store.Identity{
+			Username: username,
+		}
+		if err := idp.initParams.Store.Identity(ctx, &id); err != nil && errgo.Cause(err) != store.ErrNotFound {
+			return errgo.Mask(err)
+		}
+		var err error
+		creds, err = webauthn.Credentials(&id)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if len(creds) == 0 {
+			errMsg = "No security keys registered for " + username + "."
+		}
+	}
+	opts, err := idp.config.NewRequestOptions(creds, webauthn.UserVerificationRequired)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	state, err := newState()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	ls := loginState{
+		Options:  opts,
+		Username: username,
+		Expires:  time.Now().Add(loginStateDuration),
+	}
+	if err := idp.putState(ctx, state, &ls); err != nil {
+		return errgo.Mask(err)
+	}
+	buf, err := json.Marshal(opts)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	t := idp.initParams.Template.Lookup("webauthn-login")
+	if t == nil {
+		return errgo.Newf("cannot find webauthn-login template")
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	return errgo.Mask(t.Execute(w, loginParams{
+		Action:      idp.URL(idputil.DischargeID(req)),
+		DischargeID: idputil.DischargeID(req),
+		State:       state,
+		Username:    username,
+		Options:     string(buf),
+		Error:       errMsg,
+	}))
+}
+
+// login verifies the given response to the login attempt with the
+// given state. If the response is not valid an error with a cause of
+// params.ErrUnauthorized is returned.
+func (idp *identityProvider) login(ctx context.Context, state, response string) (*store.Identity, error) {
+	ls, err := idp.getState(ctx, state)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	var resp webauthn.AssertionResponse
+	if err := json.Unmarshal([]byte(response), &resp); err != nil {
+		return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid response")
+	}
+	id := store.Identity{
+		ID:       string(resp.UserHandle),
+		Username: ls.Username,
+	}
+	if id.ID == "" && id.Username == "" {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "security key did not identify user")
+	}
+	if err := idp.initParams.Store.Identity(ctx, &id); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "unknown user")
+		}
+		return nil, errgo.Mask(err)
+	}
+	if ls.Username != "" && id.Username != ls.Username {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "security key registered to a different user")
+	}
+	creds, err := webauthn.Credentials(&id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	cred := webauthn.FindCredential(creds, resp.ID)
+	if cred == nil {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "unknown security key")
+	}
+	signCount, err := idp.config.VerifyAssertion(ls.Options, cred, &resp)
+	if err != nil {
+		if errgo.Cause(err) == webauthn.ErrVerification {
+			return nil, errgo.WithCausef(err, params.ErrUnauthorized, "")
+		}
+		return nil, errgo.Mask(err)
+	}
+	cred.SignCount = signCount
+	if err := webauthn.PutCredential(ctx, idp.initParams.Store, &id, cred); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &id, nil
+}
+
+// getState retrieves, and invalidates, the login state with the given
+// key.
+func (idp *identityProvider) getState(ctx context.Context, state string) (*loginState, error) {
+	kv := idp.initParams.KeyValueStore
+	ctx, close := kv.Context(ctx)
+	defer close()
+	buf, err := kv.Get(ctx, stateKey(state))
+	if err != nil && errgo.Cause(err) != store.ErrNotFound {
+		return nil, errgo.Mask(err)
+	}
+	var ls loginState
+	if err == nil {
+		if err := json.Unmarshal(buf, &ls); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if ls.Options == nil || !time.Now().Before(ls.Expires) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid or expired login state")
+	}
+	// Make sure that the state cannot be used again.
+	if err := idp.putState(ctx, state, &loginState{}); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &ls, nil
+}
+
+// putState stores the given login state.
+func (idp *identityProvider) putState(ctx context.Context, state string, ls *loginState) error {
+	buf, err := json.Marshal(ls)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	kv := idp.initParams.KeyValueStore
+	ctx, close := kv.Context(ctx)
+	defer close()
+	return errgo.Mask(kv.Set(ctx, stateKey(state), buf, time.Now().Add(loginStateDuration)))
+}
+
+// contextWithMultiFactor is idp.ContextWithMultiFactor, the idp package
+// cannot be referred to directly in the identityProvider methods.
+var contextWithMultiFactor = idp.ContextWithMultiFactor
+
+func stateKey(state string) string {
+	return "login:" + state
+}
+
+func newState() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
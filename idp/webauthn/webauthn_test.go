@@ -0,0 +1,266 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package webauthn_test
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CanonicalLtd/blues-identity/config"
+	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/idp/idptest"
+	idpwebauthn "github.com/CanonicalLtd/blues-identity/idp/webauthn"
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn"
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn/webauthntest"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+const location = "https://idm.example.com"
+
+type webauthnSuite struct {
+	idptest.Suite
+
+	idp           idp.IdentityProvider
+	config        *webauthn.Config
+	authenticator *webauthntest.Authenticator
+	identity      *store.Identity
+}
+
+var _ = gc.Suite(&webauthnSuite{})
+
+func (s *webauthnSuite) SetUpSuite(c *gc.C) {
+	s.Suite.SetUpSuite(c)
+	s.Template = template.Must(template.New("").Parse(
+		`{{define "webauthn-login"}}{{.State}}|{{.Options}}|{{.Error}}{{end}}`,
+	))
+}
+
+func (s *webauthnSuite) SetUpTest(c *gc.C) {
+	s.Suite.SetUpTest(c)
+	s.idp = idpwebauthn.NewIdentityProvider(idpwebauthn.Params{})
+	err := s.idp.Init(s.Ctx, s.InitParams(c, location+"/login/webauthn"))
+	c.Assert(err, gc.Equals, nil)
+	s.config, err = webauthn.NewConfig(location, "", "")
+	c.Assert(err, gc.Equals, nil)
+	s.authenticator = webauthntest.NewAuthenticator(location)
+
+	s.identity = &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}
+	err = s.Store.UpdateIdentity(s.Ctx, s.identity, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = s.Store.Identity(s.Ctx, s.identity)
+	c.Assert(err, gc.Equals, nil)
+}
+
+// register registers a credential with s.authenticator for s.identity.
+func (s *webauthnSuite) register(c *gc.C) *webauthn.Credential {
+	opts, err := s.config.NewCreationOptions(webauthn.User{
+		ID:   webauthn.Bytes(s.identity.ID),
+		Name: s.identity.Username,
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Create(opts)
+	c.Assert(err, gc.Equals, nil)
+	cred, err := s.config.VerifyRegistration(opts, resp)
+	c.Assert(err, gc.Equals, nil)
+	err = webauthn.PutCredential(s.Ctx, s.Store, s.identity, cred)
+	c.Assert(err, gc.Equals, nil)
+	return cred
+}
+
+// loginPage fetches the login page with the given query and returns
+// the state and options from the page.
+func (s *webauthnSuite) loginPage(c *gc.C, query string) (string, *webauthn.RequestOptions, string) {
+	req, err := http.NewRequest("GET", "/login?"+query, nil)
+	c.Assert(err, gc.Equals, nil)
+	req.ParseForm()
+	rr := httptest.NewRecorder()
+	s.idp.Handle(s.Ctx, rr, req)
+	s.AssertLoginNotComplete(c)
+	c.Assert(rr.Code, gc.Equals, http.StatusOK, gc.Commentf("%s", rr.Body))
+	parts := strings.SplitN(rr.Body.String(), "|", 3)
+	c.Assert(parts, gc.HasLen, 3)
+	var opts webauthn.RequestOptions
+	// The options are escaped for use in a JavaScript string.
+	optsJSON := strings.Replace(parts[1], `&#34;`, `"`, -1)
+	err = json.Unmarshal([]byte(optsJSON), &opts)
+	c.Assert(err, gc.Equals, nil, gc.Commentf("%s", parts[1]))
+	return parts[0], &opts, parts[2]
+}
+
+// postResponse posts the given response to the login endpoint.
+func (s *webauthnSuite) postResponse(c *gc.C, state string, resp *webauthn.AssertionResponse) *httptest.ResponseRecorder {
+	buf, err := json.Marshal(resp)
+	c.Assert(err, gc.Equals, nil)
+	req, err := http.NewRequest("POST", "/login?id=1", strings.NewReader(url.Values{
+		"state":    {state},
+		"response": {string(buf)},
+	}.Encode()))
+	c.Assert(err, gc.Equals, nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ParseForm()
+	rr := httptest.NewRecorder()
+	s.idp.Handle(s.Ctx, rr, req)
+	return rr
+}
+
+func (s *webauthnSuite) TestConfig(c *gc.C) {
+	configYaml := `
+identity-providers:
+ - type: webauthn
+   rp-id: example.com
+`
+	var conf config.Config
+	err := yaml.Unmarshal([]byte(configYaml), &conf)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(conf.IdentityProviders, gc.HasLen, 1)
+	c.Assert(conf.IdentityProviders[0].Name(), gc.Equals, "webauthn")
+}
+
+func (s *webauthnSuite) TestName(c *gc.C) {
+	c.Assert(s.idp.Name(), gc.Equals, "webauthn")
+}
+
+func (s *webauthnSuite) TestDescription(c *gc.C) {
+	c.Assert(s.idp.Description(), gc.Equals, "Security Key")
+}
+
+func (s *webauthnSuite) TestInteractive(c *gc.C) {
+	c.Assert(s.idp.Interactive(), gc.Equals, true)
+}
+
+func (s *webauthnSuite) TestURL(c *gc.C) {
+	c.Assert(s.idp.URL("1"), gc.Equals, location+"/login/webauthn/login?id=1")
+}
+
+func (s *webauthnSuite) TestInitInvalidRPID(c *gc.C) {
+	i := idpwebauthn.NewIdentityProvider(idpwebauthn.Params{
+		RPID: "example.org",
+	})
+	err := i.Init(s.Ctx, s.InitParams(c, location+"/login/webauthn"))
+	c.Assert(err, gc.ErrorMatches, `relying party ID "example.org" is not valid for "https://idm.example.com/login/webauthn"`)
+}
+
+func (s *webauthnSuite) TestLogin(c *gc.C) {
+	s.register(c)
+	state, opts, errMsg := s.loginPage(c, "id=1")
+	c.Assert(errMsg, gc.Equals, "")
+	c.Assert(opts.RPID, gc.Equals, "idm.example.com")
+	c.Assert(opts.UserVerification, gc.Equals, webauthn.UserVerificationRequired)
+	c.Assert(opts.AllowCredentials, gc.HasLen, 0)
+	resp, err := s.authenticator.Get(opts)
+	c.Assert(err, gc.Equals, nil)
+	s.postResponse(c, state, resp)
+	s.AssertLoginSuccess(c, "bob")
+	s.AssertMultiFactor(c)
+
+	// The signature counter is updated.
+	id := store.Identity{Username: "bob"}
+	err = s.Store.Identity(s.Ctx, &id)
+	c.Assert(err, gc.Equals, nil)
+	creds, err := webauthn.Credentials(&id)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(creds, gc.HasLen, 1)
+	c.Assert(creds[0].SignCount, gc.Equals, uint32(1))
+}
+
+func (s *webauthnSuite) TestLoginWithUsername(c *gc.C) {
+	cred := s.register(c)
+	state, opts, errMsg := s.loginPage(c, "username=bob")
+	c.Assert(errMsg, gc.Equals, "")
+	c.Assert(opts.AllowCredentials, gc.HasLen, 1)
+	c.Assert([]byte(opts.AllowCredentials[0].ID), gc.DeepEquals, []byte(cred.ID))
+	resp, err := s.authenticator.Get(opts)
+	c.Assert(err, gc.Equals, nil)
+	// Some authenticators don't return the user handle for
+	// non-discoverable credentials.
+	resp.UserHandle = nil
+	s.postResponse(c, state, resp)
+	s.AssertLoginSuccess(c, "bob")
+}
+
+func (s *webauthnSuite) TestLoginUnknownUsername(c *gc.C) {
+	_, _, errMsg := s.loginPage(c, "username=alice")
+	c.Assert(errMsg, gc.Equals, "No security keys registered for alice.")
+}
+
+func (s *webauthnSuite) TestLoginUserNotVerified(c *gc.C) {
+	s.register(c)
+	s.authenticator.NoUserVerification = true
+	state, opts, _ := s.loginPage(c, "")
+	resp, err := s.authenticator.Get(opts)
+	c.Assert(err, gc.Equals, nil)
+	rr := s.postResponse(c, state, resp)
+	s.AssertLoginNotComplete(c)
+	_, _, errMsg := parsePage(c, rr)
+	c.Assert(errMsg, gc.Equals, "Login failed.")
+}
+
+func (s *webauthnSuite) TestLoginUnknownCredential(c *gc.C) {
+	s.register(c)
+
+	// Create a credential with a different authenticator without
+	// registering it.
+	opts, err := s.config.NewCreationOptions(webauthn.User{
+		ID:   webauthn.Bytes(s.identity.ID),
+		Name: s.identity.Username,
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+	s.authenticator = webauthntest.NewAuthenticator(location)
+	_, err = s.authenticator.Create(opts)
+	c.Assert(err, gc.Equals, nil)
+
+	state, ropts, _ := s.loginPage(c, "")
+	resp, err := s.authenticator.Get(ropts)
+	c.Assert(err, gc.Equals, nil)
+	rr := s.postResponse(c, state, resp)
+	s.AssertLoginNotComplete(c)
+	_, _, errMsg := parsePage(c, rr)
+	c.Assert(errMsg, gc.Equals, "Login failed.")
+}
+
+func (s *webauthnSuite) TestLoginStateReused(c *gc.C) {
+	s.register(c)
+	state, opts, _ := s.loginPage(c, "")
+	resp, err := s.authenticator.Get(opts)
+	c.Assert(err, gc.Equals, nil)
+	s.postResponse(c, state, resp)
+	s.AssertLoginSuccess(c, "bob")
+
+	err = s.idp.Init(s.Ctx, s.InitParams(c, location+"/login/webauthn"))
+	c.Assert(err, gc.Equals, nil)
+	s.postResponse(c, state, resp)
+	s.AssertLoginFailureMatches(c, `invalid or expired login state`)
+}
+
+func (s *webauthnSuite) TestLoginInvalidResponse(c *gc.C) {
+	state, _, _ := s.loginPage(c, "")
+	req, err := http.NewRequest("POST", "/login", strings.NewReader(url.Values{
+		"state":    {state},
+		"response": {"{"},
+	}.Encode()))
+	c.Assert(err, gc.Equals, nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ParseForm()
+	s.idp.Handle(s.Ctx, httptest.NewRecorder(), req)
+	s.AssertLoginFailureMatches(c, `invalid response`)
+}
+
+func parsePage(c *gc.C, rr *httptest.ResponseRecorder) (string, string, string) {
+	c.Assert(rr.Code, gc.Equals, http.StatusOK, gc.Commentf("%s", rr.Body))
+	parts := strings.SplitN(rr.Body.String(), "|", 3)
+	c.Assert(parts, gc.HasLen, 3)
+	return parts[0], parts[1], parts[2]
+}
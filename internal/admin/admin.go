@@ -0,0 +1,465 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/v1"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+const (
+	// adminPath is the path of the admin console. The cookies used by
+	// the console are restricted to this path.
+	adminPath = "/admin"
+
+	// csrfCookie is the name of the cookie that holds the token that
+	// must be included in every form posted to the console.
+	csrfCookie = "admin-csrf"
+
+	// dateFormat is the format of the dates entered in the user
+	// search form.
+	dateFormat = "2006-01-02"
+
+	// maxSearchResults is the maximum number of users shown in the
+	// results of a user search.
+	maxSearchResults = 200
+)
+
+// usersPageParams holds the parameters passed to the "admin-users"
+// template.
+type usersPageParams struct {
+	// Location holds the location of the identity server.
+	Location string
+
+	// Query holds the search that was made.
+	Query *usersRequest
+
+	// Users holds the users found by the search, ordered by
+	// username.
+	Users []userSummary
+
+	// More holds whether more users matched the search than are
+	// shown.
+	More bool
+
+	// Error holds any error in the search.
+	Error string
+}
+
+// userSummary holds the details of a user shown in search results.
+type userSummary struct {
+	Username   string
+	Name       string
+	Email      string
+	ProviderID string
+	LastLogin  time.Time
+}
+
+// userPageParams holds the parameters passed to the "admin-user"
+// template.
+type userPageParams struct {
+	// Location holds the location of the identity server, the forms
+	// on the page are posted to Location + "/admin/u/...".
+	Location string
+
+	// CSRFToken holds the token that must be included, as the "csrf"
+	// field, in every form that is posted.
+	CSRFToken string
+
+	// Username, Name and Email hold the user's profile.
+	Username string
+	Name     string
+	Email    string
+
+	// ProviderID holds the provider ID with which the user was
+	// created and LinkedProviderIDs the provider IDs of any
+	// identities that have been linked to the user.
+	ProviderID        string
+	LinkedProviderIDs []string
+
+	// LastLogin and LastDischarge hold the time of the user's last
+	// login and discharge.
+	LastLogin     time.Time
+	LastDischarge time.Time
+
+	// Owner holds the username of the owner of the user if it is an
+	// agent, Expires holds the time the agent expires, if it does.
+	Owner   string
+	Expires time.Time
+
+	// Groups holds the groups stored for the user. Groups provided
+	// by the user's identity provider are not included.
+	Groups []string
+
+	// Agents holds the usernames of the agents owned by the user.
+	Agents []string
+
+	// ExtraInfo holds the user's extra-info items, ordered by key.
+	ExtraInfo []extraInfoItem
+
+	// Disabled holds whether the user has been disabled.
+	Disabled bool
+
+	// IsAdmin holds whether the user is the admin user, which cannot
+	// be disabled.
+	IsAdmin bool
+}
+
+// extraInfoItem holds a single extra-info item of a user.
+type extraInfoItem struct {
+	// Key holds the extra-info key.
+	Key string
+
+	// Value holds the JSON encoded value of the item.
+	Value string
+}
+
+// usersRequest is a request for the user search page.
+type usersRequest struct {
+	httprequest.Route  `httprequest:"GET /admin"`
+	Username           string `httprequest:"username,form"`
+	ExternalID         string `httprequest:"external-id,form"`
+	Email              string `httprequest:"email,form"`
+	LastLoginSince     string `httprequest:"last-login-since,form"`
+	LastDischargeSince string `httprequest:"last-discharge-since,form"`
+}
+
+// Users handles the GET /admin endpoint that searches for users. The
+// search terms are the same as the filters available in
+// QueryUsersRequest. With no search terms all users are shown.
+func (h *handler) Users(p httprequest.Params, req *usersRequest) error {
+	if ok, err := h.authorize(p, &params.QueryUsersRequest{}); !ok {
+		return errgo.Mask(err, errgo.Any)
+	}
+	pp := usersPageParams{
+		Location: h.params.Location,
+		Query:    req,
+	}
+	var identity store.Identity
+	var filter store.Filter
+	if req.Username != "" {
+		identity.Username = req.Username
+		filter[store.Username] = store.Equal
+	}
+	if req.ExternalID != "" {
+		identity.ProviderID = store.ProviderIdentity(req.ExternalID)
+		filter[store.ProviderID] = store.Equal
+	}
+	if req.Email != "" {
+		identity.Email = req.Email
+		filter[store.Email] = store.Equal
+	}
+	var err error
+	if req.LastLoginSince != "" {
+		identity.LastLogin, err = time.Parse(dateFormat, req.LastLoginSince)
+		if err != nil {
+			pp.Error = "Invalid last login date."
+			return errgo.Mask(h.writePage(p, "admin-users", pp))
+		}
+		filter[store.LastLogin] = store.GreaterThanOrEqual
+	}
+	if req.LastDischargeSince != "" {
+		identity.LastDischarge, err = time.Parse(dateFormat, req.LastDischargeSince)
+		if err != nil {
+			pp.Error = "Invalid last discharge date."
+			return errgo.Mask(h.writePage(p, "admin-users", pp))
+		}
+		filter[store.LastDischarge] = store.GreaterThanOrEqual
+	}
+	identities, err := h.params.Store.FindIdentities(p.Context, &identity, filter, []store.Sort{{Field: store.Username}}, 0, maxSearchResults+1)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(identities) > maxSearchResults {
+		identities = identities[:maxSearchResults]
+		pp.More = true
+	}
+	for _, id := range identities {
+		pp.Users = append(pp.Users, userSummary{
+			Username:   id.Username,
+			Name:       id.Name,
+			Email:      id.Email,
+			ProviderID: string(id.ProviderID),
+			LastLogin:  id.LastLogin,
+		})
+	}
+	return errgo.Mask(h.writePage(p, "admin-users", pp))
+}
+
+// userRequest is a request for the page showing a single user.
+type userRequest struct {
+	httprequest.Route `httprequest:"GET /admin/u/:username"`
+	Username          params.Username `httprequest:"username,path"`
+}
+
+// User handles the GET /admin/u/:username endpoint that shows the
+// details of a user.
+func (h *handler) User(p httprequest.Params, req *userRequest) error {
+	ok, err := h.authorize(p,
+		&params.QueryUsersRequest{},
+		&params.UserRequest{Username: req.Username},
+		&params.UserGroupsRequest{Username: req.Username},
+		&params.UserExtraInfoRequest{Username: req.Username},
+		&apiparams.AgentsRequest{Username: req.Username},
+		&apiparams.UserDisabledRequest{Username: req.Username},
+	)
+	if !ok {
+		return errgo.Mask(err, errgo.Any)
+	}
+	id := store.Identity{
+		Username: string(req.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return errgo.Mask(err)
+	}
+	disabled, err := h.params.Authorizer.IsDisabled(p.Context, id.ProviderID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	agents, err := h.agents(p, &id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	csrfToken, err := h.csrfToken(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	pp := userPageParams{
+		Location:      h.params.Location,
+		CSRFToken:     csrfToken,
+		Username:      id.Username,
+		Name:          id.Name,
+		Email:         id.Email,
+		ProviderID:    string(id.ProviderID),
+		LastLogin:     id.LastLogin,
+		LastDischarge: id.LastDischarge,
+		Groups:        id.Groups,
+		Agents:        agents,
+		Disabled:      disabled,
+		IsAdmin:       id.Username == auth.AdminUsername,
+	}
+	for _, pid := range id.LinkedProviderIDs {
+		pp.LinkedProviderIDs = append(pp.LinkedProviderIDs, string(pid))
+	}
+	if auth.IsAgent(&id) {
+		if owner := id.ProviderInfo["owner"]; len(owner) > 1 {
+			pp.Owner = owner[1]
+		}
+		pp.Expires = auth.AgentExpiry(&id)
+	}
+	for k, v := range id.ExtraInfo {
+		if k == "sshkeys" || len(v) == 0 {
+			// SSH keys are stored with the extra-info but
+			// are not part of it, as in the v1 API.
+			continue
+		}
+		pp.ExtraInfo = append(pp.ExtraInfo, extraInfoItem{
+			Key:   k,
+			Value: v[0],
+		})
+	}
+	sort.Slice(pp.ExtraInfo, func(i, j int) bool {
+		return pp.ExtraInfo[i].Key < pp.ExtraInfo[j].Key
+	})
+	return errgo.Mask(h.writePage(p, "admin-user", pp))
+}
+
+// setGroupsRequest is a request to set the groups stored for a user.
+type setGroupsRequest struct {
+	httprequest.Route `httprequest:"POST /admin/u/:username/groups"`
+	Username          params.Username `httprequest:"username,path"`
+	CSRFToken         string          `httprequest:"csrf,form"`
+	Groups            string          `httprequest:"groups,form"`
+}
+
+// SetGroups handles the POST /admin/u/:username/groups endpoint that
+// replaces the groups stored for a user with the whitespace separated
+// groups in the form.
+func (h *handler) SetGroups(p httprequest.Params, req *setGroupsRequest) error {
+	if err := checkCSRFToken(p.Request, req.CSRFToken); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+	groups := strings.Fields(req.Groups)
+	ok, err := h.authorize(p,
+		&params.QueryUsersRequest{},
+		&params.SetUserGroupsRequest{
+			Username: req.Username,
+			Groups:   params.Groups{Groups: groups},
+		},
+	)
+	if !ok {
+		return errgo.Mask(err, errgo.Any)
+	}
+	err = h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+		Username: string(req.Username),
+		Groups:   groups,
+	}, store.Update{
+		store.Groups: store.Set,
+	})
+	if err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return errgo.Mask(err)
+	}
+	auth.Logger(p.Context, logger).Infof("groups of %s set to %q", req.Username, groups)
+	h.redirectToUser(p, req.Username)
+	return nil
+}
+
+// setDisabledRequest is a request to disable or re-enable a user.
+type setDisabledRequest struct {
+	httprequest.Route `httprequest:"POST /admin/u/:username/disabled"`
+	Username          params.Username `httprequest:"username,path"`
+	CSRFToken         string          `httprequest:"csrf,form"`
+	Disabled          bool            `httprequest:"disabled,form"`
+}
+
+// SetDisabled handles the POST /admin/u/:username/disabled endpoint
+// that disables or re-enables a user.
+func (h *handler) SetDisabled(p httprequest.Params, req *setDisabledRequest) error {
+	if err := checkCSRFToken(p.Request, req.CSRFToken); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+	ok, err := h.authorize(p,
+		&params.QueryUsersRequest{},
+		&apiparams.SetUserDisabledRequest{Username: req.Username},
+	)
+	if !ok {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if req.Username == auth.AdminUsername {
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot disable the admin user")
+	}
+	id := store.Identity{
+		Username: string(req.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return errgo.Mask(err)
+	}
+	if err := h.params.Authorizer.SetDisabled(p.Context, id.ProviderID, req.Disabled); err != nil {
+		if errgo.Cause(err) == auth.ErrDisablingNotSupported {
+			return errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return errgo.Mask(err)
+	}
+	if req.Disabled {
+		auth.Logger(p.Context, logger).Infof("disabled user %s", id.Username)
+	} else {
+		auth.Logger(p.Context, logger).Infof("enabled user %s", id.Username)
+	}
+	h.redirectToUser(p, req.Username)
+	return nil
+}
+
+// authorize checks that the browser making the request is logged in as
+// a user that is authorized to perform all of the given v1 API
+// requests. If the browser is not logged in it is redirected to log in
+// and authorize returns false with a nil error. Every page also
+// authorizes a QueryUsersRequest, which only members of the admin ACL
+// may make, so that the console is never shown to other users.
+func (h *handler) authorize(p httprequest.Params, reqs ...interface{}) (bool, error) {
+	ops := make([]bakery.Op, len(reqs))
+	for i, r := range reqs {
+		ops[i] = v1.OpForRequest(r)
+	}
+	_, err := h.reqAuth.Auth(p.Context, p.Request, ops...)
+	if isDischargeRequiredError(err) {
+		http.Redirect(p.Response, p.Request, h.params.Location+"/account/login?return="+adminPath, http.StatusFound)
+		return false, nil
+	}
+	if err != nil {
+		return false, errgo.Mask(err, errgo.Any)
+	}
+	return true, nil
+}
+
+func isDischargeRequiredError(err error) bool {
+	cause, ok := errgo.Cause(err).(*httpbakery.Error)
+	return ok && cause.Code == httpbakery.ErrDischargeRequired
+}
+
+// agents returns the usernames of the agents owned by the given
+// identity.
+func (h *handler) agents(p httprequest.Params, owner *store.Identity) ([]string, error) {
+	identities, err := auth.FindAgents(p.Context, h.params.Store, owner.ProviderID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var agents []string
+	for _, id := range identities {
+		agents = append(agents, id.Username)
+	}
+	return agents, nil
+}
+
+// redirectToUser redirects the browser to the page showing the given
+// user.
+func (h *handler) redirectToUser(p httprequest.Params, username params.Username) {
+	http.Redirect(p.Response, p.Request, h.params.Location+adminPath+"/u/"+url.PathEscape(string(username)), http.StatusSeeOther)
+}
+
+// writePage writes the named template using the given parameters.
+func (h *handler) writePage(p httprequest.Params, name string, pp interface{}) error {
+	t := h.params.Template.Lookup(name)
+	if t == nil {
+		return errgo.Newf("cannot find %s template", name)
+	}
+	p.Response.Header().Set("Content-Type", "text/html;charset=utf-8")
+	return errgo.Mask(t.Execute(p.Response, pp))
+}
+
+// csrfToken returns the CSRF token for the browser making the request,
+// creating a new one if the browser does not yet have one.
+func (h *handler) csrfToken(p httprequest.Params) (string, error) {
+	if c, err := p.Request.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return c.Value, nil
+	}
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errgo.Mask(err)
+	}
+	token := hex.EncodeToString(buf[:])
+	http.SetCookie(p.Response, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     adminPath,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.params.Location, "https:"),
+	})
+	return token, nil
+}
+
+// checkCSRFToken checks that the given token, posted in a form,
+// matches the CSRF token held in the browser's cookie.
+func checkCSRFToken(req *http.Request, token string) error {
+	c, err := req.Cookie(csrfCookie)
+	if err != nil || c.Value == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(token)) != 1 {
+		return errgo.WithCausef(nil, params.ErrForbidden, "invalid CSRF token")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admin_test
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/admin"
+	"github.com/CanonicalLtd/blues-identity/internal/discharger"
+	"github.com/CanonicalLtd/blues-identity/internal/identity"
+	"github.com/CanonicalLtd/blues-identity/internal/idmtest"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+type adminSuite struct {
+	idmtest.StoreServerSuite
+	client *http.Client
+}
+
+var _ = gc.Suite(&adminSuite{})
+
+var adminTemplate = template.Must(template.New("").Parse(`
+{{define "admin-users"}}{{range .Users}}{{.Username}},{{end}}|{{.More}}|{{.Error}}{{end}}
+{{define "admin-user"}}{{.Username}}|{{range .Groups}}{{.}},{{end}}|{{range .Agents}}{{.}},{{end}}|{{range .ExtraInfo}}{{.Key}}={{.Value}},{{end}}|{{.Disabled}}|{{.CSRFToken}}{{end}}
+`))
+
+func (s *adminSuite) SetUpTest(c *gc.C) {
+	s.Versions = map[string]identity.NewAPIHandlerFunc{
+		"admin":      admin.NewAPIHandler,
+		"discharger": discharger.NewAPIHandler,
+	}
+	s.Params.Template = adminTemplate
+	s.StoreServerSuite.SetUpTest(c)
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, gc.Equals, nil)
+	s.client = &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			req.SetBasicAuth(idmtest.AdminUsername, idmtest.AdminPassword)
+			return nil
+		},
+	}
+	s.addUser(c, "bob", "bob@example.com")
+	s.addUser(c, "alice", "alice@example.com")
+}
+
+func (s *adminSuite) TestNotLoggedIn(c *gc.C) {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(s.URL + "/admin")
+	c.Assert(err, gc.Equals, nil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusFound)
+	c.Assert(resp.Header.Get("Location"), gc.Equals, s.URL+"/account/login?return=/admin")
+}
+
+func (s *adminSuite) TestUsers(c *gc.C) {
+	fields := s.get(c, "/admin?email=bob@example.com")
+	c.Assert(fields, gc.DeepEquals, []string{"bob,", "false", ""})
+
+	fields = s.get(c, "/admin?username=nobody")
+	c.Assert(fields, gc.DeepEquals, []string{"", "false", ""})
+
+	fields = s.get(c, "/admin?last-login-since=yesterday")
+	c.Assert(fields, gc.DeepEquals, []string{"", "false", "Invalid last login date."})
+}
+
+func (s *adminSuite) TestUser(c *gc.C) {
+	err := s.Store.UpdateIdentity(s.Ctx, &store.Identity{
+		Username: "bob",
+		ExtraInfo: map[string][]string{
+			"colour": {`"blue"`},
+		},
+	}, store.Update{
+		store.ExtraInfo: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	fields := s.get(c, "/admin/u/bob")
+	c.Assert(fields[:5], gc.DeepEquals, []string{"bob", "a,b,", "", `colour=&#34;blue&#34;,`, "false"})
+	c.Assert(fields[5], gc.Not(gc.Equals), "")
+
+	resp, err := s.client.Get(s.URL + "/admin/u/nobody")
+	c.Assert(err, gc.Equals, nil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func (s *adminSuite) TestSetGroups(c *gc.C) {
+	fields := s.get(c, "/admin/u/bob")
+	fields = s.post(c, "/admin/u/bob/groups", url.Values{
+		"csrf":   {fields[5]},
+		"groups": {"c  d\ne"},
+	})
+	c.Assert(fields[1], gc.Equals, "c,d,e,")
+}
+
+func (s *adminSuite) TestSetDisabled(c *gc.C) {
+	fields := s.get(c, "/admin/u/bob")
+	csrf := fields[5]
+	fields = s.post(c, "/admin/u/bob/disabled", url.Values{
+		"csrf":     {csrf},
+		"disabled": {"true"},
+	})
+	c.Assert(fields[4], gc.Equals, "true")
+	fields = s.post(c, "/admin/u/bob/disabled", url.Values{
+		"csrf":     {csrf},
+		"disabled": {"false"},
+	})
+	c.Assert(fields[4], gc.Equals, "false")
+}
+
+func (s *adminSuite) TestInvalidCSRFToken(c *gc.C) {
+	s.get(c, "/admin/u/bob")
+	for _, token := range []string{"", "1234"} {
+		resp := s.do(c, "POST", "/admin/u/bob/disabled", url.Values{
+			"csrf":     {token},
+			"disabled": {"true"},
+		})
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+	}
+}
+
+func (s *adminSuite) addUser(c *gc.C, username, email string) {
+	err := s.Store.UpdateIdentity(s.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", username),
+		Username:   username,
+		Email:      email,
+		Groups:     []string{"a", "b"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Email:    store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+}
+
+// get gets the given admin console page as the admin user and returns
+// the fields of the page.
+func (s *adminSuite) get(c *gc.C, path string) []string {
+	return s.readPage(c, s.do(c, "GET", path, nil))
+}
+
+// post posts the given form to the given path as the admin user and
+// returns the fields of the page that is shown.
+func (s *adminSuite) post(c *gc.C, path string, form url.Values) []string {
+	return s.readPage(c, s.do(c, "POST", path, form))
+}
+
+func (s *adminSuite) do(c *gc.C, method, path string, form url.Values) *http.Response {
+	req, err := http.NewRequest(method, s.URL+path, strings.NewReader(form.Encode()))
+	c.Assert(err, gc.Equals, nil)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.SetBasicAuth(idmtest.AdminUsername, idmtest.AdminPassword)
+	resp, err := s.client.Do(req)
+	c.Assert(err, gc.Equals, nil)
+	return resp
+}
+
+func (s *adminSuite) readPage(c *gc.C, resp *http.Response) []string {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK, gc.Commentf("body %q", body))
+	return strings.Split(string(body), "|")
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package admin serves the administration web console. The console
+// is available to members of the admin ACL and every action it
+// performs is authorized in the same way as the equivalent v1 API
+// request.
+package admin
+
+import (
+	"github.com/juju/loggo"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/auth/httpauth"
+	"github.com/CanonicalLtd/blues-identity/internal/identity"
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
+)
+
+var logger = loggo.GetLogger("identity.internal.admin")
+
+// NewAPIHandler is an identity.NewAPIHandlerFunc.
+func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error) {
+	return identity.ReqServer.Handlers(new(params)), nil
+}
+
+// new returns a function that will generate a new instance of the admin
+// console handler for a request. Unlike the v1 API the requests are not
+// authorized here, each page authorizes the requests it makes so that
+// a browser that is not logged in can be sent to log in.
+func new(hParams identity.HandlerParams) func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
+	reqAuth := httpauth.New(hParams.Oven, hParams.Authorizer)
+	return func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
+		t := trace.New("identity.internal.admin", p.PathPattern)
+		ctx := trace.NewContext(p.Context, t)
+		ctx, span := tracing.StartHTTPSpan(ctx, p.Request, p.PathPattern)
+		ctx, close := hParams.Store.Context(ctx)
+		hnd := &handler{
+			params:  hParams,
+			reqAuth: reqAuth,
+			trace:   t,
+			span:    span,
+			monReq:  monitoring.NewRequest(&p),
+			close:   close,
+		}
+		return hnd, ctx, nil
+	}
+}
+
+// A handler is a handler for a request to an /admin endpoint.
+type handler struct {
+	params  identity.HandlerParams
+	reqAuth *httpauth.Authorizer
+
+	trace  trace.Trace
+	span   oteltrace.Span
+	monReq monitoring.Request
+	close  func()
+}
+
+// Close implements io.Closer. httprequest will automatically call this
+// once a request is complete.
+func (h *handler) Close() error {
+	if h.close != nil {
+		h.close()
+		h.close = nil
+	}
+	h.monReq.ObserveMetric()
+	if h.trace != nil {
+		h.trace.Finish()
+		h.trace = nil
+	}
+	if h.span != nil {
+		h.span.End()
+		h.span = nil
+	}
+	return nil
+}
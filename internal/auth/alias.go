@@ -0,0 +1,155 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+// ErrAliasesNotSupported is the error cause returned by AddAlias when
+// the Authorizer has no alias store.
+var ErrAliasesNotSupported = errgo.New("username aliases not supported")
+
+// AddAlias records that alias is an old username of the identity with
+// the given provider ID. Once recorded, looking up the alias finds the
+// identity, whatever its current username.
+func (a *Authorizer) AddAlias(ctx context.Context, alias string, providerID store.ProviderIdentity) error {
+	if a.aliasStore == nil {
+		return errgo.WithCausef(nil, ErrAliasesNotSupported, "")
+	}
+	ctx, close := a.aliasStore.Context(ctx)
+	defer close()
+	if err := a.aliasStore.Set(ctx, aliasKey(alias), []byte(providerID), time.Time{}); err != nil {
+		return errgo.Notef(err, "cannot record alias %q", alias)
+	}
+	return nil
+}
+
+// ResolveAlias returns the provider ID of the identity that previously
+// had the given username. If the username has never been used as an
+// alias then an error with a cause of params.ErrNotFound is returned.
+func (a *Authorizer) ResolveAlias(ctx context.Context, alias string) (store.ProviderIdentity, error) {
+	if a.aliasStore == nil {
+		return "", errgo.WithCausef(nil, params.ErrNotFound, "alias %q not found", alias)
+	}
+	ctx, close := a.aliasStore.Context(ctx)
+	defer close()
+	data, err := a.aliasStore.Get(ctx, aliasKey(alias))
+	if errgo.Cause(err) == store.ErrNotFound {
+		return "", errgo.WithCausef(nil, params.ErrNotFound, "alias %q not found", alias)
+	}
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return store.ProviderIdentity(data), nil
+}
+
+// CheckUsername checks that the given username is not an alias of any
+// identity other than the one with the given provider ID. If it is then
+// an error with a cause of store.ErrDuplicateUsername is returned.
+func (a *Authorizer) CheckUsername(ctx context.Context, username string, providerID store.ProviderIdentity) error {
+	if _, err := a.isOwnAlias(ctx, username, providerID); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername))
+	}
+	return nil
+}
+
+// isOwnAlias reports whether the given username is an alias of the
+// identity with the given provider ID. If it is an alias of any other
+// identity an error with a cause of store.ErrDuplicateUsername is
+// returned.
+func (a *Authorizer) isOwnAlias(ctx context.Context, username string, providerID store.ProviderIdentity) (bool, error) {
+	aliasID, err := a.ResolveAlias(ctx, username)
+	if errgo.Cause(err) == params.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	if aliasID == providerID {
+		return true, nil
+	}
+	// The alias may refer to the identity by a provider ID that has
+	// since been linked to it.
+	aliased := store.Identity{
+		ProviderID: aliasID,
+	}
+	err = a.store.Identity(ctx, &aliased)
+	if err != nil && errgo.Cause(err) != store.ErrNotFound {
+		return false, errgo.Mask(err)
+	}
+	if err == nil && aliased.ProviderID == providerID {
+		return true, nil
+	}
+	return false, errgo.Mask(store.DuplicateUsernameError(username), errgo.Is(store.ErrDuplicateUsername))
+}
+
+// AliasCheckingStore returns a store that behaves like st except that
+// UpdateIdentity returns an error with a cause of
+// store.ErrDuplicateUsername rather than give an identity a username
+// that is an alias of a different identity, see CheckUsername. An
+// update that would set an identity's username back to one of its own
+// aliases leaves the username unchanged instead, so that identity
+// providers, which derive usernames from their own records, do not
+// undo a rename. The username of the given identity is set to the
+// stored username in that case.
+func (a *Authorizer) AliasCheckingStore(st store.Store) store.Store {
+	if a.aliasStore == nil {
+		return st
+	}
+	return aliasCheckingStore{
+		Store:      st,
+		authorizer: a,
+	}
+}
+
+type aliasCheckingStore struct {
+	store.Store
+	authorizer *Authorizer
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s aliasCheckingStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	if update[store.Username] != store.Set || identity.Username == "" {
+		return s.Store.UpdateIdentity(ctx, identity, update)
+	}
+	existing := store.Identity{
+		ProviderID: identity.ProviderID,
+	}
+	if identity.ID != "" {
+		existing = store.Identity{
+			ID: identity.ID,
+		}
+	}
+	err := s.Store.Identity(ctx, &existing)
+	found := err == nil
+	if err != nil && errgo.Cause(err) != store.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	if existing.ProviderID == "" {
+		// There is nothing to check the username against.
+		return s.Store.UpdateIdentity(ctx, identity, update)
+	}
+	own, err := s.authorizer.isOwnAlias(ctx, identity.Username, existing.ProviderID)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername))
+	}
+	if own && found {
+		// The identity has been renamed since its identity
+		// provider last named it, keep the new name.
+		update[store.Username] = store.NoUpdate
+		identity.Username = existing.Username
+	}
+	return s.Store.UpdateIdentity(ctx, identity, update)
+}
+
+func aliasKey(alias string) string {
+	return "alias:" + alias
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth_test
+
+import (
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/idmtest"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+type aliasSuite struct {
+	idmtest.StoreSuite
+	authorizer *auth.Authorizer
+	context    context.Context
+	close      func()
+}
+
+var _ = gc.Suite(&aliasSuite{})
+
+func (s *aliasSuite) SetUpTest(c *gc.C) {
+	s.StoreSuite.SetUpTest(c)
+	s.context, s.close = s.Store.Context(context.Background())
+	aliasStore, err := s.ProviderDataStore.KeyValueStore(s.context, "aliases")
+	c.Assert(err, gc.Equals, nil)
+	s.authorizer = auth.New(auth.Params{
+		Location:   identityLocation,
+		Store:      s.Store,
+		AliasStore: aliasStore,
+	})
+}
+
+func (s *aliasSuite) TearDownTest(c *gc.C) {
+	s.close()
+	s.StoreSuite.TearDownTest(c)
+}
+
+func (s *aliasSuite) TestResolveAlias(c *gc.C) {
+	_, err := s.authorizer.ResolveAlias(s.context, "bob")
+	c.Assert(err, gc.ErrorMatches, `alias "bob" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	err = s.authorizer.AddAlias(s.context, "bob", store.MakeProviderIdentity("test", "bob"))
+	c.Assert(err, gc.Equals, nil)
+	providerID, err := s.authorizer.ResolveAlias(s.context, "bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(providerID, gc.Equals, store.MakeProviderIdentity("test", "bob"))
+}
+
+func (s *aliasSuite) TestIdentityResolvesAlias(c *gc.C) {
+	err := s.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "robert",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.authorizer.Identity(s.context, "bob")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	err = s.authorizer.AddAlias(s.context, "bob", store.MakeProviderIdentity("test", "bob"))
+	c.Assert(err, gc.Equals, nil)
+	id, err := s.authorizer.Identity(s.context, "bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id.Id(), gc.Equals, "robert")
+
+	// The current username is still preferred over any alias.
+	id, err = s.authorizer.Identity(s.context, "robert")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id.Id(), gc.Equals, "robert")
+}
+
+func (s *aliasSuite) TestAliasesNotSupported(c *gc.C) {
+	authorizer := auth.New(auth.Params{
+		Store: s.Store,
+	})
+	err := authorizer.AddAlias(s.context, "bob", store.MakeProviderIdentity("test", "bob"))
+	c.Assert(errgo.Cause(err), gc.Equals, auth.ErrAliasesNotSupported)
+	_, err = authorizer.ResolveAlias(s.context, "bob")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *aliasSuite) TestCheckUsername(c *gc.C) {
+	err := s.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "robert",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = s.authorizer.AddAlias(s.context, "bob", store.MakeProviderIdentity("test", "bob"))
+	c.Assert(err, gc.Equals, nil)
+
+	err = s.authorizer.CheckUsername(s.context, "alice", store.MakeProviderIdentity("test", "alice"))
+	c.Assert(err, gc.Equals, nil)
+	err = s.authorizer.CheckUsername(s.context, "bob", store.MakeProviderIdentity("test", "bob"))
+	c.Assert(err, gc.Equals, nil)
+	err = s.authorizer.CheckUsername(s.context, "bob", store.MakeProviderIdentity("other", "bob"))
+	c.Assert(err, gc.ErrorMatches, `username bob already in use`)
+	c.Assert(errgo.Cause(err), gc.Equals, store.ErrDuplicateUsername)
+}
+
+func (s *aliasSuite) TestAliasCheckingStore(c *gc.C) {
+	err := s.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "robert",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = s.authorizer.AddAlias(s.context, "bob", store.MakeProviderIdentity("test", "bob"))
+	c.Assert(err, gc.Equals, nil)
+
+	st := s.authorizer.AliasCheckingStore(s.Store)
+	err = st.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("other", "bob"),
+		Username:   "bob",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.ErrorMatches, `username bob already in use`)
+	c.Assert(errgo.Cause(err), gc.Equals, store.ErrDuplicateUsername)
+
+	// An update from the identity that had the alias does not undo
+	// the rename.
+	id := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}
+	err = st.UpdateIdentity(s.context, &id, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id.Username, gc.Equals, "robert")
+	id = store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	}
+	err = s.Store.Identity(s.context, &id)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id.Username, gc.Equals, "robert")
+
+	// Updates that don't set the username are not checked.
+	err = st.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("other", "bob"),
+		Username:   "bob",
+		Name:       "Bob",
+	}, store.Update{
+		store.Name: store.Set,
+	})
+	c.Assert(errgo.Cause(err), gc.Equals, store.ErrNotFound)
+}
@@ -4,10 +4,15 @@
 package auth
 
 import (
+	"crypto/subtle"
+	"net/http"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/juju/loggo"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/idmclient.v1/params"
@@ -17,6 +22,9 @@ import (
 	macaroon "gopkg.in/macaroon.v2"
 
 	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
 	"github.com/CanonicalLtd/blues-identity/store"
 )
 
@@ -50,19 +58,37 @@ const (
 	ActionWriteSSHKeys       = "writeSSHKeys"
 	ActionLogin              = "login"
 	ActionReadDischargeToken = "read-discharge-token"
+	ActionReload             = "reload"
+	ActionReadSSHCAKey       = "readSSHCAKey"
+	ActionSignSSHCert        = "signSSHCert"
+	ActionReadGroupSSHKeys   = "readGroupSSHKeys"
+	ActionReadAgents         = "readAgents"
+	ActionWriteAgent         = "writeAgent"
+	ActionDelete             = "delete"
+	ActionReadTokens         = "readTokens"
+	ActionWriteTokens        = "writeTokens"
+	ActionLinkIdentity       = "linkIdentity"
 )
 
-// TODO(mhilton) make the admin ACL configurable
+// AdminACL holds the ACL that always has administrative access. Further
+// groups may be added with Params.AdminGroups.
 var AdminACL = []string{AdminUsername}
 
 // An Authorizer is used to authorize operations in the identity server.
 type Authorizer struct {
-	adminUsername  string
-	adminPassword  string
-	location       string
-	checker        *identchecker.Checker
-	store          store.Store
-	groupResolvers map[string]groupResolver
+	adminUsername     string
+	adminPassword     string
+	adminPasswordHash string
+	adminACL          []string
+	location          string
+	checker           *identchecker.Checker
+	store             store.Store
+	groupResolvers    map[string]groupResolver
+	limiter           *ratelimit.Limiter
+	maxAgentDepth     int
+	tokenStore        store.KeyValueStore
+	aliasStore        store.KeyValueStore
+	disabledStore     store.KeyValueStore
 }
 
 // Params specifify the configuration parameters for a new Authroizer.
@@ -75,6 +101,16 @@ type Params struct {
 	// identity server.
 	AdminPassword string
 
+	// AdminPasswordHash is a bcrypt hash of the password of the admin
+	// user in the identity server. If this is set AdminPassword is
+	// ignored. If neither is set, or AdminUsername is empty, the admin
+	// user cannot log in with a password.
+	AdminPasswordHash string
+
+	// AdminGroups contains the groups whose members are given the
+	// same access as the admin user.
+	AdminGroups []string
+
 	// Location is the url of the discharger that third-party caveats
 	// will be addressed to. This should be the address of this
 	// identity server.
@@ -91,16 +127,53 @@ type Params struct {
 	// are configured for the service. The authenticatore uses these
 	// to get group information for authenticated users.
 	IdentityProviders []idp.IdentityProvider
+
+	// Limiter is used to limit the rate of attempts to log in with
+	// admin credentials. It may be nil.
+	Limiter *ratelimit.Limiter
+
+	// MaxAgentDepth holds the maximum length of a chain of agents,
+	// each created by the previous one. An agent created by a user
+	// that is not an agent has a depth of one. If this is zero,
+	// DefaultMaxAgentDepth is used.
+	MaxAgentDepth int
+
+	// TokenStore is used to store personal access tokens. If this is
+	// nil personal access tokens are not supported.
+	TokenStore store.KeyValueStore
+
+	// AliasStore is used to store the old usernames of renamed users.
+	// If this is nil users cannot be renamed.
+	AliasStore store.KeyValueStore
+
+	// DisabledStore is used to record which users have been
+	// disabled. If this is nil users cannot be disabled.
+	DisabledStore store.KeyValueStore
 }
 
+// DefaultMaxAgentDepth holds the maximum length of a chain of agents
+// when none is configured. By default agents cannot create other
+// agents.
+const DefaultMaxAgentDepth = 1
+
 // New creates a new Authorizer for authorizing identity server
 // operations.
 func New(params Params) *Authorizer {
 	a := &Authorizer{
-		adminUsername: params.AdminUsername,
-		adminPassword: params.AdminPassword,
-		location:      params.Location,
-		store:         params.Store,
+		adminUsername:     params.AdminUsername,
+		adminPassword:     params.AdminPassword,
+		adminPasswordHash: params.AdminPasswordHash,
+		adminACL:          append(append([]string(nil), AdminACL...), params.AdminGroups...),
+		location:          params.Location,
+		store:             params.Store,
+		limiter:           params.Limiter,
+		maxAgentDepth:     params.MaxAgentDepth,
+		tokenStore:        params.TokenStore,
+		aliasStore:        params.AliasStore,
+		disabledStore:     params.DisabledStore,
+	}
+	if a.maxAgentDepth <= 0 {
+		a.maxAgentDepth = DefaultMaxAgentDepth
 	}
 	resolvers := make(map[string]groupResolver)
 	for _, idp := range params.IdentityProviders {
@@ -111,6 +184,7 @@ func New(params Params) *Authorizer {
 	resolvers["idm"] = idmGroupResolver{
 		store:     params.Store,
 		resolvers: resolvers,
+		maxDepth:  a.maxAgentDepth,
 	}
 
 	a.groupResolvers = resolvers
@@ -127,6 +201,13 @@ func New(params Params) *Authorizer {
 	return a
 }
 
+// ClientIP returns the IP address of the client that made the given
+// request, taking into account any trusted proxies configured in the
+// rate limiter. It is suitable for use with ContextWithClientIP.
+func (a *Authorizer) ClientIP(req *http.Request) string {
+	return a.limiter.ClientIP(req)
+}
+
 func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string, public bool, _ error) {
 	kind, name := splitEntity(op.Entity)
 	switch kind {
@@ -137,10 +218,21 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 		switch op.Action {
 		case ActionRead:
 			// Only admins are allowed to read global information.
-			return AdminACL, true, nil
+			return a.adminACL, true, nil
 		case ActionDischargeFor:
 			// Only admins are allowed to discharge for other users.
-			return AdminACL, true, nil
+			return a.adminACL, true, nil
+		case ActionReload:
+			// Only admins are allowed to reload the configuration.
+			return a.adminACL, true, nil
+		case ActionReadGroupSSHKeys:
+			// Administrators and users with SSH key getter
+			// permissions can read the SSH keys of a group.
+			acl := make([]string, 0, len(a.adminACL)+1)
+			return append(append(acl, a.adminACL...), SSHKeyGetterGroup), false, nil
+		case ActionReadSSHCAKey:
+			// Everyone is allowed to read the SSH CA public key.
+			return []string{identchecker.Everyone}, true, nil
 		case ActionVerify:
 			// Everyone is allowed to verify a macaroon.
 			return []string{identchecker.Everyone}, true, nil
@@ -161,8 +253,8 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 			return nil, false, nil
 		}
 		username := name
-		acl := make([]string, 0, len(AdminACL)+2)
-		acl = append(acl, AdminACL...)
+		acl := make([]string, 0, len(a.adminACL)+2)
+		acl = append(acl, a.adminACL...)
 		switch op.Action {
 		case ActionRead:
 			return append(acl, username), false, nil
@@ -181,6 +273,32 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 			return append(acl, username, SSHKeyGetterGroup), false, nil
 		case ActionWriteSSHKeys:
 			return append(acl, username), false, nil
+		case ActionSignSSHCert:
+			// Administrators and the user themselves can obtain
+			// an SSH certificate for the user.
+			return append(acl, username), false, nil
+		case ActionReadAgents:
+			// Administrators and the user themselves can list
+			// the agents owned by the user.
+			return append(acl, username), false, nil
+		case ActionReadTokens, ActionWriteTokens:
+			// Administrators and the user themselves can manage
+			// the user's personal access tokens.
+			return append(acl, username), false, nil
+		case ActionLinkIdentity:
+			// Administrators and the user themselves can link
+			// another identity to the user.
+			return append(acl, username), false, nil
+		case ActionWriteAgent, ActionDelete:
+			// Administrators and the owners of an agent, at any
+			// level of the ownership chain, can modify or
+			// remove it. Only administrators can remove other
+			// users.
+			owners, err := a.agentOwners(ctx, username)
+			if err != nil {
+				return nil, false, errgo.Mask(err)
+			}
+			return append(acl, owners...), false, nil
 		}
 	case "groups":
 		switch op.Action {
@@ -188,16 +306,23 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 			return strings.Fields(name), true, nil
 		}
 	}
-	logger.Infof("no ACL found for op %#v", op)
+	Logger(ctx, logger).Infof("no ACL found for op %#v", op)
 	return nil, false, nil
 }
 
 // SetAdminPublicKey configures the public key on the admin user. This is
-// to allow agent login as the admin user.
+// to allow agent login as the admin user. If pk is nil the admin user is
+// created if necessary, but any existing public key, such as one created
+// by BootstrapAdminAgent, is left in place.
 func (a *Authorizer) SetAdminPublicKey(ctx context.Context, pk *bakery.PublicKey) error {
+	update := store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	}
 	var pks []bakery.PublicKey
 	if pk != nil {
 		pks = append(pks, *pk)
+		update[store.PublicKeys] = store.Set
 	}
 	return errgo.Mask(a.store.UpdateIdentity(
 		ctx,
@@ -206,14 +331,202 @@ func (a *Authorizer) SetAdminPublicKey(ctx context.Context, pk *bakery.PublicKey
 			Username:   AdminUsername,
 			PublicKeys: pks,
 		},
+		update,
+	))
+}
+
+// ErrAdminAgentExists is the error cause returned by BootstrapAdminAgent
+// when the admin user already has a public key.
+var ErrAdminAgentExists = errgo.New("admin agent already exists")
+
+// BootstrapAdminAgent sets the public key of the admin user in the given
+// store, so that an agent holding the corresponding private key can log
+// in as the admin user. It is intended to create the first admin agent
+// for a new identity server, so if the admin user already has a public
+// key an error with a cause of ErrAdminAgentExists is returned.
+func BootstrapAdminAgent(ctx context.Context, st store.Store, pk *bakery.PublicKey) error {
+	id := store.Identity{
+		ProviderID: AdminProviderID,
+	}
+	err := st.Identity(ctx, &id)
+	if err == nil && len(id.PublicKeys) > 0 {
+		return errgo.WithCausef(nil, ErrAdminAgentExists, "")
+	}
+	if err != nil && errgo.Cause(err) != store.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(st.UpdateIdentity(
+		ctx,
+		&store.Identity{
+			ProviderID: AdminProviderID,
+			Username:   AdminUsername,
+			PublicKeys: []bakery.PublicKey{*pk},
+		},
 		store.Update{
 			store.Username:   store.Set,
-			store.Groups:     store.Set,
 			store.PublicKeys: store.Set,
 		},
 	))
 }
 
+// agentOwners returns the current usernames of the owners of the given
+// agent, starting with the user that created it and continuing up the
+// ownership chain. If the user does not exist or is not an agent then
+// no usernames are returned.
+func (a *Authorizer) agentOwners(ctx context.Context, username string) ([]string, error) {
+	identity := &store.Identity{
+		Username: username,
+	}
+	if err := a.store.Identity(ctx, identity); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	var owners []string
+	for len(owners) < a.maxAgentDepth && IsAgent(identity) {
+		owner, err := ownerOf(ctx, a.store, identity)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if owner == nil {
+			// The owner has been removed, only administrators
+			// can manage the agent.
+			break
+		}
+		owners = append(owners, owner.Username)
+		identity = owner
+	}
+	return owners, nil
+}
+
+// CheckAgentDepth checks that an agent created by the given owner would
+// not make the chain of agents, each created by the previous one,
+// longer than the configured maximum. If it would, an error with a
+// cause of params.ErrForbidden is returned.
+func (a *Authorizer) CheckAgentDepth(ctx context.Context, owner *store.Identity) error {
+	// The new agent would be one further down the chain than its
+	// owner.
+	depth := 1
+	for identity := owner; IsAgent(identity); depth++ {
+		if depth >= a.maxAgentDepth {
+			return errgo.WithCausef(nil, params.ErrForbidden, "cannot create an agent using an agent account: maximum agent depth (%d) reached", a.maxAgentDepth)
+		}
+		next, err := ownerOf(ctx, a.store, identity)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if next == nil {
+			break
+		}
+		identity = next
+	}
+	return nil
+}
+
+// IsAgent reports whether the given identity is an agent created by
+// another user.
+func IsAgent(identity *store.Identity) bool {
+	return identity.ProviderID.Provider() == "idm" && len(identity.ProviderInfo["owner"]) > 0
+}
+
+// FindAgents returns the agents owned by the identity with the given
+// provider ID, sorted by username.
+func FindAgents(ctx context.Context, st store.Store, owner store.ProviderIdentity) ([]store.Identity, error) {
+	identities, err := st.FindIdentities(ctx, &store.Identity{
+		ProviderInfo: map[string][]string{
+			"owner": {string(owner)},
+		},
+	}, store.Filter{
+		store.ProviderInfo: store.Equal,
+	}, []store.Sort{{Field: store.Username}}, 0, 0)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// The owner's username is also stored in the "owner" provider
+	// info, so make sure the provider ID is in the first position.
+	agents := identities[:0]
+	for _, id := range identities {
+		if IsAgent(&id) && id.ProviderInfo["owner"][0] == string(owner) {
+			agents = append(agents, id)
+		}
+	}
+	return agents, nil
+}
+
+// ownerOf returns the identity of the owner of the given agent. If the
+// identity is not an agent, or the owner no longer exists, nil is
+// returned.
+func ownerOf(ctx context.Context, st store.Store, identity *store.Identity) (*store.Identity, error) {
+	if !IsAgent(identity) {
+		return nil, nil
+	}
+	owner := &store.Identity{
+		ProviderID: store.ProviderIdentity(identity.ProviderInfo["owner"][0]),
+	}
+	if err := st.Identity(ctx, owner); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	return owner, nil
+}
+
+// agentExpiresKey is the key in an agent's ProviderInfo that holds the
+// time after which the agent may no longer log in.
+const agentExpiresKey = "expires"
+
+// AgentExpiry returns the time after which the given agent identity
+// may no longer log in. If the identity does not expire the zero time
+// is returned.
+func AgentExpiry(identity *store.Identity) time.Time {
+	v := identity.ProviderInfo[agentExpiresKey]
+	if len(v) == 0 {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, v[0])
+	if err != nil {
+		// Treat an unparsable expiry time as having already
+		// expired, rather than allowing the agent to log in
+		// forever.
+		logger.Warningf("invalid expiry time %q for %q", v[0], identity.Username)
+		return time.Unix(0, 0)
+	}
+	return t
+}
+
+// IsExpired reports whether the given identity has an expiry time that
+// is not after now.
+func IsExpired(identity *store.Identity, now time.Time) bool {
+	t := AgentExpiry(identity)
+	return !t.IsZero() && !t.After(now)
+}
+
+// AgentExpiryUpdate returns the identity fields and update that will set
+// the expiry time of an agent to t. If t is zero the expiry time will be
+// removed.
+func AgentExpiryUpdate(t time.Time) (map[string][]string, store.Operation) {
+	if t.IsZero() {
+		return map[string][]string{agentExpiresKey: nil}, store.Clear
+	}
+	return map[string][]string{
+		agentExpiresKey: {t.UTC().Format(time.RFC3339)},
+	}, store.Set
+}
+
+// checkAdminCredentials reports whether the given basic authentication
+// credentials are those of the admin user.
+func (a *Authorizer) checkAdminCredentials(username, password string) bool {
+	if a.adminUsername == "" || username != a.adminUsername {
+		return false
+	}
+	if a.adminPasswordHash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(a.adminPasswordHash), []byte(password)) == nil
+	}
+	return a.adminPassword != "" && subtle.ConstantTimeCompare([]byte(password), []byte(a.adminPassword)) == 1
+}
+
 // Auth checks that client, as identified by the given context and
 // macaroons, is authorized to perform the given operations. It may
 // return an bakery.DischargeRequiredError when further checks are
@@ -268,10 +581,18 @@ func (c identityClient) IdentityFromContext(ctx context.Context) (_ident identch
 		if err != nil {
 			return nil, nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 		}
+		if err := c.authorizer.CheckEnabled(ctx, &id.id); err != nil {
+			return nil, nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+		}
 		return id, nil, nil
 	}
 	if username, password, ok := userCredentialsFromContext(ctx); ok {
-		if username == c.authorizer.adminUsername && password == c.authorizer.adminPassword {
+		limiter := c.authorizer.limiter
+		if err := limiter.Allow(ctx, "admin", clientIPFromContext(ctx), username); err != nil {
+			return nil, nil, errgo.Mask(err, ratelimit.IsLimitError)
+		}
+		if c.authorizer.checkAdminCredentials(username, password) {
+			limiter.LoginSucceeded(ctx, clientIPFromContext(ctx), username)
 			return &Identity{
 				id: store.Identity{
 					Username: AdminUsername,
@@ -279,6 +600,7 @@ func (c identityClient) IdentityFromContext(ctx context.Context) (_ident identch
 				authorizer: c.authorizer,
 			}, nil, nil
 		}
+		limiter.LoginFailed(ctx, clientIPFromContext(ctx), username)
 		return nil, nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid credentials")
 	}
 	return nil, []checkers.Caveat{
@@ -313,12 +635,34 @@ func (c identityClient) DeclaredIdentity(ctx context.Context, declared map[strin
 	if err := CheckUserDomain(ctx, username); err != nil {
 		return nil, errgo.Mask(err)
 	}
-	return &Identity{
+	id := &Identity{
 		id: store.Identity{
 			Username: username,
 		},
 		authorizer: c.authorizer,
-	}, nil
+	}
+	if username == AdminUsername {
+		return id, nil
+	}
+	// Macaroons issued before a user was disabled, or before an
+	// agent expired, must not continue to work. A user that cannot
+	// be found is left for the operation's ACL to decide, as before.
+	err := id.lookup(ctx)
+	if errgo.Cause(err) == params.ErrNotFound {
+		return id, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if IsExpired(&id.id, time.Now()) {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "agent %q has expired", username)
+	}
+	if c.authorizer.disabledStore != nil {
+		if err := c.authorizer.CheckEnabled(ctx, &id.id); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+		}
+	}
+	return id, nil
 }
 
 // An Identity is the implementation of identchecker.Identity used in the
@@ -378,7 +722,7 @@ func (id *Identity) Groups(ctx context.Context) ([]string, error) {
 		var err error
 		groups, err = gr.resolveGroups(ctx, &id.id)
 		if err != nil {
-			logger.Warningf("error resolving groups: %s", err)
+			Logger(ctx, logger).Warningf("error resolving groups: %s", err)
 		} else {
 			id.resolvedGroups = groups
 		}
@@ -400,7 +744,25 @@ func (id *Identity) lookup(ctx context.Context) error {
 	if id.id.ID != "" {
 		return nil
 	}
-	if err := id.authorizer.store.Identity(ctx, &id.id); err != nil {
+	err := id.authorizer.store.Identity(ctx, &id.id)
+	if errgo.Cause(err) == store.ErrNotFound && id.id.Username != "" {
+		// The user may have been renamed, in which case the old
+		// username is still accepted for now.
+		username := id.id.Username
+		providerID, aerr := id.authorizer.ResolveAlias(ctx, username)
+		if aerr == nil {
+			id.id = store.Identity{
+				ProviderID: providerID,
+			}
+			err = id.authorizer.store.Identity(ctx, &id.id)
+			if err == nil {
+				Logger(ctx, logger).Warningf("deprecated username %q used for %s", username, id.id.Username)
+			}
+		} else if errgo.Cause(aerr) != params.ErrNotFound {
+			return errgo.Mask(aerr)
+		}
+	}
+	if err != nil {
 		if errgo.Cause(err) == store.ErrNotFound {
 			return errgo.WithCausef(err, params.ErrNotFound, "")
 		}
@@ -472,51 +834,70 @@ type groupResolver interface {
 type idmGroupResolver struct {
 	store     store.Store
 	resolvers map[string]groupResolver
+	maxDepth  int
 }
 
-// resolveGroups implements groupResolver by checking returning
-// groups that are in both the identity and the owner of the
-// identity.
+// resolveGroups implements groupResolver by returning the groups that
+// are in the identity and in every owner along its ownership chain.
 func (r idmGroupResolver) resolveGroups(ctx context.Context, identity *store.Identity) ([]string, error) {
-	if len(identity.ProviderInfo["owner"]) == 0 {
-		// No owner - no groups. This applies to admin@idm, but for
-		// other users, it's probably an internal inconsistency error.
-		return nil, nil
-	}
-	ownerID := store.ProviderIdentity(identity.ProviderInfo["owner"][0])
-	if ownerID == AdminProviderID {
-		// The admin user is a member of all groups by definition.
-		return identity.Groups, nil
-	}
-	ownerIdentity := store.Identity{
-		ProviderID: ownerID,
-	}
-	if err := r.store.Identity(ctx, &ownerIdentity); err != nil {
-		if errgo.Cause(err) != store.ErrNotFound {
+	username := identity.Username
+	groups := identity.Groups
+	for depth := 1; ; depth++ {
+		if len(identity.ProviderInfo["owner"]) == 0 {
+			// No owner - no groups. This applies to admin@idm, but for
+			// other users, it's probably an internal inconsistency error.
+			return nil, nil
+		}
+		ownerID := store.ProviderIdentity(identity.ProviderInfo["owner"][0])
+		if ownerID == AdminProviderID {
+			// The admin user is a member of all groups by definition.
+			return groups, nil
+		}
+		ownerIdentity := store.Identity{
+			ProviderID: ownerID,
+		}
+		if err := r.store.Identity(ctx, &ownerIdentity); err != nil {
+			if errgo.Cause(err) != store.ErrNotFound {
+				return nil, errgo.Mask(err)
+			}
+			return nil, nil
+		}
+		if IsAgent(&ownerIdentity) {
+			// The owner is itself an agent, continue up the
+			// chain.
+			if depth >= r.maxDepth {
+				return nil, errgo.Newf("agent %q is more than %d agents away from its owning user", username, r.maxDepth)
+			}
+			groups = intersectStrings(groups, ownerIdentity.Groups)
+			identity = &ownerIdentity
+			continue
+		}
+		resolver := r.resolvers[ownerID.Provider()]
+		if resolver == nil {
+			// Owner is somehow in an unknown provider.
+			// TODO log/return an error?
+			return nil, nil
+		}
+		ownerGroups, err := resolver.resolveGroups(ctx, &ownerIdentity)
+		if err != nil {
 			return nil, errgo.Mask(err)
 		}
-		return nil, nil
+		return intersectStrings(groups, ownerGroups), nil
 	}
-	resolver := r.resolvers[ownerID.Provider()]
-	if resolver == nil {
-		// Owner is somehow in an unknown provider.
-		// TODO log/return an error?
-		return nil, nil
-	}
-	ownerGroups, err := resolver.resolveGroups(ctx, &ownerIdentity)
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-	allowedGroups := make([]string, 0, len(identity.Groups))
-	for _, g1 := range identity.Groups {
-		for _, g2 := range ownerGroups {
-			if g2 == g1 {
-				allowedGroups = append(allowedGroups, g1)
+}
+
+// intersectStrings returns the elements of ss1 that are also in ss2.
+func intersectStrings(ss1, ss2 []string) []string {
+	ss := make([]string, 0, len(ss1))
+	for _, s1 := range ss1 {
+		for _, s2 := range ss2 {
+			if s2 == s1 {
+				ss = append(ss, s1)
 				break
 			}
 		}
 	}
-	return allowedGroups, nil
+	return ss
 }
 
 type idpGroupResolver struct {
@@ -526,7 +907,11 @@ type idpGroupResolver struct {
 // resolveGroups implements groupResolver by getting the groups from the
 // idp and adding them to the set stored in the identity server.
 func (r idpGroupResolver) resolveGroups(ctx context.Context, id *store.Identity) ([]string, error) {
+	ctx, span := tracing.StartSpan(ctx, "idp.GetGroups", attribute.String("idp", r.idp.Name()))
+	startTime := time.Now()
 	groups, err := r.idp.GetGroups(ctx, id)
+	monitoring.ObserveGetGroups(r.idp.Name(), startTime, err)
+	tracing.EndSpan(span, err)
 	if err != nil {
 		// We couldn't get the groups, so return only those stored in the database.
 		return id.Groups, errgo.Mask(err)
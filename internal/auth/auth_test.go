@@ -5,8 +5,10 @@ package auth_test
 
 import (
 	"sort"
+	"time"
 
 	jc "github.com/juju/testing/checkers"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
 	gc "gopkg.in/check.v1"
 	errgo "gopkg.in/errgo.v1"
@@ -154,6 +156,89 @@ func (s *authSuite) TestAuthorizeWithAdminCredentials(c *gc.C) {
 	}
 }
 
+func (s *authSuite) newAuthorizer(p auth.Params) *auth.Authorizer {
+	p.Location = identityLocation
+	p.MacaroonVerifier = s.oven
+	p.Store = s.Store
+	return auth.New(p)
+}
+
+func (s *authSuite) TestAuthorizeWithAdminPasswordHash(c *gc.C) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	c.Assert(err, gc.Equals, nil)
+	authorizer := s.newAuthorizer(auth.Params{
+		AdminUsername:     "admin",
+		AdminPassword:     "password",
+		AdminPasswordHash: string(hash),
+	})
+	ctx := auth.ContextWithUserCredentials(context.Background(), "admin", "secret")
+	authInfo, err := authorizer.Auth(ctx, nil, identchecker.LoginOp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(authInfo.Identity.Id(), gc.Equals, auth.AdminUsername)
+
+	// The cleartext password is ignored when a hash is configured.
+	ctx = auth.ContextWithUserCredentials(context.Background(), "admin", "password")
+	_, err = authorizer.Auth(ctx, nil, identchecker.LoginOp)
+	c.Assert(err, gc.ErrorMatches, "could not determine identity: invalid credentials")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+}
+
+func (s *authSuite) TestAuthorizeWithoutAdminCredentials(c *gc.C) {
+	authorizer := s.newAuthorizer(auth.Params{})
+	ctx := auth.ContextWithUserCredentials(context.Background(), "", "")
+	_, err := authorizer.Auth(ctx, nil, identchecker.LoginOp)
+	c.Assert(err, gc.ErrorMatches, "could not determine identity: invalid credentials")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+}
+
+func (s *authSuite) TestAdminGroups(c *gc.C) {
+	authorizer := s.newAuthorizer(auth.Params{
+		AdminGroups: []string{"admins"},
+	})
+	acl, public, err := auth.AuthorizerACLForOp(authorizer, context.Background(), auth.GlobalOp(auth.ActionRead))
+	c.Assert(err, gc.IsNil)
+	c.Assert(public, gc.Equals, true)
+	c.Assert(acl, jc.DeepEquals, []string{auth.AdminUsername, "admins"})
+	acl, _, err = auth.AuthorizerACLForOp(authorizer, context.Background(), auth.UserOp("bob", auth.ActionWriteGroups))
+	c.Assert(err, gc.IsNil)
+	c.Assert(acl, jc.DeepEquals, []string{auth.AdminUsername, "admins"})
+}
+
+func (s *authSuite) TestBootstrapAdminAgent(c *gc.C) {
+	// Remove the key set in SetUpTest.
+	err := s.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: auth.AdminProviderID,
+	}, store.Update{
+		store.PublicKeys: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.Equals, nil)
+	err = auth.BootstrapAdminAgent(s.context, s.Store, &key.Public)
+	c.Assert(err, gc.Equals, nil)
+	id := store.Identity{
+		ProviderID: auth.AdminProviderID,
+	}
+	err = s.Store.Identity(s.context, &id)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id.Username, gc.Equals, auth.AdminUsername)
+	c.Assert(id.PublicKeys, jc.DeepEquals, []bakery.PublicKey{key.Public})
+
+	err = auth.BootstrapAdminAgent(s.context, s.Store, &s.adminAgentKey.Public)
+	c.Assert(errgo.Cause(err), gc.Equals, auth.ErrAdminAgentExists)
+
+	// Setting a nil admin public key leaves the bootstrapped key in place.
+	err = s.authorizer.SetAdminPublicKey(s.context, nil)
+	c.Assert(err, gc.Equals, nil)
+	id = store.Identity{
+		ProviderID: auth.AdminProviderID,
+	}
+	err = s.Store.Identity(s.context, &id)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id.PublicKeys, jc.DeepEquals, []bakery.PublicKey{key.Public})
+}
+
 func (s *authSuite) TestUserHasPublicKeyCaveat(c *gc.C) {
 	key, err := bakery.GenerateKey()
 	c.Assert(err, gc.IsNil)
@@ -200,6 +285,165 @@ func (s *authSuite) TestUserHasPublicKeyChecker(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, `caveat.*not satisfied: invalid public key ".*": .*`)
 }
 
+func (s *authSuite) TestUserHasPublicKeyCheckerExpired(c *gc.C) {
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	s.createIdentity(c, "test-user", &key.Public)
+	checker := auth.NewChecker(s.authorizer)
+	checkCaveat := func() error {
+		cav := checker.Namespace().ResolveCaveat(auth.UserHasPublicKeyCaveat("test-user", &key.Public))
+		return checker.CheckFirstPartyCaveat(s.context, cav.Condition)
+	}
+	setExpiry := func(t time.Time) {
+		info, op := auth.AgentExpiryUpdate(t)
+		err := s.Store.UpdateIdentity(s.context, &store.Identity{
+			Username:     "test-user",
+			ProviderInfo: info,
+		}, store.Update{
+			store.ProviderInfo: op,
+		})
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	setExpiry(time.Now().Add(time.Hour))
+	err = checkCaveat()
+	c.Assert(err, gc.IsNil)
+
+	setExpiry(time.Now().Add(-time.Minute))
+	err = checkCaveat()
+	c.Assert(err, gc.ErrorMatches, "caveat.*not satisfied: user has expired")
+
+	setExpiry(time.Time{})
+	err = checkCaveat()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *authSuite) TestAgentExpiry(c *gc.C) {
+	now := time.Now()
+	id := &store.Identity{}
+	c.Assert(auth.AgentExpiry(id).IsZero(), gc.Equals, true)
+	c.Assert(auth.IsExpired(id, now), gc.Equals, false)
+
+	t := now.Add(time.Hour).Truncate(time.Second)
+	id.ProviderInfo, _ = auth.AgentExpiryUpdate(t)
+	c.Assert(auth.AgentExpiry(id).Equal(t), gc.Equals, true)
+	c.Assert(auth.IsExpired(id, now), gc.Equals, false)
+	c.Assert(auth.IsExpired(id, t), gc.Equals, true)
+
+	// An invalid expiry time is treated as having expired.
+	id.ProviderInfo = map[string][]string{"expires": {"bad"}}
+	c.Assert(auth.IsExpired(id, now), gc.Equals, true)
+}
+
+func (s *authSuite) TestAgentOwnerACL(c *gc.C) {
+	s.createIdentity(c, "bob", nil)
+	err := s.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "agent"),
+		Username:   "agent@idm",
+		ProviderInfo: map[string][]string{
+			"owner": {string(store.MakeProviderIdentity("test", "bob")), "bob"},
+		},
+	}, store.Update{
+		store.Username:     store.Set,
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	for _, action := range []string{auth.ActionWriteAgent, auth.ActionDelete} {
+		acl, public, err := auth.AuthorizerACLForOp(s.authorizer, s.context, auth.UserOp("agent@idm", action))
+		c.Assert(err, gc.IsNil)
+		c.Assert(public, gc.Equals, false)
+		c.Assert(acl, jc.DeepEquals, append(auth.AdminACL, "bob"))
+	}
+
+	// If the owner changes their username the new name is used.
+	err = s.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "robert",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	acl, _, err := auth.AuthorizerACLForOp(s.authorizer, s.context, auth.UserOp("agent@idm", auth.ActionDelete))
+	c.Assert(err, gc.IsNil)
+	c.Assert(acl, jc.DeepEquals, append(auth.AdminACL, "robert"))
+}
+
+func (s *authSuite) createAgent(c *gc.C, name string, owner store.ProviderIdentity, groups ...string) *store.Identity {
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", name),
+		Username:   name + "@idm",
+		Groups:     groups,
+		ProviderInfo: map[string][]string{
+			"owner": {string(owner)},
+		},
+	}
+	err := s.Store.UpdateIdentity(s.context, id, store.Update{
+		store.Username:     store.Set,
+		store.Groups:       store.Set,
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = s.Store.Identity(s.context, id)
+	c.Assert(err, gc.Equals, nil)
+	return id
+}
+
+func (s *authSuite) TestAgentChain(c *gc.C) {
+	s.createIdentity(c, "bob", nil, "g1", "g2")
+	agent1 := s.createAgent(c, "agent1", store.MakeProviderIdentity("test", "bob"), "g1", "g2")
+	agent2 := s.createAgent(c, "agent2", agent1.ProviderID, "g1", "g3")
+	bob := &store.Identity{
+		Username: "bob",
+	}
+	err := s.Store.Identity(s.context, bob)
+	c.Assert(err, gc.Equals, nil)
+
+	idps := []idp.IdentityProvider{
+		test.NewIdentityProvider(test.Params{
+			Name:      "test",
+			GetGroups: s.getGroups,
+		}),
+	}
+
+	// By default agents cannot create other agents, and agents
+	// further down the chain have no groups.
+	authorizer := s.newAuthorizer(auth.Params{
+		IdentityProviders: idps,
+	})
+	err = authorizer.CheckAgentDepth(s.context, bob)
+	c.Assert(err, gc.Equals, nil)
+	err = authorizer.CheckAgentDepth(s.context, agent1)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+	c.Assert(err, gc.ErrorMatches, `cannot create an agent using an agent account: maximum agent depth \(1\) reached`)
+	id, err := authorizer.Identity(s.context, "agent2@idm")
+	c.Assert(err, gc.Equals, nil)
+	groups, err := id.Groups(s.context)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.HasLen, 0)
+
+	authorizer = s.newAuthorizer(auth.Params{
+		IdentityProviders: idps,
+		MaxAgentDepth:     2,
+	})
+	err = authorizer.CheckAgentDepth(s.context, agent1)
+	c.Assert(err, gc.Equals, nil)
+	err = authorizer.CheckAgentDepth(s.context, agent2)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+
+	// The groups are the intersection of those along the chain.
+	id, err = authorizer.Identity(s.context, "agent2@idm")
+	c.Assert(err, gc.Equals, nil)
+	groups, err = id.Groups(s.context)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []string{"g1"})
+
+	// Every owner in the chain can manage the agent.
+	acl, _, err := auth.AuthorizerACLForOp(authorizer, s.context, auth.UserOp("agent2@idm", auth.ActionDelete))
+	c.Assert(err, gc.IsNil)
+	c.Assert(acl, jc.DeepEquals, append(auth.AdminACL, "agent1@idm", "bob"))
+}
+
 var aclForOpTests = []struct {
 	op           bakery.Op
 	expect       []string
@@ -254,6 +498,24 @@ var aclForOpTests = []struct {
 }, {
 	op:     auth.UserOp("bob", "writeSSHKeys"),
 	expect: append([]string{"bob"}, auth.AdminACL...),
+}, {
+	op:     auth.UserOp("bob", "readAgents"),
+	expect: append([]string{"bob"}, auth.AdminACL...),
+}, {
+	op:     auth.UserOp("bob", "writeAgent"),
+	expect: auth.AdminACL,
+}, {
+	op:     auth.UserOp("bob", "delete"),
+	expect: auth.AdminACL,
+}, {
+	op:     auth.UserOp("bob", "readTokens"),
+	expect: append([]string{"bob"}, auth.AdminACL...),
+}, {
+	op:     auth.UserOp("bob", "writeTokens"),
+	expect: append([]string{"bob"}, auth.AdminACL...),
+}, {
+	op:     auth.UserOp("bob", "linkIdentity"),
+	expect: append([]string{"bob"}, auth.AdminACL...),
 }}
 
 func (s *authSuite) TestACLForOp(c *gc.C) {
@@ -295,6 +557,32 @@ func (s *authSuite) TestExistingUserGroups(c *gc.C) {
 	assertAuthorizedGroups(c, authInfo, []string{"test-group1", "test-group2"})
 }
 
+func (s *authSuite) TestCachedGroups(c *gc.C) {
+	s.providerGroups = []string{"provider-group"}
+	id := s.createIdentity(c, "test", nil, "test-group")
+	storeID, err := id.StoreIdentity(s.context)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(s.authorizer.CachedGroups(s.context, storeID), jc.DeepEquals, []string{"test-group"})
+	c.Assert(s.authorizer.HasGroupCaches(), gc.Equals, true)
+
+	// Groups cached by the identity provider are included.
+	var cached []string
+	authorizer := s.newAuthorizer(auth.Params{
+		IdentityProviders: []idp.IdentityProvider{
+			test.NewIdentityProvider(test.Params{
+				Name:      "test",
+				GetGroups: s.getGroups,
+				CachedGroups: func(*store.Identity) ([]string, bool) {
+					return cached, cached != nil
+				},
+			}),
+		},
+	})
+	c.Assert(authorizer.CachedGroups(s.context, storeID), jc.DeepEquals, []string{"test-group"})
+	cached = []string{"cached-group"}
+	c.Assert(authorizer.CachedGroups(s.context, storeID), jc.DeepEquals, []string{"cached-group", "test-group"})
+}
+
 func assertAuthorizedGroups(c *gc.C, authInfo *identchecker.AuthInfo, expectGroups []string) {
 	c.Assert(authInfo.Identity, gc.NotNil)
 	ident := authInfo.Identity.(*auth.Identity)
@@ -6,6 +6,7 @@ package auth
 import (
 	"bytes"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
@@ -67,6 +68,9 @@ func (a *Authorizer) checkUserHasPublicKey(ctx context.Context, cond, arg string
 		}
 		return errgo.Newf("public key not valid for user")
 	}
+	if IsExpired(&identity, time.Now()) {
+		return errgo.Newf("user has expired")
+	}
 	for _, pk := range identity.PublicKeys {
 		if bytes.Equal(pk.Key[:], publicKey.Key[:]) {
 			return nil
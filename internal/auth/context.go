@@ -4,6 +4,12 @@
 package auth
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/loggo"
 	"golang.org/x/net/context"
 )
 
@@ -14,6 +20,17 @@ const (
 	requiredDomainKey
 	dischargeIDKey
 	usernameKey
+	idpKey
+	logFieldsKey
+	clientIPKey
+)
+
+// Names of the fields recorded in LogFields.
+const (
+	LogFieldRequestID   = "request-id"
+	LogFieldDischargeID = "discharge-id"
+	LogFieldUsername    = "username"
+	LogFieldIDP         = "idp"
 )
 
 type userCredentials struct {
@@ -32,6 +49,18 @@ func userCredentialsFromContext(ctx context.Context) (username, password string,
 	return uc.username, uc.password, ok
 }
 
+// ContextWithClientIP returns a context with the IP address of the
+// client making the request attached. This is used to rate limit
+// attempts to log in with user credentials.
+func ContextWithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
+
 // ContextWithRequiredDomain returns a context associated
 // with the given domain, such that declared identities
 // will only be allowed if they have that domain.
@@ -47,6 +76,7 @@ func requiredDomainFromContext(ctx context.Context) string {
 // ContextWithDischargeID returns a context with the given discharge ID
 // stored.
 func ContextWithDischargeID(ctx context.Context, dischargeID string) context.Context {
+	LogFieldsFromContext(ctx).Set(LogFieldDischargeID, dischargeID)
 	return context.WithValue(ctx, dischargeIDKey, dischargeID)
 }
 
@@ -59,6 +89,7 @@ func dischargeIDFromContext(ctx context.Context) string {
 // Any user attached to the context will be considered authenticated by
 // IdentityFromContext.
 func ContextWithUsername(ctx context.Context, username string) context.Context {
+	LogFieldsFromContext(ctx).Set(LogFieldUsername, username)
 	return context.WithValue(ctx, usernameKey, username)
 }
 
@@ -66,3 +97,181 @@ func usernameFromContext(ctx context.Context) string {
 	username, _ := ctx.Value(usernameKey).(string)
 	return username
 }
+
+// ContextWithIDP returns a context with the name of the identity
+// provider handling the request stored.
+func ContextWithIDP(ctx context.Context, idp string) context.Context {
+	LogFieldsFromContext(ctx).Set(LogFieldIDP, idp)
+	return context.WithValue(ctx, idpKey, idp)
+}
+
+// IDPFromContext returns the name of the identity provider stored with
+// ContextWithIDP, if any.
+func IDPFromContext(ctx context.Context) string {
+	idp, _ := ctx.Value(idpKey).(string)
+	return idp
+}
+
+// LogFields holds the fields that identify a request in structured log
+// output. A LogFields is shared by all the contexts derived from the
+// one to which it is attached, so fields set while handling a request
+// are visible once the request has completed. It is safe to call
+// methods on a nil *LogFields, they do nothing.
+type LogFields struct {
+	mu     sync.Mutex
+	fields map[string]string
+}
+
+// Set sets the value of the given field. Empty values are ignored.
+func (f *LogFields) Set(key, value string) {
+	if f == nil || value == "" {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fields == nil {
+		f.fields = make(map[string]string)
+	}
+	f.fields[key] = value
+}
+
+// Map returns a copy of the fields that have been set.
+func (f *LogFields) Map() map[string]string {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := make(map[string]string, len(f.fields))
+	for k, v := range f.fields {
+		m[k] = v
+	}
+	return m
+}
+
+// ContextWithLogFields returns a context with the given LogFields
+// attached. Any discharge ID, username or identity provider
+// subsequently stored in a derived context will also be set in f.
+func ContextWithLogFields(ctx context.Context, f *LogFields) context.Context {
+	return context.WithValue(ctx, logFieldsKey, f)
+}
+
+// LogFieldsFromContext returns the LogFields attached to the given
+// context, or nil if there are none.
+func LogFieldsFromContext(ctx context.Context) *LogFields {
+	f, _ := ctx.Value(logFieldsKey).(*LogFields)
+	return f
+}
+
+// logPrefix returns the prefix that is added to log messages written
+// with a RequestLogger using f. Values that contain spaces or ']' could
+// not be parsed back out of the prefix by SplitLogMessage, so they are
+// left out.
+func (f *LogFields) logPrefix() string {
+	m := f.Map()
+	if len(m) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(m))
+	for k, v := range m {
+		if strings.ContainsAny(v, " \t\n]") {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	fields := make([]string, len(keys))
+	for i, k := range keys {
+		fields[i] = k + "=" + m[k]
+	}
+	return "[" + strings.Join(fields, " ") + "] "
+}
+
+// SplitLogMessage splits a log message written by a RequestLogger into
+// the fields it was written with and the original message. If the
+// message has no fields then nil and the unchanged message are
+// returned.
+func SplitLogMessage(msg string) (map[string]string, string) {
+	if !strings.HasPrefix(msg, "[") {
+		return nil, msg
+	}
+	end := strings.Index(msg, "] ")
+	if end == -1 {
+		return nil, msg
+	}
+	fields := make(map[string]string)
+	for _, f := range strings.Fields(msg[1:end]) {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 || !isLogField(parts[0]) {
+			return nil, msg
+		}
+		fields[parts[0]] = parts[1]
+	}
+	if len(fields) == 0 {
+		return nil, msg
+	}
+	return fields, msg[end+2:]
+}
+
+func isLogField(key string) bool {
+	switch key {
+	case LogFieldRequestID, LogFieldDischargeID, LogFieldUsername, LogFieldIDP:
+		return true
+	}
+	return false
+}
+
+// A RequestLogger writes log messages about a request to a
+// loggo.Logger. Each message is prefixed with the LogFields of the
+// request, in the form "[key=value ...] ", so that it can be related to
+// the request in the logs. The JSON log writer splits the fields from
+// the message again using SplitLogMessage.
+type RequestLogger struct {
+	logger loggo.Logger
+	fields *LogFields
+}
+
+// Logger returns a RequestLogger that writes messages to the given
+// logger with the LogFields attached to the given context.
+func Logger(ctx context.Context, logger loggo.Logger) RequestLogger {
+	return RequestLogger{
+		logger: logger,
+		fields: LogFieldsFromContext(ctx),
+	}
+}
+
+// Debugf logs a message at the DEBUG level.
+func (l RequestLogger) Debugf(format string, args ...interface{}) {
+	l.logf(loggo.DEBUG, format, args)
+}
+
+// Infof logs a message at the INFO level.
+func (l RequestLogger) Infof(format string, args ...interface{}) {
+	l.logf(loggo.INFO, format, args)
+}
+
+// Warningf logs a message at the WARNING level.
+func (l RequestLogger) Warningf(format string, args ...interface{}) {
+	l.logf(loggo.WARNING, format, args)
+}
+
+// Errorf logs a message at the ERROR level.
+func (l RequestLogger) Errorf(format string, args ...interface{}) {
+	l.logf(loggo.ERROR, format, args)
+}
+
+func (l RequestLogger) logf(level loggo.Level, format string, args []interface{}) {
+	if !l.logger.IsLevelEnabled(level) {
+		return
+	}
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
+	}
+	// The call depth skips logf and the exported method that called
+	// it, so that the location logged is that of the caller.
+	l.logger.LogCallf(2, level, "%s%s", l.fields.logPrefix(), msg)
+}
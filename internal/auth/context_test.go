@@ -0,0 +1,84 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth_test
+
+import (
+	"path/filepath"
+
+	"github.com/juju/loggo"
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+)
+
+type contextSuite struct{}
+
+var _ = gc.Suite(&contextSuite{})
+
+func (s *contextSuite) TestRequestLogger(c *gc.C) {
+	w := new(loggo.TestWriter)
+	loggo.RegisterWriter("test-request-logger", w)
+	defer loggo.RemoveWriter("test-request-logger")
+	logger := loggo.GetLogger("identity.internal.auth.test")
+	logger.SetLogLevel(loggo.INFO)
+
+	fields := new(auth.LogFields)
+	fields.Set(auth.LogFieldRequestID, "req-1")
+	ctx := auth.ContextWithLogFields(context.Background(), fields)
+	auth.ContextWithUsername(ctx, "bob")
+	auth.ContextWithDischargeID(ctx, "not a valid ] field")
+	auth.Logger(ctx, logger).Infof("hello %s", "world")
+	auth.Logger(ctx, logger).Debugf("not logged")
+	auth.Logger(context.Background(), logger).Warningf("no fields")
+
+	log := w.Log()
+	c.Assert(log, gc.HasLen, 2)
+	c.Assert(log[0].Message, gc.Equals, "[request-id=req-1 username=bob] hello world")
+	c.Assert(filepath.Base(log[0].Filename), gc.Equals, "context_test.go")
+	c.Assert(log[1].Message, gc.Equals, "no fields")
+
+	msgFields, msg := auth.SplitLogMessage(log[0].Message)
+	c.Assert(msgFields, gc.DeepEquals, map[string]string{
+		auth.LogFieldRequestID: "req-1",
+		auth.LogFieldUsername:  "bob",
+	})
+	c.Assert(msg, gc.Equals, "hello world")
+}
+
+var splitLogMessageTests = []struct {
+	about        string
+	msg          string
+	expectFields map[string]string
+	expectMsg    string
+}{{
+	about:     "no fields",
+	msg:       "hello world",
+	expectMsg: "hello world",
+}, {
+	about: "fields",
+	msg:   "[idp=test discharge-id=1234] hello world",
+	expectFields: map[string]string{
+		auth.LogFieldIDP:         "test",
+		auth.LogFieldDischargeID: "1234",
+	},
+	expectMsg: "hello world",
+}, {
+	about:     "unknown field",
+	msg:       "[colour=blue] hello world",
+	expectMsg: "[colour=blue] hello world",
+}, {
+	about:     "not fields",
+	msg:       "[PANIC] hello world",
+	expectMsg: "[PANIC] hello world",
+}}
+
+func (s *contextSuite) TestSplitLogMessage(c *gc.C) {
+	for i, test := range splitLogMessageTests {
+		c.Logf("test %d. %s", i, test.about)
+		fields, msg := auth.SplitLogMessage(test.msg)
+		c.Assert(fields, gc.DeepEquals, test.expectFields)
+		c.Assert(msg, gc.Equals, test.expectMsg)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+// ErrDisablingNotSupported is the error cause returned by SetDisabled
+// when the Authorizer has no disabled store.
+var ErrDisablingNotSupported = errgo.New("disabling users not supported")
+
+// disabledValue is the value stored in the disabled store for an
+// identity that is disabled. Enabling an identity stores an empty value
+// as the store cannot remove keys.
+const disabledValue = "disabled"
+
+// SetDisabled sets whether the identity with the given provider ID is
+// disabled. A disabled identity cannot log in and any macaroons that
+// have already been issued to it are no longer accepted.
+func (a *Authorizer) SetDisabled(ctx context.Context, providerID store.ProviderIdentity, disabled bool) error {
+	if a.disabledStore == nil {
+		return errgo.WithCausef(nil, ErrDisablingNotSupported, "")
+	}
+	ctx, close := a.disabledStore.Context(ctx)
+	defer close()
+	var value []byte
+	if disabled {
+		value = []byte(disabledValue)
+	}
+	if err := a.disabledStore.Set(ctx, string(providerID), value, time.Time{}); err != nil {
+		return errgo.Notef(err, "cannot update disabled status of %s", providerID)
+	}
+	return nil
+}
+
+// IsDisabled reports whether the identity with the given provider ID
+// has been disabled.
+func (a *Authorizer) IsDisabled(ctx context.Context, providerID store.ProviderIdentity) (bool, error) {
+	if a.disabledStore == nil {
+		return false, nil
+	}
+	ctx, close := a.disabledStore.Context(ctx)
+	defer close()
+	value, err := a.disabledStore.Get(ctx, string(providerID))
+	if errgo.Cause(err) == store.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return string(value) == disabledValue, nil
+}
+
+// CheckEnabled checks that the given identity has not been disabled. If
+// it has an error with a cause of params.ErrUnauthorized is returned.
+func (a *Authorizer) CheckEnabled(ctx context.Context, id *store.Identity) error {
+	disabled, err := a.IsDisabled(ctx, id.ProviderID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if disabled {
+		return errgo.WithCausef(nil, params.ErrUnauthorized, "user %s is disabled", id.Username)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth_test
+
+import (
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/idmtest"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+type disableSuite struct {
+	idmtest.StoreSuite
+	authorizer *auth.Authorizer
+	context    context.Context
+	close      func()
+}
+
+var _ = gc.Suite(&disableSuite{})
+
+func (s *disableSuite) SetUpTest(c *gc.C) {
+	s.StoreSuite.SetUpTest(c)
+	s.context, s.close = s.Store.Context(context.Background())
+	disabledStore, err := s.ProviderDataStore.KeyValueStore(s.context, "disabled")
+	c.Assert(err, gc.Equals, nil)
+	s.authorizer = auth.New(auth.Params{
+		Location:      identityLocation,
+		Store:         s.Store,
+		DisabledStore: disabledStore,
+	})
+}
+
+func (s *disableSuite) TearDownTest(c *gc.C) {
+	s.close()
+	s.StoreSuite.TearDownTest(c)
+}
+
+func (s *disableSuite) TestSetDisabled(c *gc.C) {
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}
+	disabled, err := s.authorizer.IsDisabled(s.context, id.ProviderID)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(disabled, gc.Equals, false)
+	err = s.authorizer.CheckEnabled(s.context, id)
+	c.Assert(err, gc.Equals, nil)
+
+	err = s.authorizer.SetDisabled(s.context, id.ProviderID, true)
+	c.Assert(err, gc.Equals, nil)
+	disabled, err = s.authorizer.IsDisabled(s.context, id.ProviderID)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(disabled, gc.Equals, true)
+	err = s.authorizer.CheckEnabled(s.context, id)
+	c.Assert(err, gc.ErrorMatches, `user bob is disabled`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+
+	err = s.authorizer.SetDisabled(s.context, id.ProviderID, false)
+	c.Assert(err, gc.Equals, nil)
+	disabled, err = s.authorizer.IsDisabled(s.context, id.ProviderID)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(disabled, gc.Equals, false)
+}
+
+func (s *disableSuite) TestDisablingNotSupported(c *gc.C) {
+	authorizer := auth.New(auth.Params{
+		Store: s.Store,
+	})
+	providerID := store.MakeProviderIdentity("test", "bob")
+	err := authorizer.SetDisabled(s.context, providerID, true)
+	c.Assert(errgo.Cause(err), gc.Equals, auth.ErrDisablingNotSupported)
+	disabled, err := authorizer.IsDisabled(s.context, providerID)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(disabled, gc.Equals, false)
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+// CachedGroups returns the groups of the given identity without
+// contacting its identity provider. These are the groups stored for the
+// identity along with any cached by its identity provider, if that
+// implements idp.GroupCache. As both are shared by every identity
+// server, the result does not depend on which server is asked. This
+// makes it suitable for checking the membership of many identities at
+// once.
+func (a *Authorizer) CachedGroups(ctx context.Context, id *store.Identity) []string {
+	r, ok := a.groupResolvers[id.ProviderID.Provider()].(idpGroupResolver)
+	if !ok {
+		return id.Groups
+	}
+	gc, ok := r.idp.(idp.GroupCache)
+	if !ok {
+		return id.Groups
+	}
+	groups, ok := gc.CachedGroups(ctx, id)
+	if !ok || len(groups) == 0 {
+		return id.Groups
+	}
+	return uniqueStrings(append(append([]string(nil), groups...), id.Groups...))
+}
+
+// HasGroupCaches reports whether any of the identity providers
+// implements idp.GroupCache.
+func (a *Authorizer) HasGroupCaches() bool {
+	for _, r := range a.groupResolvers {
+		if r, ok := r.(idpGroupResolver); ok {
+			if _, ok := r.idp.(idp.GroupCache); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
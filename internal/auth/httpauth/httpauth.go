@@ -5,6 +5,7 @@ package httpauth
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
@@ -16,6 +17,7 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
 	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
 )
 
 // An Authorizer is used to authorize HTTP requests.
@@ -38,10 +40,23 @@ func New(o *bakery.Oven, a *auth.Authorizer) *Authorizer {
 // perform the given operations. It may return an httpbakery error when
 // further checks are required, or params.ErrUnauthorized if the user is
 // authenticated but does not have the required authorization.
+//
+// If the request holds a personal access token as a bearer token in its
+// Authorization header then only that token is used to authorize the
+// request.
 func (a *Authorizer) Auth(ctx context.Context, req *http.Request, ops ...bakery.Op) (*identchecker.AuthInfo, error) {
 	ctx = httpbakery.ContextWithRequest(ctx, req)
+	if token, ok := bearerToken(req); ok {
+		ctx = auth.ContextWithClientIP(ctx, a.authorizer.ClientIP(req))
+		authInfo, err := a.authorizer.AuthToken(ctx, token, ops...)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized), ratelimit.IsLimitError)
+		}
+		return authInfo, nil
+	}
 	if username, password, ok := req.BasicAuth(); ok {
 		ctx = auth.ContextWithUserCredentials(ctx, username, password)
+		ctx = auth.ContextWithClientIP(ctx, a.authorizer.ClientIP(req))
 	}
 	authInfo, err := a.authorizer.Auth(ctx, httpbakery.RequestMacaroons(req), ops...)
 	if err == nil {
@@ -49,7 +64,7 @@ func (a *Authorizer) Auth(ctx context.Context, req *http.Request, ops ...bakery.
 	}
 	derr, ok := errgo.Cause(err).(*bakery.DischargeRequiredError)
 	if !ok {
-		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized), ratelimit.IsLimitError)
 	}
 	caveats := append(derr.Caveats, checkers.TimeBeforeCaveat(time.Now().Add(365*24*time.Hour)))
 	m, err := a.oven.NewMacaroon(
@@ -68,3 +83,14 @@ func (a *Authorizer) Auth(ctx context.Context, req *http.Request, ops ...bakery.
 		CookieNameSuffix: "idm",
 	})
 }
+
+// bearerToken returns the bearer token held in the Authorization header
+// of the given request, if there is one.
+func bearerToken(req *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(h[len(prefix):]), true
+}
@@ -5,6 +5,7 @@ package httpauth_test
 
 import (
 	"net/http"
+	"time"
 
 	"golang.org/x/net/context"
 	gc "gopkg.in/check.v1"
@@ -17,6 +18,7 @@ import (
 	"github.com/CanonicalLtd/blues-identity/internal/auth"
 	"github.com/CanonicalLtd/blues-identity/internal/auth/httpauth"
 	"github.com/CanonicalLtd/blues-identity/internal/idmtest"
+	"github.com/CanonicalLtd/blues-identity/store"
 )
 
 type authSuite struct {
@@ -44,12 +46,15 @@ func (s *authSuite) SetUpTest(c *gc.C) {
 		Locator:  locator,
 		Location: "identity",
 	})
+	tokenStore, err := s.ProviderDataStore.KeyValueStore(context.Background(), "tokens")
+	c.Assert(err, gc.Equals, nil)
 	s.auth = auth.New(auth.Params{
 		AdminUsername:    "test-admin",
 		AdminPassword:    "open sesame",
 		Location:         identityLocation,
 		Store:            s.Store,
 		MacaroonVerifier: s.oven,
+		TokenStore:       tokenStore,
 	})
 	s.authorizer = httpauth.New(s.oven, s.auth)
 }
@@ -110,3 +115,97 @@ func (s *authSuite) TestAuthorizeMacaroonRequired(c *gc.C) {
 	c.Assert(derr.Info.MacaroonPath, gc.Equals, "../")
 	c.Assert(derr.Info.Macaroon, gc.NotNil)
 }
+
+func (s *authSuite) TestAuthorizeWithToken(c *gc.C) {
+	ctx := context.Background()
+	bob := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}
+	err := s.Store.UpdateIdentity(ctx, bob, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	token, _, err := s.auth.CreateToken(ctx, bob, "test", []string{"read-ssh-keys"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+
+	tests := []struct {
+		about              string
+		token              string
+		op                 bakery.Op
+		expectErrorMessage string
+	}{{
+		about:              "login",
+		token:              token,
+		op:                 identchecker.LoginOp,
+		expectErrorMessage: `token "test" does not allow login`,
+	}, {
+		about: "operation in scope",
+		token: token,
+		op: bakery.Op{
+			Entity: "u-bob",
+			Action: auth.ActionReadSSHKeys,
+		},
+	}, {
+		about: "operation not in scope",
+		token: token,
+		op: bakery.Op{
+			Entity: "u-bob",
+			Action: auth.ActionWriteSSHKeys,
+		},
+		expectErrorMessage: `token "test" does not allow "writeSSHKeys"`,
+	}, {
+		about: "operation in scope but not allowed to user",
+		token: token,
+		op: bakery.Op{
+			Entity: "u-alice",
+			Action: auth.ActionReadSSHKeys,
+		},
+		expectErrorMessage: `permission denied`,
+	}, {
+		about:              "bad secret",
+		token:              token[:len(token)-1] + "x",
+		op:                 identchecker.LoginOp,
+		expectErrorMessage: `invalid token`,
+	}, {
+		about:              "malformed token",
+		token:              "not-a-token",
+		op:                 identchecker.LoginOp,
+		expectErrorMessage: `invalid token`,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d. %s", i, test.about)
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		authInfo, err := s.authorizer.Auth(ctx, req, test.op)
+		if test.expectErrorMessage != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectErrorMessage)
+			c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(authInfo.Identity.Id(), gc.Equals, "bob")
+	}
+}
+
+func (s *authSuite) TestAuthorizeWithRevokedToken(c *gc.C) {
+	ctx := context.Background()
+	bob := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}
+	err := s.Store.UpdateIdentity(ctx, bob, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	token, t, err := s.auth.CreateToken(ctx, bob, "test", []string{"read-ssh-keys"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+	err = s.auth.RevokeToken(ctx, bob, t.ID)
+	c.Assert(err, gc.Equals, nil)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	_, err = s.authorizer.Auth(ctx, req, identchecker.LoginOp)
+	c.Assert(err, gc.ErrorMatches, `invalid token`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+}
@@ -0,0 +1,478 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+// TokenScopes holds the scopes that may be granted to a personal access
+// token, along with the operation actions that each scope allows. A
+// token never allows an operation that the token's owner could not
+// perform themselves, and never allows tokens to be managed. Tokens
+// cannot create, modify or remove agents as an agent's keys give
+// access that outlives the token. Only tokens with the read-user scope
+// may be used to log in.
+var TokenScopes = map[string][]string{
+	"read-user":      {ActionRead, ActionReadGroups},
+	"read-ssh-keys":  {ActionReadSSHKeys, ActionReadGroupSSHKeys},
+	"write-ssh-keys": {ActionReadSSHKeys, ActionWriteSSHKeys},
+	"ssh-cert":       {ActionReadSSHCAKey, ActionSignSSHCert},
+	"read-agents":    {ActionReadAgents},
+}
+
+// ErrTokensNotSupported is the error cause returned by the token
+// methods when the Authorizer has no token store.
+var ErrTokensNotSupported = errgo.New("personal access tokens not supported")
+
+const (
+	// tokenPrefix is the prefix of every personal access token.
+	tokenPrefix = "idm"
+
+	// tokenLastUsedResolution is the smallest interval at which the
+	// last-used time of a token is updated.
+	tokenLastUsedResolution = time.Minute
+)
+
+// A Token holds the information stored about a personal access token.
+// The token secret itself is never stored, only its hash.
+type Token struct {
+	// ID holds the unique identifier of the token.
+	ID string `json:"id"`
+
+	// Name holds the name given to the token by its owner.
+	Name string `json:"name"`
+
+	// Owner holds the provider identity of the user that owns the
+	// token.
+	Owner store.ProviderIdentity `json:"owner"`
+
+	// Scopes holds the scopes granted to the token, see TokenScopes.
+	Scopes []string `json:"scopes"`
+
+	// Hash holds the SHA-256 hash of the token secret.
+	Hash []byte `json:"hash"`
+
+	// Created holds the time the token was created.
+	Created time.Time `json:"created"`
+
+	// Expires holds the time at which the token expires. If this is
+	// zero the token does not expire.
+	Expires time.Time `json:"expires,omitempty"`
+
+	// LastUsed holds the approximate time the token was last used.
+	// This is not stored with the token, it is filled in by Tokens.
+	LastUsed time.Time `json:"-"`
+
+	// Revoked holds whether the token has been revoked.
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+// allows reports whether the token's scopes allow the given operation
+// action.
+func (t *Token) allows(action string) bool {
+	for _, scope := range t.Scopes {
+		for _, a := range TokenScopes[scope] {
+			if a == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasScope reports whether the token has been granted the given scope.
+func (t *Token) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckTokenScopes checks that all the given scopes are valid token
+// scopes. The returned error will have a cause of params.ErrBadRequest.
+func CheckTokenScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "no scopes specified")
+	}
+	for _, scope := range scopes {
+		if _, ok := TokenScopes[scope]; !ok {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// CreateToken creates a new personal access token owned by the given
+// identity. It returns the token, which is not retrievable again, and
+// the information stored about it.
+func (a *Authorizer) CreateToken(ctx context.Context, owner *store.Identity, name string, scopes []string, expires time.Time) (string, *Token, error) {
+	if a.tokenStore == nil {
+		return "", nil, errgo.WithCausef(nil, ErrTokensNotSupported, "")
+	}
+	if name == "" {
+		return "", nil, errgo.WithCausef(nil, params.ErrBadRequest, "no token name specified")
+	}
+	if err := CheckTokenScopes(scopes); err != nil {
+		return "", nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	now := time.Now()
+	if !expires.IsZero() && !expires.After(now) {
+		return "", nil, errgo.WithCausef(nil, params.ErrBadRequest, "token expiry time is in the past")
+	}
+	id, err := randomString(8, hexEncode)
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	hash := sha256.Sum256([]byte(secret))
+	t := &Token{
+		ID:      id,
+		Name:    name,
+		Owner:   owner.ProviderID,
+		Scopes:  append([]string(nil), scopes...),
+		Hash:    hash[:],
+		Created: now.UTC().Round(time.Second),
+		Expires: expires.UTC(),
+	}
+	ctx, close := a.tokenStore.Context(ctx)
+	defer close()
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	if err := a.tokenStore.Add(ctx, tokenKey(id), data, t.Expires); err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	if err := a.addUserToken(ctx, owner.ProviderID, id); err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	return fmt.Sprintf("%s_%s_%s", tokenPrefix, id, secret), t, nil
+}
+
+// Tokens returns the personal access tokens owned by the given
+// identity, in the order they were created. Revoked tokens are not
+// included.
+func (a *Authorizer) Tokens(ctx context.Context, owner *store.Identity) ([]*Token, error) {
+	if a.tokenStore == nil {
+		return nil, errgo.WithCausef(nil, ErrTokensNotSupported, "")
+	}
+	ctx, close := a.tokenStore.Context(ctx)
+	defer close()
+	all, err := a.userTokens(ctx, owner.ProviderID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	tokens := make([]*Token, 0, len(all))
+	for _, t := range all {
+		if t.Revoked {
+			continue
+		}
+		t.LastUsed = a.tokenLastUsed(ctx, t.ID)
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// RevokeToken revokes the personal access token with the given ID owned
+// by the given identity. If there is no such token an error with a cause
+// of params.ErrNotFound is returned.
+func (a *Authorizer) RevokeToken(ctx context.Context, owner *store.Identity, id string) error {
+	if a.tokenStore == nil {
+		return errgo.WithCausef(nil, ErrTokensNotSupported, "")
+	}
+	ctx, close := a.tokenStore.Context(ctx)
+	defer close()
+	t, err := a.token(ctx, id)
+	if err != nil && errgo.Cause(err) != store.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	if err != nil || t.Owner != owner.ProviderID || t.Revoked {
+		return errgo.WithCausef(nil, params.ErrNotFound, "token %q not found", id)
+	}
+	return errgo.Mask(a.setTokenRevoked(ctx, t))
+}
+
+// RevokeTokens revokes all the personal access tokens owned by the
+// identity with the given provider ID. It is used when the identity is
+// removed so that its tokens cannot be used again should an identity
+// with the same provider ID be created later. If personal access tokens
+// are not supported nothing is done.
+func (a *Authorizer) RevokeTokens(ctx context.Context, owner store.ProviderIdentity) error {
+	if a.tokenStore == nil {
+		return nil
+	}
+	ctx, close := a.tokenStore.Context(ctx)
+	defer close()
+	tokens, err := a.userTokens(ctx, owner)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, t := range tokens {
+		if t.Revoked {
+			continue
+		}
+		if err := a.setTokenRevoked(ctx, t); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// setTokenRevoked marks the given token as revoked. The stored token
+// is left to expire immediately, although stores that do not garbage
+// collect will keep it, revoked, indefinitely.
+func (a *Authorizer) setTokenRevoked(ctx context.Context, t *Token) error {
+	t.Revoked = true
+	data, err := json.Marshal(t)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(a.tokenStore.Set(ctx, tokenKey(t.ID), data, time.Now()))
+}
+
+// TransferTokens transfers the personal access tokens owned by the
+// identity with the provider ID from to the identity with the provider
+// ID to. If personal access tokens are not supported nothing is done.
+func (a *Authorizer) TransferTokens(ctx context.Context, from, to store.ProviderIdentity) error {
+	if a.tokenStore == nil {
+		return nil
+	}
+	ctx, close := a.tokenStore.Context(ctx)
+	defer close()
+	tokens, err := a.userTokens(ctx, from)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, t := range tokens {
+		if t.Revoked {
+			continue
+		}
+		// The token is added to the new owner's tokens before its
+		// owner is changed so that it is never left unlisted.
+		if err := a.addUserToken(ctx, to, t.ID); err != nil {
+			return errgo.Mask(err)
+		}
+		t.Owner = to
+		data, err := json.Marshal(t)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if err := a.tokenStore.Set(ctx, tokenKey(t.ID), data, t.Expires); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// AuthToken checks that the holder of the given personal access token
+// is authorized to perform the given operations. The operations must be
+// allowed both by the token's scopes and by the ACLs that apply to the
+// token's owner. If the token is invalid, or the operations are not
+// allowed, an error with a cause of params.ErrUnauthorized is returned.
+func (a *Authorizer) AuthToken(ctx context.Context, token string, ops ...bakery.Op) (*identchecker.AuthInfo, error) {
+	if err := a.limiter.Allow(ctx, "token", clientIPFromContext(ctx), ""); err != nil {
+		return nil, errgo.Mask(err, ratelimit.IsLimitError)
+	}
+	if a.tokenStore == nil {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "personal access tokens not supported")
+	}
+	tctx, close := a.tokenStore.Context(ctx)
+	defer close()
+	t, err := a.checkToken(tctx, token)
+	if err != nil {
+		Logger(ctx, logger).Infof("invalid personal access token: %s", err)
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid token")
+	}
+	for _, op := range ops {
+		if op == identchecker.LoginOp {
+			// Logging in reveals the identity of the token's
+			// owner, which only the read-user scope allows.
+			if !t.hasScope("read-user") {
+				return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "token %q does not allow login", t.Name)
+			}
+			continue
+		}
+		if !t.allows(op.Action) {
+			return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "token %q does not allow %q", t.Name, op.Action)
+		}
+	}
+	owner := store.Identity{
+		ProviderID: t.Owner,
+	}
+	if err := a.store.Identity(ctx, &owner); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid token")
+		}
+		return nil, errgo.Mask(err)
+	}
+	a.tokenUsed(tctx, t.ID)
+	return a.Auth(ContextWithUsername(ctx, owner.Username), nil, ops...)
+}
+
+// checkToken checks that the given token is valid and returns the
+// stored information about it.
+func (a *Authorizer) checkToken(ctx context.Context, token string) (*Token, error) {
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 || parts[0] != tokenPrefix {
+		return nil, errgo.New("malformed token")
+	}
+	t, err := a.token(ctx, parts[1])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	hash := sha256.Sum256([]byte(parts[2]))
+	if subtle.ConstantTimeCompare(hash[:], t.Hash) != 1 {
+		return nil, errgo.Newf("token %q has incorrect secret", t.ID)
+	}
+	if t.Revoked {
+		return nil, errgo.Newf("token %q has been revoked", t.ID)
+	}
+	if !t.Expires.IsZero() && !time.Now().Before(t.Expires) {
+		return nil, errgo.Newf("token %q has expired", t.ID)
+	}
+	return t, nil
+}
+
+// token retrieves the token with the given ID from the token store.
+func (a *Authorizer) token(ctx context.Context, id string) (*Token, error) {
+	data, err := a.tokenStore.Get(ctx, tokenKey(id))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	var t Token
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal token %q", id)
+	}
+	return &t, nil
+}
+
+// tokenUsed records that the token with the given ID has just been
+// used. The last-used time is stored separately from the token so that
+// recording it cannot race with revoking the token.
+func (a *Authorizer) tokenUsed(ctx context.Context, id string) {
+	now := time.Now().UTC()
+	if now.Sub(a.tokenLastUsed(ctx, id)) < tokenLastUsedResolution {
+		return
+	}
+	if err := a.tokenStore.Set(ctx, lastUsedKey(id), []byte(now.Format(time.RFC3339)), time.Time{}); err != nil {
+		Logger(ctx, logger).Warningf("cannot record use of token %q: %s", id, err)
+	}
+}
+
+// tokenLastUsed returns the time the token with the given ID was last
+// used, or the zero time if it has never been used.
+func (a *Authorizer) tokenLastUsed(ctx context.Context, id string) time.Time {
+	data, err := a.tokenStore.Get(ctx, lastUsedKey(id))
+	if err != nil {
+		if errgo.Cause(err) != store.ErrNotFound {
+			Logger(ctx, logger).Warningf("cannot get last use of token %q: %s", id, err)
+		}
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, string(data))
+	if err != nil {
+		Logger(ctx, logger).Warningf("invalid last use time for token %q: %s", id, err)
+		return time.Time{}
+	}
+	return t
+}
+
+// addUserToken records that the token with the given ID is owned by
+// the user with the given provider identity. Each of a user's tokens
+// is recorded under its own numbered key, claimed with Add, so that
+// concurrent additions cannot overwrite one another.
+func (a *Authorizer) addUserToken(ctx context.Context, owner store.ProviderIdentity, id string) error {
+	for n := 0; ; n++ {
+		err := a.tokenStore.Add(ctx, userTokenKey(owner, n), []byte(id), time.Time{})
+		if err == nil {
+			return nil
+		}
+		if errgo.Cause(err) != store.ErrDuplicateKey {
+			return errgo.Mask(err)
+		}
+	}
+}
+
+// userTokens returns the tokens recorded as owned by the user with the
+// given provider identity, in the order they were added, including any
+// revoked tokens that remain in the store. Tokens that have since been
+// transferred to another user are not included.
+func (a *Authorizer) userTokens(ctx context.Context, owner store.ProviderIdentity) ([]*Token, error) {
+	var tokens []*Token
+	seen := make(map[string]bool)
+	for n := 0; ; n++ {
+		data, err := a.tokenStore.Get(ctx, userTokenKey(owner, n))
+		if errgo.Cause(err) == store.ErrNotFound {
+			return tokens, nil
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		id := string(data)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		t, err := a.token(ctx, id)
+		if errgo.Cause(err) == store.ErrNotFound {
+			// The token has expired and been garbage collected.
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if t.Owner != owner {
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+}
+
+func tokenKey(id string) string {
+	return "token:" + id
+}
+
+func lastUsedKey(id string) string {
+	return "last-used:" + id
+}
+
+func userTokenKey(owner store.ProviderIdentity, n int) string {
+	return fmt.Sprintf("user:%s|%d", owner, n)
+}
+
+func hexEncode(buf []byte) string {
+	return fmt.Sprintf("%x", buf)
+}
+
+// randomString returns n random bytes encoded with the given encoding
+// function.
+func randomString(n int, encode func([]byte) string) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return encode(buf), nil
+}
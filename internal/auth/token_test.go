@@ -0,0 +1,299 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/idmtest"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+type tokenSuite struct {
+	idmtest.StoreSuite
+	authorizer *auth.Authorizer
+	context    context.Context
+	close      func()
+	bob        *store.Identity
+}
+
+var _ = gc.Suite(&tokenSuite{})
+
+func (s *tokenSuite) SetUpTest(c *gc.C) {
+	s.StoreSuite.SetUpTest(c)
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.Equals, nil)
+	oven := bakery.NewOven(bakery.OvenParams{
+		Key:      key,
+		Location: "identity",
+	})
+	s.context, s.close = s.Store.Context(context.Background())
+	tokenStore, err := s.ProviderDataStore.KeyValueStore(s.context, "tokens")
+	c.Assert(err, gc.Equals, nil)
+	s.authorizer = auth.New(auth.Params{
+		Location:         identityLocation,
+		MacaroonVerifier: oven,
+		Store:            s.Store,
+		TokenStore:       tokenStore,
+	})
+	s.bob = &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}
+	err = s.Store.UpdateIdentity(s.context, s.bob, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *tokenSuite) TearDownTest(c *gc.C) {
+	s.close()
+	s.StoreSuite.TearDownTest(c)
+}
+
+func (s *tokenSuite) TestCreateToken(c *gc.C) {
+	expires := time.Now().Add(time.Hour).UTC()
+	token, t, err := s.authorizer.CreateToken(s.context, s.bob, "my-token", []string{"read-ssh-keys", "ssh-cert"}, expires)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(strings.HasPrefix(token, "idm_"+t.ID+"_"), gc.Equals, true, gc.Commentf("token %q", token))
+	c.Assert(t.Name, gc.Equals, "my-token")
+	c.Assert(t.Owner, gc.Equals, s.bob.ProviderID)
+	c.Assert(t.Scopes, jc.DeepEquals, []string{"read-ssh-keys", "ssh-cert"})
+	c.Assert(t.Expires.Equal(expires), gc.Equals, true)
+
+	tokens, err := s.authorizer.Tokens(s.context, s.bob)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tokens, gc.HasLen, 1)
+	c.Assert(tokens[0].ID, gc.Equals, t.ID)
+	c.Assert(tokens[0].Name, gc.Equals, "my-token")
+	c.Assert(tokens[0].LastUsed.IsZero(), gc.Equals, true)
+}
+
+func (s *tokenSuite) TestCreateTokenConcurrent(c *gc.C) {
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, err := s.authorizer.CreateToken(s.context, s.bob, fmt.Sprintf("token%d", i), []string{"read-ssh-keys"}, time.Time{})
+			c.Check(err, gc.Equals, nil)
+		}(i)
+	}
+	wg.Wait()
+	tokens, err := s.authorizer.Tokens(s.context, s.bob)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tokens, gc.HasLen, n)
+}
+
+func (s *tokenSuite) TestCreateTokenErrors(c *gc.C) {
+	tests := []struct {
+		about       string
+		name        string
+		scopes      []string
+		expires     time.Time
+		expectError string
+	}{{
+		about:       "no name",
+		scopes:      []string{"read-ssh-keys"},
+		expectError: `no token name specified`,
+	}, {
+		about:       "no scopes",
+		name:        "test",
+		expectError: `no scopes specified`,
+	}, {
+		about:       "invalid scope",
+		name:        "test",
+		scopes:      []string{"read-ssh-keys", "everything"},
+		expectError: `invalid scope "everything"`,
+	}, {
+		about:       "expired",
+		name:        "test",
+		scopes:      []string{"read-ssh-keys"},
+		expires:     time.Now().Add(-time.Hour),
+		expectError: `token expiry time is in the past`,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d. %s", i, test.about)
+		_, _, err := s.authorizer.CreateToken(s.context, s.bob, test.name, test.scopes, test.expires)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	}
+}
+
+func (s *tokenSuite) TestAuthToken(c *gc.C) {
+	token, t, err := s.authorizer.CreateToken(s.context, s.bob, "test", []string{"read-ssh-keys"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+
+	authInfo, err := s.authorizer.AuthToken(s.context, token, auth.UserOp("bob", auth.ActionReadSSHKeys))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(authInfo.Identity.Id(), gc.Equals, "bob")
+
+	// The token's last use has been recorded.
+	tokens, err := s.authorizer.Tokens(s.context, s.bob)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tokens, gc.HasLen, 1)
+	c.Assert(tokens[0].ID, gc.Equals, t.ID)
+	c.Assert(time.Since(tokens[0].LastUsed) < time.Minute, gc.Equals, true, gc.Commentf("last used %v", tokens[0].LastUsed))
+
+	// Tokens cannot be used to manage tokens.
+	_, err = s.authorizer.AuthToken(s.context, token, auth.UserOp("bob", auth.ActionWriteTokens))
+	c.Assert(err, gc.ErrorMatches, `token "test" does not allow "writeTokens"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+}
+
+func (s *tokenSuite) TestAuthTokenLogin(c *gc.C) {
+	token, _, err := s.authorizer.CreateToken(s.context, s.bob, "test", []string{"ssh-cert"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.authorizer.AuthToken(s.context, token, identchecker.LoginOp)
+	c.Assert(err, gc.ErrorMatches, `token "test" does not allow login`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+
+	token, _, err = s.authorizer.CreateToken(s.context, s.bob, "test2", []string{"read-user"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+	authInfo, err := s.authorizer.AuthToken(s.context, token, identchecker.LoginOp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(authInfo.Identity.Id(), gc.Equals, "bob")
+}
+
+func (s *tokenSuite) TestAuthTokenReadAgents(c *gc.C) {
+	token, _, err := s.authorizer.CreateToken(s.context, s.bob, "test", []string{"read-agents"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = s.authorizer.AuthToken(s.context, token, auth.UserOp("bob", auth.ActionReadAgents))
+	c.Assert(err, gc.Equals, nil)
+
+	// Tokens cannot be used to create or change agents.
+	for _, action := range []string{auth.ActionCreateAgent, auth.ActionWriteAgent, auth.ActionDelete} {
+		_, err = s.authorizer.AuthToken(s.context, token, auth.UserOp("bob", action))
+		c.Assert(err, gc.ErrorMatches, `token "test" does not allow "`+action+`"`)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+	}
+}
+
+func (s *tokenSuite) TestAuthTokenOwnerRemoved(c *gc.C) {
+	token, _, err := s.authorizer.CreateToken(s.context, s.bob, "test", []string{"read-ssh-keys"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+	err = s.Store.RemoveIdentity(s.context, &store.Identity{ProviderID: s.bob.ProviderID})
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = s.authorizer.AuthToken(s.context, token, auth.UserOp("bob", auth.ActionReadSSHKeys))
+	c.Assert(err, gc.ErrorMatches, `invalid token`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+}
+
+func (s *tokenSuite) TestRevokeToken(c *gc.C) {
+	token1, t1, err := s.authorizer.CreateToken(s.context, s.bob, "token1", []string{"read-ssh-keys"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+	token2, t2, err := s.authorizer.CreateToken(s.context, s.bob, "token2", []string{"read-ssh-keys"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+
+	err = s.authorizer.RevokeToken(s.context, s.bob, t1.ID)
+	c.Assert(err, gc.Equals, nil)
+
+	tokens, err := s.authorizer.Tokens(s.context, s.bob)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tokens, gc.HasLen, 1)
+	c.Assert(tokens[0].ID, gc.Equals, t2.ID)
+
+	_, err = s.authorizer.AuthToken(s.context, token1, auth.UserOp("bob", auth.ActionReadSSHKeys))
+	c.Assert(err, gc.ErrorMatches, `invalid token`)
+	_, err = s.authorizer.AuthToken(s.context, token2, auth.UserOp("bob", auth.ActionReadSSHKeys))
+	c.Assert(err, gc.Equals, nil)
+
+	err = s.authorizer.RevokeToken(s.context, s.bob, t1.ID)
+	c.Assert(err, gc.ErrorMatches, `token ".*" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *tokenSuite) TestRevokeTokens(c *gc.C) {
+	token, _, err := s.authorizer.CreateToken(s.context, s.bob, "test", []string{"read-ssh-keys"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+	err = s.authorizer.RevokeTokens(s.context, s.bob.ProviderID)
+	c.Assert(err, gc.Equals, nil)
+
+	tokens, err := s.authorizer.Tokens(s.context, s.bob)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tokens, gc.HasLen, 0)
+
+	// The token is not valid even if the identity is removed and
+	// created again.
+	err = s.Store.RemoveIdentity(s.context, &store.Identity{ProviderID: s.bob.ProviderID})
+	c.Assert(err, gc.Equals, nil)
+	err = s.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: s.bob.ProviderID,
+		Username:   "bob",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.authorizer.AuthToken(s.context, token, auth.UserOp("bob", auth.ActionReadSSHKeys))
+	c.Assert(err, gc.ErrorMatches, `invalid token`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+}
+
+func (s *tokenSuite) TestRevokeTokenOtherUser(c *gc.C) {
+	_, t, err := s.authorizer.CreateToken(s.context, s.bob, "test", []string{"read-ssh-keys"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+	alice := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+	}
+	err = s.authorizer.RevokeToken(s.context, alice, t.ID)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *tokenSuite) TestTransferTokens(c *gc.C) {
+	alice := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+	}
+	err := s.Store.UpdateIdentity(s.context, alice, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	_, t1, err := s.authorizer.CreateToken(s.context, alice, "token1", []string{"read-ssh-keys"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+	_, t2, err := s.authorizer.CreateToken(s.context, s.bob, "token2", []string{"read-ssh-keys"}, time.Time{})
+	c.Assert(err, gc.Equals, nil)
+
+	err = s.authorizer.TransferTokens(s.context, s.bob.ProviderID, alice.ProviderID)
+	c.Assert(err, gc.Equals, nil)
+
+	tokens, err := s.authorizer.Tokens(s.context, alice)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tokens, gc.HasLen, 2)
+	c.Assert(tokens[0].ID, gc.Equals, t1.ID)
+	c.Assert(tokens[1].ID, gc.Equals, t2.ID)
+	c.Assert(tokens[1].Owner, gc.Equals, alice.ProviderID)
+	tokens, err = s.authorizer.Tokens(s.context, s.bob)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tokens, gc.HasLen, 0)
+
+	// The transferred token can be revoked by its new owner.
+	err = s.authorizer.RevokeToken(s.context, alice, t2.ID)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *tokenSuite) TestTokensNotSupported(c *gc.C) {
+	authorizer := auth.New(auth.Params{
+		Store: s.Store,
+	})
+	_, _, err := authorizer.CreateToken(s.context, s.bob, "test", []string{"read-ssh-keys"}, time.Time{})
+	c.Assert(errgo.Cause(err), gc.Equals, auth.ErrTokensNotSupported)
+	_, err = authorizer.AuthToken(s.context, "idm_1234_5678", identchecker.LoginOp)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+}
@@ -0,0 +1,481 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/idmclient.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon.v2"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/v1"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+const (
+	// accountPath is the path of the account pages. All the cookies
+	// used by the account pages are restricted to this path.
+	accountPath = "/account"
+
+	// accountLoginPrefix is the prefix of the discharge IDs used for
+	// logins to the account pages. When such a login completes the
+	// browser is returned to the account pages.
+	accountLoginPrefix = "account-"
+
+	// accountIdentityCookie is the name of the cookie that holds the
+	// identity macaroon of the user logged in to the account pages.
+	accountIdentityCookie = "macaroon-idm"
+
+	// accountLoginCookie is the name of the cookie that holds the
+	// discharge ID of the login to the account pages that the
+	// browser has started.
+	accountLoginCookie = "account-login"
+
+	// accountCSRFCookie is the name of the cookie that holds the token
+	// that must be included in every form posted to the account
+	// pages.
+	accountCSRFCookie = "account-csrf"
+)
+
+// loginReturnPaths holds the paths of the web pages that may use the
+// account login to log users in. The identity cookie set when such a
+// login completes is restricted to the path of the pages that started
+// it.
+var loginReturnPaths = map[string]bool{
+	accountPath: true,
+	"/admin":    true,
+}
+
+// accountPageParams holds the parameters passed to the "account"
+// template.
+type accountPageParams struct {
+	// Location holds the location of the identity server, the
+	// account page forms are posted to Location + "/account/...".
+	Location string
+
+	// CSRFToken holds the token that must be included, as the "csrf"
+	// field, in every form that is posted.
+	CSRFToken string
+
+	// Username, Name and Email hold the user's profile.
+	Username string
+	Name     string
+	Email    string
+
+	// LastLogin and LastDischarge hold the time of the user's last
+	// login and discharge. They are zero if the user has never
+	// logged in or had a macaroon discharged.
+	LastLogin     time.Time
+	LastDischarge time.Time
+
+	// Identities holds the identity provider identities with which
+	// the user can log in, the first is the one with which the user
+	// was created, any others have been linked to the user.
+	Identities []accountIdentity
+
+	// Groups holds the groups of which the user is a member.
+	Groups []string
+
+	// SSHKeys holds the user's SSH public keys.
+	SSHKeys []string
+
+	// Agents holds the agents owned by the user.
+	Agents []apiparams.Agent
+
+	// Discharges holds the most recent discharges made for the user,
+	// most recent first.
+	Discharges []dischargeRecord
+
+	// Error holds any error from a previous action.
+	Error string
+}
+
+// accountIdentity holds an identity provider identity of a user.
+type accountIdentity struct {
+	// Provider holds the name of the identity provider.
+	Provider string
+
+	// ID holds the provider specific ID of the user.
+	ID string
+}
+
+// accountRequest is a request for the account page.
+type accountRequest struct {
+	httprequest.Route `httprequest:"GET /account"`
+}
+
+// Account handles the GET /account endpoint that shows the account page
+// of the logged in user. If the user is not logged in they are
+// redirected to log in first.
+func (h *handler) Account(p httprequest.Params, req *accountRequest) error {
+	id, err := h.accountIdentity(p)
+	if err != nil || id == nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(h.writeAccountPage(p, id, ""), errgo.Any)
+}
+
+// accountAddSSHKeyRequest is a request to add an SSH key to the logged
+// in user.
+type accountAddSSHKeyRequest struct {
+	httprequest.Route `httprequest:"POST /account/ssh-keys"`
+	CSRFToken         string `httprequest:"csrf,form"`
+	Key               string `httprequest:"key,form"`
+}
+
+// AccountAddSSHKey handles the POST /account/ssh-keys endpoint that
+// adds an SSH key to the logged in user.
+func (h *handler) AccountAddSSHKey(p httprequest.Params, req *accountAddSSHKeyRequest) error {
+	if err := checkAccountCSRFToken(p.Request, req.CSRFToken); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+	id, err := h.accountIdentity(p)
+	if err != nil || id == nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	username := params.Username(id.Id())
+	if err := h.authorizeAccount(p, &params.PutSSHKeysRequest{Username: username}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	key := strings.TrimSpace(req.Key)
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+		return errgo.Mask(h.writeAccountPage(p, id, "Invalid SSH key."), errgo.Any)
+	}
+	if err := h.updateAccountSSHKeys(p, id, key, store.Push); err != nil {
+		return errgo.Mask(err)
+	}
+	http.Redirect(p.Response, p.Request, h.params.Location+accountPath, http.StatusSeeOther)
+	return nil
+}
+
+// accountRemoveSSHKeyRequest is a request to remove an SSH key from the
+// logged in user.
+type accountRemoveSSHKeyRequest struct {
+	httprequest.Route `httprequest:"POST /account/ssh-keys/remove"`
+	CSRFToken         string `httprequest:"csrf,form"`
+	Key               string `httprequest:"key,form"`
+}
+
+// AccountRemoveSSHKey handles the POST /account/ssh-keys/remove
+// endpoint that removes an SSH key from the logged in user.
+func (h *handler) AccountRemoveSSHKey(p httprequest.Params, req *accountRemoveSSHKeyRequest) error {
+	if err := checkAccountCSRFToken(p.Request, req.CSRFToken); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+	id, err := h.accountIdentity(p)
+	if err != nil || id == nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	username := params.Username(id.Id())
+	if err := h.authorizeAccount(p, &params.DeleteSSHKeysRequest{Username: username}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := h.updateAccountSSHKeys(p, id, req.Key, store.Pull); err != nil {
+		return errgo.Mask(err)
+	}
+	http.Redirect(p.Response, p.Request, h.params.Location+accountPath, http.StatusSeeOther)
+	return nil
+}
+
+// accountLoginRequest is a request to log in to the account pages.
+type accountLoginRequest struct {
+	httprequest.Route `httprequest:"GET /account/login"`
+	// Return holds the path of the pages to return to once the
+	// login completes. If this is empty the browser returns to the
+	// account pages.
+	Return string `httprequest:"return,form"`
+}
+
+// AccountLogin handles the GET /account/login endpoint. It starts a new
+// login and redirects the browser to the normal login page. Once the
+// login completes the browser is redirected to
+// /account/login/complete.
+func (h *handler) AccountLogin(p httprequest.Params, req *accountLoginRequest) error {
+	returnPath := req.Return
+	if returnPath == "" {
+		returnPath = accountPath
+	}
+	if !loginReturnPaths[returnPath] {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid return path %q", returnPath)
+	}
+	state, err := newChallengeState()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	dischargeID := accountLoginPrefix + state
+	if err := h.params.place.NewRendezvous(p.Context, dischargeID, &dischargeRequestInfo{
+		Origin:     p.Request.Header.Get("Origin"),
+		ReturnPath: returnPath,
+	}); err != nil {
+		return errgo.Notef(err, "cannot make rendezvous")
+	}
+	// The discharge ID is bound to this browser so that a completed
+	// login cannot be used to log a different browser in.
+	http.SetCookie(p.Response, h.accountCookie(accountLoginCookie, dischargeID))
+	http.Redirect(p.Response, p.Request, h.params.Location+"/login?did="+dischargeID, http.StatusFound)
+	return nil
+}
+
+// accountLoginCompleteRequest is a request to complete a login to the
+// account pages.
+type accountLoginCompleteRequest struct {
+	httprequest.Route `httprequest:"GET /account/login/complete"`
+	DischargeID       string `httprequest:"did,form"`
+}
+
+// AccountLoginComplete handles the GET /account/login/complete
+// endpoint. It sets the identity cookie for the user that has just
+// logged in and returns the browser to the pages that started the
+// login, normally the account page.
+func (h *handler) AccountLoginComplete(p httprequest.Params, req *accountLoginCompleteRequest) error {
+	c, err := p.Request.Cookie(accountLoginCookie)
+	if err != nil || !isAccountLogin(req.DischargeID) || subtle.ConstantTimeCompare([]byte(c.Value), []byte(req.DischargeID)) != 1 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "login not started by this browser")
+	}
+	info, login, err := h.params.place.Wait(p.Context, req.DischargeID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if login.Error != nil {
+		return errgo.WithCausef(nil, params.ErrUnauthorized, "login failed: %s", login.Error.Message)
+	}
+	if login.DischargeToken == nil {
+		return errgo.WithCausef(nil, params.ErrUnauthorized, "login failed: no discharge token")
+	}
+	mss, err := h.params.checker.macaroonsFromDischargeToken(p.Context, login.DischargeToken)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	authInfo, err := h.params.Authorizer.Auth(auth.ContextWithDischargeID(p.Context, req.DischargeID), mss, identchecker.LoginOp)
+	if err != nil {
+		return errgo.WithCausef(err, params.ErrUnauthorized, "login failed")
+	}
+	m, err := h.params.Oven.NewMacaroon(
+		p.Context,
+		bakery.LatestVersion,
+		[]checkers.Caveat{
+			idmclient.UserDeclaration(authInfo.Identity.Id()),
+			checkers.TimeBeforeCaveat(time.Now().Add(identityMacaroonDuration)),
+		},
+		identchecker.LoginOp,
+	)
+	if err != nil {
+		return errgo.Notef(err, "cannot mint macaroon")
+	}
+	cookie, err := httpbakery.NewCookie(nil, macaroon.Slice{m.M()})
+	if err != nil {
+		return errgo.Notef(err, "cannot make cookie")
+	}
+	returnPath := accountPath
+	if loginReturnPaths[info.ReturnPath] {
+		returnPath = info.ReturnPath
+	}
+	cookie.Name = accountIdentityCookie
+	cookie.Path = returnPath
+	cookie.HttpOnly = true
+	cookie.Secure = h.secureCookies()
+	http.SetCookie(p.Response, cookie)
+	loginCookie := h.accountCookie(accountLoginCookie, "")
+	loginCookie.MaxAge = -1
+	http.SetCookie(p.Response, loginCookie)
+	http.Redirect(p.Response, p.Request, h.params.Location+returnPath, http.StatusSeeOther)
+	return nil
+}
+
+// isAccountLogin reports whether the given discharge ID is for a login
+// to the account pages.
+func isAccountLogin(dischargeID string) bool {
+	return strings.HasPrefix(dischargeID, accountLoginPrefix)
+}
+
+// accountIdentity returns the identity of the user logged in to the
+// account pages. If the user is not logged in then the browser is
+// redirected to log in and a nil identity is returned.
+func (h *handler) accountIdentity(p httprequest.Params) (*auth.Identity, error) {
+	authInfo, err := h.params.reqAuth.Auth(p.Context, p.Request, identchecker.LoginOp)
+	if isDischargeRequiredError(err) {
+		http.Redirect(p.Response, p.Request, h.params.Location+accountPath+"/login", http.StatusFound)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	id, ok := authInfo.Identity.(*auth.Identity)
+	if !ok {
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "account pages not available to %s", authInfo.Identity.Id())
+	}
+	return id, nil
+}
+
+// authorizeAccount checks that the logged in user is authorized to
+// perform all of the given v1 API requests. Actions on the account
+// pages are authorized as the equivalent API requests so that the
+// pages never allow more than the API does.
+func (h *handler) authorizeAccount(p httprequest.Params, reqs ...interface{}) error {
+	ops := make([]bakery.Op, len(reqs))
+	for i, r := range reqs {
+		ops[i] = v1.OpForRequest(r)
+	}
+	_, err := h.params.reqAuth.Auth(p.Context, p.Request, ops...)
+	return errgo.Mask(err, errgo.Any)
+}
+
+// updateAccountSSHKeys updates the SSH keys of the given identity with
+// the given key using the given operation.
+func (h *handler) updateAccountSSHKeys(p httprequest.Params, id *auth.Identity, key string, op store.Operation) error {
+	sid, err := id.StoreIdentity(p.Context)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+		ID: sid.ID,
+		ExtraInfo: map[string][]string{
+			"sshkeys": {key},
+		},
+	}, store.Update{
+		store.ExtraInfo: op,
+	}))
+}
+
+// writeAccountPage writes the account page for the given identity.
+func (h *handler) writeAccountPage(p httprequest.Params, id *auth.Identity, errMsg string) error {
+	username := params.Username(id.Id())
+	err := h.authorizeAccount(p,
+		&params.UserRequest{Username: username},
+		&params.UserGroupsRequest{Username: username},
+		&params.SSHKeysRequest{Username: username},
+		&apiparams.AgentsRequest{Username: username},
+	)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	sid, err := id.StoreIdentity(p.Context)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	groups, err := id.Groups(p.Context)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	agents, err := h.accountAgents(p, sid)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	discharges, err := h.params.history.get(p.Context, sid.ProviderID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	csrfToken, err := h.accountCSRFToken(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	pp := accountPageParams{
+		Location:      h.params.Location,
+		CSRFToken:     csrfToken,
+		Username:      sid.Username,
+		Name:          sid.Name,
+		Email:         sid.Email,
+		LastLogin:     sid.LastLogin,
+		LastDischarge: sid.LastDischarge,
+		Groups:        groups,
+		SSHKeys:       sid.ExtraInfo["sshkeys"],
+		Agents:        agents,
+		Discharges:    discharges,
+		Error:         errMsg,
+	}
+	for _, pid := range append([]store.ProviderIdentity{sid.ProviderID}, sid.LinkedProviderIDs...) {
+		provider, id := pid.Split()
+		pp.Identities = append(pp.Identities, accountIdentity{
+			Provider: provider,
+			ID:       id,
+		})
+	}
+	t := h.params.Template.Lookup("account")
+	if t == nil {
+		return errgo.Newf("cannot find account template")
+	}
+	p.Response.Header().Set("Content-Type", "text/html;charset=utf-8")
+	return errgo.Mask(t.Execute(p.Response, pp))
+}
+
+// accountAgents returns the agents owned by the given identity.
+func (h *handler) accountAgents(p httprequest.Params, owner *store.Identity) ([]apiparams.Agent, error) {
+	identities, err := auth.FindAgents(p.Context, h.params.Store, owner.ProviderID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var agents []apiparams.Agent
+	for i := range identities {
+		id := &identities[i]
+		agent := apiparams.Agent{
+			Username: params.Username(id.Username),
+			FullName: id.Name,
+			Groups:   id.Groups,
+		}
+		if t := auth.AgentExpiry(id); !t.IsZero() {
+			agent.Expires = &t
+		}
+		if !id.LastLogin.IsZero() {
+			t := id.LastLogin
+			agent.LastLogin = &t
+		}
+		agents = append(agents, agent)
+	}
+	return agents, nil
+}
+
+// accountCSRFToken returns the CSRF token for the browser making the
+// request, creating a new one if the browser does not yet have one.
+func (h *handler) accountCSRFToken(p httprequest.Params) (string, error) {
+	if c, err := p.Request.Cookie(accountCSRFCookie); err == nil && c.Value != "" {
+		return c.Value, nil
+	}
+	token, err := newChallengeState()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	http.SetCookie(p.Response, h.accountCookie(accountCSRFCookie, token))
+	return token, nil
+}
+
+// checkAccountCSRFToken checks that the given token, posted in a form,
+// matches the CSRF token held in the browser's cookie. Another site can
+// cause the browser to post a form, but cannot read the cookie.
+func checkAccountCSRFToken(req *http.Request, token string) error {
+	c, err := req.Cookie(accountCSRFCookie)
+	if err != nil || c.Value == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(token)) != 1 {
+		return errgo.WithCausef(nil, params.ErrForbidden, "invalid CSRF token")
+	}
+	return nil
+}
+
+// accountCookie creates a cookie for use by the account pages.
+func (h *handler) accountCookie(name, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     accountPath,
+		HttpOnly: true,
+		Secure:   h.secureCookies(),
+	}
+}
+
+// secureCookies reports whether the account cookies should only be
+// sent over HTTPS.
+func (h *handler) secureCookies() bool {
+	return strings.HasPrefix(h.params.Location, "https:")
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/idp/test"
+	"github.com/CanonicalLtd/blues-identity/internal/idmtest"
+)
+
+type accountSuite struct {
+	idmtest.DischargeSuite
+}
+
+var _ = gc.Suite(&accountSuite{})
+
+var accountTemplate = template.Must(template.New("").Parse(`
+{{define "login"}}login successful as user {{.Username}}
+{{end}}
+{{define "account"}}{{.Username}}|{{range .Identities}}{{.Provider}}:{{.ID}},{{end}}|{{range .SSHKeys}}{{.}},{{end}}|{{range .Agents}}{{.Username}},{{end}}|{{len .Discharges}}|{{.Error}}|{{.CSRFToken}}{{end}}
+`))
+
+const accountSSHKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIARz96BBURYtxzj5SBz+jucqkmIXrDeFa/A3CfcPYOQy"
+
+func (s *accountSuite) SetUpTest(c *gc.C) {
+	s.Params.IdentityProviders = []idp.IdentityProvider{
+		test.NewIdentityProvider(test.Params{Name: "test"}),
+	}
+	s.Params.Template = accountTemplate
+	s.DischargeSuite.SetUpTest(c)
+}
+
+func (s *accountSuite) TestLogin(c *gc.C) {
+	_, page := s.login(c, interactor.User)
+	c.Assert(page.fields[:6], gc.DeepEquals, []string{
+		"test-interactive",
+		"test:test-interactive,",
+		"",
+		"",
+		"0",
+		"",
+	})
+	c.Assert(page.csrfToken, gc.Not(gc.Equals), "")
+}
+
+func (s *accountSuite) TestDischargeHistory(c *gc.C) {
+	_, err := s.Discharge(c, "is-authenticated-user", s.Client(interactor))
+	c.Assert(err, gc.Equals, nil)
+	_, page := s.login(c, interactor.User)
+	c.Assert(page.fields[4], gc.Equals, "1")
+}
+
+func (s *accountSuite) TestSSHKeys(c *gc.C) {
+	client, page := s.login(c, interactor.User)
+
+	page = s.post(c, client, "/account/ssh-keys", url.Values{
+		"csrf": {page.csrfToken},
+		"key":  {accountSSHKey},
+	})
+	c.Assert(page.fields[2], gc.Equals, accountSSHKey+",")
+
+	page = s.post(c, client, "/account/ssh-keys", url.Values{
+		"csrf": {page.csrfToken},
+		"key":  {"not a key"},
+	})
+	c.Assert(page.fields[2], gc.Equals, accountSSHKey+",")
+	c.Assert(page.fields[5], gc.Equals, "Invalid SSH key.")
+
+	page = s.post(c, client, "/account/ssh-keys/remove", url.Values{
+		"csrf": {page.csrfToken},
+		"key":  {accountSSHKey},
+	})
+	c.Assert(page.fields[2], gc.Equals, "")
+}
+
+func (s *accountSuite) TestSSHKeysInvalidCSRFToken(c *gc.C) {
+	client, _ := s.login(c, interactor.User)
+	for _, token := range []string{"", "1234"} {
+		resp, err := client.PostForm(s.URL+"/account/ssh-keys", url.Values{
+			"csrf": {token},
+			"key":  {accountSSHKey},
+		})
+		c.Assert(err, gc.Equals, nil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+	}
+}
+
+func (s *accountSuite) TestLoginCompleteOtherBrowser(c *gc.C) {
+	resp, err := noRedirectClient.Get(s.URL + "/account/login")
+	c.Assert(err, gc.Equals, nil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusFound)
+	u, err := url.Parse(resp.Header.Get("Location"))
+	c.Assert(err, gc.Equals, nil)
+	did := u.Query().Get("did")
+	c.Assert(strings.HasPrefix(did, "account-"), gc.Equals, true, gc.Commentf("did %q", did))
+
+	// A browser without the login cookie cannot complete the login.
+	resp, err = noRedirectClient.Get(s.URL + "/account/login/complete?did=" + did)
+	c.Assert(err, gc.Equals, nil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
+// accountPage holds the fields of an account page rendered with
+// accountTemplate.
+type accountPage struct {
+	fields    []string
+	csrfToken string
+}
+
+// login logs in to the account pages as the given user, using a new
+// browser, and returns the browser and the account page that is shown.
+func (s *accountSuite) login(c *gc.C, u *params.User) (*http.Client, accountPage) {
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, gc.Equals, nil)
+	client := &http.Client{Jar: jar}
+
+	// Visiting the account page starts a login with the test
+	// identity provider.
+	resp, err := client.Get(s.URL + "/account")
+	c.Assert(err, gc.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	var loginResp struct {
+		URL string `json:"url"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&loginResp)
+	c.Assert(err, gc.Equals, nil)
+
+	body, err := json.Marshal(u)
+	c.Assert(err, gc.Equals, nil)
+	resp, err = client.Post(loginResp.URL, "application/json", bytes.NewReader(body))
+	c.Assert(err, gc.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.Request.URL.Path, gc.Equals, "/account")
+	return client, s.readPage(c, resp)
+}
+
+// post posts the given form to the given account path and returns the
+// account page that is shown.
+func (s *accountSuite) post(c *gc.C, client *http.Client, path string, form url.Values) accountPage {
+	resp, err := client.PostForm(s.URL+path, form)
+	c.Assert(err, gc.Equals, nil)
+	defer resp.Body.Close()
+	return s.readPage(c, resp)
+}
+
+func (s *accountSuite) readPage(c *gc.C, resp *http.Response) accountPage {
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK, gc.Commentf("body %q", body))
+	fields := strings.Split(string(body), "|")
+	c.Assert(fields, gc.HasLen, 7, gc.Commentf("body %q", body))
+	return accountPage{
+		fields:    fields,
+		csrfToken: fields[6],
+	}
+}
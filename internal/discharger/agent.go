@@ -19,6 +19,7 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 
 	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
 	"github.com/CanonicalLtd/blues-identity/store"
 )
 
@@ -74,6 +75,9 @@ func (h *handler) agentLoginV1(ctx context.Context, dischargeID string, req *htt
 	if username == "" {
 		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "username not specified")
 	}
+	if err := h.params.Limiter.Allow(ctx, "agent-login", h.params.Limiter.ClientIP(req), username); err != nil {
+		return nil, errgo.Mask(err, ratelimit.IsLimitError)
+	}
 	pk := req.Form.Get("public-key")
 	if pk == "" {
 		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "public-key not specified")
@@ -82,6 +86,9 @@ func (h *handler) agentLoginV1(ctx context.Context, dischargeID string, req *htt
 	if err := key.Key.UnmarshalText([]byte(pk)); err != nil {
 		return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid public-key")
 	}
+	if err := h.checkAgentNotExpired(ctx, username); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
 	m, err := h.agentMacaroon(ctx, httpbakery.RequestVersion(req), identchecker.LoginOp, username, &key, dischargeID)
 	if err != nil {
 		return nil, errgo.Mask(err)
@@ -109,13 +116,19 @@ func (h *handler) AgentLoginPost(p httprequest.Params, alr *agentLoginPostReques
 
 // agentLogin handles the common parts of the agent login protocols.
 func (h *handler) agentLogin(ctx context.Context, req *http.Request, dischargeID string, user string, key *bakery.PublicKey) (*agent.LegacyAgentResponse, error) {
+	if err := h.params.Limiter.Allow(ctx, "agent-login", h.params.Limiter.ClientIP(req), user); err != nil {
+		return nil, errgo.Mask(err, ratelimit.IsLimitError)
+	}
+	if err := h.checkAgentNotExpired(ctx, user); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
 	loginOp := loginOp(user)
 	vers := httpbakery.RequestVersion(req)
 	ctx = httpbakery.ContextWithRequest(ctx, req)
 	ctx = auth.ContextWithDischargeID(ctx, dischargeID)
 	_, err := h.params.Authorizer.Auth(ctx, httpbakery.RequestMacaroons(req), loginOp)
 	if err == nil {
-		dt, err := h.params.dischargeTokenCreator.DischargeToken(ctx, dischargeID, &store.Identity{
+		dt, err := h.params.dischargeTokenCreator.dischargeToken(ctx, dischargeID, &store.Identity{
 			Username: user,
 		})
 		if err != nil {
@@ -146,6 +159,25 @@ func (h *handler) agentLogin(ctx context.Context, req *http.Request, dischargeID
 	})
 }
 
+// checkAgentNotExpired checks that the given agent has not passed its
+// expiry time. Unknown users are not rejected here, they will fail
+// when the public key is checked.
+func (h *handler) checkAgentNotExpired(ctx context.Context, user string) error {
+	identity := store.Identity{
+		Username: user,
+	}
+	if err := h.params.Store.Identity(ctx, &identity); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return nil
+		}
+		return errgo.Mask(err)
+	}
+	if auth.IsExpired(&identity, time.Now()) {
+		return errgo.WithCausef(nil, params.ErrForbidden, "agent %q has expired", user)
+	}
+	return nil
+}
+
 // agentMacaroon creates a new macaroon containing a local third-party
 // caveat addressed to the specified agent.
 func (h *handler) agentMacaroon(ctx context.Context, vers bakery.Version, op bakery.Op, user string, key *bakery.PublicKey, dischargeID string) (*bakery.Macaroon, error) {
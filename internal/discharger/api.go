@@ -7,6 +7,7 @@ package discharger
 
 import (
 	"github.com/juju/loggo"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 	"golang.org/x/net/trace"
 	"gopkg.in/errgo.v1"
@@ -14,9 +15,11 @@ import (
 	"gopkg.in/juju/idmclient.v1/params"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
 	"github.com/CanonicalLtd/blues-identity/internal/auth/httpauth"
 	"github.com/CanonicalLtd/blues-identity/internal/identity"
 	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
 )
 
 var logger = loggo.GetLogger("identity.internal.discharger")
@@ -25,21 +28,42 @@ var logger = loggo.GetLogger("identity.internal.discharger")
 func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error) {
 	reqAuth := httpauth.New(params.Oven, params.Authorizer)
 	place := &place{params.MeetingPlace}
+	totp, err := newTOTPChecker(params.Context, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	webauthn, err := newWebAuthnChecker(params.Context, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
 	dt := &dischargeTokenCreator{
-		params: params,
+		params:   params,
+		totp:     totp,
+		webauthn: webauthn,
 	}
 	vc := &visitCompleter{
 		params:                params,
 		dischargeTokenCreator: dt,
-		place: place,
+		place:                 place,
+		totp:                  totp,
+		webauthn:              webauthn,
+	}
+	if err := initIDPs(params.Context, params, dt, vc); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	deviceCodes, err := newDeviceCodes(params.Context, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
 	}
-	if err := initIDPs(context.Background(), params, dt, vc); err != nil {
+	history, err := newDischargeHistory(params.Context, params)
+	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	checker := &thirdPartyCaveatChecker{
 		params:  params,
 		place:   place,
 		reqAuth: reqAuth,
+		history: history,
 	}
 	handlers := identity.ReqServer.Handlers(handlerCreator(handlerParams{
 		HandlerParams:         params,
@@ -48,6 +72,8 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 		visitCompleter:        vc,
 		place:                 place,
 		reqAuth:               reqAuth,
+		deviceCodes:           deviceCodes,
+		history:               history,
 	}))
 	d := httpbakery.NewDischarger(httpbakery.DischargerParams{
 		CheckerP:        checker,
@@ -75,6 +101,8 @@ type handlerParams struct {
 	visitCompleter        *visitCompleter
 	place                 *place
 	reqAuth               *httpauth.Authorizer
+	deviceCodes           *deviceCodes
+	history               *dischargeHistory
 }
 
 // handlerCreator returns a function that creates new instances of the discharger API handler for a request.
@@ -82,11 +110,16 @@ func handlerCreator(hParams handlerParams) func(p httprequest.Params, arg interf
 	return func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
 		t := trace.New(p.Request.URL.Path, p.PathPattern)
 		ctx := trace.NewContext(p.Context, t)
+		ctx, span := tracing.StartHTTPSpan(ctx, p.Request, p.PathPattern)
+		// Record the discharge ID, if there is one, so that all the
+		// requests involved in a login can be found in the logs.
+		auth.LogFieldsFromContext(ctx).Set(auth.LogFieldDischargeID, p.Request.Form.Get("did"))
 		ctx, close1 := hParams.Store.Context(ctx)
 		ctx, close2 := hParams.MeetingStore.Context(ctx)
 		hnd := &handler{
 			params: hParams,
 			trace:  t,
+			span:   span,
 			monReq: monitoring.NewRequest(&p),
 			close: func() {
 				close2()
@@ -114,6 +147,7 @@ type handler struct {
 
 	monReq monitoring.Request
 	trace  trace.Trace
+	span   oteltrace.Span
 	close  func()
 }
 
@@ -122,6 +156,7 @@ type handler struct {
 func (h *handler) Close() error {
 	h.close()
 	h.trace.Finish()
+	h.span.End()
 	h.monReq.ObserveMetric()
 	return nil
 }
@@ -13,6 +13,7 @@ import (
 // by the API handler method which takes the given argument r.
 func opForRequest(_ interface{}) bakery.Op {
 	// All of the endpoints are part of the login action and can be
-	// accessed by anyone.
+	// accessed by anyone. The account pages authorize the logged in
+	// user themselves.
 	return auth.GlobalOp(auth.ActionLogin)
 }
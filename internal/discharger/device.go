@@ -0,0 +1,286 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+	"github.com/CanonicalLtd/blues-identity/internal/identity"
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
+	"github.com/CanonicalLtd/blues-identity/meeting"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+const (
+	// deviceCodeDuration is the length of time for which a user code
+	// remains valid.
+	deviceCodeDuration = 10 * time.Minute
+
+	// deviceDataStore is the name of the ProviderDataStore key value
+	// store that holds pending user codes.
+	deviceDataStore = "device"
+
+	// userCodeAlphabet holds the characters used in user codes. As
+	// recommended by RFC 8628 these are upper case consonants, which
+	// are easy to type and can't spell words.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+	// userCodeLength is the number of characters in a user code.
+	userCodeLength = 8
+
+	// deviceCodeInterval is the polling interval that clients are
+	// asked to use while waiting for the user to log in.
+	deviceCodeInterval = 5 * time.Second
+)
+
+// deviceLogin holds the state of a pending device login, it is stored
+// using the user code as the key.
+type deviceLogin struct {
+	DischargeID string `json:"discharge-id"`
+	Domain      string `json:"domain,omitempty"`
+}
+
+// devicePageParams holds the parameters passed to the "device"
+// template.
+type devicePageParams struct {
+	// Action holds the URL to which the form must be posted.
+	Action string
+
+	// Code holds the user code, if it is already known.
+	Code string
+
+	// Error holds any error from a previous attempt.
+	Error string
+}
+
+// deviceCodes manages the user codes issued for device logins.
+type deviceCodes struct {
+	params identity.HandlerParams
+	kv     store.KeyValueStore
+}
+
+// newDeviceCodes creates a new deviceCodes.
+func newDeviceCodes(ctx context.Context, params identity.HandlerParams) (*deviceCodes, error) {
+	kv, err := params.ProviderDataStore.KeyValueStore(ctx, deviceDataStore)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &deviceCodes{
+		params: params,
+		kv:     kv,
+	}, nil
+}
+
+// newCode creates a new user code for the given login.
+func (d *deviceCodes) newCode(ctx context.Context, l *deviceLogin) (string, error) {
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	ctx, close := d.kv.Context(ctx)
+	defer close()
+	// The code space is large enough that collisions are rare, but
+	// try a few times in case of one.
+	for i := 0; i < 5; i++ {
+		code, err := newUserCode()
+		if err != nil {
+			return "", errgo.Mask(err)
+		}
+		err = d.kv.Add(ctx, code, buf, time.Now().Add(deviceCodeDuration))
+		if err == nil {
+			return code, nil
+		}
+		if errgo.Cause(err) != store.ErrDuplicateKey {
+			return "", errgo.Mask(err)
+		}
+	}
+	return "", errgo.Newf("cannot allocate user code")
+}
+
+// use retrieves the login for the given user code and ensures the code
+// cannot be used again. The code is claimed by adding a key that marks
+// it as used, so that concurrent requests cannot both use it.
+func (d *deviceCodes) use(ctx context.Context, code string) (*deviceLogin, error) {
+	code = normalizeUserCode(code)
+	if len(code) != userCodeLength {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "invalid user code")
+	}
+	ctx, close := d.kv.Context(ctx)
+	defer close()
+	buf, err := d.kv.Get(ctx, code)
+	if errgo.Cause(err) == store.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "invalid user code")
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var l deviceLogin
+	if err := json.Unmarshal(buf, &l); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = d.kv.Add(ctx, usedCodeKey(code), []byte{1}, time.Now().Add(deviceCodeDuration))
+	if errgo.Cause(err) == store.ErrDuplicateKey {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "invalid user code")
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &l, nil
+}
+
+// usedCodeKey returns the key that marks the given user code as used.
+// User codes only contain upper case letters so this cannot clash with
+// a code.
+func usedCodeKey(code string) string {
+	return "used:" + code
+}
+
+// writePage writes the device page to w.
+func (d *deviceCodes) writePage(w http.ResponseWriter, code, errMsg string) error {
+	t := d.params.Template.Lookup("device")
+	if t == nil {
+		return errgo.Newf("cannot find device template")
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	return errgo.Mask(t.Execute(w, devicePageParams{
+		Action: d.params.Location + "/device",
+		Code:   code,
+		Error:  errMsg,
+	}))
+}
+
+// newUserCode generates a new random user code.
+func newUserCode() (string, error) {
+	code := make([]byte, 0, userCodeLength)
+	var buf [16]byte
+	for len(code) < userCodeLength {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return "", errgo.Mask(err)
+		}
+		for _, b := range buf {
+			// Discard values that would bias the result.
+			if int(b) >= 256-256%len(userCodeAlphabet) {
+				continue
+			}
+			code = append(code, userCodeAlphabet[int(b)%len(userCodeAlphabet)])
+			if len(code) == userCodeLength {
+				break
+			}
+		}
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode converts a user code as entered by a user to the
+// form in which it is stored.
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z':
+			return r
+		}
+		return -1
+	}, code)
+}
+
+// formatUserCode formats a user code for display.
+func formatUserCode(code string) string {
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// deviceCodeRequest is a request for a user code with which a login can
+// be completed from a different device.
+type deviceCodeRequest struct {
+	httprequest.Route `httprequest:"POST /device-code"`
+	DischargeID       string `httprequest:"did,form"`
+	Domain            string `httprequest:"domain,form"`
+}
+
+// DeviceCode handles the POST /device-code endpoint that creates a new
+// user code for a pending login.
+func (h *handler) DeviceCode(p httprequest.Params, req *deviceCodeRequest) (*apiparams.DeviceCodeResponse, error) {
+	if req.DischargeID == "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "discharge id parameter not found")
+	}
+	status, _, err := h.params.place.Status(p.Context, req.DischargeID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if status != meeting.StatusPending {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "login not found, probably expired")
+	}
+	code, err := h.params.deviceCodes.newCode(p.Context, &deviceLogin{
+		DischargeID: req.DischargeID,
+		Domain:      req.Domain,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	verificationURI := h.params.Location + "/device"
+	return &apiparams.DeviceCodeResponse{
+		UserCode:                formatUserCode(code),
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?code=" + formatUserCode(code),
+		ExpiresIn:               int(deviceCodeDuration / time.Second),
+		Interval:                int(deviceCodeInterval / time.Second),
+	}, nil
+}
+
+// devicePageRequest is a request for the page on which a user enters a
+// user code.
+type devicePageRequest struct {
+	httprequest.Route `httprequest:"GET /device"`
+	Code              string `httprequest:"code,form"`
+}
+
+// DevicePage handles the GET /device endpoint that shows the form on
+// which a user enters a user code.
+func (h *handler) DevicePage(p httprequest.Params, req *devicePageRequest) error {
+	return errgo.Mask(h.params.deviceCodes.writePage(p.Response, req.Code, ""))
+}
+
+// deviceLoginRequest is a request to log in to complete the device
+// login with the given user code.
+type deviceLoginRequest struct {
+	httprequest.Route `httprequest:"POST /device"`
+	Code              string `httprequest:"code,form"`
+}
+
+// DeviceLogin handles the POST /device endpoint. If the user code is
+// valid the user is redirected to log in, which completes the login
+// for the device that requested the code. Requests are rate limited by
+// client IP address to prevent user codes being guessed.
+func (h *handler) DeviceLogin(p httprequest.Params, req *deviceLoginRequest) error {
+	if err := h.params.Limiter.Allow(p.Context, "device", h.params.Limiter.ClientIP(p.Request), ""); err != nil {
+		return errgo.Mask(err, ratelimit.IsLimitError)
+	}
+	l, err := h.params.deviceCodes.use(p.Context, req.Code)
+	if errgo.Cause(err) == params.ErrNotFound {
+		return errgo.Mask(h.params.deviceCodes.writePage(p.Response, req.Code, "Invalid or expired code."))
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	v := url.Values{
+		"did": {l.DischargeID},
+	}
+	if l.Domain != "" {
+		v.Set("domain", l.Domain)
+	}
+	http.Redirect(p.Response, p.Request, h.params.Location+"/login?"+v.Encode(), http.StatusFound)
+	return nil
+}
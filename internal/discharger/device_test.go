@@ -0,0 +1,218 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger_test
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+	"github.com/CanonicalLtd/blues-identity/devicelogin"
+	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/idp/test"
+	"github.com/CanonicalLtd/blues-identity/internal/idmtest"
+)
+
+type deviceSuite struct {
+	idmtest.DischargeSuite
+}
+
+var _ = gc.Suite(&deviceSuite{})
+
+var deviceTemplate = template.Must(template.New("").Parse(`
+{{define "login"}}login successful as user {{.Username}}
+{{end}}
+{{define "device"}}{{.Action}}|{{.Code}}|{{.Error}}{{end}}
+`))
+
+// noRedirectClient is an HTTP client that does not follow redirects.
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (s *deviceSuite) SetUpTest(c *gc.C) {
+	s.Params.IdentityProviders = []idp.IdentityProvider{
+		test.NewIdentityProvider(test.Params{Name: "test", Domain: "test-domain"}),
+	}
+	s.Params.Template = deviceTemplate
+	s.DischargeSuite.SetUpTest(c)
+}
+
+func (s *deviceSuite) TestDeviceLogin(c *gc.C) {
+	client := s.Client(devicelogin.Interactor{
+		Prompt: func(resp *apiparams.DeviceCodeResponse) error {
+			c.Check(resp.VerificationURI, gc.Equals, s.URL+"/device")
+			c.Check(resp.UserCode, gc.Matches, `[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}`)
+			c.Check(resp.ExpiresIn, gc.Equals, 600)
+			c.Check(resp.Interval, gc.Equals, 5)
+
+			// Check the page shows the code.
+			httpResp, err := http.Get(resp.VerificationURIComplete)
+			c.Assert(err, gc.Equals, nil)
+			defer httpResp.Body.Close()
+			body, err := ioutil.ReadAll(httpResp.Body)
+			c.Assert(err, gc.Equals, nil)
+			c.Check(string(body), gc.Equals, s.URL+"/device|"+resp.UserCode+"|")
+
+			// Enter the code as a user might.
+			code := strings.ToLower(strings.Replace(resp.UserCode, "-", " ", 1))
+			loginURL := s.enterCode(c, code)
+			return interactor.OpenWebBrowser(loginURL)
+		},
+	})
+	ms, err := s.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, gc.Equals, nil)
+	s.AssertMacaroon(c, ms, identchecker.LoginOp, "test-interactive")
+}
+
+func (s *deviceSuite) TestDeviceLoginCancelled(c *gc.C) {
+	client := s.Client(devicelogin.Interactor{
+		Prompt: func(resp *apiparams.DeviceCodeResponse) error {
+			loginURL := s.enterCode(c, resp.UserCode)
+			httpResp, err := http.PostForm(s.URL+"/login-cancel", url.Values{
+				"did": {loginURL.Query().Get("did")},
+			})
+			c.Assert(err, gc.Equals, nil)
+			httpResp.Body.Close()
+			c.Check(httpResp.StatusCode, gc.Equals, http.StatusOK)
+			return nil
+		},
+	})
+	_, err := s.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, gc.ErrorMatches, `.*login failed: login cancelled`)
+}
+
+func (s *deviceSuite) TestCodeCanOnlyBeUsedOnce(c *gc.C) {
+	client := s.Client(devicelogin.Interactor{
+		Prompt: func(resp *apiparams.DeviceCodeResponse) error {
+			loginURL := s.enterCode(c, resp.UserCode)
+			c.Check(s.enterInvalidCode(c, resp.UserCode), gc.Equals, s.URL+"/device|"+resp.UserCode+"|Invalid or expired code.")
+			return interactor.OpenWebBrowser(loginURL)
+		},
+	})
+	ms, err := s.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, gc.Equals, nil)
+	s.AssertMacaroon(c, ms, identchecker.LoginOp, "test-interactive")
+}
+
+func (s *deviceSuite) TestConcurrentCodeUse(c *gc.C) {
+	client := s.Client(devicelogin.Interactor{
+		Prompt: func(resp *apiparams.DeviceCodeResponse) error {
+			const n = 10
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var loginURLs []string
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					httpResp, err := noRedirectClient.PostForm(s.URL+"/device", url.Values{
+						"code": {resp.UserCode},
+					})
+					if !c.Check(err, gc.Equals, nil) {
+						return
+					}
+					httpResp.Body.Close()
+					if httpResp.StatusCode == http.StatusFound {
+						mu.Lock()
+						defer mu.Unlock()
+						loginURLs = append(loginURLs, httpResp.Header.Get("Location"))
+					}
+				}()
+			}
+			wg.Wait()
+			c.Assert(loginURLs, gc.HasLen, 1)
+			loginURL, err := url.Parse(loginURLs[0])
+			c.Assert(err, gc.Equals, nil)
+			return interactor.OpenWebBrowser(loginURL)
+		},
+	})
+	ms, err := s.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, gc.Equals, nil)
+	s.AssertMacaroon(c, ms, identchecker.LoginOp, "test-interactive")
+}
+
+func (s *deviceSuite) TestInvalidCode(c *gc.C) {
+	c.Assert(s.enterInvalidCode(c, "BCDF-GHJK"), gc.Equals, s.URL+"/device|BCDF-GHJK|Invalid or expired code.")
+	c.Assert(s.enterInvalidCode(c, "short"), gc.Equals, s.URL+"/device|short|Invalid or expired code.")
+}
+
+func (s *deviceSuite) TestDeviceCodeUnknownLogin(c *gc.C) {
+	resp, err := http.PostForm(s.URL+"/device-code", url.Values{
+		"did": {"1234"},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+type deviceRateLimitSuite struct {
+	idmtest.DischargeSuite
+}
+
+var _ = gc.Suite(&deviceRateLimitSuite{})
+
+func (s *deviceRateLimitSuite) SetUpTest(c *gc.C) {
+	s.Params.IdentityProviders = []idp.IdentityProvider{
+		test.NewIdentityProvider(test.Params{Name: "test"}),
+	}
+	s.Params.Template = deviceTemplate
+	s.Params.IPRateLimit = 0.001
+	s.Params.IPRateBurst = 2
+	s.DischargeSuite.SetUpTest(c)
+}
+
+func (s *deviceRateLimitSuite) TestDeviceLoginRateLimited(c *gc.C) {
+	for i := 0; i < 3; i++ {
+		resp, err := noRedirectClient.PostForm(s.URL+"/device", url.Values{
+			"code": {"BCDF-GHJK"},
+		})
+		c.Assert(err, gc.Equals, nil)
+		resp.Body.Close()
+		if i < 2 {
+			c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+			continue
+		}
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	}
+}
+
+// enterCode submits the given user code to the device page and returns
+// the URL to which the browser is redirected to log in.
+func (s *deviceSuite) enterCode(c *gc.C, code string) *url.URL {
+	resp, err := noRedirectClient.PostForm(s.URL+"/device", url.Values{
+		"code": {code},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusFound)
+	u, err := url.Parse(resp.Header.Get("Location"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(u.Path, gc.Equals, "/login")
+	c.Assert(u.Query().Get("did"), gc.Not(gc.Equals), "")
+	return u
+}
+
+// enterInvalidCode submits the given user code to the device page and
+// returns the page that is shown.
+func (s *deviceSuite) enterInvalidCode(c *gc.C, code string) string {
+	resp, err := noRedirectClient.PostForm(s.URL+"/device", url.Values{
+		"code": {code},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.Equals, nil)
+	return string(body)
+}
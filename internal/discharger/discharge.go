@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/context"
 	"golang.org/x/net/trace"
 	"gopkg.in/errgo.v1"
@@ -20,13 +21,18 @@ import (
 	"gopkg.in/juju/names.v2"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 	"gopkg.in/macaroon.v2"
 
+	"github.com/CanonicalLtd/blues-identity/apiparams"
 	"github.com/CanonicalLtd/blues-identity/internal/auth"
 	"github.com/CanonicalLtd/blues-identity/internal/auth/httpauth"
 	"github.com/CanonicalLtd/blues-identity/internal/identity"
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
 	"github.com/CanonicalLtd/blues-identity/store"
 )
 
@@ -37,6 +43,7 @@ type thirdPartyCaveatChecker struct {
 	reqAuth *httpauth.Authorizer
 	checker *bakery.Checker
 	place   *place
+	history *dischargeHistory
 }
 
 // CheckThirdPartyCaveat implements httpbakery.ThirdPartyCaveatChecker.
@@ -45,7 +52,57 @@ type thirdPartyCaveatChecker struct {
 func (c *thirdPartyCaveatChecker) CheckThirdPartyCaveat(ctx context.Context, p httpbakery.ThirdPartyCaveatCheckerParams) ([]checkers.Caveat, error) {
 	t := trace.New(p.Request.URL.Path, "")
 	defer t.Finish()
-	return c.checkThirdPartyCaveat(trace.NewContext(ctx, t), p)
+	condition := caveatCondition(p.Caveat)
+	ctx, span := tracing.StartSpan(trace.NewContext(ctx, t), "discharge", attribute.String("caveat.condition", condition))
+	startTime := time.Now()
+	var caveats []checkers.Caveat
+	err := c.params.Limiter.Allow(ctx, "discharge", c.params.Limiter.ClientIP(p.Request), "")
+	if err == nil {
+		caveats, err = c.checkThirdPartyCaveat(ctx, p)
+	}
+	monitoring.ObserveDischarge(condition, dischargeOutcome(err), startTime)
+	tracing.EndSpan(span, err)
+	return caveats, err
+}
+
+// caveatCondition returns the condition of the given caveat for use as
+// a metric label. Unrecognised conditions are grouped together so that
+// the number of label values is bounded.
+func caveatCondition(ci *bakery.ThirdPartyCaveatInfo) string {
+	cond, _, err := checkers.ParseCaveat(string(ci.Condition))
+	if err != nil {
+		return "invalid"
+	}
+	switch cond {
+	case "is-authenticated-user", "is-member-of":
+		return cond
+	}
+	return "other"
+}
+
+// dischargeOutcome classifies the given error returned from
+// checkThirdPartyCaveat for use as a metric label.
+func dischargeOutcome(err error) string {
+	if err == nil {
+		return monitoring.OutcomeSuccess
+	}
+	if ratelimit.IsLimitError(errgo.Cause(err)) {
+		return monitoring.OutcomeThrottled
+	}
+	switch cause := errgo.Cause(err); cause {
+	case params.ErrUnauthorized, params.ErrForbidden, bakery.ErrPermissionDenied:
+		return monitoring.OutcomeDenied
+	case params.ErrBadRequest, checkers.ErrCaveatNotRecognized:
+		return monitoring.OutcomeBadRequest
+	default:
+		if herr, ok := cause.(*httpbakery.Error); ok {
+			switch herr.Code {
+			case httpbakery.ErrInteractionRequired, httpbakery.ErrDischargeRequired:
+				return monitoring.OutcomeInteractionRequired
+			}
+		}
+	}
+	return monitoring.OutcomeError
 }
 
 // checkThirdPartyCaveat checks the given caveat. This function is called
@@ -69,7 +126,7 @@ func (c *thirdPartyCaveatChecker) checkThirdPartyCaveat(ctx context.Context, p h
 	}
 
 	domain := ""
-	if c, err := p.Request.Cookie("domain"); err == nil && names.IsValidUserDomain(c.Value) {
+	if c, err := p.Request.Cookie(domainCookie); err == nil && names.IsValidUserDomain(c.Value) {
 		domain = c.Value
 	}
 	cond, args, err := checkers.ParseCaveat(string(p.Caveat.Condition))
@@ -124,8 +181,9 @@ func (c *thirdPartyCaveatChecker) checkThirdPartyCaveat(ctx context.Context, p h
 		// TODO return appropriate error code when permission denied.
 		return nil, errgo.Mask(err)
 	}
-	logger.Debugf("authorization for %#v succeeded", authInfo.Identity)
+	auth.Logger(ctx, logger).Debugf("authorization for %#v succeeded", authInfo.Identity)
 	c.updateDischargeTime(ctx, authInfo.Identity.Id())
+	c.recordDischarge(ctx, authInfo.Identity, interactionRequiredParams.info)
 	if cond == "is-member-of" {
 		return nil, nil
 	}
@@ -165,7 +223,29 @@ func (c *thirdPartyCaveatChecker) updateDischargeTime(ctx context.Context, usern
 		},
 	)
 	if err != nil {
-		logger.Infof("unexpected error updating last discharge time: %s", err)
+		auth.Logger(ctx, logger).Infof("unexpected error updating last discharge time: %s", err)
+	}
+}
+
+// recordDischarge adds the discharge described by info to the discharge
+// history of the given identity.
+func (c *thirdPartyCaveatChecker) recordDischarge(ctx context.Context, ident identchecker.Identity, info *dischargeRequestInfo) {
+	id, ok := ident.(*auth.Identity)
+	if !ok || c.history == nil {
+		return
+	}
+	sid, err := id.StoreIdentity(ctx)
+	if err != nil {
+		auth.Logger(ctx, logger).Infof("cannot record discharge for %s: %s", id.Id(), err)
+		return
+	}
+	err = c.history.add(ctx, sid.ProviderID, dischargeRecord{
+		Time:      time.Now(),
+		Condition: info.Condition,
+		Origin:    info.Origin,
+	})
+	if err != nil {
+		auth.Logger(ctx, logger).Infof("cannot record discharge for %s: %s", id.Id(), err)
 	}
 }
 
@@ -201,6 +281,11 @@ func (c *thirdPartyCaveatChecker) interactionRequiredError(ctx context.Context,
 	visitURL := c.params.Location + "/login" + visitParams
 	waitTokenURL := c.params.Location + "/wait-token?did=" + p.dischargeID
 	httpbakery.SetWebBrowserInteraction(ierr, visitURL, waitTokenURL)
+	ierr.SetInteraction(apiparams.DeviceInteractionMethod, apiparams.DeviceInteractionInfo{
+		DeviceCodeURL:  c.params.Location + "/device-code" + visitParams,
+		LoginStatusURL: c.params.Location + "/login-status?did=" + p.dischargeID,
+		WaitTokenURL:   waitTokenURL,
+	})
 
 	// Set the URLs used by old clients for backward compatibility.
 	legacyVisitURL := c.params.Location + "/login-legacy" + visitParams
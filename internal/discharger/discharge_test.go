@@ -27,6 +27,7 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	"gopkg.in/macaroon.v2"
 
+	"github.com/CanonicalLtd/blues-identity/apiparams"
 	"github.com/CanonicalLtd/blues-identity/idp"
 	"github.com/CanonicalLtd/blues-identity/idp/test"
 	"github.com/CanonicalLtd/blues-identity/internal/idmtest"
@@ -126,6 +127,105 @@ func (s *dischargeSuite) TestVisitURLWithEscapedDomainCookie(c *gc.C) {
 	c.Assert(openWebBrowser.url.Query().Get("domain"), gc.Equals, "test+2")
 }
 
+func (s *dischargeSuite) TestLoginStatus(c *gc.C) {
+	var did string
+	var statuses []apiparams.LoginStatusResponse
+	client := s.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: func(u *url.URL) error {
+			did = u.Query().Get("did")
+			statuses = append(statuses, s.loginStatus(c, did))
+			if err := interactor.OpenWebBrowser(u); err != nil {
+				return err
+			}
+			statuses = append(statuses, s.loginStatus(c, did))
+			return nil
+		},
+	})
+	ms, err := s.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, gc.Equals, nil)
+	s.AssertMacaroon(c, ms, identchecker.LoginOp, "test-interactive")
+	c.Assert(statuses, gc.DeepEquals, []apiparams.LoginStatusResponse{{
+		Status: apiparams.LoginPending,
+	}, {
+		Status: apiparams.LoginCompleted,
+	}})
+	// Once the discharge token has been collected the login is
+	// no longer available.
+	c.Assert(s.loginStatus(c, did), gc.DeepEquals, apiparams.LoginStatusResponse{
+		Status: apiparams.LoginExpired,
+	})
+}
+
+func (s *dischargeSuite) TestLoginStatusNoDischargeID(c *gc.C) {
+	resp, err := http.Get(s.URL + "/login-status")
+	c.Assert(err, gc.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *dischargeSuite) TestCancelLogin(c *gc.C) {
+	var did string
+	var status apiparams.LoginStatusResponse
+	client := s.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: func(u *url.URL) error {
+			did = u.Query().Get("did")
+			resp := s.cancelLogin(c, did)
+			resp.Body.Close()
+			c.Check(resp.StatusCode, gc.Equals, http.StatusOK)
+			status = s.loginStatus(c, did)
+			return nil
+		},
+	})
+	_, err := s.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, gc.ErrorMatches, `.*login cancelled`)
+	c.Assert(status, gc.DeepEquals, apiparams.LoginStatusResponse{
+		Status: apiparams.LoginFailed,
+		Error:  "login cancelled",
+	})
+
+	resp := s.cancelLogin(c, did)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func (s *dischargeSuite) TestCancelCompletedLogin(c *gc.C) {
+	var statusCode int
+	client := s.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: func(u *url.URL) error {
+			if err := interactor.OpenWebBrowser(u); err != nil {
+				return err
+			}
+			resp := s.cancelLogin(c, u.Query().Get("did"))
+			resp.Body.Close()
+			statusCode = resp.StatusCode
+			return nil
+		},
+	})
+	ms, err := s.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, gc.Equals, nil)
+	s.AssertMacaroon(c, ms, identchecker.LoginOp, "test-interactive")
+	c.Assert(statusCode, gc.Equals, http.StatusConflict)
+}
+
+func (s *dischargeSuite) loginStatus(c *gc.C, did string) apiparams.LoginStatusResponse {
+	resp, err := http.Get(s.URL + "/login-status?did=" + url.QueryEscape(did))
+	c.Assert(err, gc.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	var status apiparams.LoginStatusResponse
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	c.Assert(err, gc.Equals, nil)
+	return status
+}
+
+func (s *dischargeSuite) cancelLogin(c *gc.C, did string) *http.Response {
+	resp, err := http.PostForm(s.URL+"/login-cancel", url.Values{
+		"did": {did},
+	})
+	c.Assert(err, gc.Equals, nil)
+	return resp
+}
+
 // cookiesToMacaroons returns a slice of any macaroons found
 // in the given slice of cookies.
 func cookiesToMacaroons(cookies []*http.Cookie) []macaroon.Slice {
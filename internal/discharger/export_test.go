@@ -4,6 +4,10 @@
 package discharger
 
 import (
+	"net/http"
+
+	"golang.org/x/net/context"
+
 	"github.com/CanonicalLtd/blues-identity/idp"
 	"github.com/CanonicalLtd/blues-identity/internal/identity"
 )
@@ -13,9 +17,42 @@ var NewIDPHandler = newIDPHandler
 type LoginInfo loginInfo
 
 func NewVisitCompleter(params identity.HandlerParams) idp.VisitCompleter {
+	totp, err := newTOTPChecker(context.Background(), params)
+	if err != nil {
+		panic(err)
+	}
+	webauthn, err := newWebAuthnChecker(context.Background(), params)
+	if err != nil {
+		panic(err)
+	}
 	return &visitCompleter{
-		params:                params,
-		dischargeTokenCreator: &dischargeTokenCreator{params: params},
-		place: &place{params.MeetingPlace},
+		params: params,
+		dischargeTokenCreator: &dischargeTokenCreator{
+			params:   params,
+			totp:     totp,
+			webauthn: webauthn,
+		},
+		place:    &place{params.MeetingPlace},
+		totp:     totp,
+		webauthn: webauthn,
 	}
 }
+
+// CompleteTOTP completes a TOTP challenge using the given visit
+// completer, which must have been created with NewVisitCompleter.
+func CompleteTOTP(vc idp.VisitCompleter, w http.ResponseWriter, req *http.Request, state, code string) {
+	vc.(*visitCompleter).completeTOTP(context.Background(), w, req, state, code)
+}
+
+// CompleteWebAuthn completes a security key challenge using the given
+// visit completer, which must have been created with NewVisitCompleter.
+func CompleteWebAuthn(vc idp.VisitCompleter, w http.ResponseWriter, req *http.Request, state, response string) {
+	vc.(*visitCompleter).completeWebAuthn(context.Background(), w, req, state, response)
+}
+
+// NewDischargeTokenCreator returns the discharge token creator used by
+// the given visit completer, which must have been created with
+// NewVisitCompleter.
+func NewDischargeTokenCreator(vc idp.VisitCompleter) idp.DischargeTokenCreator {
+	return vc.(*visitCompleter).dischargeTokenCreator
+}
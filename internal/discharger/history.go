@@ -0,0 +1,96 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"encoding/json"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/identity"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+const (
+	// historyDataStore is the name of the ProviderDataStore key value
+	// store that holds the recent discharges made for each user.
+	historyDataStore = "discharges"
+
+	// maxDischargeHistory is the number of recent discharges that are
+	// recorded for each user.
+	maxDischargeHistory = 20
+)
+
+// A dischargeRecord records a single discharge made for a user.
+type dischargeRecord struct {
+	// Time holds the time of the discharge.
+	Time time.Time `json:"time"`
+
+	// Condition holds the condition of the discharged caveat.
+	Condition string `json:"condition"`
+
+	// Origin holds the origin of the discharge request, if known.
+	Origin string `json:"origin,omitempty"`
+}
+
+// dischargeHistory records the most recent discharges made for each
+// user.
+type dischargeHistory struct {
+	kv store.KeyValueStore
+}
+
+// newDischargeHistory creates a new dischargeHistory.
+func newDischargeHistory(ctx context.Context, params identity.HandlerParams) (*dischargeHistory, error) {
+	kv, err := params.ProviderDataStore.KeyValueStore(ctx, historyDataStore)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &dischargeHistory{
+		kv: kv,
+	}, nil
+}
+
+// add records a discharge for the user with the given provider ID,
+// discarding the oldest record if there are already
+// maxDischargeHistory. Concurrent discharges for the same user may
+// cause a record to be lost, which is acceptable for a history that is
+// only informational.
+func (h *dischargeHistory) add(ctx context.Context, providerID store.ProviderIdentity, r dischargeRecord) error {
+	ctx, close := h.kv.Context(ctx)
+	defer close()
+	records, err := h.get(ctx, providerID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	records = append([]dischargeRecord{r}, records...)
+	if len(records) > maxDischargeHistory {
+		records = records[:maxDischargeHistory]
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(h.kv.Set(ctx, string(providerID), data, time.Time{}))
+}
+
+// get returns the recorded discharges for the user with the given
+// provider ID, most recent first.
+func (h *dischargeHistory) get(ctx context.Context, providerID store.ProviderIdentity) ([]dischargeRecord, error) {
+	ctx, close := h.kv.Context(ctx)
+	defer close()
+	data, err := h.kv.Get(ctx, string(providerID))
+	if errgo.Cause(err) == store.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var records []dischargeRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal discharge history for %s", providerID)
+	}
+	return records, nil
+}
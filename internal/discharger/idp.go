@@ -6,6 +6,7 @@ package discharger
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -14,14 +15,20 @@ import (
 	"golang.org/x/net/trace"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/idmclient.v1"
+	"gopkg.in/juju/idmclient.v1/params"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
 	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/idp/idputil"
 	"github.com/CanonicalLtd/blues-identity/internal/auth"
 	"github.com/CanonicalLtd/blues-identity/internal/identity"
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn"
 	"github.com/CanonicalLtd/blues-identity/store"
 )
 
@@ -42,13 +49,16 @@ func initIDPs(ctx context.Context, params identity.HandlerParams, dt *dischargeT
 			return errgo.Mask(err)
 		}
 		if err := ip.Init(ctx, idp.InitParams{
-			Store:                 params.Store,
+			// Identity providers must not give a new identity
+			// the old username of another.
+			Store:                 params.Authorizer.AliasCheckingStore(params.Store),
 			KeyValueStore:         kvStore,
 			URLPrefix:             params.Location + "/login/" + ip.Name(),
 			DischargeTokenCreator: dt,
-			VisitCompleter:        vc,
+			VisitCompleter:        &monitoredVisitCompleter{vc, ip.Name()},
 			Template:              params.Template,
 			Key:                   params.Key,
+			LoginLimiter:          ratelimit.NewLoginLimiter(params.Limiter, ip),
 		}); err != nil {
 			return errgo.Mask(err)
 		}
@@ -56,26 +66,98 @@ func initIDPs(ctx context.Context, params identity.HandlerParams, dt *dischargeT
 	return nil
 }
 
+// monitoredVisitCompleter is an idp.VisitCompleter that records the
+// outcome of each login through an identity provider before passing it
+// on.
+type monitoredVisitCompleter struct {
+	idp.VisitCompleter
+	idp string
+}
+
+// Success implements idp.VisitCompleter.Success.
+func (vc *monitoredVisitCompleter) Success(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, id *store.Identity) {
+	auth.LogFieldsFromContext(ctx).Set(auth.LogFieldUsername, id.Username)
+	monitoring.LoginCompleted(vc.idp, monitoring.OutcomeSuccess)
+	vc.VisitCompleter.Success(ctx, w, req, dischargeID, id)
+}
+
+// Failure implements idp.VisitCompleter.Failure.
+func (vc *monitoredVisitCompleter) Failure(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, err error) {
+	monitoring.LoginCompleted(vc.idp, monitoring.OutcomeFailure)
+	vc.VisitCompleter.Failure(ctx, w, req, dischargeID, err)
+}
+
 func newIDPHandler(params identity.HandlerParams, idp idp.IdentityProvider) httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
 		t := trace.New("identity.internal.v1.idp", idp.Name())
 		defer t.Finish()
 		ctx := trace.NewContext(context.Background(), t)
+		ctx = auth.ContextWithLogFields(ctx, auth.LogFieldsFromContext(req.Context()))
+		ctx = auth.ContextWithIDP(ctx, idp.Name())
+		ctx, span := tracing.StartHTTPSpan(ctx, req, "idp."+idp.Name())
+		defer span.End()
 		ctx, close := params.Store.Context(ctx)
 		defer close()
 		ctx, close = params.MeetingStore.Context(ctx)
 		defer close()
 		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/login/"+idp.Name())
 		req.ParseForm()
+		auth.LogFieldsFromContext(ctx).Set(auth.LogFieldDischargeID, idputil.DischargeID(req))
 		idp.Handle(ctx, w, req)
 	}
 }
 
 type dischargeTokenCreator struct {
-	params identity.HandlerParams
+	params   identity.HandlerParams
+	totp     *totpChecker
+	webauthn *webauthnChecker
 }
 
+// DischargeToken implements idp.DischargeTokenCreator.DischargeToken.
+// Identities that must use two-factor authentication cannot be issued
+// a discharge token directly by an identity provider, they must log in
+// interactively so that the second factor can be checked.
 func (d *dischargeTokenCreator) DischargeToken(ctx context.Context, dischargeID string, id *store.Identity) (*httpbakery.DischargeToken, error) {
+	id, err := linkedIdentity(ctx, d.params.Store, id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	required, err := d.secondFactorRequired(ctx, id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if required {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "two-factor authentication required, use an interactive login")
+	}
+	return d.dischargeToken(ctx, dischargeID, id)
+}
+
+// secondFactorRequired reports whether the given identity must complete
+// any second factor challenge before a discharge token can be issued.
+func (d *dischargeTokenCreator) secondFactorRequired(ctx context.Context, id *store.Identity) (bool, error) {
+	required, err := d.webauthn.required(ctx, id)
+	if err != nil || required {
+		return required, errgo.Mask(err)
+	}
+	required, err = d.totp.required(ctx, id)
+	return required, errgo.Mask(err)
+}
+
+// dischargeToken creates a discharge token for the given identity
+// without performing any further checks other than that the identity
+// has not been disabled.
+func (d *dischargeTokenCreator) dischargeToken(ctx context.Context, dischargeID string, id *store.Identity) (*httpbakery.DischargeToken, error) {
+	if err := d.params.Authorizer.CheckEnabled(ctx, id); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	// A declaration of a username that was previously used by
+	// another identity would identify that identity.
+	if err := d.params.Authorizer.CheckUsername(ctx, id.Username, id.ProviderID); err != nil {
+		if errgo.Cause(err) == store.ErrDuplicateUsername {
+			return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "username %q was previously used by another user", id.Username)
+		}
+		return nil, errgo.Mask(err)
+	}
 	cavs := []checkers.Caveat{
 		idmclient.UserDeclaration(id.Username),
 	}
@@ -100,7 +182,7 @@ func (d *dischargeTokenCreator) DischargeToken(ctx context.Context, dischargeID
 	if err := d.params.Store.UpdateIdentity(ctx, id, store.Update{
 		store.LastLogin: store.Set,
 	}); err != nil {
-		logger.Errorf("cannot update last login time: %s", err)
+		auth.Logger(ctx, logger).Errorf("cannot update last login time: %s", err)
 	}
 	return &httpbakery.DischargeToken{
 		Kind:  "macaroon",
@@ -108,16 +190,204 @@ func (d *dischargeTokenCreator) DischargeToken(ctx context.Context, dischargeID
 	}, nil
 }
 
+// linkedIdentity returns the identity that should be logged in when an
+// identity provider authenticates the given identity. If the identity's
+// provider ID has been linked to another identity then that identity is
+// returned, otherwise id is returned unchanged.
+func linkedIdentity(ctx context.Context, st store.Store, id *store.Identity) (*store.Identity, error) {
+	if id.ProviderID == "" {
+		return id, nil
+	}
+	linked := store.Identity{
+		ProviderID: id.ProviderID,
+	}
+	if err := st.Identity(ctx, &linked); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return id, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	if linked.ProviderID == id.ProviderID {
+		return id, nil
+	}
+	return &linked, nil
+}
+
 // A visitCompleter is an implementation of idp.VisitCompleter.
 type visitCompleter struct {
 	params                identity.HandlerParams
 	dischargeTokenCreator *dischargeTokenCreator
 	place                 *place
+	totp                  *totpChecker
+	webauthn              *webauthnChecker
 }
 
-// Success implements idp.VisitCompleter.Success.
+// Success implements idp.VisitCompleter.Success. If the identity must
+// use two-factor authentication then a security key or TOTP challenge
+// is written instead, and the login is completed by completeWebAuthn or
+// completeTOTP. Security keys take precedence over TOTP. No challenge
+// is made if the identity provider has already used more than one
+// factor.
 func (c *visitCompleter) Success(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, id *store.Identity) {
-	dt, err := c.dischargeTokenCreator.DischargeToken(ctx, dischargeID, id)
+	id, err := linkedIdentity(ctx, c.params.Store, id)
+	if err != nil {
+		c.Failure(ctx, w, req, dischargeID, errgo.Mask(err))
+		return
+	}
+	if idp.IsMultiFactor(ctx) {
+		c.complete(ctx, w, req, dischargeID, id, "login", id)
+		return
+	}
+	required, err := c.webauthn.required(ctx, id)
+	if err != nil {
+		c.Failure(ctx, w, req, dischargeID, errgo.Mask(err))
+		return
+	}
+	if required {
+		if err := c.webauthn.challenge(ctx, w, dischargeID, id); err != nil {
+			c.Failure(ctx, w, req, dischargeID, errgo.Mask(err))
+		}
+		return
+	}
+	required, err = c.totp.required(ctx, id)
+	if err != nil {
+		c.Failure(ctx, w, req, dischargeID, errgo.Mask(err))
+		return
+	}
+	if required {
+		if err := c.totp.challenge(ctx, w, dischargeID, id); err != nil {
+			c.Failure(ctx, w, req, dischargeID, errgo.Mask(err))
+		}
+		return
+	}
+	c.complete(ctx, w, req, dischargeID, id, "login", id)
+}
+
+// completeWebAuthn completes a login that required a security key
+// challenge using the response from the user's security key.
+func (c *visitCompleter) completeWebAuthn(ctx context.Context, w http.ResponseWriter, req *http.Request, state, response string) {
+	if c.webauthn == nil {
+		c.Failure(ctx, w, req, "", errgo.WithCausef(nil, params.ErrNotFound, "security keys not enabled"))
+		return
+	}
+	ch, err := c.webauthn.getChallenge(ctx, state)
+	if err != nil {
+		c.Failure(ctx, w, req, "", errgo.Mask(err, errgo.Is(params.ErrBadRequest)))
+		return
+	}
+	ip := c.params.Limiter.ClientIP(req)
+	if err := c.params.Limiter.Allow(ctx, "login-webauthn", ip, ch.Username); err != nil {
+		c.Failure(ctx, w, req, ch.DischargeID, errgo.Mask(err, ratelimit.IsLimitError))
+		return
+	}
+	attempt, err := claimAttempt(ctx, c.webauthn.kv, state, maxWebAuthnAttempts, time.Now().Add(webauthnChallengeDuration))
+	if err != nil {
+		c.Failure(ctx, w, req, ch.DischargeID, errgo.Mask(err))
+		return
+	}
+	if attempt == 0 {
+		c.webauthn.removeChallenge(ctx, state)
+		c.Failure(ctx, w, req, ch.DischargeID, errgo.WithCausef(nil, params.ErrUnauthorized, "too many failed security key attempts"))
+		return
+	}
+	id, err := c.webauthn.verify(ctx, ch, response)
+	if errgo.Cause(err) == webauthn.ErrVerification {
+		auth.Logger(ctx, logger).Infof("security key verification failed for %s: %s", ch.Username, err)
+		// Failures are also counted against the user so that
+		// starting a new login doesn't allow more attempts.
+		c.params.Limiter.LoginFailed(ctx, ip, ch.Username)
+		if attempt == maxWebAuthnAttempts {
+			c.webauthn.removeChallenge(ctx, state)
+			c.Failure(ctx, w, req, ch.DischargeID, errgo.WithCausef(nil, params.ErrUnauthorized, "too many failed security key attempts"))
+			return
+		}
+		// Each attempt uses a new challenge.
+		if err := c.webauthn.newOptions(ctx, ch); err != nil {
+			c.Failure(ctx, w, req, ch.DischargeID, errgo.Mask(err))
+			return
+		}
+		if err := c.webauthn.putChallenge(ctx, state, ch); err != nil {
+			c.Failure(ctx, w, req, ch.DischargeID, errgo.Mask(err))
+			return
+		}
+		if err := c.webauthn.writeChallengePage(w, state, ch, "Security key verification failed, please try again."); err != nil {
+			c.Failure(ctx, w, req, ch.DischargeID, errgo.Mask(err))
+		}
+		return
+	}
+	if err != nil {
+		c.Failure(ctx, w, req, ch.DischargeID, errgo.Mask(err, errgo.Is(params.ErrBadRequest)))
+		return
+	}
+	c.webauthn.removeChallenge(ctx, state)
+	c.complete(ctx, w, req, ch.DischargeID, id, "login", id)
+}
+
+// completeTOTP completes a login that required a TOTP challenge using
+// the code supplied by the user.
+func (c *visitCompleter) completeTOTP(ctx context.Context, w http.ResponseWriter, req *http.Request, state, code string) {
+	if c.totp == nil {
+		c.Failure(ctx, w, req, "", errgo.WithCausef(nil, params.ErrNotFound, "two-factor authentication not enabled"))
+		return
+	}
+	ch, err := c.totp.getChallenge(ctx, state)
+	if err != nil {
+		c.Failure(ctx, w, req, "", errgo.Mask(err, errgo.Is(params.ErrBadRequest)))
+		return
+	}
+	ip := c.params.Limiter.ClientIP(req)
+	if err := c.params.Limiter.Allow(ctx, "login-totp", ip, ch.Username); err != nil {
+		c.Failure(ctx, w, req, ch.DischargeID, errgo.Mask(err, ratelimit.IsLimitError))
+		return
+	}
+	// Claim the attempt before verifying the code so that parallel
+	// requests cannot try more codes than allowed.
+	attempt, err := claimAttempt(ctx, c.totp.kv, state, maxTOTPAttempts, time.Now().Add(totpChallengeDuration))
+	if err != nil {
+		c.Failure(ctx, w, req, ch.DischargeID, errgo.Mask(err))
+		return
+	}
+	if attempt == 0 {
+		c.totp.removeChallenge(ctx, state)
+		c.Failure(ctx, w, req, ch.DischargeID, errgo.WithCausef(nil, params.ErrUnauthorized, "too many incorrect codes"))
+		return
+	}
+	id, recoveryCodes, err := c.totp.verify(ctx, ch, code)
+	if errgo.Cause(err) == errInvalidTOTPCode {
+		// Incorrect codes are also counted against the user so
+		// that starting a new login doesn't allow more attempts.
+		c.params.Limiter.LoginFailed(ctx, ip, ch.Username)
+		if attempt == maxTOTPAttempts {
+			c.totp.removeChallenge(ctx, state)
+			c.Failure(ctx, w, req, ch.DischargeID, errgo.WithCausef(nil, params.ErrUnauthorized, "too many incorrect codes"))
+			return
+		}
+		if err := c.totp.writeChallengePage(w, state, ch, "Invalid code, please try again."); err != nil {
+			c.Failure(ctx, w, req, ch.DischargeID, errgo.Mask(err))
+		}
+		return
+	}
+	if err != nil {
+		c.Failure(ctx, w, req, ch.DischargeID, errgo.Mask(err))
+		return
+	}
+	c.totp.removeChallenge(ctx, state)
+	if recoveryCodes != nil {
+		c.complete(ctx, w, req, ch.DischargeID, id, "totp-recovery-codes", totpRecoveryCodesParams{
+			Username:      id.Username,
+			RecoveryCodes: recoveryCodes,
+		})
+		return
+	}
+	c.complete(ctx, w, req, ch.DischargeID, id, "login", id)
+}
+
+// complete completes a successful login by issuing a discharge token
+// for the given identity and then rendering the named template with
+// the given parameters. Successful logins to the account pages are
+// redirected back to the account pages instead.
+func (c *visitCompleter) complete(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, id *store.Identity, tmpl string, tmplParams interface{}) {
+	dt, err := c.dischargeTokenCreator.dischargeToken(ctx, dischargeID, id)
 	if err != nil {
 		c.Failure(ctx, w, req, dischargeID, errgo.Mask(err))
 		return
@@ -128,14 +398,21 @@ func (c *visitCompleter) Success(ctx context.Context, w http.ResponseWriter, req
 			return
 		}
 	}
-	t := c.params.Template.Lookup("login")
+	if isAccountLogin(dischargeID) && tmpl == "login" {
+		// The browser returns to the account pages to collect the
+		// login. Any other page, such as newly issued recovery
+		// codes, must still be shown to the user.
+		http.Redirect(w, req, c.params.Location+"/account/login/complete?did="+url.QueryEscape(dischargeID), http.StatusSeeOther)
+		return
+	}
+	t := c.params.Template.Lookup(tmpl)
 	if t == nil {
 		fmt.Fprintf(w, "Login successful as %s", id.Username)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html;charset=utf-8")
-	if err := t.Execute(w, id); err != nil {
-		logger.Errorf("error processing login template: %s", err)
+	if err := t.Execute(w, tmplParams); err != nil {
+		auth.Logger(ctx, logger).Errorf("error processing %s template: %s", tmpl, err)
 	}
 }
 
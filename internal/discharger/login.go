@@ -5,14 +5,34 @@ package discharger
 
 import (
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+	"gopkg.in/juju/names.v2"
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 
 	"github.com/CanonicalLtd/blues-identity/idp"
 )
 
+const (
+	// domainCookie is the name of the cookie that holds the domain
+	// of the identity provider the user last chose to log in with.
+	domainCookie = "domain"
+
+	// idpCookie is the name of the cookie that holds the name of the
+	// identity provider the user last chose to log in with, which
+	// may not have a domain.
+	idpCookie = "idp"
+
+	// domainCookieDuration is the length of time for which the
+	// chosen domain and identity provider are remembered.
+	domainCookieDuration = 365 * 24 * time.Hour
+)
+
 // legacyLoginRequest is a request to start a login to the identity manager
 // using the legacy visit-wait protocol.
 type legacyLoginRequest struct {
@@ -69,36 +89,207 @@ func (h *handler) Login(p httprequest.Params, lr *loginRequest) error {
 	return h.login(p, lr.DischargeID, lr.Domain)
 }
 
-// login handles a visit request for the given discharge ID and client-specified
-// domain. It chooses the first applicable interactive identity provider that
-// matches the client-specified domain, or the first interactive identity provider
-// if none do.
+// login handles a visit request for the given discharge ID and
+// client-specified domain. If no domain is specified then the identity
+// provider remembered in the idp cookie is used, or failing that the
+// domain remembered in the domain cookie. If an interactive identity
+// provider matches, or there is only one interactive identity
+// provider, then the user is sent straight to it, otherwise the user
+// is shown a page on which to choose an identity provider.
 func (h *handler) login(p httprequest.Params, dischargeID, domain string) error {
-	// Use the normal interactive login method.
+	idps := h.interactiveIdentityProviders()
+	if len(idps) == 0 {
+		return errgo.Newf("no interactive login methods found")
+	}
 	var selected idp.IdentityProvider
-	for _, idp := range h.params.IdentityProviders {
-		if !idp.Interactive() {
-			continue
+	if domain == "" {
+		if c, err := p.Request.Cookie(idpCookie); err == nil {
+			for _, idp := range idps {
+				if idp.Name() == c.Value {
+					selected = idp
+					break
+				}
+			}
+		}
+		if c, err := p.Request.Cookie(domainCookie); err == nil && names.IsValidUserDomain(c.Value) {
+			domain = c.Value
+		}
+	}
+	if selected == nil && domain != "" {
+		for _, idp := range idps {
+			if idp.Domain() == domain {
+				selected = idp
+				break
+			}
+		}
+	}
+	if selected == nil {
+		// Servers without a chooser template behave as they
+		// always have and use the first interactive identity
+		// provider.
+		if len(idps) > 1 && h.params.Template.Lookup("idp-chooser") != nil {
+			return errgo.Mask(h.writeChooserPage(p.Response, dischargeID, "", ""))
+		}
+		selected = idps[0]
+	}
+	http.Redirect(p.Response, p.Request, selected.URL(dischargeID), http.StatusFound)
+	return nil
+}
+
+// chooseIDPRequest is a request to log in with an identity provider
+// chosen on the identity provider chooser page.
+type chooseIDPRequest struct {
+	httprequest.Route `httprequest:"GET /login-choose"`
+	DischargeID       string `httprequest:"did,form"`
+	IDP               string `httprequest:"idp,form"`
+	Email             string `httprequest:"email,form"`
+}
+
+// ChooseIDP handles the GET /login-choose endpoint that is used by the
+// identity provider chooser page. The identity provider is either
+// named directly, or found from the domain of the given email address.
+// The chosen identity provider is remembered in the idp cookie, and its
+// domain in the domain cookie, so that the user is not asked again.
+func (h *handler) ChooseIDP(p httprequest.Params, r *chooseIDPRequest) error {
+	var selected idp.IdentityProvider
+	switch {
+	case r.IDP != "":
+		for _, idp := range h.interactiveIdentityProviders() {
+			if idp.Name() == r.IDP {
+				selected = idp
+				break
+			}
 		}
-		// Select the first interactive identity provider even if
-		// it does not match the domain. If no subsequent match
-		// is found for the domain then this identity provider
-		// will be used.
 		if selected == nil {
-			selected = idp
+			return errgo.WithCausef(nil, params.ErrNotFound, "identity provider %q not found", r.IDP)
 		}
-		if domain == "" {
-			break
+	case r.Email != "":
+		selected = h.identityProviderForEmail(r.Email)
+		if selected == nil {
+			return errgo.Mask(h.writeChooserPage(p.Response, r.DischargeID, r.Email, "No identity provider found for that email address."))
 		}
-		if idp.Domain() == domain {
-			selected = idp
-			break
+	default:
+		return errgo.Mask(h.writeChooserPage(p.Response, r.DischargeID, "", "Choose an identity provider."))
+	}
+	http.SetCookie(p.Response, h.loginCookie(idpCookie, selected.Name()))
+	// An identity provider without a domain must not leave the
+	// domain of a previous choice in place, as the domain is also
+	// sent by discharge requests.
+	http.SetCookie(p.Response, h.loginCookie(domainCookie, selected.Domain()))
+	http.Redirect(p.Response, p.Request, selected.URL(r.DischargeID), http.StatusFound)
+	return nil
+}
+
+// loginCookie returns a cookie that remembers the given value for the
+// login page. If the value is empty the cookie is removed.
+func (h *handler) loginCookie(name, value string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  time.Now().Add(domainCookieDuration),
+		HttpOnly: true,
+		Secure:   h.secureCookies(),
+	}
+	if value == "" {
+		cookie.Expires = time.Time{}
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+// interactiveIdentityProviders returns the configured interactive
+// identity providers in the order they were configured.
+func (h *handler) interactiveIdentityProviders() []idp.IdentityProvider {
+	var idps []idp.IdentityProvider
+	for _, idp := range h.params.IdentityProviders {
+		if idp.Interactive() {
+			idps = append(idps, idp)
 		}
 	}
-	if selected == nil {
-		return errgo.Newf("no interactive login methods found")
+	return idps
+}
+
+// identityProviderForEmail returns the first interactive identity
+// provider that has the domain of the given email address in its
+// email domains, or nil if there is none.
+func (h *handler) identityProviderForEmail(email string) idp.IdentityProvider {
+	n := strings.LastIndex(email, "@")
+	if n == -1 {
+		return nil
+	}
+	domain := strings.TrimSpace(email[n+1:])
+	for _, ip := range h.interactiveIdentityProviders() {
+		ci, ok := ip.(idp.ChooserInfo)
+		if !ok {
+			continue
+		}
+		for _, d := range ci.EmailDomains() {
+			if strings.EqualFold(d, domain) {
+				return ip
+			}
+		}
 	}
-	url := selected.URL(dischargeID)
-	http.Redirect(p.Response, p.Request, url, http.StatusFound)
 	return nil
 }
+
+// idpChooserParams holds the parameters passed to the idp-chooser
+// template.
+type idpChooserParams struct {
+	// Action contains the URL to which the email form is submitted.
+	Action string
+
+	// DischargeID contains the discharge ID of the login, it must
+	// be included in the submitted form.
+	DischargeID string
+
+	// IDPs contains the identity providers that may be chosen.
+	IDPs []chooserIDP
+
+	// Email contains the email address that was entered, if any.
+	Email string
+
+	// Error contains any error message to show.
+	Error string
+}
+
+// chooserIDP holds the details of an identity provider shown on the
+// chooser page.
+type chooserIDP struct {
+	Name        string
+	Description string
+	IconURL     string
+
+	// URL contains the URL that chooses this identity provider.
+	URL string
+}
+
+// writeChooserPage writes the identity provider chooser page to w.
+func (h *handler) writeChooserPage(w http.ResponseWriter, dischargeID, email, errMsg string) error {
+	t := h.params.Template.Lookup("idp-chooser")
+	if t == nil {
+		return errgo.Newf("cannot find idp-chooser template")
+	}
+	pp := idpChooserParams{
+		Action:      h.params.Location + "/login-choose",
+		DischargeID: dischargeID,
+		Email:       email,
+		Error:       errMsg,
+	}
+	for _, ip := range h.interactiveIdentityProviders() {
+		cidp := chooserIDP{
+			Name:        ip.Name(),
+			Description: ip.Description(),
+			URL: h.params.Location + "/login-choose?" + url.Values{
+				"did": {dischargeID},
+				"idp": {ip.Name()},
+			}.Encode(),
+		}
+		if ci, ok := ip.(idp.ChooserInfo); ok {
+			cidp.IconURL = ci.IconURL()
+		}
+		pp.IDPs = append(pp.IDPs, cidp)
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	return errgo.Mask(t.Execute(w, pp))
+}
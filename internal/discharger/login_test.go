@@ -5,6 +5,7 @@ package discharger_test
 
 import (
 	"encoding/json"
+	"html/template"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -25,16 +26,25 @@ type loginSuite struct {
 
 var _ = gc.Suite(&loginSuite{})
 
+var loginTemplate = template.Must(template.New("").Parse(`
+{{define "login"}}login successful as user {{.Username}}
+{{end}}
+{{define "idp-chooser"}}{{.Action}}|{{.DischargeID}}|{{range .IDPs}}{{.Name}},{{.Description}},{{.IconURL}},{{.URL}};{{end}}|{{.Email}}|{{.Error}}{{end}}
+`))
+
 func (s *loginSuite) SetUpTest(c *gc.C) {
 	s.Params.IdentityProviders = []idp.IdentityProvider{
 		test.NewIdentityProvider(test.Params{
 			Name: "test",
 		}),
 		test.NewIdentityProvider(test.Params{
-			Name:   "test2",
-			Domain: "test2",
+			Name:         "test2",
+			Domain:       "test2",
+			Icon:         "https://example.com/test2.png",
+			EmailDomains: []string{"corp.example.com"},
 		}),
 	}
+	s.Params.Template = loginTemplate
 	s.apiSuite.SetUpTest(c)
 }
 
@@ -104,10 +114,14 @@ func (s *loginSuite) TestLoginFailure(c *gc.C) {
 }
 
 func (s *loginSuite) TestInteractiveIdentityProviderSelection(c *gc.C) {
-	resp := s.getNoRedirect(c, "/login")
+	resp := s.getNoRedirect(c, "/login?did=1234")
 	defer resp.Body.Close()
-	c.Assert(resp.StatusCode, gc.Equals, http.StatusFound)
-	c.Assert(resp.Header.Get("Location"), gc.Equals, s.URL+"/login/test/login")
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(body), gc.Equals, s.URL+"/login-choose|1234|"+
+		"test,Test,,"+s.URL+"/login-choose?did=1234&amp;idp=test;"+
+		"test2,Test,https://example.com/test2.png,"+s.URL+"/login-choose?did=1234&amp;idp=test2;||")
 }
 
 func (s *loginSuite) TestInteractiveIdentityProviderSelectionWithDomain(c *gc.C) {
@@ -117,6 +131,79 @@ func (s *loginSuite) TestInteractiveIdentityProviderSelectionWithDomain(c *gc.C)
 	c.Assert(resp.Header.Get("Location"), gc.Equals, s.URL+"/login/test2/login")
 }
 
+func (s *loginSuite) TestInteractiveIdentityProviderSelectionWithDomainCookie(c *gc.C) {
+	req, err := http.NewRequest("GET", "/login?did=1234", nil)
+	c.Assert(err, gc.Equals, nil)
+	req.AddCookie(&http.Cookie{
+		Name:  "domain",
+		Value: "test2",
+	})
+	resp := s.RoundTrip(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusFound)
+	c.Assert(resp.Header.Get("Location"), gc.Equals, s.URL+"/login/test2/login?id=1234")
+}
+
+func (s *loginSuite) TestChooseIdentityProvider(c *gc.C) {
+	resp := s.getNoRedirect(c, "/login-choose?did=1234&idp=test2")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusFound)
+	c.Assert(resp.Header.Get("Location"), gc.Equals, s.URL+"/login/test2/login?id=1234")
+	cookies := resp.Cookies()
+	c.Assert(cookies, gc.HasLen, 2)
+	c.Assert(cookies[0].Name, gc.Equals, "idp")
+	c.Assert(cookies[0].Value, gc.Equals, "test2")
+	c.Assert(cookies[0].Expires.After(time.Now()), gc.Equals, true)
+	c.Assert(cookies[1].Name, gc.Equals, "domain")
+	c.Assert(cookies[1].Value, gc.Equals, "test2")
+	c.Assert(cookies[1].Expires.After(time.Now()), gc.Equals, true)
+}
+
+func (s *loginSuite) TestChooseIdentityProviderWithoutDomain(c *gc.C) {
+	resp := s.getNoRedirect(c, "/login-choose?did=1234&idp=test")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusFound)
+	c.Assert(resp.Header.Get("Location"), gc.Equals, s.URL+"/login/test/login?id=1234")
+	cookies := resp.Cookies()
+	c.Assert(cookies, gc.HasLen, 2)
+	c.Assert(cookies[0].Name, gc.Equals, "idp")
+	c.Assert(cookies[0].Value, gc.Equals, "test")
+	c.Assert(cookies[0].Expires.After(time.Now()), gc.Equals, true)
+	c.Assert(cookies[1].Name, gc.Equals, "domain")
+	c.Assert(cookies[1].MaxAge, gc.Equals, -1)
+
+	// The choice is remembered on the next login.
+	req, err := http.NewRequest("GET", "/login?did=5678", nil)
+	c.Assert(err, gc.Equals, nil)
+	req.AddCookie(cookies[0])
+	resp = s.RoundTrip(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusFound)
+	c.Assert(resp.Header.Get("Location"), gc.Equals, s.URL+"/login/test/login?id=5678")
+}
+
+func (s *loginSuite) TestChooseIdentityProviderNotFound(c *gc.C) {
+	resp := s.getNoRedirect(c, "/login-choose?did=1234&idp=nothing")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func (s *loginSuite) TestChooseIdentityProviderByEmail(c *gc.C) {
+	resp := s.getNoRedirect(c, "/login-choose?did=1234&email=alice%40Corp.Example.com")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusFound)
+	c.Assert(resp.Header.Get("Location"), gc.Equals, s.URL+"/login/test2/login?id=1234")
+}
+
+func (s *loginSuite) TestChooseIdentityProviderByUnknownEmail(c *gc.C) {
+	resp := s.getNoRedirect(c, "/login-choose?did=1234&email=alice%40example.com")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(body), gc.Matches, `.*\|alice@example.com\|No identity provider found for that email address.`)
+}
+
 func (s *loginSuite) TestLoginMethodsIncludesAgent(c *gc.C) {
 	req, err := http.NewRequest("GET", "/login-legacy", nil)
 	c.Assert(err, gc.Equals, nil)
@@ -18,6 +18,11 @@ type dischargeRequestInfo struct {
 	Caveat    []byte
 	Condition string
 	Origin    string
+
+	// ReturnPath holds the path of the web pages to which the
+	// browser returns when a login to the account pages, or another
+	// page using the same login, completes.
+	ReturnPath string
 }
 
 type loginInfo struct {
@@ -66,3 +71,18 @@ func (p *place) Wait(ctx context.Context, id string) (*dischargeRequestInfo, *lo
 	}
 	return &info, &login, nil
 }
+
+func (p *place) Status(ctx context.Context, id string) (meeting.Status, *loginInfo, error) {
+	status, loginData, err := p.place.Status(ctx, id)
+	if err != nil {
+		return 0, nil, errgo.Notef(err, "cannot get status")
+	}
+	if status != meeting.StatusDone {
+		return status, nil, nil
+	}
+	var login loginInfo
+	if err := json.Unmarshal(loginData, &login); err != nil {
+		return 0, nil, errgo.Notef(err, "cannot unmarshal loginData")
+	}
+	return status, &login, nil
+}
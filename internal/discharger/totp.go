@@ -0,0 +1,433 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/identity"
+	"github.com/CanonicalLtd/blues-identity/internal/totp"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+const (
+	// totpChallengeDuration is the length of time for which a TOTP
+	// challenge remains valid.
+	totpChallengeDuration = 10 * time.Minute
+
+	// maxTOTPAttempts is the number of incorrect codes that may be
+	// entered for a single challenge.
+	maxTOTPAttempts = 5
+
+	// numRecoveryCodes is the number of recovery codes generated
+	// when a user enrols.
+	numRecoveryCodes = 10
+
+	// totpDataStore is the name of the ProviderDataStore key value
+	// store that holds pending TOTP challenges.
+	totpDataStore = "totp"
+)
+
+// ProviderInfo keys used to store the TOTP state of an identity.
+const (
+	totpSecretKey        = "totp-secret"
+	totpRecoveryCodesKey = "totp-recovery-codes"
+	totpLastStepKey      = "totp-last-step"
+)
+
+// errInvalidTOTPCode is the error returned when a user enters a code
+// that is not valid.
+var errInvalidTOTPCode = errgo.New("invalid code")
+
+// totpChallenge holds the state of a pending TOTP challenge between the
+// identity provider completing the login and the user entering a code.
+type totpChallenge struct {
+	DischargeID string `json:"discharge-id,omitempty"`
+	Username    string `json:"username"`
+
+	// Secret holds the encrypted secret that is being enrolled. This
+	// is empty if the user is already enrolled.
+	Secret string `json:"secret,omitempty"`
+}
+
+// totpPageParams holds the parameters passed to the "totp" template.
+type totpPageParams struct {
+	// Action holds the URL to which the form must be posted.
+	Action string
+
+	// State holds the challenge state that must be posted with the
+	// code.
+	State string
+
+	// Username holds the username of the user being challenged.
+	Username string
+
+	// Secret holds the base32 encoded secret when the user is
+	// enrolling.
+	Secret string
+
+	// URI holds an otpauth URI for the secret when the user is
+	// enrolling.
+	URI string
+
+	// Error holds any error from a previous attempt.
+	Error string
+}
+
+// totpRecoveryCodesParams holds the parameters passed to the
+// "totp-recovery-codes" template.
+type totpRecoveryCodesParams struct {
+	Username      string
+	RecoveryCodes []string
+}
+
+// totpChecker implements the TOTP two-factor authentication step that
+// is performed after an identity provider has authenticated a user
+// and before a discharge token is issued.
+type totpChecker struct {
+	params identity.HandlerParams
+	kv     store.KeyValueStore
+}
+
+// newTOTPChecker creates a new totpChecker. If TOTP is not configured
+// a nil checker is returned, all the totpChecker methods can be safely
+// called on a nil checker.
+func newTOTPChecker(ctx context.Context, params identity.HandlerParams) (*totpChecker, error) {
+	if params.TOTPKey == nil {
+		return nil, nil
+	}
+	kv, err := params.ProviderDataStore.KeyValueStore(ctx, totpDataStore)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &totpChecker{
+		params: params,
+		kv:     kv,
+	}, nil
+}
+
+// required reports whether the given identity must complete a TOTP
+// challenge before a discharge token can be issued. This is the case
+// if the identity has enrolled, or if it is a member of any of the
+// groups that are required to use TOTP.
+func (c *totpChecker) required(ctx context.Context, id *store.Identity) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	aid, err := c.params.Authorizer.Identity(ctx, id.Username)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	sid, err := aid.StoreIdentity(ctx)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	if len(sid.ProviderInfo[totpSecretKey]) > 0 {
+		return true, nil
+	}
+	return memberOfAny(ctx, aid, c.params.TOTPRequiredGroups)
+}
+
+// memberOfAny reports whether the given identity is a member of any of
+// the given groups.
+func memberOfAny(ctx context.Context, id *auth.Identity, groups []string) (bool, error) {
+	if len(groups) == 0 {
+		return false, nil
+	}
+	idGroups, err := id.Groups(ctx)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	for _, g := range idGroups {
+		for _, rg := range groups {
+			if g == rg {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// challenge starts a new TOTP challenge for the given identity and
+// writes the challenge page to w. If the identity has not yet enrolled
+// a new secret is generated and shown to the user.
+func (c *totpChecker) challenge(ctx context.Context, w http.ResponseWriter, dischargeID string, id *store.Identity) error {
+	sid := store.Identity{
+		Username: id.Username,
+	}
+	if err := c.params.Store.Identity(ctx, &sid); err != nil {
+		return errgo.Mask(err)
+	}
+	ch := totpChallenge{
+		DischargeID: dischargeID,
+		Username:    id.Username,
+	}
+	if len(sid.ProviderInfo[totpSecretKey]) == 0 {
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		ch.Secret, err = totp.Encrypt(c.params.TOTPKey, secret)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	state, err := newChallengeState()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.putChallenge(ctx, state, &ch); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(c.writeChallengePage(w, state, &ch, ""))
+}
+
+// writeChallengePage writes the page for the given challenge to w.
+func (c *totpChecker) writeChallengePage(w http.ResponseWriter, state string, ch *totpChallenge, errMsg string) error {
+	p := totpPageParams{
+		Action:   c.params.Location + "/login-totp",
+		State:    state,
+		Username: ch.Username,
+		Error:    errMsg,
+	}
+	if ch.Secret != "" {
+		secret, err := totp.Decrypt(c.params.TOTPKey, ch.Secret)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		p.Secret = totp.EncodeSecret(secret)
+		p.URI = totp.URI(c.params.TOTPIssuer, ch.Username, secret)
+	}
+	t := c.params.Template.Lookup("totp")
+	if t == nil {
+		return errgo.Newf("cannot find totp template")
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	return errgo.Mask(t.Execute(w, p))
+}
+
+// verify checks the given code against the given challenge. If the
+// challenge is for an enrolment then the secret is stored on the
+// identity and the newly generated recovery codes are returned. If the
+// code is not valid an error with a cause of errInvalidTOTPCode is
+// returned.
+func (c *totpChecker) verify(ctx context.Context, ch *totpChallenge, code string) (*store.Identity, []string, error) {
+	id := store.Identity{
+		Username: ch.Username,
+	}
+	if err := c.params.Store.Identity(ctx, &id); err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	now := time.Now()
+	if ch.Secret != "" {
+		secret, err := totp.Decrypt(c.params.TOTPKey, ch.Secret)
+		if err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		step, ok := totp.Validate(secret, code, now)
+		if !ok {
+			return nil, nil, errInvalidTOTPCode
+		}
+		if err := c.claimStep(ctx, &id, step, now); err != nil {
+			return nil, nil, errgo.Mask(err, errgo.Is(errInvalidTOTPCode))
+		}
+		codes, err := totp.GenerateRecoveryCodes(numRecoveryCodes)
+		if err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		hashes := make([]string, len(codes))
+		for i, code := range codes {
+			hashes[i] = totp.HashRecoveryCode(code)
+		}
+		if err := c.params.Store.UpdateIdentity(ctx, &store.Identity{
+			ID: id.ID,
+			ProviderInfo: map[string][]string{
+				totpSecretKey:        {ch.Secret},
+				totpRecoveryCodesKey: hashes,
+				totpLastStepKey:      {strconv.FormatUint(step, 10)},
+			},
+		}, store.Update{
+			store.ProviderInfo: store.Set,
+		}); err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		return &id, codes, nil
+	}
+	if len(id.ProviderInfo[totpSecretKey]) == 0 {
+		return nil, nil, errgo.Newf("%s is not enrolled for two-factor authentication", id.Username)
+	}
+	secret, err := totp.Decrypt(c.params.TOTPKey, id.ProviderInfo[totpSecretKey][0])
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	if step, ok := totp.Validate(secret, code, now); ok {
+		if v := id.ProviderInfo[totpLastStepKey]; len(v) > 0 {
+			// Don't allow a code to be used more than once.
+			last, err := strconv.ParseUint(v[0], 10, 64)
+			if err == nil && step <= last {
+				return nil, nil, errInvalidTOTPCode
+			}
+		}
+		if err := c.claimStep(ctx, &id, step, now); err != nil {
+			return nil, nil, errgo.Mask(err, errgo.Is(errInvalidTOTPCode))
+		}
+		if err := c.params.Store.UpdateIdentity(ctx, &store.Identity{
+			ID: id.ID,
+			ProviderInfo: map[string][]string{
+				totpLastStepKey: {strconv.FormatUint(step, 10)},
+			},
+		}, store.Update{
+			store.ProviderInfo: store.Set,
+		}); err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		return &id, nil, nil
+	}
+	hash := totp.HashRecoveryCode(code)
+	for _, h := range id.ProviderInfo[totpRecoveryCodesKey] {
+		if h != hash {
+			continue
+		}
+		// Claim the code before removing it so that concurrent
+		// requests cannot both use it. Recovery codes are
+		// random, so the claim is kept indefinitely.
+		if err := c.claim(ctx, fmt.Sprintf("recovery:%q|%s", id.ID, hash), time.Time{}); err != nil {
+			return nil, nil, errgo.Mask(err, errgo.Is(errInvalidTOTPCode))
+		}
+		if err := c.params.Store.UpdateIdentity(ctx, &store.Identity{
+			ID: id.ID,
+			ProviderInfo: map[string][]string{
+				totpRecoveryCodesKey: {hash},
+			},
+		}, store.Update{
+			store.ProviderInfo: store.Pull,
+		}); err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		auth.Logger(ctx, logger).Infof("%s logged in with a recovery code", id.Username)
+		return &id, nil, nil
+	}
+	return nil, nil, errInvalidTOTPCode
+}
+
+// claimStep claims the given time step for the given identity so that
+// a code cannot be used more than once, even by concurrent requests.
+// If the step has already been claimed an error with a cause of
+// errInvalidTOTPCode is returned.
+func (c *totpChecker) claimStep(ctx context.Context, id *store.Identity, step uint64, now time.Time) error {
+	// A step can only be matched while it is within Skew periods of
+	// the current time.
+	expire := now.Add((2*totp.Skew + 1) * totp.Period)
+	return errgo.Mask(c.claim(ctx, fmt.Sprintf("step:%q|%d", id.ID, step), expire), errgo.Is(errInvalidTOTPCode))
+}
+
+// claim adds the given key to the key value store. If the key has
+// already been claimed an error with a cause of errInvalidTOTPCode is
+// returned.
+func (c *totpChecker) claim(ctx context.Context, key string, expire time.Time) error {
+	ctx, close := c.kv.Context(ctx)
+	defer close()
+	err := c.kv.Add(ctx, key, []byte{1}, expire)
+	if errgo.Cause(err) == store.ErrDuplicateKey {
+		return errInvalidTOTPCode
+	}
+	return errgo.Mask(err)
+}
+
+// getChallenge retrieves the challenge with the given state.
+func (c *totpChecker) getChallenge(ctx context.Context, state string) (*totpChallenge, error) {
+	ctx, close := c.kv.Context(ctx)
+	defer close()
+	buf, err := c.kv.Get(ctx, state)
+	if errgo.Cause(err) == store.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid or expired login state")
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var ch totpChallenge
+	if err := json.Unmarshal(buf, &ch); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if ch.Username == "" {
+		// The challenge has been completed.
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid or expired login state")
+	}
+	return &ch, nil
+}
+
+// putChallenge stores the given challenge with the given state.
+func (c *totpChecker) putChallenge(ctx context.Context, state string, ch *totpChallenge) error {
+	buf, err := json.Marshal(ch)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	ctx, close := c.kv.Context(ctx)
+	defer close()
+	return errgo.Mask(c.kv.Set(ctx, state, buf, time.Now().Add(totpChallengeDuration)))
+}
+
+// removeChallenge ensures that the challenge with the given state can
+// no longer be used.
+func (c *totpChecker) removeChallenge(ctx context.Context, state string) {
+	if err := c.putChallenge(ctx, state, &totpChallenge{}); err != nil {
+		auth.Logger(ctx, logger).Errorf("cannot remove TOTP challenge: %s", err)
+	}
+}
+
+// claimAttempt claims the next of the max attempts allowed for the
+// second factor challenge with the given state, returning the number of
+// the claimed attempt starting at 1. If every attempt has been claimed
+// then 0 is returned. Each attempt is claimed by adding a key to kv, so
+// concurrent requests for the same challenge cannot make more than max
+// attempts between them.
+func claimAttempt(ctx context.Context, kv store.KeyValueStore, state string, max int, expire time.Time) (int, error) {
+	ctx, close := kv.Context(ctx)
+	defer close()
+	for n := 1; n <= max; n++ {
+		err := kv.Add(ctx, state+"-attempt-"+strconv.Itoa(n), []byte{1}, expire)
+		if err == nil {
+			return n, nil
+		}
+		if errgo.Cause(err) != store.ErrDuplicateKey {
+			return 0, errgo.Mask(err)
+		}
+	}
+	return 0, nil
+}
+
+// newChallengeState generates a new random state value for a
+// second factor challenge.
+func newChallengeState() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// totpRequest is a request to complete a TOTP challenge.
+type totpRequest struct {
+	httprequest.Route `httprequest:"POST /login-totp"`
+	State             string `httprequest:"state,form"`
+	Code              string `httprequest:"code,form"`
+}
+
+// LoginTOTP handles the POST /login-totp endpoint that is used to
+// complete a TOTP challenge.
+func (h *handler) LoginTOTP(p httprequest.Params, r *totpRequest) {
+	h.params.visitCompleter.completeTOTP(p.Context, p.Response, p.Request, r.State, r.Code)
+}
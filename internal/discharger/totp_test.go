@@ -0,0 +1,296 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger_test
+
+import (
+	"encoding/base32"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/discharger"
+	"github.com/CanonicalLtd/blues-identity/internal/identity"
+	"github.com/CanonicalLtd/blues-identity/internal/idmtest"
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
+	"github.com/CanonicalLtd/blues-identity/internal/totp"
+	"github.com/CanonicalLtd/blues-identity/meeting"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+type totpSuite struct {
+	idmtest.StoreSuite
+
+	meetingPlace *meeting.Place
+	vc           idp.VisitCompleter
+}
+
+var _ = gc.Suite(&totpSuite{})
+
+var totpTemplate = template.Must(template.New("").Parse(`
+{{define "login"}}login {{.Username}}{{end}}
+{{define "totp"}}{{.State}}|{{.Secret}}|{{.Error}}{{end}}
+{{define "totp-recovery-codes"}}{{.Username}}|{{range .RecoveryCodes}}{{.}},{{end}}{{end}}
+`))
+
+func (s *totpSuite) SetUpTest(c *gc.C) {
+	s.StoreSuite.SetUpTest(c)
+
+	oven := bakery.NewOven(bakery.OvenParams{
+		Namespace: auth.Namespace,
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return s.BakeryRootKeyStore
+		},
+		Key:      bakery.MustGenerateKey(),
+		Location: "idmtest",
+	})
+	var err error
+	s.meetingPlace, err = meeting.NewPlace(meeting.Params{
+		Store:      s.MeetingStore,
+		Metrics:    monitoring.NewMeetingMetrics(),
+		ListenAddr: "localhost",
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+	kv, err := s.ProviderDataStore.KeyValueStore(context.Background(), "ratelimit")
+	c.Assert(err, gc.Equals, nil)
+	s.vc = discharger.NewVisitCompleter(identity.HandlerParams{
+		ServerParams: identity.ServerParams{
+			Store:              s.Store,
+			ProviderDataStore:  s.ProviderDataStore,
+			MeetingStore:       s.MeetingStore,
+			RootKeyStore:       s.BakeryRootKeyStore,
+			Template:           totpTemplate,
+			Location:           "https://idm.example.com",
+			TOTPKey:            &key,
+			TOTPIssuer:         "Test",
+			TOTPRequiredGroups: []string{"admin"},
+		},
+		MeetingPlace: s.meetingPlace,
+		Oven:         oven,
+		Authorizer: auth.New(auth.Params{
+			Store: s.Store,
+		}),
+		Limiter: ratelimit.New(kv, ratelimit.Params{
+			MaxFailures: 10,
+		}),
+	})
+
+	s.addIdentity(c, "alice", "admin")
+	s.addIdentity(c, "bob", "users")
+}
+
+func (s *totpSuite) TearDownTest(c *gc.C) {
+	s.meetingPlace.Close()
+	s.StoreSuite.TearDownTest(c)
+}
+
+func (s *totpSuite) addIdentity(c *gc.C, username string, groups ...string) {
+	err := s.Store.UpdateIdentity(context.Background(), &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", username),
+		Username:   username,
+		Groups:     groups,
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+}
+
+// login calls Success on the visit completer for the given user and
+// returns the body of the response.
+func (s *totpSuite) login(c *gc.C, username string) string {
+	req, err := http.NewRequest("GET", "", nil)
+	c.Assert(err, gc.Equals, nil)
+	rr := httptest.NewRecorder()
+	s.vc.Success(context.Background(), rr, req, "", &store.Identity{
+		Username: username,
+	})
+	c.Assert(rr.Code, gc.Equals, http.StatusOK, gc.Commentf("%s", rr.Body))
+	return rr.Body.String()
+}
+
+// challenge logs in as the given user and returns the challenge state
+// and, if the user is enrolling, the secret.
+func (s *totpSuite) challenge(c *gc.C, username string) (state string, secret []byte) {
+	parts := strings.Split(s.login(c, username), "|")
+	c.Assert(parts, gc.HasLen, 3)
+	c.Assert(parts[0], gc.Not(gc.Equals), "")
+	if parts[1] != "" {
+		var err error
+		secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(parts[1])
+		c.Assert(err, gc.Equals, nil)
+	}
+	return parts[0], secret
+}
+
+// complete completes the challenge with the given state using the
+// given code and returns the response.
+func (s *totpSuite) complete(c *gc.C, state, code string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "", nil)
+	c.Assert(err, gc.Equals, nil)
+	rr := httptest.NewRecorder()
+	discharger.CompleteTOTP(s.vc, rr, req, state, code)
+	return rr
+}
+
+// enrol enrols the given user and returns the secret and recovery
+// codes.
+func (s *totpSuite) enrol(c *gc.C, username string) ([]byte, []string) {
+	state, secret := s.challenge(c, username)
+	c.Assert(secret, gc.NotNil)
+	rr := s.complete(c, state, totp.Code(secret, time.Now()))
+	c.Assert(rr.Code, gc.Equals, http.StatusOK, gc.Commentf("%s", rr.Body))
+	parts := strings.Split(rr.Body.String(), "|")
+	c.Assert(parts, gc.HasLen, 2)
+	c.Assert(parts[0], gc.Equals, username)
+	codes := strings.Split(strings.TrimSuffix(parts[1], ","), ",")
+	c.Assert(codes, gc.HasLen, 10)
+	return secret, codes
+}
+
+func (s *totpSuite) TestLoginNotRequired(c *gc.C) {
+	c.Assert(s.login(c, "bob"), gc.Equals, "login bob")
+}
+
+func (s *totpSuite) TestEnrol(c *gc.C) {
+	s.enrol(c, "alice")
+	id := store.Identity{Username: "alice"}
+	err := s.Store.Identity(context.Background(), &id)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id.ProviderInfo["totp-secret"], gc.HasLen, 1)
+	c.Assert(id.ProviderInfo["totp-recovery-codes"], gc.HasLen, 10)
+}
+
+func (s *totpSuite) TestEnrolInvalidCode(c *gc.C) {
+	state, secret := s.challenge(c, "alice")
+	rr := s.complete(c, state, "000000")
+	c.Assert(rr.Code, gc.Equals, http.StatusOK)
+	// The challenge is shown again with the same secret.
+	c.Assert(rr.Body.String(), gc.Equals, state+"|"+totp.EncodeSecret(secret)+"|Invalid code, please try again.")
+}
+
+func (s *totpSuite) TestLoginWithCode(c *gc.C) {
+	secret, _ := s.enrol(c, "alice")
+	state, secret2 := s.challenge(c, "alice")
+	c.Assert(secret2, gc.IsNil)
+
+	// The code used to enrol cannot be used again.
+	rr := s.complete(c, state, totp.Code(secret, time.Now()))
+	c.Assert(rr.Body.String(), gc.Equals, state+"||Invalid code, please try again.")
+
+	rr = s.complete(c, state, totp.Code(secret, time.Now().Add(totp.Period)))
+	c.Assert(rr.Code, gc.Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), gc.Equals, "login alice")
+
+	// The challenge cannot be reused.
+	rr = s.complete(c, state, totp.Code(secret, time.Now().Add(totp.Period)))
+	c.Assert(rr.Code, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *totpSuite) TestLoginWithRecoveryCode(c *gc.C) {
+	_, codes := s.enrol(c, "alice")
+	state, _ := s.challenge(c, "alice")
+	rr := s.complete(c, state, strings.ToUpper(codes[0]))
+	c.Assert(rr.Code, gc.Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), gc.Equals, "login alice")
+
+	// Each recovery code can only be used once.
+	state, _ = s.challenge(c, "alice")
+	rr = s.complete(c, state, codes[0])
+	c.Assert(rr.Body.String(), gc.Equals, state+"||Invalid code, please try again.")
+}
+
+func (s *totpSuite) TestTooManyAttempts(c *gc.C) {
+	s.enrol(c, "alice")
+	state, _ := s.challenge(c, "alice")
+	for i := 0; i < 4; i++ {
+		rr := s.complete(c, state, "000000")
+		c.Assert(rr.Code, gc.Equals, http.StatusOK)
+	}
+	rr := s.complete(c, state, "000000")
+	c.Assert(rr.Code, gc.Equals, http.StatusUnauthorized)
+}
+
+func (s *totpSuite) TestConcurrentAttempts(c *gc.C) {
+	s.enrol(c, "alice")
+	state, _ := s.challenge(c, "alice")
+	codes := make(chan int)
+	for i := 0; i < 20; i++ {
+		go func() {
+			codes <- s.complete(c, state, "000000").Code
+		}()
+	}
+	n := 0
+	for i := 0; i < 20; i++ {
+		if <-codes == http.StatusOK {
+			n++
+		}
+	}
+	c.Assert(n, gc.Equals, 4)
+}
+
+func (s *totpSuite) TestFailuresCountedAcrossChallenges(c *gc.C) {
+	secret, _ := s.enrol(c, "alice")
+	for i := 0; i < 10; i++ {
+		state, _ := s.challenge(c, "alice")
+		rr := s.complete(c, state, "000000")
+		c.Assert(rr.Code, gc.Equals, http.StatusOK)
+	}
+	// Even a correct code is refused once the user is locked out.
+	state, _ := s.challenge(c, "alice")
+	rr := s.complete(c, state, totp.Code(secret, time.Now().Add(totp.Period)))
+	c.Assert(rr.Code, gc.Equals, http.StatusTooManyRequests)
+}
+
+func (s *totpSuite) TestConcurrentCodes(c *gc.C) {
+	secret, codes := s.enrol(c, "alice")
+	tests := []string{
+		totp.Code(secret, time.Now().Add(totp.Period)),
+		codes[0],
+	}
+	for _, code := range tests {
+		states := make([]string, 5)
+		for i := range states {
+			states[i], _ = s.challenge(c, "alice")
+		}
+		bodies := make(chan string)
+		for _, state := range states {
+			go func(state string) {
+				bodies <- s.complete(c, state, code).Body.String()
+			}(state)
+		}
+		n := 0
+		for range states {
+			if <-bodies == "login alice" {
+				n++
+			}
+		}
+		c.Assert(n, gc.Equals, 1, gc.Commentf("code %s", code))
+	}
+}
+
+func (s *totpSuite) TestDischargeTokenRequiresInteractiveLogin(c *gc.C) {
+	dt := discharger.NewDischargeTokenCreator(s.vc)
+	_, err := dt.DischargeToken(context.Background(), "", &store.Identity{
+		Username: "alice",
+	})
+	c.Assert(err, gc.ErrorMatches, `two-factor authentication required, use an interactive login`)
+
+	tok, err := dt.DischargeToken(context.Background(), "", &store.Identity{
+		Username: "bob",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tok.Kind, gc.Equals, "macaroon")
+}
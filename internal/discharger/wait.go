@@ -5,6 +5,7 @@ package discharger
 
 import (
 	"encoding/base64"
+	"time"
 
 	"golang.org/x/net/context"
 	errgo "gopkg.in/errgo.v1"
@@ -13,6 +14,11 @@ import (
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
+	"github.com/CanonicalLtd/blues-identity/meeting"
 )
 
 // waitTokenRequest is the request sent to the server to wait for logins to
@@ -79,7 +85,11 @@ func (h *handler) wait(ctx context.Context, dischargeID string) (*dischargeReque
 		return nil, nil, errgo.WithCausef(nil, params.ErrBadRequest, "discharge id parameter not found")
 	}
 	// TODO don't wait forever here.
+	ctx, span := tracing.StartSpan(ctx, "rendezvous.Wait")
+	startTime := time.Now()
 	reqInfo, login, err := h.params.place.Wait(ctx, dischargeID)
+	monitoring.ObserveRendezvousWait(startTime)
+	tracing.EndSpan(span, err)
 	if err != nil {
 		return nil, nil, errgo.Notef(err, "cannot wait")
 	}
@@ -88,3 +98,73 @@ func (h *handler) wait(ctx context.Context, dischargeID string) (*dischargeReque
 	}
 	return reqInfo, login.DischargeToken, nil
 }
+
+// loginStatusRequest is the request sent to the server to find out the
+// status of a login without waiting for it to complete.
+type loginStatusRequest struct {
+	httprequest.Route `httprequest:"GET /login-status"`
+	DischargeID       string `httprequest:"did,form"`
+}
+
+// LoginStatus returns the current status of the login for the given
+// discharge ID.
+func (h *handler) LoginStatus(p httprequest.Params, req *loginStatusRequest) (*apiparams.LoginStatusResponse, error) {
+	if req.DischargeID == "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "discharge id parameter not found")
+	}
+	status, login, err := h.params.place.Status(p.Context, req.DischargeID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	switch status {
+	case meeting.StatusPending:
+		return &apiparams.LoginStatusResponse{
+			Status: apiparams.LoginPending,
+		}, nil
+	case meeting.StatusDone:
+		if login.Error != nil {
+			return &apiparams.LoginStatusResponse{
+				Status: apiparams.LoginFailed,
+				Error:  login.Error.Message,
+			}, nil
+		}
+		return &apiparams.LoginStatusResponse{
+			Status: apiparams.LoginCompleted,
+		}, nil
+	default:
+		return &apiparams.LoginStatusResponse{
+			Status: apiparams.LoginExpired,
+		}, nil
+	}
+}
+
+// cancelLoginRequest is the request sent to the server to abandon a
+// login. Any client waiting for the login will receive an error.
+type cancelLoginRequest struct {
+	httprequest.Route `httprequest:"POST /login-cancel"`
+	DischargeID       string `httprequest:"did,form"`
+}
+
+// CancelLogin cancels the pending login for the given discharge ID.
+func (h *handler) CancelLogin(p httprequest.Params, req *cancelLoginRequest) error {
+	if req.DischargeID == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "discharge id parameter not found")
+	}
+	// Completing the rendezvous fails if the login has already
+	// completed, so a login that completes while it is being
+	// cancelled is never overwritten.
+	err := h.params.place.Done(p.Context, req.DischargeID, &loginInfo{
+		Error: &httpbakery.Error{
+			Message: "login cancelled",
+		},
+	})
+	switch errgo.Cause(err) {
+	case nil:
+		return nil
+	case meeting.ErrAlreadyDone:
+		return errgo.WithCausef(nil, apiparams.ErrConflict, "login already completed")
+	case meeting.ErrNotFound:
+		return errgo.WithCausef(nil, params.ErrNotFound, "login not found, probably expired")
+	}
+	return errgo.Notef(err, "cannot cancel login")
+}
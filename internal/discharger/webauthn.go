@@ -0,0 +1,316 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/identity"
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+const (
+	// webauthnChallengeDuration is the length of time for which a
+	// security key challenge remains valid.
+	webauthnChallengeDuration = 10 * time.Minute
+
+	// maxWebAuthnAttempts is the number of failed security key
+	// responses that may be made for a single challenge.
+	maxWebAuthnAttempts = 5
+
+	// webauthnDataStore is the name of the ProviderDataStore key
+	// value store that holds pending security key challenges.
+	webauthnDataStore = "security-key"
+)
+
+// webauthnChallenge holds the state of a pending security key challenge
+// between the identity provider completing the login and the user
+// responding with their security key.
+type webauthnChallenge struct {
+	DischargeID string `json:"discharge-id,omitempty"`
+	Username    string `json:"username"`
+
+	// Creation holds the options used to register a new security key
+	// when the user has none registered.
+	Creation *webauthn.CreationOptions `json:"creation,omitempty"`
+
+	// Request holds the options used to authenticate with one of the
+	// user's registered security keys.
+	Request *webauthn.RequestOptions `json:"request,omitempty"`
+}
+
+// webauthnPageParams holds the parameters passed to the "webauthn"
+// template.
+type webauthnPageParams struct {
+	// Action holds the URL to which the form must be posted.
+	Action string
+
+	// State holds the challenge state that must be posted with the
+	// response.
+	State string
+
+	// Username holds the username of the user being challenged.
+	Username string
+
+	// Register holds whether the user is registering a new security
+	// key. If this is true Options must be passed to
+	// navigator.credentials.create, otherwise they must be passed
+	// to navigator.credentials.get.
+	Register bool
+
+	// Options holds the JSON encoded options for the security key.
+	Options string
+
+	// Error holds any error from a previous attempt.
+	Error string
+}
+
+// webauthnChecker implements the security key two-factor
+// authentication step that is performed after an identity provider has
+// authenticated a user and before a discharge token is issued.
+type webauthnChecker struct {
+	params identity.HandlerParams
+	config *webauthn.Config
+	kv     store.KeyValueStore
+}
+
+// newWebAuthnChecker creates a new webauthnChecker. If security keys
+// are not configured a nil checker is returned, all the
+// webauthnChecker methods can be safely called on a nil checker.
+func newWebAuthnChecker(ctx context.Context, params identity.HandlerParams) (*webauthnChecker, error) {
+	if params.WebAuthnRPID == "" {
+		return nil, nil
+	}
+	config, err := webauthn.NewConfig(params.Location, params.WebAuthnRPID, "")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	config.AttestationRoots = params.WebAuthnAttestationRoots
+	kv, err := params.ProviderDataStore.KeyValueStore(ctx, webauthnDataStore)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &webauthnChecker{
+		params: params,
+		config: config,
+		kv:     kv,
+	}, nil
+}
+
+// required reports whether the given identity must complete a security
+// key challenge before a discharge token can be issued. This is the
+// case if the identity has registered a security key, or if it is a
+// member of any of the groups that are required to use security keys.
+func (c *webauthnChecker) required(ctx context.Context, id *store.Identity) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	aid, err := c.params.Authorizer.Identity(ctx, id.Username)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	sid, err := aid.StoreIdentity(ctx)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	creds, err := webauthn.Credentials(sid)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	if len(creds) > 0 {
+		return true, nil
+	}
+	return memberOfAny(ctx, aid, c.params.WebAuthnRequiredGroups)
+}
+
+// challenge starts a new security key challenge for the given identity
+// and writes the challenge page to w. If the identity has no registered
+// security keys the user is asked to register one.
+func (c *webauthnChecker) challenge(ctx context.Context, w http.ResponseWriter, dischargeID string, id *store.Identity) error {
+	ch := webauthnChallenge{
+		DischargeID: dischargeID,
+		Username:    id.Username,
+	}
+	if err := c.newOptions(ctx, &ch); err != nil {
+		return errgo.Mask(err)
+	}
+	state, err := newChallengeState()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.putChallenge(ctx, state, &ch); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(c.writeChallengePage(w, state, &ch, ""))
+}
+
+// newOptions sets new security key options, with a new random
+// challenge, on the given challenge.
+func (c *webauthnChecker) newOptions(ctx context.Context, ch *webauthnChallenge) error {
+	id := store.Identity{
+		Username: ch.Username,
+	}
+	if err := c.params.Store.Identity(ctx, &id); err != nil {
+		return errgo.Mask(err)
+	}
+	creds, err := webauthn.Credentials(&id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	ch.Creation, ch.Request = nil, nil
+	if len(creds) == 0 {
+		displayName := id.Name
+		if displayName == "" {
+			displayName = id.Username
+		}
+		ch.Creation, err = c.config.NewCreationOptions(webauthn.User{
+			ID:          webauthn.Bytes(id.ID),
+			Name:        id.Username,
+			DisplayName: displayName,
+		}, nil)
+		return errgo.Mask(err)
+	}
+	// The first factor has already been checked so the security key
+	// only needs to prove the user's presence.
+	ch.Request, err = c.config.NewRequestOptions(creds, webauthn.UserVerificationDiscouraged)
+	return errgo.Mask(err)
+}
+
+// writeChallengePage writes the page for the given challenge to w.
+func (c *webauthnChecker) writeChallengePage(w http.ResponseWriter, state string, ch *webauthnChallenge, errMsg string) error {
+	var opts interface{} = ch.Request
+	if ch.Creation != nil {
+		opts = ch.Creation
+	}
+	buf, err := json.Marshal(opts)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	t := c.params.Template.Lookup("webauthn")
+	if t == nil {
+		return errgo.Newf("cannot find webauthn template")
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	return errgo.Mask(t.Execute(w, webauthnPageParams{
+		Action:   c.params.Location + "/login-webauthn",
+		State:    state,
+		Username: ch.Username,
+		Register: ch.Creation != nil,
+		Options:  string(buf),
+		Error:    errMsg,
+	}))
+}
+
+// verify checks the given security key response against the given
+// challenge. If the challenge is for a registration then the new
+// security key is stored on the identity. If the response fails
+// verification an error with a cause of webauthn.ErrVerification is
+// returned.
+func (c *webauthnChecker) verify(ctx context.Context, ch *webauthnChallenge, response string) (*store.Identity, error) {
+	id := store.Identity{
+		Username: ch.Username,
+	}
+	if err := c.params.Store.Identity(ctx, &id); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if ch.Creation != nil {
+		var resp webauthn.AttestationResponse
+		if err := json.Unmarshal([]byte(response), &resp); err != nil {
+			return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid response")
+		}
+		cred, err := c.config.VerifyRegistration(ch.Creation, &resp)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(webauthn.ErrVerification))
+		}
+		if err := webauthn.PutCredential(ctx, c.params.Store, &id, cred); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		auth.Logger(ctx, logger).Infof("%s registered a security key", id.Username)
+		return &id, nil
+	}
+	var resp webauthn.AssertionResponse
+	if err := json.Unmarshal([]byte(response), &resp); err != nil {
+		return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid response")
+	}
+	creds, err := webauthn.Credentials(&id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	cred := webauthn.FindCredential(creds, resp.ID)
+	if cred == nil {
+		return nil, errgo.WithCausef(nil, webauthn.ErrVerification, "unknown security key")
+	}
+	signCount, err := c.config.VerifyAssertion(ch.Request, cred, &resp)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(webauthn.ErrVerification))
+	}
+	cred.SignCount = signCount
+	if err := webauthn.PutCredential(ctx, c.params.Store, &id, cred); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &id, nil
+}
+
+// getChallenge retrieves the challenge with the given state.
+func (c *webauthnChecker) getChallenge(ctx context.Context, state string) (*webauthnChallenge, error) {
+	ctx, close := c.kv.Context(ctx)
+	defer close()
+	buf, err := c.kv.Get(ctx, state)
+	if errgo.Cause(err) == store.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid or expired login state")
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var ch webauthnChallenge
+	if err := json.Unmarshal(buf, &ch); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if ch.Username == "" {
+		// The challenge has been completed.
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid or expired login state")
+	}
+	return &ch, nil
+}
+
+// putChallenge stores the given challenge with the given state.
+func (c *webauthnChecker) putChallenge(ctx context.Context, state string, ch *webauthnChallenge) error {
+	buf, err := json.Marshal(ch)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	ctx, close := c.kv.Context(ctx)
+	defer close()
+	return errgo.Mask(c.kv.Set(ctx, state, buf, time.Now().Add(webauthnChallengeDuration)))
+}
+
+// removeChallenge ensures that the challenge with the given state can
+// no longer be used.
+func (c *webauthnChecker) removeChallenge(ctx context.Context, state string) {
+	if err := c.putChallenge(ctx, state, &webauthnChallenge{}); err != nil {
+		auth.Logger(ctx, logger).Errorf("cannot remove security key challenge: %s", err)
+	}
+}
+
+// webauthnRequest is a request to complete a security key challenge.
+type webauthnRequest struct {
+	httprequest.Route `httprequest:"POST /login-webauthn"`
+	State             string `httprequest:"state,form"`
+	Response          string `httprequest:"response,form"`
+}
+
+// LoginWebAuthn handles the POST /login-webauthn endpoint that is used
+// to complete a security key challenge.
+func (h *handler) LoginWebAuthn(p httprequest.Params, r *webauthnRequest) {
+	h.params.visitCompleter.completeWebAuthn(p.Context, p.Response, p.Request, r.State, r.Response)
+}
@@ -0,0 +1,283 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger_test
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/discharger"
+	"github.com/CanonicalLtd/blues-identity/internal/identity"
+	"github.com/CanonicalLtd/blues-identity/internal/idmtest"
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn"
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn/webauthntest"
+	"github.com/CanonicalLtd/blues-identity/meeting"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+const webauthnLocation = "https://idm.example.com"
+
+type webauthnSuite struct {
+	idmtest.StoreSuite
+
+	meetingPlace  *meeting.Place
+	vc            idp.VisitCompleter
+	authenticator *webauthntest.Authenticator
+}
+
+var _ = gc.Suite(&webauthnSuite{})
+
+var webauthnTemplate = template.Must(template.New("").Parse(`
+{{define "login"}}login {{.Username}}{{end}}
+{{define "totp"}}totp {{.Username}}{{end}}
+{{define "webauthn"}}{{.State}}|{{.Register}}|{{.Options}}|{{.Error}}{{end}}
+`))
+
+func (s *webauthnSuite) SetUpTest(c *gc.C) {
+	s.StoreSuite.SetUpTest(c)
+
+	oven := bakery.NewOven(bakery.OvenParams{
+		Namespace: auth.Namespace,
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return s.BakeryRootKeyStore
+		},
+		Key:      bakery.MustGenerateKey(),
+		Location: "idmtest",
+	})
+	var err error
+	s.meetingPlace, err = meeting.NewPlace(meeting.Params{
+		Store:      s.MeetingStore,
+		Metrics:    monitoring.NewMeetingMetrics(),
+		ListenAddr: "localhost",
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+	s.vc = discharger.NewVisitCompleter(identity.HandlerParams{
+		ServerParams: identity.ServerParams{
+			Store:                  s.Store,
+			ProviderDataStore:      s.ProviderDataStore,
+			MeetingStore:           s.MeetingStore,
+			RootKeyStore:           s.BakeryRootKeyStore,
+			Template:               webauthnTemplate,
+			Location:               webauthnLocation,
+			TOTPKey:                &key,
+			TOTPRequiredGroups:     []string{"users"},
+			WebAuthnRPID:           "idm.example.com",
+			WebAuthnRequiredGroups: []string{"admin"},
+		},
+		MeetingPlace: s.meetingPlace,
+		Oven:         oven,
+		Authorizer: auth.New(auth.Params{
+			Store: s.Store,
+		}),
+	})
+	s.authenticator = webauthntest.NewAuthenticator(webauthnLocation)
+
+	s.addIdentity(c, "alice", "admin")
+	s.addIdentity(c, "bob", "users")
+	s.addIdentity(c, "carol")
+}
+
+func (s *webauthnSuite) TearDownTest(c *gc.C) {
+	s.meetingPlace.Close()
+	s.StoreSuite.TearDownTest(c)
+}
+
+func (s *webauthnSuite) addIdentity(c *gc.C, username string, groups ...string) {
+	err := s.Store.UpdateIdentity(context.Background(), &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", username),
+		Username:   username,
+		Groups:     groups,
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+}
+
+// login calls Success on the visit completer for the given user and
+// returns the body of the response.
+func (s *webauthnSuite) login(c *gc.C, ctx context.Context, username string) string {
+	req, err := http.NewRequest("GET", "", nil)
+	c.Assert(err, gc.Equals, nil)
+	rr := httptest.NewRecorder()
+	s.vc.Success(ctx, rr, req, "", &store.Identity{
+		Username: username,
+	})
+	c.Assert(rr.Code, gc.Equals, http.StatusOK, gc.Commentf("%s", rr.Body))
+	return rr.Body.String()
+}
+
+// webauthnPage holds the contents of a rendered "webauthn" template.
+type webauthnPage struct {
+	state    string
+	register bool
+	options  string
+	error    string
+}
+
+func parseWebAuthnPage(c *gc.C, body string) webauthnPage {
+	parts := strings.Split(body, "|")
+	c.Assert(parts, gc.HasLen, 4, gc.Commentf("%s", body))
+	c.Assert(parts[0], gc.Not(gc.Equals), "")
+	return webauthnPage{
+		state:    parts[0],
+		register: parts[1] == "true",
+		// The options are escaped for use in a JavaScript string.
+		options: strings.Replace(parts[2], `&#34;`, `"`, -1),
+		error:   parts[3],
+	}
+}
+
+// challenge logs in as the given user and returns the challenge page.
+func (s *webauthnSuite) challenge(c *gc.C, username string) webauthnPage {
+	return parseWebAuthnPage(c, s.login(c, context.Background(), username))
+}
+
+// complete completes the challenge with the given state using the
+// given security key response and returns the response.
+func (s *webauthnSuite) complete(c *gc.C, state string, resp interface{}) *httptest.ResponseRecorder {
+	buf, err := json.Marshal(resp)
+	c.Assert(err, gc.Equals, nil)
+	req, err := http.NewRequest("POST", "", nil)
+	c.Assert(err, gc.Equals, nil)
+	rr := httptest.NewRecorder()
+	discharger.CompleteWebAuthn(s.vc, rr, req, state, string(buf))
+	return rr
+}
+
+// register registers s.authenticator for the given user.
+func (s *webauthnSuite) register(c *gc.C, username string) {
+	p := s.challenge(c, username)
+	c.Assert(p.register, gc.Equals, true)
+	var opts webauthn.CreationOptions
+	err := json.Unmarshal([]byte(p.options), &opts)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Create(&opts)
+	c.Assert(err, gc.Equals, nil)
+	rr := s.complete(c, p.state, resp)
+	c.Assert(rr.Code, gc.Equals, http.StatusOK, gc.Commentf("%s", rr.Body))
+	c.Assert(rr.Body.String(), gc.Equals, "login "+username)
+}
+
+// assertion responds to the given challenge page using
+// s.authenticator.
+func (s *webauthnSuite) assertion(c *gc.C, p webauthnPage) *webauthn.AssertionResponse {
+	c.Assert(p.register, gc.Equals, false)
+	var opts webauthn.RequestOptions
+	err := json.Unmarshal([]byte(p.options), &opts)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Get(&opts)
+	c.Assert(err, gc.Equals, nil)
+	return resp
+}
+
+func (s *webauthnSuite) TestLoginNotRequired(c *gc.C) {
+	c.Assert(s.login(c, context.Background(), "carol"), gc.Equals, "login carol")
+}
+
+func (s *webauthnSuite) TestRegister(c *gc.C) {
+	s.register(c, "alice")
+	id := store.Identity{Username: "alice"}
+	err := s.Store.Identity(context.Background(), &id)
+	c.Assert(err, gc.Equals, nil)
+	creds, err := webauthn.Credentials(&id)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(creds, gc.HasLen, 1)
+}
+
+func (s *webauthnSuite) TestLoginWithSecurityKey(c *gc.C) {
+	s.register(c, "alice")
+	p := s.challenge(c, "alice")
+	resp := s.assertion(c, p)
+	rr := s.complete(c, p.state, resp)
+	c.Assert(rr.Code, gc.Equals, http.StatusOK, gc.Commentf("%s", rr.Body))
+	c.Assert(rr.Body.String(), gc.Equals, "login alice")
+
+	// The challenge cannot be reused.
+	rr = s.complete(c, p.state, resp)
+	c.Assert(rr.Code, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *webauthnSuite) TestSecurityKeyPreferredOverTOTP(c *gc.C) {
+	c.Assert(s.login(c, context.Background(), "bob"), gc.Equals, "totp bob")
+
+	// Once bob has a security key it is used instead of TOTP.
+	config, err := webauthn.NewConfig(webauthnLocation, "", "")
+	c.Assert(err, gc.Equals, nil)
+	id := store.Identity{Username: "bob"}
+	err = s.Store.Identity(context.Background(), &id)
+	c.Assert(err, gc.Equals, nil)
+	opts, err := config.NewCreationOptions(webauthn.User{
+		ID:   webauthn.Bytes(id.ID),
+		Name: id.Username,
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Create(opts)
+	c.Assert(err, gc.Equals, nil)
+	cred, err := config.VerifyRegistration(opts, resp)
+	c.Assert(err, gc.Equals, nil)
+	err = webauthn.PutCredential(context.Background(), s.Store, &id, cred)
+	c.Assert(err, gc.Equals, nil)
+
+	p := s.challenge(c, "bob")
+	rr := s.complete(c, p.state, s.assertion(c, p))
+	c.Assert(rr.Body.String(), gc.Equals, "login bob")
+}
+
+func (s *webauthnSuite) TestVerificationFailed(c *gc.C) {
+	s.register(c, "alice")
+	p := s.challenge(c, "alice")
+	resp := s.assertion(c, p)
+	resp.Signature[len(resp.Signature)-1] ^= 1
+	for i := 0; i < 4; i++ {
+		rr := s.complete(c, p.state, resp)
+		c.Assert(rr.Code, gc.Equals, http.StatusOK)
+		p2 := parseWebAuthnPage(c, rr.Body.String())
+		c.Assert(p2.state, gc.Equals, p.state)
+		c.Assert(p2.error, gc.Equals, "Security key verification failed, please try again.")
+		// Each attempt has a new challenge.
+		c.Assert(p2.options, gc.Not(gc.Equals), p.options)
+		p = p2
+	}
+	rr := s.complete(c, p.state, resp)
+	c.Assert(rr.Code, gc.Equals, http.StatusUnauthorized)
+}
+
+func (s *webauthnSuite) TestInvalidResponse(c *gc.C) {
+	p := s.challenge(c, "alice")
+	rr := s.complete(c, p.state, "not a response")
+	c.Assert(rr.Code, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *webauthnSuite) TestMultiFactorLogin(c *gc.C) {
+	ctx := idp.ContextWithMultiFactor(context.Background())
+	c.Assert(s.login(c, ctx, "alice"), gc.Equals, "login alice")
+}
+
+func (s *webauthnSuite) TestDischargeTokenRequiresInteractiveLogin(c *gc.C) {
+	dt := discharger.NewDischargeTokenCreator(s.vc)
+	_, err := dt.DischargeToken(context.Background(), "", &store.Identity{
+		Username: "alice",
+	})
+	c.Assert(err, gc.ErrorMatches, `two-factor authentication required, use an interactive login`)
+
+	tok, err := dt.DischargeToken(context.Background(), "", &store.Identity{
+		Username: "carol",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tok.Kind, gc.Equals, "macaroon")
+}
@@ -11,6 +11,9 @@ import (
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/juju/idmclient.v1/params"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
 )
 
 // ErrLoginRequired is returned by the /debug/* endpoints when OpenID
@@ -47,10 +50,14 @@ func errToResp(ctx context.Context, err error) (int, interface{}) {
 		status = http.StatusMethodNotAllowed
 	case params.ErrServiceUnavailable:
 		status = http.StatusServiceUnavailable
+	case apiparams.ErrTooManyRequests:
+		status = http.StatusTooManyRequests
+	case apiparams.ErrConflict:
+		status = http.StatusConflict
 	}
 
 	if status == http.StatusInternalServerError {
-		logger.Errorf("Internal Server Error: %s (%s)", err, errgo.Details(err))
+		auth.Logger(ctx, logger).Errorf("Internal Server Error: %s (%s)", err, errgo.Details(err))
 	}
 
 	return status, errorBody
@@ -4,16 +4,21 @@
 package identity
 
 import (
+	"crypto/x509"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/loggo"
 	"github.com/juju/utils/debugstatus"
 	"github.com/julienschmidt/httprouter"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
@@ -23,6 +28,7 @@ import (
 	"github.com/CanonicalLtd/blues-identity/idp"
 	"github.com/CanonicalLtd/blues-identity/internal/auth"
 	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
 	"github.com/CanonicalLtd/blues-identity/meeting"
 	"github.com/CanonicalLtd/blues-identity/store"
 )
@@ -66,65 +72,235 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		Locator:            locator,
 		Location:           "identity",
 	})
-	auth := auth.New(auth.Params{
-		AdminUsername:     sp.AuthUsername,
-		AdminPassword:     sp.AuthPassword,
-		Location:          sp.Location,
-		MacaroonVerifier:  oven,
-		Store:             sp.Store,
-		IdentityProviders: sp.IdentityProviders,
-	})
-	if err := auth.SetAdminPublicKey(context.Background(), sp.AdminAgentPublicKey); err != nil {
+	limiter, err := newLimiter(sp)
+	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-
+	tokenStore, err := newKeyValueStore(sp, tokenDataStore)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create token store")
+	}
+	aliasStore, err := newKeyValueStore(sp, aliasDataStore)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create alias store")
+	}
+	disabledStore, err := newKeyValueStore(sp, disabledDataStore)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create disabled store")
+	}
 	place, err := meeting.NewPlace(meeting.Params{
 		Store:       sp.MeetingStore,
 		Metrics:     monitoring.NewMeetingMetrics(),
 		ListenAddr:  sp.PrivateAddr,
+		PubSub:      sp.MeetingPubSub,
 		WaitTimeout: sp.WaitTimeout,
 	})
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot create meeting place")
 	}
 
-	// Create the HTTP server.
 	srv := &Server{
-		router:       httprouter.New(),
-		meetingPlace: place,
+		params:        sp,
+		versions:      versions,
+		oven:          oven,
+		limiter:       limiter,
+		tokenStore:    tokenStore,
+		aliasStore:    aliasStore,
+		disabledStore: disabledStore,
+		meetingPlace:  place,
+	}
+	hs, err := srv.newHandlerSet(sp)
+	if err != nil {
+		place.Close()
+		return nil, errgo.Mask(err)
+	}
+	if err := hs.authorizer.SetAdminPublicKey(context.Background(), sp.AdminAgentPublicKey); err != nil {
+		hs.cancel()
+		place.Close()
+		return nil, errgo.Mask(err)
 	}
+	srv.handlers.Store(hs)
+	return srv, nil
+}
+
+// handlerSet holds the handlers created for a particular set of identity
+// providers.
+type handlerSet struct {
+	router     *httprouter.Router
+	authorizer *auth.Authorizer
+
+	// cancel cancels the context passed to the handlers in
+	// HandlerParams.Context.
+	cancel context.CancelFunc
+}
+
+// newHandlerSet creates the handlers for all the API versions served by
+// srv using the given parameters.
+func (srv *Server) newHandlerSet(sp ServerParams) (_ *handlerSet, err error) {
+	names := make(map[string]bool)
+	for _, idp := range sp.IdentityProviders {
+		if names[idp.Name()] {
+			return nil, errgo.Newf("duplicate identity provider name %q", idp.Name())
+		}
+		names[idp.Name()] = true
+	}
+	auth := auth.New(auth.Params{
+		AdminUsername:     sp.AuthUsername,
+		AdminPassword:     sp.AuthPassword,
+		AdminPasswordHash: sp.AuthPasswordHash,
+		AdminGroups:       sp.AdminGroups,
+		Location:          sp.Location,
+		MacaroonVerifier:  srv.oven,
+		Store:             sp.Store,
+		IdentityProviders: sp.IdentityProviders,
+		Limiter:           srv.limiter,
+		MaxAgentDepth:     sp.MaxAgentDepth,
+		TokenStore:        srv.tokenStore,
+		AliasStore:        srv.aliasStore,
+		DisabledStore:     srv.disabledStore,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+	router := httprouter.New()
 	// Disable the automatic rerouting in order to maintain
 	// compatibility. It might be worthwhile relaxing this in the
 	// future.
-	srv.router.RedirectTrailingSlash = false
-	srv.router.RedirectFixedPath = false
-	srv.router.NotFound = http.HandlerFunc(notFound)
-	srv.router.MethodNotAllowed = http.HandlerFunc(srv.methodNotAllowed)
-
-	srv.router.Handle("OPTIONS", "/*path", srv.options)
-	srv.router.Handler("GET", "/metrics", prometheus.Handler())
-	srv.router.Handler("GET", "/static/*path", http.StripPrefix("/static", http.FileServer(sp.StaticFileSystem)))
-	for name, newAPI := range versions {
+	router.RedirectTrailingSlash = false
+	router.RedirectFixedPath = false
+	router.NotFound = http.HandlerFunc(notFound)
+	router.MethodNotAllowed = http.HandlerFunc(srv.methodNotAllowed)
+
+	router.Handle("OPTIONS", "/*path", srv.options)
+	router.Handler("GET", "/metrics", prometheus.Handler())
+	router.Handler("GET", "/static/*path", http.StripPrefix("/static", http.FileServer(sp.StaticFileSystem)))
+	for name, newAPI := range srv.versions {
 		handlers, err := newAPI(HandlerParams{
 			ServerParams: sp,
-			Oven:         oven,
+			Context:      ctx,
+			Oven:         srv.oven,
 			Authorizer:   auth,
-			MeetingPlace: place,
+			MeetingPlace: srv.meetingPlace,
+			Limiter:      srv.limiter,
 		})
 		if err != nil {
 			return nil, errgo.Notef(err, "cannot create API %s", name)
 		}
 		for _, h := range handlers {
-			srv.router.Handle(h.Method, h.Path, h.Handle)
+			router.Handle(h.Method, h.Path, h.Handle)
 		}
 	}
-	return srv, nil
+	return &handlerSet{
+		router:     router,
+		authorizer: auth,
+		cancel:     cancel,
+	}, nil
+}
+
+// ReloadIdentityProviders replaces the identity providers used by the
+// server with the given ones, which should not have been initialised.
+// New handlers are created for every API version, initialising the
+// identity providers, and then swapped in atomically. If the handlers
+// cannot be created an error is returned and the server continues to
+// use its existing handlers.
+//
+// The meeting place is shared by the old and new handlers, so logins
+// that are in progress when the identity providers are reloaded can
+// complete as long as their identity provider is still configured.
+func (srv *Server) ReloadIdentityProviders(idps []idp.IdentityProvider) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return errgo.Newf("server is closed")
+	}
+	sp := srv.params
+	sp.IdentityProviders = idps
+	hs, err := srv.newHandlerSet(sp)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	old := srv.handlers.Load().(*handlerSet)
+	srv.handlers.Store(hs)
+	srv.params = sp
+	// Stop any background work in the old identity providers.
+	// Requests that are already being served by the old handlers
+	// are allowed to complete.
+	old.cancel()
+	return nil
+}
+
+// rateLimitDataStore is the name of the KeyValueStore that holds the
+// rate limiter's state.
+const rateLimitDataStore = "ratelimit"
+
+// newLimiter creates the rate limiter specified by the given
+// parameters. A limiter is created even if no limits are specified, as
+// identity providers may specify their own limits for failed logins.
+func newLimiter(sp ServerParams) (*ratelimit.Limiter, error) {
+	kv, err := sp.ProviderDataStore.KeyValueStore(context.Background(), rateLimitDataStore)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create rate limit store")
+	}
+	return ratelimit.New(kv, ratelimit.Params{
+		IPRate:          sp.IPRateLimit,
+		IPBurst:         sp.IPRateBurst,
+		UserRate:        sp.UserRateLimit,
+		UserBurst:       sp.UserRateBurst,
+		MaxFailures:     sp.MaxFailedLogins,
+		LockoutDuration: sp.FailedLoginLockout,
+		TrustedProxies:  sp.TrustedProxies,
+	}), nil
+}
+
+const (
+	// tokenDataStore is the name of the KeyValueStore that holds
+	// personal access tokens.
+	tokenDataStore = "tokens"
+
+	// aliasDataStore is the name of the KeyValueStore that holds the
+	// old usernames of renamed users.
+	aliasDataStore = "aliases"
+
+	// disabledDataStore is the name of the KeyValueStore that records
+	// which users have been disabled.
+	disabledDataStore = "disabled"
+)
+
+// newKeyValueStore creates the named KeyValueStore for use by the
+// server itself. If there is no ProviderDataStore it returns nil, which
+// disables the features that depend on the store.
+func newKeyValueStore(sp ServerParams, name string) (store.KeyValueStore, error) {
+	if sp.ProviderDataStore == nil {
+		return nil, nil
+	}
+	kv, err := sp.ProviderDataStore.KeyValueStore(context.Background(), name)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return kv, nil
 }
 
 // Server serves the identity endpoints.
 type Server struct {
-	router       *httprouter.Router
-	meetingPlace *meeting.Place
+	// handlers holds the *handlerSet currently used to serve
+	// requests.
+	handlers atomic.Value
+
+	versions      map[string]NewAPIHandlerFunc
+	oven          *bakery.Oven
+	limiter       *ratelimit.Limiter
+	tokenStore    store.KeyValueStore
+	aliasStore    store.KeyValueStore
+	disabledStore store.KeyValueStore
+	meetingPlace  *meeting.Place
+
+	// mu guards the fields below and serialises reloads.
+	mu     sync.Mutex
+	params ServerParams
+	closed bool
 }
 
 // ServeHTTP implements http.Handler.
@@ -141,12 +317,19 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Bakery-Protocol-Version, Macaroons, X-Requested-With, Content-Type")
 	w.Header().Set("Access-Control-Cache-Max-Age", "600")
-	srv.router.ServeHTTP(w, req)
+	srv.handlers.Load().(*handlerSet).router.ServeHTTP(w, req)
 }
 
 // Close  closes any resources held by this Handler.
 func (s *Server) Close() {
 	logger.Debugf("Closing Server")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.handlers.Load().(*handlerSet).cancel()
 	s.meetingPlace.Close()
 }
 
@@ -156,6 +339,11 @@ type ServerParams struct {
 	// rendezvous information.
 	MeetingStore meeting.Store
 
+	// MeetingPubSub holds the PubSub that will be used to pass
+	// rendezvous requests between identity servers. If this is nil,
+	// requests are sent directly to the server's PrivateAddr.
+	MeetingPubSub meeting.PubSub
+
 	// ProviderDataStore holds the storeage that can be used by
 	// identity providers to store data that is not associated with
 	// an individual identity.
@@ -168,12 +356,23 @@ type ServerParams struct {
 	// Store holds the identities store for the identity server.
 	Store store.Store
 
-	// AuthUsername holds the username for admin login.
+	// AuthUsername holds the username for admin login. If this is
+	// empty admin login with basic authentication is disabled, and
+	// admin access is only available to the admin agent and members
+	// of AdminGroups.
 	AuthUsername string
 
 	// AuthPassword holds the password for admin login.
 	AuthPassword string
 
+	// AuthPasswordHash holds a bcrypt hash of the password for admin
+	// login. If this is set it is used instead of AuthPassword.
+	AuthPasswordHash string
+
+	// AdminGroups holds the groups whose members have full
+	// administrative access to the identity server.
+	AdminGroups []string
+
 	// Key holds the keypair to use with the bakery service.
 	Key *bakery.KeyPair
 
@@ -212,11 +411,100 @@ type ServerParams struct {
 	// WaitTimeout holds the time after which an interactive discharge wait
 	// request will timeout.
 	WaitTimeout time.Duration
+
+	// TOTPKey holds the key used to encrypt the TOTP secrets of
+	// identities. If this is nil TOTP two-factor authentication is
+	// disabled.
+	TOTPKey *[32]byte
+
+	// TOTPIssuer holds the issuer name that is shown in users'
+	// authenticator applications.
+	TOTPIssuer string
+
+	// TOTPRequiredGroups holds the groups whose members must enrol
+	// in, and use, TOTP two-factor authentication when logging in.
+	TOTPRequiredGroups []string
+
+	// WebAuthnRPID holds the WebAuthn relying party ID used for
+	// security keys. If this is empty security keys cannot be used
+	// as a second authentication factor.
+	WebAuthnRPID string
+
+	// WebAuthnAttestationRoots holds the root certificates of the
+	// authenticator manufacturers that are trusted. If this is set
+	// then only security keys that attest to having been made by
+	// one of those manufacturers can be registered.
+	WebAuthnAttestationRoots *x509.CertPool
+
+	// WebAuthnRequiredGroups holds the groups whose members must
+	// register, and use, a security key when logging in.
+	WebAuthnRequiredGroups []string
+
+	// IPRateLimit holds the average number of authentication
+	// requests per second allowed from a single IP address. If this
+	// is zero requests are not limited by IP address.
+	IPRateLimit float64
+
+	// IPRateBurst holds the number of authentication requests that
+	// may be made from a single IP address in quick succession.
+	IPRateBurst int
+
+	// UserRateLimit holds the average number of authentication
+	// requests per second allowed for a single username. If this is
+	// zero requests are not limited by username.
+	UserRateLimit float64
+
+	// UserRateBurst holds the number of authentication requests that
+	// may be made for a single username in quick succession.
+	UserRateBurst int
+
+	// MaxFailedLogins holds the number of consecutive failed password
+	// logins after which a username is locked out. If this is zero
+	// usernames are never locked out.
+	MaxFailedLogins int
+
+	// FailedLoginLockout holds the length of time for which a
+	// username is locked out after too many failed logins.
+	FailedLoginLockout time.Duration
+
+	// TrustedProxies holds the networks of the proxies that are
+	// trusted to report the address of the client in the
+	// X-Forwarded-For header of a request. The address reported by
+	// a trusted proxy is used for rate limiting.
+	TrustedProxies []*net.IPNet
+
+	// SSHCAKey holds the key of the SSH certificate authority used
+	// to sign SSH user certificates. If this is nil SSH certificates
+	// cannot be issued.
+	SSHCAKey ssh.Signer
+
+	// SSHCertValidity holds the maximum length of time for which
+	// issued SSH certificates are valid. If this is zero
+	// certificates are valid for one hour.
+	SSHCertValidity time.Duration
+
+	// MaxAgentDepth holds the maximum length of a chain of agents,
+	// each created by the previous one. An agent created by a user
+	// that is not an agent has a depth of one. If this is zero agents
+	// cannot create other agents.
+	MaxAgentDepth int
+
+	// Reload, if set, is called when an administrator requests that
+	// the server reload its configuration using the /v1/reload
+	// endpoint. It will usually read the configuration and call
+	// ReloadIdentityProviders on the server.
+	Reload func() error
 }
 
 type HandlerParams struct {
 	ServerParams
 
+	// Context contains a context that is cancelled when the handlers
+	// are replaced, because the identity providers have been
+	// reloaded, or when the server is closed. Any background work
+	// started by the handlers should stop when it is done.
+	Context context.Context
+
 	// Oven contains a bakery.Oven that should be used by handlers to
 	// mint new macaroons.
 	Oven *bakery.Oven
@@ -228,6 +516,11 @@ type HandlerParams struct {
 	// MeetingPlace contains the meeting place that should be used by
 	// handlers to complete rendezvous.
 	MeetingPlace *meeting.Place
+
+	// Limiter contains the rate limiter that should be used by
+	// handlers to limit authentication requests. It may be nil, in
+	// which case requests are not limited.
+	Limiter *ratelimit.Limiter
 }
 
 //notFound is the handler that is called when a handler cannot be found
@@ -245,7 +538,7 @@ func (s *Server) methodNotAllowed(w http.ResponseWriter, req *http.Request) {
 		if method == req.Method {
 			continue
 		}
-		if h, _, _ := s.router.Lookup(method, req.URL.Path); h != nil {
+		if h, _, _ := s.handlers.Load().(*handlerSet).router.Lookup(method, req.URL.Path); h != nil {
 			WriteError(context.TODO(), w, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed for %s", req.Method, req.URL.Path))
 			return
 		}
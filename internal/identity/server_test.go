@@ -229,6 +229,75 @@ func (s *serverSuite) TestServerStaticFiles(c *gc.C) {
 	c.Assert(rr.Body.String(), gc.Equals, "test file")
 }
 
+func (s *serverSuite) TestReloadIdentityProviders(c *gc.C) {
+	var contexts []context.Context
+	newAPI := func(p identity.HandlerParams) ([]httprequest.Handler, error) {
+		var hs []httprequest.Handler
+		for _, ip := range p.IdentityProviders {
+			if err := ip.Init(p.Context, idp.InitParams{}); err != nil {
+				return nil, err
+			}
+			name := ip.Name()
+			hs = append(hs, httprequest.Handler{
+				Method: "GET",
+				Path:   "/login/" + name,
+				Handle: func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+					httprequest.WriteJSON(w, http.StatusOK, name)
+				},
+			})
+		}
+		contexts = append(contexts, p.Context)
+		return hs, nil
+	}
+	h, err := identity.New(identity.ServerParams{
+		Store:        s.Store,
+		MeetingStore: s.MeetingStore,
+		IdentityProviders: []idp.IdentityProvider{
+			test.NewIdentityProvider(test.Params{Name: "idp1"}),
+		},
+	}, map[string]identity.NewAPIHandlerFunc{
+		"v1": newAPI,
+	})
+	c.Assert(err, gc.IsNil)
+	defer h.Close()
+	assertServesLogin(c, h, "idp1")
+
+	err = h.ReloadIdentityProviders([]idp.IdentityProvider{
+		test.NewIdentityProvider(test.Params{Name: "idp2"}),
+	})
+	c.Assert(err, gc.IsNil)
+	assertServesLogin(c, h, "idp2")
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: h,
+		URL:     "/login/idp1",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotFound)
+	c.Assert(contexts, gc.HasLen, 2)
+	c.Assert(contexts[0].Err(), gc.Equals, context.Canceled)
+	c.Assert(contexts[1].Err(), gc.IsNil)
+
+	// An invalid set of identity providers leaves the existing
+	// handlers in place.
+	err = h.ReloadIdentityProviders([]idp.IdentityProvider{
+		test.NewIdentityProvider(test.Params{Name: "idp3"}),
+		test.NewIdentityProvider(test.Params{Name: "idp3"}),
+	})
+	c.Assert(err, gc.ErrorMatches, `duplicate identity provider name "idp3"`)
+	assertServesLogin(c, h, "idp2")
+	c.Assert(contexts[1].Err(), gc.IsNil)
+
+	h.Close()
+	c.Assert(contexts[1].Err(), gc.Equals, context.Canceled)
+}
+
+func assertServesLogin(c *gc.C, h http.Handler, name string) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    h,
+		URL:        "/login/" + name,
+		ExpectBody: name,
+	})
+}
+
 func assertServesVersion(c *gc.C, h http.Handler, vers string) {
 	path := vers
 	if path != "" {
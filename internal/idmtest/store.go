@@ -82,6 +82,7 @@ func AssertEqualIdentity(c *gc.C, obtained, expected *store.Identity) {
 	opts := []cmp.Option{
 		cmpopts.EquateEmpty(),
 		cmpopts.SortSlices(func(s, t string) bool { return s < t }),
+		cmpopts.SortSlices(func(s, t store.ProviderIdentity) bool { return s < t }),
 		cmpopts.SortSlices(func(x, y bakery.PublicKey) bool { return string(x.Key[:]) < string(y.Key[:]) }),
 	}
 	msg := cmp.Diff(obtained, expected, opts...)
@@ -0,0 +1,238 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package logging provides request identification and structured JSON
+// logging for the identity server.
+package logging
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+)
+
+// RequestIDHeader is the HTTP header that holds the request ID.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the longest request ID that will be accepted
+// from a client.
+const maxRequestIDLength = 64
+
+// RequestIDHandler returns a handler that assigns an ID to each request
+// before passing it to h. If the request comes from one of the given
+// trusted proxies and already has a valid ID in its X-Request-Id
+// header, that ID is used, otherwise a new random ID is generated. The
+// ID is returned in the X-Request-Id response header and is stored in a
+// new auth.LogFields attached to the request context.
+func RequestIDHandler(h http.Handler, trustedProxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var id string
+		if fromProxy(req, trustedProxies) {
+			id = req.Header.Get(RequestIDHeader)
+		}
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		fields := new(auth.LogFields)
+		fields.Set(auth.LogFieldRequestID, id)
+		h.ServeHTTP(w, req.WithContext(auth.ContextWithLogFields(req.Context(), fields)))
+	})
+}
+
+// fromProxy reports whether the given request was made directly by one
+// of the given proxies.
+func fromProxy(req *http.Request, proxies []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validRequestID reports whether the given request ID supplied by a
+// client is acceptable. To keep the logs readable only short IDs
+// containing letters, digits, '-', '_' and '.' are allowed.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a new random request ID.
+func newRequestID() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(errgo.Notef(err, "cannot generate request ID"))
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// accessLogEntry is the JSON object written to the access log for each
+// request.
+type accessLogEntry struct {
+	Time       time.Time         `json:"time"`
+	RemoteAddr string            `json:"remote-addr"`
+	Method     string            `json:"method"`
+	URI        string            `json:"uri"`
+	Status     int               `json:"status"`
+	Size       int64             `json:"size"`
+	Duration   float64           `json:"duration"`
+	Referer    string            `json:"referer,omitempty"`
+	UserAgent  string            `json:"user-agent,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// AccessLogHandler returns a handler that writes a JSON access log
+// entry to w for each request served by h. The entry includes any
+// fields set in the request's auth.LogFields while the request was
+// handled, so the handler must be wrapped by RequestIDHandler.
+func AccessLogHandler(w io.Writer, h http.Handler) http.Handler {
+	enc := &syncEncoder{enc: json.NewEncoder(w)}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		lw := &loggingResponseWriter{ResponseWriter: rw}
+		h.ServeHTTP(lw, req)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		enc.Encode(accessLogEntry{
+			Time:       start.UTC(),
+			RemoteAddr: req.RemoteAddr,
+			Method:     req.Method,
+			URI:        req.RequestURI,
+			Status:     lw.status,
+			Size:       lw.size,
+			Duration:   time.Since(start).Seconds(),
+			Referer:    req.Referer(),
+			UserAgent:  req.UserAgent(),
+			Fields:     auth.LogFieldsFromContext(req.Context()).Map(),
+		})
+	})
+}
+
+// loggingResponseWriter is an http.ResponseWriter that records the
+// status and size of the response.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader.
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.Write.
+func (w *loggingResponseWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(buf)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher.Flush.
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker.Hijack.
+func (w *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errgo.New("response does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// jsonLogEntry is the JSON object written for each log message by the
+// writer returned from NewJSONWriter.
+type jsonLogEntry struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Module  string            `json:"module"`
+	Caller  string            `json:"caller,omitempty"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// NewJSONWriter returns a loggo.Writer that writes each log message to
+// w as a JSON object on a single line. The fields of messages written
+// with an auth.RequestLogger are written separately from the message.
+func NewJSONWriter(w io.Writer) loggo.Writer {
+	return &jsonWriter{enc: &syncEncoder{enc: json.NewEncoder(w)}}
+}
+
+type jsonWriter struct {
+	enc *syncEncoder
+}
+
+// Write implements loggo.Writer.Write.
+func (w *jsonWriter) Write(entry loggo.Entry) {
+	fields, msg := auth.SplitLogMessage(entry.Message)
+	e := jsonLogEntry{
+		Time:    entry.Timestamp.UTC(),
+		Level:   entry.Level.String(),
+		Module:  entry.Module,
+		Message: msg,
+		Fields:  fields,
+	}
+	if entry.Filename != "" {
+		e.Caller = filepath.Base(entry.Filename) + ":" + strconv.Itoa(entry.Line)
+	}
+	w.enc.Encode(e)
+}
+
+// syncEncoder serializes writes to a json.Encoder so that entries
+// written concurrently are not interleaved.
+type syncEncoder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (e *syncEncoder) Encode(v interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// There's nowhere sensible to report a failure to write a log
+	// entry, so ignore any error.
+	e.enc.Encode(v)
+}
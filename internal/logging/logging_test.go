@@ -0,0 +1,149 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/juju/loggo"
+	gc "gopkg.in/check.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/logging"
+)
+
+type loggingSuite struct{}
+
+var _ = gc.Suite(&loggingSuite{})
+
+func (s *loggingSuite) TestRequestIDHandlerGeneratesID(c *gc.C) {
+	var fields map[string]string
+	h := logging.RequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fields = auth.LogFieldsFromContext(req.Context()).Map()
+	}), nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	id := rr.Header().Get(logging.RequestIDHeader)
+	c.Assert(id, gc.Matches, `[0-9a-f]{32}`)
+	c.Assert(fields, gc.DeepEquals, map[string]string{
+		auth.LogFieldRequestID: id,
+	})
+
+	// Each request gets a different ID.
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	c.Assert(rr.Header().Get(logging.RequestIDHeader), gc.Not(gc.Equals), id)
+}
+
+var requestIDHeaderTests = []struct {
+	about      string
+	remoteAddr string
+	header     string
+	expectID   string
+}{{
+	about:    "valid id",
+	header:   "abc-123_X.y",
+	expectID: "abc-123_X.y",
+}, {
+	about:  "invalid characters",
+	header: "abc 123",
+}, {
+	about:  "too long",
+	header: string(bytes.Repeat([]byte("a"), 65)),
+}, {
+	about:      "untrusted client",
+	remoteAddr: "198.51.100.1:1234",
+	header:     "abc-123_X.y",
+}}
+
+func (s *loggingSuite) TestRequestIDHandlerUsesRequestHeader(c *gc.C) {
+	_, proxies, err := net.ParseCIDR("192.0.2.0/24")
+	c.Assert(err, gc.Equals, nil)
+	h := logging.RequestIDHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), []*net.IPNet{proxies})
+	for i, test := range requestIDHeaderTests {
+		c.Logf("test %d. %s", i, test.about)
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.remoteAddr != "" {
+			req.RemoteAddr = test.remoteAddr
+		}
+		req.Header.Set(logging.RequestIDHeader, test.header)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if test.expectID != "" {
+			c.Assert(rr.Header().Get(logging.RequestIDHeader), gc.Equals, test.expectID)
+		} else {
+			c.Assert(rr.Header().Get(logging.RequestIDHeader), gc.Matches, `[0-9a-f]{32}`)
+		}
+	}
+}
+
+func (s *loggingSuite) TestAccessLogHandler(c *gc.C) {
+	var buf bytes.Buffer
+	_, proxies, err := net.ParseCIDR("192.0.2.1/32")
+	c.Assert(err, gc.Equals, nil)
+	h := logging.RequestIDHandler(logging.AccessLogHandler(&buf, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := auth.ContextWithDischargeID(req.Context(), "1234")
+		ctx = auth.ContextWithIDP(ctx, "test")
+		auth.ContextWithUsername(ctx, "bob")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	})), []*net.IPNet{proxies})
+	req := httptest.NewRequest("GET", "/login?did=1234", nil)
+	req.Header.Set(logging.RequestIDHeader, "req-1")
+	req.Header.Set("User-Agent", "test-agent")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &entry)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entry["time"], gc.NotNil)
+	c.Assert(entry["duration"], gc.NotNil)
+	delete(entry, "time")
+	delete(entry, "duration")
+	c.Assert(entry, gc.DeepEquals, map[string]interface{}{
+		"remote-addr": "192.0.2.1:1234",
+		"method":      "GET",
+		"uri":         "/login?did=1234",
+		"status":      float64(http.StatusTeapot),
+		"size":        float64(5),
+		"user-agent":  "test-agent",
+		"fields": map[string]interface{}{
+			"request-id":   "req-1",
+			"discharge-id": "1234",
+			"idp":          "test",
+			"username":     "bob",
+		},
+	})
+}
+
+func (s *loggingSuite) TestJSONWriter(c *gc.C) {
+	var buf bytes.Buffer
+	w := logging.NewJSONWriter(&buf)
+	w.Write(loggo.Entry{
+		Level:     loggo.WARNING,
+		Module:    "identity.test",
+		Filename:  "/src/identity/test.go",
+		Line:      42,
+		Timestamp: time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+		Message:   "something happened",
+	})
+	c.Assert(buf.String(), gc.Equals, `{"time":"2018-01-02T03:04:05Z","level":"WARNING","module":"identity.test","caller":"test.go:42","message":"something happened"}`+"\n")
+}
+
+func (s *loggingSuite) TestJSONWriterRequestFields(c *gc.C) {
+	var buf bytes.Buffer
+	w := logging.NewJSONWriter(&buf)
+	w.Write(loggo.Entry{
+		Level:     loggo.INFO,
+		Module:    "identity.test",
+		Timestamp: time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+		Message:   "[request-id=req-1 username=bob] something happened",
+	})
+	c.Assert(buf.String(), gc.Equals, `{"time":"2018-01-02T03:04:05Z","level":"INFO","module":"identity.test","message":"something happened","fields":{"request-id":"req-1","username":"bob"}}`+"\n")
+}
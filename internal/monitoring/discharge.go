@@ -0,0 +1,76 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dischargesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blues_identity",
+		Subsystem: "discharger",
+		Name:      "discharges_total",
+		Help:      "The number of discharge requests by caveat condition and outcome.",
+	}, []string{"condition", "outcome"})
+	dischargeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "blues_identity",
+		Subsystem: "discharger",
+		Name:      "discharge_duration_seconds",
+		Help:      "The time taken to check a third party caveat by caveat condition and outcome.",
+	}, []string{"condition", "outcome"})
+	loginsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blues_identity",
+		Subsystem: "discharger",
+		Name:      "logins_total",
+		Help:      "The number of completed logins by identity provider and outcome.",
+	}, []string{"idp", "outcome"})
+	rendezvousWaitDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "blues_identity",
+		Subsystem: "rendevous",
+		Name:      "wait_duration_seconds",
+		Help:      "The time spent waiting for a rendezvous to complete.",
+		Buckets:   []float64{.1, .5, 1, 5, 10, 30, 60, 120, 300},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(dischargesTotal)
+	prometheus.MustRegister(dischargeDuration)
+	prometheus.MustRegister(loginsTotal)
+	prometheus.MustRegister(rendezvousWaitDuration)
+}
+
+// Outcomes used when reporting discharges and logins.
+const (
+	OutcomeSuccess             = "success"
+	OutcomeFailure             = "failure"
+	OutcomeInteractionRequired = "interaction-required"
+	OutcomeDenied              = "denied"
+	OutcomeBadRequest          = "bad-request"
+	OutcomeThrottled           = "throttled"
+	OutcomeError               = "error"
+)
+
+// ObserveDischarge records a discharge request for a caveat with the
+// given condition that started at the given time and finished with the
+// given outcome.
+func ObserveDischarge(condition, outcome string, startTime time.Time) {
+	dischargesTotal.WithLabelValues(condition, outcome).Inc()
+	dischargeDuration.WithLabelValues(condition, outcome).Observe(float64(time.Since(startTime)) / float64(time.Second))
+}
+
+// LoginCompleted records a login attempt using the given identity
+// provider that finished with the given outcome.
+func LoginCompleted(idp, outcome string) {
+	loginsTotal.WithLabelValues(idp, outcome).Inc()
+}
+
+// ObserveRendezvousWait records the time spent waiting for a rendezvous
+// that started at the given time.
+func ObserveRendezvousWait(startTime time.Time) {
+	rendezvousWaitDuration.Observe(float64(time.Since(startTime)) / float64(time.Second))
+}
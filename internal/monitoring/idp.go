@@ -0,0 +1,40 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	getGroupsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "blues_identity",
+		Subsystem: "idp",
+		Name:      "get_groups_duration_seconds",
+		Help:      "The time taken to retrieve a user's groups from an identity provider.",
+	}, []string{"idp"})
+	getGroupsErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blues_identity",
+		Subsystem: "idp",
+		Name:      "get_groups_errors_total",
+		Help:      "The number of failed attempts to retrieve a user's groups from an identity provider.",
+	}, []string{"idp"})
+)
+
+func init() {
+	prometheus.MustRegister(getGroupsDuration)
+	prometheus.MustRegister(getGroupsErrors)
+}
+
+// ObserveGetGroups records a call to the GetGroups method of the given
+// identity provider that started at the given time and returned the
+// given error.
+func ObserveGetGroups(idp string, startTime time.Time, err error) {
+	getGroupsDuration.WithLabelValues(idp).Observe(float64(time.Since(startTime)) / float64(time.Second))
+	if err != nil {
+		getGroupsErrors.WithLabelValues(idp).Inc()
+	}
+}
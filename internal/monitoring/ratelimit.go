@@ -0,0 +1,25 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var throttledTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "blues_identity",
+	Subsystem: "ratelimit",
+	Name:      "throttled_total",
+	Help:      "The number of requests refused by rate limiting by endpoint and reason.",
+}, []string{"endpoint", "reason"})
+
+func init() {
+	prometheus.MustRegister(throttledTotal)
+}
+
+// RequestThrottled records a request to the given endpoint that was
+// refused for the given reason.
+func RequestThrottled(endpoint, reason string) {
+	throttledTotal.WithLabelValues(endpoint, reason).Inc()
+}
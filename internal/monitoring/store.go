@@ -0,0 +1,66 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+var storeOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "blues_identity",
+	Subsystem: "store",
+	Name:      "operation_duration_seconds",
+	Help:      "The duration of identity store operations by backend and operation.",
+}, []string{"backend", "operation"})
+
+func init() {
+	prometheus.MustRegister(storeOperationDuration)
+}
+
+// InstrumentStore returns a store.Store that records the duration of
+// each operation on s, which is labelled with the given backend name.
+func InstrumentStore(s store.Store, backend string) store.Store {
+	return &instrumentedStore{
+		Store:   s,
+		backend: backend,
+	}
+}
+
+type instrumentedStore struct {
+	store.Store
+	backend string
+}
+
+func (s *instrumentedStore) observe(operation string, startTime time.Time) {
+	storeOperationDuration.WithLabelValues(s.backend, operation).Observe(float64(time.Since(startTime)) / float64(time.Second))
+}
+
+// Identity implements store.Store.Identity.
+func (s *instrumentedStore) Identity(ctx context.Context, identity *store.Identity) error {
+	defer s.observe("identity", time.Now())
+	return s.Store.Identity(ctx, identity)
+}
+
+// FindIdentities implements store.Store.FindIdentities.
+func (s *instrumentedStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
+	defer s.observe("find_identities", time.Now())
+	return s.Store.FindIdentities(ctx, ref, filter, sort, skip, limit)
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s *instrumentedStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	defer s.observe("update_identity", time.Now())
+	return s.Store.UpdateIdentity(ctx, identity, update)
+}
+
+// RemoveIdentity implements store.Store.RemoveIdentity.
+func (s *instrumentedStore) RemoveIdentity(ctx context.Context, identity *store.Identity) error {
+	defer s.observe("remove_identity", time.Now())
+	return s.Store.RemoveIdentity(ctx, identity)
+}
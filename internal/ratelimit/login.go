@@ -0,0 +1,59 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ratelimit
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/idp"
+)
+
+// loginLimiter is an idp.LoginLimiter that limits logins through an
+// identity provider using a Limiter.
+type loginLimiter struct {
+	limiter *Limiter
+	idp     string
+}
+
+// NewLoginLimiter returns an idp.LoginLimiter for the given identity
+// provider, or nil if l is nil. If the identity provider implements
+// idp.LockoutPolicy its limits are used for failed logins.
+func NewLoginLimiter(l *Limiter, ip idp.IdentityProvider) idp.LoginLimiter {
+	if l == nil {
+		return nil
+	}
+	if lp, ok := ip.(idp.LockoutPolicy); ok {
+		l = l.WithLockout(lp.LockoutPolicy())
+	}
+	return &loginLimiter{
+		limiter: l,
+		idp:     ip.Name(),
+	}
+}
+
+// Allow implements idp.LoginLimiter.Allow.
+func (l *loginLimiter) Allow(ctx context.Context, req *http.Request, username string) error {
+	if err := l.limiter.Allow(ctx, l.idp, l.limiter.ClientIP(req), username); err != nil {
+		return errgo.Mask(err, IsLimitError)
+	}
+	return nil
+}
+
+// LoginFailed implements idp.LoginLimiter.LoginFailed.
+func (l *loginLimiter) LoginFailed(ctx context.Context, req *http.Request, username string) {
+	l.limiter.LoginFailed(ctx, l.limiter.ClientIP(req), username)
+}
+
+// LoginSucceeded implements idp.LoginLimiter.LoginSucceeded.
+func (l *loginLimiter) LoginSucceeded(ctx context.Context, req *http.Request, username string) {
+	l.limiter.LoginSucceeded(ctx, l.limiter.ClientIP(req), username)
+}
+
+// Unlock implements idp.LoginLimiter.Unlock.
+func (l *loginLimiter) Unlock(ctx context.Context, username string) {
+	l.limiter.Unlock(ctx, username)
+}
@@ -0,0 +1,449 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package ratelimit limits the rate at which clients may make
+// authentication requests, and locks out usernames after repeated
+// failed logins from a client. The limit state is held in a
+// store.KeyValueStore so that it is shared by all identity servers using
+// the same database.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/utils/clock"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/idmclient.v1/params"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+var logger = loggo.GetLogger("identity.internal.ratelimit")
+
+// defaultLockoutDuration is the lockout duration used when MaxFailures
+// is specified without LockoutDuration.
+const defaultLockoutDuration = 15 * time.Minute
+
+// Params holds the parameters for a Limiter. A rate of zero means that
+// requests are not limited on that basis.
+type Params struct {
+	// IPRate holds the average number of requests per second that
+	// may be made from a single IP address.
+	IPRate float64
+
+	// IPBurst holds the number of requests that may be made from a
+	// single IP address in quick succession. If this is less than one
+	// then one is used.
+	IPBurst int
+
+	// UserRate holds the average number of requests per second that
+	// may be made for a single username.
+	UserRate float64
+
+	// UserBurst holds the number of requests that may be made for a
+	// single username in quick succession. If this is less than one
+	// then one is used.
+	UserBurst int
+
+	// MaxFailures holds the number of failed logins from a single
+	// client within LockoutDuration after which a username is locked
+	// out for that client. If this is zero usernames are never
+	// locked out.
+	MaxFailures int
+
+	// LockoutDuration holds the length of time for which a username
+	// is locked out. If this is zero 15 minutes is used.
+	LockoutDuration time.Duration
+
+	// TrustedProxies holds the networks of the proxies that are
+	// trusted to report the address of the client in the
+	// X-Forwarded-For header of a request, see ClientIP.
+	TrustedProxies []*net.IPNet
+
+	// Clock holds the clock used by the limiter. If this is nil the
+	// wall clock is used.
+	Clock clock.Clock
+}
+
+// A Limiter limits requests using token buckets per client IP address
+// and per username. It is safe to call methods on a nil *Limiter, in
+// which case nothing is limited.
+//
+// IPv6 clients are limited by /64 network rather than by address, as a
+// single client is commonly given a whole /64.
+type Limiter struct {
+	kv     store.KeyValueStore
+	params Params
+}
+
+// New returns a new Limiter that stores its state in the given store.
+func New(kv store.KeyValueStore, p Params) *Limiter {
+	if p.IPBurst < 1 {
+		p.IPBurst = 1
+	}
+	if p.UserBurst < 1 {
+		p.UserBurst = 1
+	}
+	if p.LockoutDuration == 0 {
+		p.LockoutDuration = defaultLockoutDuration
+	}
+	if p.Clock == nil {
+		p.Clock = clock.WallClock
+	}
+	return &Limiter{
+		kv:     kv,
+		params: p,
+	}
+}
+
+// IsLimitError reports whether the given error is an *Error. It is
+// suitable for use as an errgo cause predicate.
+func IsLimitError(err error) bool {
+	_, ok := err.(*Error)
+	return ok
+}
+
+// Error is the error returned when a request is refused by a Limiter.
+type Error struct {
+	// Message holds the error message.
+	Message string
+
+	// RetryAfter holds the length of time the client should wait
+	// before trying again.
+	RetryAfter time.Duration
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the error code of the error, which is always
+// apiparams.ErrTooManyRequests.
+func (e *Error) ErrorCode() params.ErrorCode {
+	return apiparams.ErrTooManyRequests
+}
+
+// SetHeader implements httprequest.HeaderSetter by setting the
+// Retry-After header.
+func (e *Error) SetHeader(h http.Header) {
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+}
+
+// Allow checks whether a request to the given endpoint from the given
+// client IP address, on behalf of the given username, is allowed. Either
+// ip or username may be empty if it is not known. If the request is not
+// allowed an error with a cause of type *Error is returned.
+//
+// The endpoint is only used to label metrics, the limits apply across
+// all endpoints.
+func (l *Limiter) Allow(ctx context.Context, endpoint, ip, username string) error {
+	if l == nil {
+		return nil
+	}
+	ctx, close := l.kv.Context(ctx)
+	defer close()
+	ip = clientNetwork(ip)
+	if username != "" && l.params.MaxFailures > 0 {
+		expires, err := l.lockedUntil(ctx, ip, username)
+		if err != nil {
+			// Don't lock users out because the store is unavailable.
+			logger.Warningf("cannot get failed logins for %q: %s", username, err)
+		} else if now := l.params.Clock.Now(); now.Before(expires) {
+			monitoring.RequestThrottled(endpoint, "lockout")
+			return &Error{
+				Message:    fmt.Sprintf("too many failed login attempts for %q, try again later", username),
+				RetryAfter: expires.Sub(now),
+			}
+		}
+	}
+	if ip != "" && l.params.IPRate > 0 {
+		if wait := l.take(ctx, "ip:"+ip, l.params.IPRate, l.params.IPBurst); wait > 0 {
+			monitoring.RequestThrottled(endpoint, "ip")
+			return &Error{
+				Message:    "too many requests, try again later",
+				RetryAfter: wait,
+			}
+		}
+	}
+	if username != "" && l.params.UserRate > 0 {
+		if wait := l.take(ctx, "user:"+username, l.params.UserRate, l.params.UserBurst); wait > 0 {
+			monitoring.RequestThrottled(endpoint, "user")
+			return &Error{
+				Message:    fmt.Sprintf("too many requests for %q, try again later", username),
+				RetryAfter: wait,
+			}
+		}
+	}
+	return nil
+}
+
+// WithLockout returns a Limiter that shares l's state and rate limits
+// but that locks out usernames after maxFailures failed logins for the
+// given duration. If maxFailures is zero l is returned. If duration is
+// zero 15 minutes is used. If l is nil then nil is returned.
+func (l *Limiter) WithLockout(maxFailures int, duration time.Duration) *Limiter {
+	if l == nil || maxFailures == 0 {
+		return l
+	}
+	if duration == 0 {
+		duration = defaultLockoutDuration
+	}
+	l1 := *l
+	l1.params.MaxFailures = maxFailures
+	l1.params.LockoutDuration = duration
+	return &l1
+}
+
+// LoginFailed records a failed login attempt for the given username by
+// the client with the given IP address.
+//
+// Each failure is recorded by adding the first of MaxFailures numbered
+// keys that does not yet exist, so that concurrent failures cannot
+// overwrite one another. The keys are numbered afresh in each period of
+// LockoutDuration, so failures that span the start of a period may not
+// lock the username out until there have been nearly twice MaxFailures
+// of them.
+func (l *Limiter) LoginFailed(ctx context.Context, ip, username string) {
+	if l == nil || l.params.MaxFailures == 0 {
+		return
+	}
+	ctx, close := l.kv.Context(ctx)
+	defer close()
+	ip = clientNetwork(ip)
+	key, err := l.failuresKey(ctx, ip, username)
+	if err != nil {
+		logger.Warningf("cannot record failed login for %q: %s", username, err)
+		return
+	}
+	now := l.params.Clock.Now()
+	period := now.UnixNano() / int64(l.params.LockoutDuration)
+	periodEnd := time.Unix(0, (period+1)*int64(l.params.LockoutDuration))
+	for i := 0; i < l.params.MaxFailures; i++ {
+		err := l.kv.Add(ctx, fmt.Sprintf("%s|%d|%d", key, period, i), []byte(now.Format(time.RFC3339)), periodEnd)
+		if errgo.Cause(err) == store.ErrDuplicateKey {
+			continue
+		}
+		if err != nil {
+			logger.Warningf("cannot record failed login for %q: %s", username, err)
+			return
+		}
+		if i < l.params.MaxFailures-1 {
+			return
+		}
+		break
+	}
+	// This is the last failure allowed, so lock the username out.
+	expires := now.Add(l.params.LockoutDuration)
+	buf, err := expires.MarshalText()
+	if err != nil {
+		logger.Errorf("cannot marshal lockout time: %s", err)
+		return
+	}
+	if err := l.kv.Set(ctx, "locked:"+key, buf, expires); err != nil {
+		logger.Warningf("cannot lock out %q: %s", username, err)
+		return
+	}
+	logger.Infof("%q locked out for %s after %d failed logins from %s", username, l.params.LockoutDuration, l.params.MaxFailures, ip)
+}
+
+// LoginSucceeded clears any record of failed login attempts for the
+// given username by the client with the given IP address.
+func (l *Limiter) LoginSucceeded(ctx context.Context, ip, username string) {
+	if l == nil || l.params.MaxFailures == 0 {
+		return
+	}
+	ctx, close := l.kv.Context(ctx)
+	defer close()
+	if err := l.newGeneration(ctx, clientKey(clientNetwork(ip), username)); err != nil {
+		logger.Warningf("cannot clear failed logins for %q: %s", username, err)
+	}
+}
+
+// Unlock clears any record of failed login attempts for the given
+// username by all clients, so that a username that is locked out may
+// be used again. It is used, for example, when a user's password is
+// reset.
+func (l *Limiter) Unlock(ctx context.Context, username string) {
+	if l == nil || l.params.MaxFailures == 0 {
+		return
+	}
+	ctx, close := l.kv.Context(ctx)
+	defer close()
+	if err := l.newGeneration(ctx, userKey(username)); err != nil {
+		logger.Warningf("cannot unlock %q: %s", username, err)
+	}
+}
+
+// take takes a token from the bucket with the given key, which is
+// refilled at the given rate up to the given burst size. If the bucket
+// is empty it returns the time until a token will be available.
+//
+// Token n of a bucket is added at time n/rate, and may be taken from
+// then until burst tokens later have been added. Each token is taken
+// by adding a numbered key to the store, so that concurrent requests
+// cannot take the same token.
+func (l *Limiter) take(ctx context.Context, key string, rate float64, burst int) time.Duration {
+	now := l.params.Clock.Now()
+	first := int64(float64(now.UnixNano()) / float64(time.Second) * rate)
+	for n := first; n < first+int64(burst); n++ {
+		// Once the next token has been added this token can no
+		// longer be taken, so it needn't be kept.
+		err := l.kv.Add(ctx, fmt.Sprintf("%s|%d", key, n), []byte{1}, tokenTime(n+1, rate))
+		if err == nil {
+			return 0
+		}
+		if errgo.Cause(err) != store.ErrDuplicateKey {
+			// Don't refuse requests because the store is unavailable.
+			logger.Warningf("cannot take rate limit token for %q: %s", key, err)
+			return 0
+		}
+	}
+	return tokenTime(first+1, rate).Sub(now)
+}
+
+// tokenTime returns the time at which token n of a bucket refilled at
+// the given rate is added.
+func tokenTime(n int64, rate float64) time.Time {
+	return time.Unix(0, int64(float64(n)/rate*float64(time.Second)))
+}
+
+// clientNetwork returns the network by which the client with the
+// given IP address is limited. This is the address itself for IPv4
+// clients and the /64 network containing the address for IPv6
+// clients.
+func clientNetwork(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.To4() != nil {
+		return ip
+	}
+	return addr.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// userKey returns the key of the generation of the failed login
+// records for the given username, which is changed by Unlock.
+func userKey(username string) string {
+	return "user:" + strconv.Quote(username)
+}
+
+// clientKey returns the key of the generation of the failed login
+// records for the given username and client IP address, which is
+// changed by LoginSucceeded.
+func clientKey(ip, username string) string {
+	return "client:" + strconv.Quote(username) + "|" + ip
+}
+
+// failuresKey returns the key that identifies the current failed
+// login records for the given username and client IP address. It
+// includes the generations of those records so that starting a new
+// generation discards the old records without having to remove them.
+func (l *Limiter) failuresKey(ctx context.Context, ip, username string) (string, error) {
+	userGen, err := l.generation(ctx, userKey(username))
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	clientGen, err := l.generation(ctx, clientKey(ip, username))
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return fmt.Sprintf("failures:%q|%s|%s|%s", username, ip, userGen, clientGen), nil
+}
+
+// lockedUntil returns the time until which the given username is
+// locked out for the client with the given IP address. If it is not
+// locked out the zero time is returned.
+func (l *Limiter) lockedUntil(ctx context.Context, ip, username string) (time.Time, error) {
+	var t time.Time
+	key, err := l.failuresKey(ctx, ip, username)
+	if err != nil {
+		return t, errgo.Mask(err)
+	}
+	buf, err := l.kv.Get(ctx, "locked:"+key)
+	if errgo.Cause(err) == store.ErrNotFound {
+		return t, nil
+	}
+	if err != nil {
+		return t, errgo.Mask(err)
+	}
+	if err := t.UnmarshalText(buf); err != nil {
+		return t, errgo.Mask(err)
+	}
+	return t, nil
+}
+
+// generation returns the generation stored with the given key, or ""
+// if there is none.
+func (l *Limiter) generation(ctx context.Context, key string) (string, error) {
+	buf, err := l.kv.Get(ctx, key)
+	if errgo.Cause(err) == store.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return string(buf), nil
+}
+
+// newGeneration starts a new generation of the failed login records
+// identified by the given key. Once the generation has been stored for
+// twice LockoutDuration any records from before it will have expired,
+// so it need not be kept any longer.
+func (l *Limiter) newGeneration(ctx context.Context, key string) error {
+	now := l.params.Clock.Now()
+	gen := strconv.FormatInt(now.UnixNano(), 36)
+	return errgo.Mask(l.kv.Set(ctx, key, []byte(gen), now.Add(2*l.params.LockoutDuration)))
+}
+
+// ClientIP returns the IP address of the client that made the given
+// request, or "" if req is nil. If the request was made through trusted
+// proxies, the address is taken from the X-Forwarded-For header, to
+// which each proxy appends the address it received the request from.
+// The address returned is the last one not added by a trusted proxy,
+// as earlier addresses may have been set by the client itself.
+func (l *Limiter) ClientIP(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if l == nil || len(l.params.TrustedProxies) == 0 {
+		return ip
+	}
+	var forwarded []string
+	for _, h := range req.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(h, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(addr))
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0 && l.trustedProxy(ip); i-- {
+		ip = forwarded[i]
+	}
+	return ip
+}
+
+// trustedProxy reports whether the given address is that of a trusted
+// proxy.
+func (l *Limiter) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.params.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
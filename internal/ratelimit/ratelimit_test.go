@@ -0,0 +1,281 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ratelimit_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/juju/testing"
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+	"github.com/CanonicalLtd/blues-identity/internal/ratelimit"
+	"github.com/CanonicalLtd/blues-identity/memstore"
+)
+
+type ratelimitSuite struct {
+	clock *testing.Clock
+}
+
+var _ = gc.Suite(&ratelimitSuite{})
+
+var epoch = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func (s *ratelimitSuite) SetUpTest(c *gc.C) {
+	s.clock = testing.NewClock(epoch)
+}
+
+func (s *ratelimitSuite) newLimiter(c *gc.C, p ratelimit.Params) *ratelimit.Limiter {
+	kv, err := memstore.NewProviderDataStore().KeyValueStore(context.Background(), "ratelimit")
+	c.Assert(err, gc.IsNil)
+	p.Clock = s.clock
+	return ratelimit.New(kv, p)
+}
+
+func (s *ratelimitSuite) TestNilLimiter(c *gc.C) {
+	var l *ratelimit.Limiter
+	ctx := context.Background()
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", "bob"), gc.IsNil)
+	l.LoginFailed(ctx, "192.0.2.1", "bob")
+	l.LoginSucceeded(ctx, "192.0.2.1", "bob")
+	l.Unlock(ctx, "bob")
+	c.Assert(l.WithLockout(5, time.Minute), gc.IsNil)
+}
+
+func (s *ratelimitSuite) TestIPLimit(c *gc.C) {
+	l := s.newLimiter(c, ratelimit.Params{
+		IPRate:  1,
+		IPBurst: 2,
+	})
+	ctx := context.Background()
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", ""), gc.IsNil)
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", ""), gc.IsNil)
+	err := l.Allow(ctx, "test", "192.0.2.1", "")
+	c.Assert(err, gc.ErrorMatches, `too many requests, try again later`)
+	c.Assert(err.(*ratelimit.Error).RetryAfter, gc.Equals, time.Second)
+
+	// Other clients are unaffected.
+	c.Assert(l.Allow(ctx, "test", "192.0.2.2", ""), gc.IsNil)
+
+	// The bucket is refilled over time.
+	s.clock.Advance(time.Second)
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", ""), gc.IsNil)
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", ""), gc.NotNil)
+}
+
+func (s *ratelimitSuite) TestIPLimitConcurrentRequests(c *gc.C) {
+	l := s.newLimiter(c, ratelimit.Params{
+		IPRate:  1,
+		IPBurst: 5,
+	})
+	ctx := context.Background()
+	errs := make(chan error)
+	for i := 0; i < 20; i++ {
+		go func() {
+			errs <- l.Allow(ctx, "test", "192.0.2.1", "")
+		}()
+	}
+	n := 0
+	for i := 0; i < 20; i++ {
+		if <-errs == nil {
+			n++
+		}
+	}
+	c.Assert(n, gc.Equals, 5)
+}
+
+func (s *ratelimitSuite) TestIPv6ClientsLimitedByNetwork(c *gc.C) {
+	l := s.newLimiter(c, ratelimit.Params{
+		IPRate:      1,
+		MaxFailures: 1,
+	})
+	ctx := context.Background()
+	c.Assert(l.Allow(ctx, "test", "2001:db8::1", ""), gc.IsNil)
+	c.Assert(l.Allow(ctx, "test", "2001:db8::2", ""), gc.NotNil)
+	c.Assert(l.Allow(ctx, "test", "2001:db8:0:1::1", ""), gc.IsNil)
+
+	l.LoginFailed(ctx, "2001:db8::1", "bob")
+	s.clock.Advance(time.Minute)
+	c.Assert(l.Allow(ctx, "test", "2001:db8::3", "bob"), gc.ErrorMatches, `too many failed login attempts for "bob", try again later`)
+	c.Assert(l.Allow(ctx, "test", "2001:db8:0:1::1", "bob"), gc.IsNil)
+}
+
+func (s *ratelimitSuite) TestUserLimit(c *gc.C) {
+	l := s.newLimiter(c, ratelimit.Params{
+		UserRate: 0.5,
+	})
+	ctx := context.Background()
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", "bob"), gc.IsNil)
+	err := l.Allow(ctx, "test", "192.0.2.2", "bob")
+	c.Assert(err, gc.ErrorMatches, `too many requests for "bob", try again later`)
+	c.Assert(err.(*ratelimit.Error).RetryAfter, gc.Equals, 2*time.Second)
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", "alice"), gc.IsNil)
+
+	// Requests without a username are not limited.
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", ""), gc.IsNil)
+}
+
+func (s *ratelimitSuite) TestLockout(c *gc.C) {
+	l := s.newLimiter(c, ratelimit.Params{
+		MaxFailures:     2,
+		LockoutDuration: time.Minute,
+	})
+	ctx := context.Background()
+	l.LoginFailed(ctx, "192.0.2.1", "bob")
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", "bob"), gc.IsNil)
+	s.clock.Advance(time.Second)
+	l.LoginFailed(ctx, "192.0.2.1", "bob")
+	err := l.Allow(ctx, "test", "192.0.2.1", "bob")
+	c.Assert(err, gc.ErrorMatches, `too many failed login attempts for "bob", try again later`)
+	c.Assert(err.(*ratelimit.Error).RetryAfter, gc.Equals, time.Minute)
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", "alice"), gc.IsNil)
+
+	// Other clients may still log in as the user.
+	c.Assert(l.Allow(ctx, "test", "192.0.2.2", "bob"), gc.IsNil)
+
+	s.clock.Advance(time.Minute)
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", "bob"), gc.IsNil)
+}
+
+func (s *ratelimitSuite) TestLockoutCountsConcurrentFailures(c *gc.C) {
+	l := s.newLimiter(c, ratelimit.Params{
+		MaxFailures: 3,
+	})
+	ctx := context.Background()
+	done := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		go func() {
+			l.LoginFailed(ctx, "192.0.2.1", "bob")
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", "bob"), gc.ErrorMatches, `too many failed login attempts for "bob", try again later`)
+}
+
+func (s *ratelimitSuite) TestLoginSucceededClearsFailures(c *gc.C) {
+	l := s.newLimiter(c, ratelimit.Params{
+		MaxFailures: 2,
+	})
+	ctx := context.Background()
+	l.LoginFailed(ctx, "192.0.2.1", "bob")
+	l.LoginFailed(ctx, "192.0.2.2", "bob")
+	s.clock.Advance(time.Second)
+	l.LoginSucceeded(ctx, "192.0.2.1", "bob")
+	l.LoginFailed(ctx, "192.0.2.1", "bob")
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", "bob"), gc.IsNil)
+
+	// Failures from other clients are still counted.
+	l.LoginFailed(ctx, "192.0.2.2", "bob")
+	c.Assert(l.Allow(ctx, "test", "192.0.2.2", "bob"), gc.NotNil)
+}
+
+func (s *ratelimitSuite) TestUnlock(c *gc.C) {
+	l := s.newLimiter(c, ratelimit.Params{
+		MaxFailures: 1,
+	})
+	ctx := context.Background()
+	l.LoginFailed(ctx, "192.0.2.1", "bob")
+	l.LoginFailed(ctx, "192.0.2.2", "bob")
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", "bob"), gc.NotNil)
+	c.Assert(l.Allow(ctx, "test", "192.0.2.2", "bob"), gc.NotNil)
+	s.clock.Advance(time.Second)
+	l.Unlock(ctx, "bob")
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", "bob"), gc.IsNil)
+	c.Assert(l.Allow(ctx, "test", "192.0.2.2", "bob"), gc.IsNil)
+}
+
+func (s *ratelimitSuite) TestWithLockout(c *gc.C) {
+	l := s.newLimiter(c, ratelimit.Params{})
+	ctx := context.Background()
+	c.Assert(l.WithLockout(0, 0), gc.Equals, l)
+	l1 := l.WithLockout(1, time.Minute)
+	l1.LoginFailed(ctx, "192.0.2.1", "bob")
+	err := l1.Allow(ctx, "test", "192.0.2.1", "bob")
+	c.Assert(err, gc.ErrorMatches, `too many failed login attempts for "bob", try again later`)
+	c.Assert(err.(*ratelimit.Error).RetryAfter, gc.Equals, time.Minute)
+
+	// The original limiter doesn't lock users out.
+	c.Assert(l.Allow(ctx, "test", "192.0.2.1", "bob"), gc.IsNil)
+}
+
+func (s *ratelimitSuite) TestError(c *gc.C) {
+	err := &ratelimit.Error{
+		Message:    "test",
+		RetryAfter: 1500 * time.Millisecond,
+	}
+	c.Assert(err.ErrorCode(), gc.Equals, apiparams.ErrTooManyRequests)
+	h := make(http.Header)
+	err.SetHeader(h)
+	c.Assert(h.Get("Retry-After"), gc.Equals, "2")
+	c.Assert(ratelimit.IsLimitError(err), gc.Equals, true)
+	c.Assert(ratelimit.IsLimitError(errgo.New("test")), gc.Equals, false)
+}
+
+func (s *ratelimitSuite) TestClientIP(c *gc.C) {
+	var l *ratelimit.Limiter
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	c.Assert(l.ClientIP(req), gc.Equals, "192.0.2.1")
+	req.RemoteAddr = "[2001:db8::1]:1234"
+	c.Assert(l.ClientIP(req), gc.Equals, "2001:db8::1")
+	c.Assert(l.ClientIP(nil), gc.Equals, "")
+
+	// X-Forwarded-For is ignored without trusted proxies.
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	c.Assert(l.ClientIP(req), gc.Equals, "2001:db8::1")
+}
+
+var clientIPTests = []struct {
+	about         string
+	remoteAddr    string
+	forwardedFor  []string
+	expectAddress string
+}{{
+	about:         "direct request",
+	remoteAddr:    "198.51.100.1:1234",
+	forwardedFor:  []string{"203.0.113.1"},
+	expectAddress: "198.51.100.1",
+}, {
+	about:         "through a trusted proxy",
+	remoteAddr:    "10.0.0.1:1234",
+	forwardedFor:  []string{"198.51.100.1"},
+	expectAddress: "198.51.100.1",
+}, {
+	about:         "through several trusted proxies",
+	remoteAddr:    "10.0.0.1:1234",
+	forwardedFor:  []string{"203.0.113.1, 198.51.100.1", "10.0.0.2"},
+	expectAddress: "198.51.100.1",
+}, {
+	about:         "only trusted proxies",
+	remoteAddr:    "10.0.0.1:1234",
+	forwardedFor:  []string{"10.0.0.2"},
+	expectAddress: "10.0.0.2",
+}, {
+	about:         "trusted proxy without header",
+	remoteAddr:    "10.0.0.1:1234",
+	expectAddress: "10.0.0.1",
+}}
+
+func (s *ratelimitSuite) TestClientIPTrustedProxies(c *gc.C) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	c.Assert(err, gc.IsNil)
+	l := s.newLimiter(c, ratelimit.Params{
+		TrustedProxies: []*net.IPNet{proxies},
+	})
+	for i, test := range clientIPTests {
+		c.Logf("test %d. %s", i, test.about)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header["X-Forwarded-For"] = test.forwardedFor
+		c.Assert(l.ClientIP(req), gc.Equals, test.expectAddress)
+	}
+}
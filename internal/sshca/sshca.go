@@ -0,0 +1,115 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package sshca implements the signing of OpenSSH user certificates for
+// identities in the identity manager.
+package sshca
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// DefaultValidity holds the length of time for which certificates
+	// are valid when no validity has been configured.
+	DefaultValidity = time.Hour
+
+	// ClockSkew holds the length of time before the signing time
+	// from which certificates are valid. This allows for clock
+	// differences between the identity manager and SSH servers.
+	ClockSkew = 5 * time.Minute
+
+	// GroupPrincipalPrefix holds the prefix added to group names to
+	// form their principals, so that a group can never be mistaken
+	// for a user with the same name.
+	GroupPrincipalPrefix = "group:"
+)
+
+// defaultExtensions holds the extensions included in every
+// certificate. These match the permissions granted by default to
+// certificates created with ssh-keygen.
+var defaultExtensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
+// A Request holds the details of a certificate to be signed.
+type Request struct {
+	// PublicKey holds the public key to certify.
+	PublicKey ssh.PublicKey
+
+	// KeyID holds the identifier of the certificate, this is logged
+	// by SSH servers when the certificate is used.
+	KeyID string
+
+	// Principals holds the principals for which the certificate is
+	// valid.
+	Principals []string
+
+	// ValidAfter and ValidBefore hold the times between which the
+	// certificate is valid.
+	ValidAfter, ValidBefore time.Time
+}
+
+// Sign creates a new user certificate for the given request, signed by
+// the given CA key.
+func Sign(ca ssh.Signer, r Request) (*ssh.Certificate, error) {
+	if _, ok := r.PublicKey.(*ssh.Certificate); ok {
+		return nil, errgo.New("cannot certify a certificate")
+	}
+	if !r.ValidBefore.After(r.ValidAfter) {
+		return nil, errgo.New("invalid validity period")
+	}
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	extensions := make(map[string]string, len(defaultExtensions))
+	for k, v := range defaultExtensions {
+		extensions[k] = v
+	}
+	cert := &ssh.Certificate{
+		Key:             r.PublicKey,
+		Serial:          binary.BigEndian.Uint64(buf[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           r.KeyID,
+		ValidPrincipals: r.Principals,
+		ValidAfter:      uint64(r.ValidAfter.Unix()),
+		ValidBefore:     uint64(r.ValidBefore.Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: extensions,
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, errgo.Notef(err, "cannot sign certificate")
+	}
+	return cert, nil
+}
+
+// Principals returns the principals for a certificate issued to the
+// user with the given username who is a member of the given groups.
+// The username is always the first principal, it is followed by the
+// groups in sorted order, each prefixed with GroupPrincipalPrefix.
+func Principals(username string, groups []string) []string {
+	principals := []string{username}
+	seen := make(map[string]bool)
+	sorted := append([]string(nil), groups...)
+	sort.Strings(sorted)
+	for _, g := range sorted {
+		if seen[g] {
+			continue
+		}
+		seen[g] = true
+		principals = append(principals, GroupPrincipalPrefix+g)
+	}
+	return principals
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sshca_test
+
+import (
+	"crypto/rand"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	gc "gopkg.in/check.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/sshca"
+)
+
+type sshcaSuite struct{}
+
+var _ = gc.Suite(&sshcaSuite{})
+
+func (s *sshcaSuite) TestSign(c *gc.C) {
+	ca := newSigner(c)
+	key := newSigner(c)
+	now := time.Now().Truncate(time.Second)
+	cert, err := sshca.Sign(ca, sshca.Request{
+		PublicKey:   key.PublicKey(),
+		KeyID:       "bob@example",
+		Principals:  []string{"bob@example", "g1"},
+		ValidAfter:  now.Add(-sshca.ClockSkew),
+		ValidBefore: now.Add(time.Hour),
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(cert.CertType, gc.Equals, uint32(ssh.UserCert))
+	c.Assert(cert.KeyId, gc.Equals, "bob@example")
+	c.Assert(cert.ValidPrincipals, gc.DeepEquals, []string{"bob@example", "g1"})
+	c.Assert(cert.ValidBefore, gc.Equals, uint64(now.Add(time.Hour).Unix()))
+	c.Assert(cert.Permissions.Extensions["permit-pty"], gc.Equals, "")
+
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+		},
+	}
+	_, err = checker.Authenticate(connMetadata("g1"), cert)
+	c.Assert(err, gc.IsNil)
+	_, err = checker.Authenticate(connMetadata("g2"), cert)
+	c.Assert(err, gc.ErrorMatches, `ssh: principal "g2" not in the set of valid principals for given certificate: .*`)
+}
+
+func (s *sshcaSuite) TestSignCertificate(c *gc.C) {
+	ca := newSigner(c)
+	now := time.Now()
+	cert, err := sshca.Sign(ca, sshca.Request{
+		PublicKey:   newSigner(c).PublicKey(),
+		ValidAfter:  now,
+		ValidBefore: now.Add(time.Hour),
+	})
+	c.Assert(err, gc.IsNil)
+	_, err = sshca.Sign(ca, sshca.Request{
+		PublicKey:   cert,
+		ValidAfter:  now,
+		ValidBefore: now.Add(time.Hour),
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot certify a certificate`)
+}
+
+func (s *sshcaSuite) TestSignInvalidValidity(c *gc.C) {
+	now := time.Now()
+	_, err := sshca.Sign(newSigner(c), sshca.Request{
+		PublicKey:   newSigner(c).PublicKey(),
+		ValidAfter:  now,
+		ValidBefore: now,
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid validity period`)
+}
+
+var principalsTests = []struct {
+	about    string
+	username string
+	groups   []string
+	expect   []string
+}{{
+	about:    "no groups",
+	username: "bob",
+	expect:   []string{"bob"},
+}, {
+	about:    "groups sorted",
+	username: "bob",
+	groups:   []string{"g2", "g1"},
+	expect:   []string{"bob", "group:g1", "group:g2"},
+}, {
+	about:    "duplicates removed",
+	username: "bob",
+	groups:   []string{"g1", "g1"},
+	expect:   []string{"bob", "group:g1"},
+}, {
+	about:    "group with the same name as the user",
+	username: "bob",
+	groups:   []string{"bob", "alice"},
+	expect:   []string{"bob", "group:alice", "group:bob"},
+}}
+
+func (s *sshcaSuite) TestPrincipals(c *gc.C) {
+	for i, test := range principalsTests {
+		c.Logf("test %d. %s", i, test.about)
+		c.Check(sshca.Principals(test.username, test.groups), gc.DeepEquals, test.expect)
+	}
+}
+
+func newSigner(c *gc.C) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	signer, err := ssh.NewSignerFromKey(key)
+	c.Assert(err, gc.IsNil)
+	return signer
+}
+
+// connMetadata implements ssh.ConnMetadata for a connection by the
+// given user.
+type connMetadata string
+
+func (m connMetadata) User() string        { return string(m) }
+func (connMetadata) SessionID() []byte     { return nil }
+func (connMetadata) ClientVersion() []byte { return nil }
+func (connMetadata) ServerVersion() []byte { return nil }
+func (connMetadata) RemoteAddr() net.Addr  { return nil }
+func (connMetadata) LocalAddr() net.Addr   { return nil }
@@ -0,0 +1,192 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package totp implements the time-based one-time password algorithm
+// described in RFC 6238 along with the helpers required to store TOTP
+// secrets and recovery codes.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// Digits holds the number of digits in a generated code.
+	Digits = 6
+
+	// Period holds the length of time for which each code is valid.
+	Period = 30 * time.Second
+
+	// Skew holds the number of periods either side of the current
+	// one for which codes will be accepted. This allows for clock
+	// differences between the server and the authenticator.
+	Skew = 1
+
+	// secretLen holds the length, in bytes, of generated secrets.
+	secretLen = 20
+
+	// recoveryCodeLen holds the length, in bytes, of the random part
+	// of generated recovery codes.
+	recoveryCodeLen = 5
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret generates a new random TOTP secret.
+func GenerateSecret() ([]byte, error) {
+	secret := make([]byte, secretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return secret, nil
+}
+
+// EncodeSecret encodes the given secret in the base32 form that is
+// used by authenticator applications.
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// URI returns an otpauth URI suitable for configuring an authenticator
+// application with the given secret for the given account.
+func URI(issuer, account string, secret []byte) string {
+	label := account
+	if issuer != "" {
+		label = issuer + ":" + account
+	}
+	v := url.Values{
+		"secret":    {EncodeSecret(secret)},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(int(Period / time.Second))},
+	}
+	if issuer != "" {
+		v.Set("issuer", issuer)
+	}
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + label,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// Code returns the code for the given secret at the given time.
+func Code(secret []byte, t time.Time) string {
+	return code(secret, step(t))
+}
+
+// Validate checks whether the given code is valid for the given secret
+// at the given time. If the code is valid the time step that it
+// matched is returned, this can be used by callers to prevent a code
+// from being used more than once.
+func Validate(secret []byte, c string, t time.Time) (uint64, bool) {
+	c = strings.TrimSpace(c)
+	if len(c) != Digits {
+		return 0, false
+	}
+	now := step(t)
+	for i := -Skew; i <= Skew; i++ {
+		s := now + uint64(i)
+		if subtle.ConstantTimeCompare([]byte(code(secret, s)), []byte(c)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// step returns the time step for the given time.
+func step(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(Period/time.Second)
+}
+
+// code generates the code for the given secret and time step as
+// described in RFC 4226.
+func code(secret []byte, s uint64) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], s)
+	h := hmac.New(sha1.New, secret)
+	h.Write(buf[:])
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, v%mod)
+}
+
+// Encrypt encrypts the given secret with the given key so that it can
+// be stored. The returned value can be decrypted with Decrypt.
+func Encrypt(key *[32]byte, secret []byte) (string, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", errgo.Mask(err)
+	}
+	box := secretbox.Seal(nonce[:], secret, &nonce, key)
+	return base64.RawURLEncoding.EncodeToString(box), nil
+}
+
+// Decrypt decrypts a secret previously encrypted with Encrypt.
+func Decrypt(key *[32]byte, s string) ([]byte, error) {
+	box, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid encrypted secret")
+	}
+	if len(box) < 24 {
+		return nil, errgo.Newf("invalid encrypted secret")
+	}
+	var nonce [24]byte
+	copy(nonce[:], box)
+	secret, ok := secretbox.Open(nil, box[24:], &nonce, key)
+	if !ok {
+		return nil, errgo.Newf("cannot decrypt secret")
+	}
+	return secret, nil
+}
+
+// GenerateRecoveryCodes generates n new random recovery codes.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	buf := make([]byte, recoveryCodeLen)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		c := strings.ToLower(encoding.EncodeToString(buf))
+		codes[i] = c[:len(c)/2] + "-" + c[len(c)/2:]
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode returns the hash of the given recovery code that
+// should be stored in place of the code. Codes are normalized before
+// hashing so that the case of the code and any separators are ignored.
+func HashRecoveryCode(c string) string {
+	c = strings.ToLower(c)
+	c = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, c)
+	sum := sha256.Sum256([]byte(c))
+	return hex.EncodeToString(sum[:])
+}
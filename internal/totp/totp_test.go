@@ -0,0 +1,129 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package totp_test
+
+import (
+	"net/url"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/totp"
+)
+
+type totpSuite struct{}
+
+var _ = gc.Suite(&totpSuite{})
+
+// rfcSecret is the SHA1 secret used for the test vectors in RFC 6238.
+var rfcSecret = []byte("12345678901234567890")
+
+var codeTests = []struct {
+	time       int64
+	expectCode string
+}{{
+	time:       59,
+	expectCode: "287082",
+}, {
+	time:       1111111109,
+	expectCode: "081804",
+}, {
+	time:       1111111111,
+	expectCode: "050471",
+}, {
+	time:       1234567890,
+	expectCode: "005924",
+}, {
+	time:       2000000000,
+	expectCode: "279037",
+}, {
+	time:       20000000000,
+	expectCode: "353130",
+}}
+
+func (s *totpSuite) TestCode(c *gc.C) {
+	for i, test := range codeTests {
+		c.Logf("test %d. %d", i, test.time)
+		c.Assert(totp.Code(rfcSecret, time.Unix(test.time, 0)), gc.Equals, test.expectCode)
+	}
+}
+
+func (s *totpSuite) TestValidate(c *gc.C) {
+	t := time.Unix(1234567890, 0)
+	step, ok := totp.Validate(rfcSecret, "005924", t)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(step, gc.Equals, uint64(1234567890/30))
+
+	// Codes from adjacent periods are accepted.
+	step, ok = totp.Validate(rfcSecret, totp.Code(rfcSecret, t.Add(-totp.Period)), t)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(step, gc.Equals, uint64(1234567890/30-1))
+	_, ok = totp.Validate(rfcSecret, totp.Code(rfcSecret, t.Add(totp.Period)), t)
+	c.Assert(ok, gc.Equals, true)
+
+	// Codes from further away are not.
+	_, ok = totp.Validate(rfcSecret, totp.Code(rfcSecret, t.Add(2*totp.Period)), t)
+	c.Assert(ok, gc.Equals, false)
+	_, ok = totp.Validate(rfcSecret, "12345", t)
+	c.Assert(ok, gc.Equals, false)
+	_, ok = totp.Validate([]byte("another secret"), "005924", t)
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *totpSuite) TestURI(c *gc.C) {
+	uri := totp.URI("Candid", "bob@example.com", rfcSecret)
+	u, err := url.Parse(uri)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(u.Scheme, gc.Equals, "otpauth")
+	c.Assert(u.Host, gc.Equals, "totp")
+	c.Assert(u.Path, gc.Equals, "/Candid:bob@example.com")
+	c.Assert(u.Query(), gc.DeepEquals, url.Values{
+		"secret":    {"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"},
+		"issuer":    {"Candid"},
+		"algorithm": {"SHA1"},
+		"digits":    {"6"},
+		"period":    {"30"},
+	})
+}
+
+func (s *totpSuite) TestGenerateSecret(c *gc.C) {
+	s1, err := totp.GenerateSecret()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(s1, gc.HasLen, 20)
+	s2, err := totp.GenerateSecret()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(s1, gc.Not(gc.DeepEquals), s2)
+}
+
+func (s *totpSuite) TestEncryptDecrypt(c *gc.C) {
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+	enc, err := totp.Encrypt(&key, rfcSecret)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(enc, gc.Not(gc.Equals), string(rfcSecret))
+	secret, err := totp.Decrypt(&key, enc)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(secret, gc.DeepEquals, rfcSecret)
+
+	var key2 [32]byte
+	_, err = totp.Decrypt(&key2, enc)
+	c.Assert(err, gc.ErrorMatches, `cannot decrypt secret`)
+
+	_, err = totp.Decrypt(&key, "!")
+	c.Assert(err, gc.ErrorMatches, `invalid encrypted secret: .*`)
+}
+
+func (s *totpSuite) TestRecoveryCodes(c *gc.C) {
+	codes, err := totp.GenerateRecoveryCodes(10)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(codes, gc.HasLen, 10)
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		c.Assert(code, gc.Matches, `[a-z2-7]{4}-[a-z2-7]{4}`)
+		c.Assert(seen[code], gc.Equals, false)
+		seen[code] = true
+	}
+	c.Assert(totp.HashRecoveryCode("ABCD-efgh"), gc.Equals, totp.HashRecoveryCode("abcdefgh"))
+	c.Assert(totp.HashRecoveryCode("abcd-efgh"), gc.Not(gc.Equals), totp.HashRecoveryCode("abcd-efgi"))
+}
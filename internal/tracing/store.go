@@ -0,0 +1,64 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package tracing
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/context"
+
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+// InstrumentStore returns a store.Store that records a span for each
+// operation on s, which is labelled with the given backend name.
+func InstrumentStore(s store.Store, backend string) store.Store {
+	return &tracedStore{
+		Store:   s,
+		backend: backend,
+	}
+}
+
+type tracedStore struct {
+	store.Store
+	backend string
+}
+
+func (s *tracedStore) startSpan(ctx context.Context, operation string) (context.Context, func(error)) {
+	ctx, span := StartSpan(ctx, "store."+operation, attribute.String("db.system", s.backend))
+	return ctx, func(err error) {
+		EndSpan(span, err)
+	}
+}
+
+// Identity implements store.Store.Identity.
+func (s *tracedStore) Identity(ctx context.Context, identity *store.Identity) error {
+	ctx, end := s.startSpan(ctx, "Identity")
+	err := s.Store.Identity(ctx, identity)
+	end(err)
+	return err
+}
+
+// FindIdentities implements store.Store.FindIdentities.
+func (s *tracedStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
+	ctx, end := s.startSpan(ctx, "FindIdentities")
+	identities, err := s.Store.FindIdentities(ctx, ref, filter, sort, skip, limit)
+	end(err)
+	return identities, err
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s *tracedStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	ctx, end := s.startSpan(ctx, "UpdateIdentity")
+	err := s.Store.UpdateIdentity(ctx, identity, update)
+	end(err)
+	return err
+}
+
+// RemoveIdentity implements store.Store.RemoveIdentity.
+func (s *tracedStore) RemoveIdentity(ctx context.Context, identity *store.Identity) error {
+	ctx, end := s.startSpan(ctx, "RemoveIdentity")
+	err := s.Store.RemoveIdentity(ctx, identity)
+	end(err)
+	return err
+}
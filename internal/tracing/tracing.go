@@ -0,0 +1,157 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package tracing provides support for recording OpenTelemetry traces.
+// Until Setup is called all spans are discarded.
+package tracing
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+)
+
+// instrumentationName is the name of the tracer used to create spans.
+const instrumentationName = "github.com/CanonicalLtd/blues-identity"
+
+// defaultServiceName is the service name reported if none is specified
+// in the Params.
+const defaultServiceName = "identity"
+
+// Params holds the parameters for Setup.
+type Params struct {
+	// Endpoint holds the host:port address of the OTLP HTTP
+	// collector to which spans are exported.
+	Endpoint string
+
+	// Insecure specifies that spans should be exported over plain
+	// HTTP rather than HTTPS.
+	Insecure bool
+
+	// ServiceName holds the service name attached to all exported
+	// spans. If this is empty "identity" is used.
+	ServiceName string
+}
+
+// Setup configures the process to export spans to the OTLP collector
+// specified in the given parameters and to propagate W3C trace context
+// on HTTP requests. The returned function flushes any pending spans and
+// stops the exporter, it should be called before the process exits.
+func Setup(ctx context.Context, p Params) (shutdown func(context.Context) error, _ error) {
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(p.Endpoint),
+	}
+	if p.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exp, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create OTLP exporter")
+	}
+	serviceName := p.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// SetTracerProvider sets the provider used to create spans and
+// enables W3C trace context propagation.
+func SetTracerProvider(tp trace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// StartSpan starts a new span with the given name and attributes as a
+// child of any span in the given context. The returned context
+// contains the new span.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartHTTPSpan starts a new server span with the given name for the
+// given incoming HTTP request. If the request carries trace context the
+// span is created as a child of the remote span.
+func StartHTTPSpan(ctx context.Context, req *http.Request, name string) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(req.Header))
+	return otel.Tracer(instrumentationName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.target", req.URL.Path),
+		),
+	)
+}
+
+// EndSpan ends the given span, recording the given error if it is not
+// nil.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Transport returns an http.RoundTripper that records a client span for
+// each request made through rt and propagates the trace context to the
+// server. If rt is nil then http.DefaultTransport is used at the time
+// each request is made.
+func Transport(rt http.RoundTripper) http.RoundTripper {
+	return &transport{rt}
+}
+
+// NewHTTPClient returns a new http.Client that uses Transport(nil).
+func NewHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: Transport(nil),
+	}
+}
+
+type transport struct {
+	rt http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.rt
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	ctx, span := otel.Tracer(instrumentationName).Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.String()),
+		),
+	)
+	// A RoundTripper must not modify the request, so make a copy
+	// with its own headers to carry the trace context.
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		EndSpan(span, err)
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	span.End()
+	return resp, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package tracing_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
+	"github.com/CanonicalLtd/blues-identity/internal/tracing/tracingtest"
+)
+
+type tracingSuite struct {
+	tracingtest.Suite
+}
+
+var _ = gc.Suite(&tracingSuite{})
+
+func (s *tracingSuite) TestStartSpan(c *gc.C) {
+	ctx, parent := tracing.StartSpan(context.Background(), "parent")
+	_, child := tracing.StartSpan(ctx, "child")
+	tracing.EndSpan(child, errgo.New("test error"))
+	tracing.EndSpan(parent, nil)
+
+	c.Assert(s.SpanNames(), gc.DeepEquals, []string{"child", "parent"})
+	childSpan := s.Span(c, "child")
+	parentSpan := s.Span(c, "parent")
+	c.Assert(childSpan.Parent.SpanID(), gc.Equals, parentSpan.SpanContext.SpanID())
+	c.Assert(childSpan.Status.Code, gc.Equals, codes.Error)
+	c.Assert(childSpan.Status.Description, gc.Equals, "test error")
+	c.Assert(parentSpan.Status.Code, gc.Equals, codes.Unset)
+}
+
+func (s *tracingSuite) TestTransportPropagatesTraceContext(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, span := tracing.StartHTTPSpan(context.Background(), req, "server")
+		span.End()
+	}))
+	defer srv.Close()
+
+	ctx, span := tracing.StartSpan(context.Background(), "client")
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	req = req.WithContext(ctx)
+	resp, err := tracing.NewHTTPClient().Do(req)
+	c.Assert(err, gc.Equals, nil)
+	resp.Body.Close()
+	span.End()
+
+	// The request passed to the client must not be modified.
+	c.Assert(req.Header.Get("Traceparent"), gc.Equals, "")
+
+	clientSpan := s.Span(c, "HTTP GET")
+	c.Assert(clientSpan.SpanKind, gc.Equals, trace.SpanKindClient)
+	c.Assert(clientSpan.Parent.SpanID(), gc.Equals, s.Span(c, "client").SpanContext.SpanID())
+	remoteSpan := s.Span(c, "server")
+	c.Assert(remoteSpan.SpanKind, gc.Equals, trace.SpanKindServer)
+	c.Assert(remoteSpan.Parent.IsRemote(), gc.Equals, true)
+	c.Assert(remoteSpan.Parent.SpanID(), gc.Equals, clientSpan.SpanContext.SpanID())
+	c.Assert(remoteSpan.SpanContext.TraceID(), gc.Equals, clientSpan.SpanContext.TraceID())
+}
+
+func (s *tracingSuite) TestTransportRecordsServerErrors(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	resp, err := tracing.NewHTTPClient().Get(srv.URL)
+	c.Assert(err, gc.Equals, nil)
+	resp.Body.Close()
+	c.Assert(s.Span(c, "HTTP GET").Status.Code, gc.Equals, codes.Error)
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package tracingtest provides a test suite that records spans in
+// memory so that they can be inspected by tests.
+package tracingtest
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
+)
+
+// Suite is a test suite that installs a tracer provider that records
+// all ended spans in Exporter for the duration of each test.
+type Suite struct {
+	// Exporter holds the spans recorded during the current test.
+	Exporter *tracetest.InMemoryExporter
+
+	provider        *sdktrace.TracerProvider
+	savedProvider   trace.TracerProvider
+	savedPropagator propagation.TextMapPropagator
+}
+
+func (s *Suite) SetUpSuite(c *gc.C) {}
+
+func (s *Suite) TearDownSuite(c *gc.C) {}
+
+func (s *Suite) SetUpTest(c *gc.C) {
+	s.savedProvider = otel.GetTracerProvider()
+	s.savedPropagator = otel.GetTextMapPropagator()
+	s.Exporter = tracetest.NewInMemoryExporter()
+	s.provider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(s.Exporter))
+	tracing.SetTracerProvider(s.provider)
+}
+
+func (s *Suite) TearDownTest(c *gc.C) {
+	otel.SetTracerProvider(s.savedProvider)
+	otel.SetTextMapPropagator(s.savedPropagator)
+	s.provider.Shutdown(context.Background())
+}
+
+// SpanNames returns the names of all the spans recorded so far in the
+// order in which they ended.
+func (s *Suite) SpanNames() []string {
+	var names []string
+	for _, span := range s.Exporter.GetSpans() {
+		names = append(names, span.Name)
+	}
+	return names
+}
+
+// Span returns the first recorded span with the given name. The test
+// fails if there is no such span.
+func (s *Suite) Span(c *gc.C, name string) tracetest.SpanStub {
+	for _, span := range s.Exporter.GetSpans() {
+		if span.Name == name {
+			return span
+		}
+	}
+	c.Fatalf("no span named %q, recorded spans %q", name, s.SpanNames())
+	panic("unreachable")
+}
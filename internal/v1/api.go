@@ -5,6 +5,7 @@ package v1
 
 import (
 	"github.com/juju/loggo"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 	"golang.org/x/net/trace"
 	"gopkg.in/errgo.v1"
@@ -15,6 +16,7 @@ import (
 	"github.com/CanonicalLtd/blues-identity/internal/auth/httpauth"
 	"github.com/CanonicalLtd/blues-identity/internal/identity"
 	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/CanonicalLtd/blues-identity/internal/tracing"
 )
 
 var logger = loggo.GetLogger("identity.internal.v1")
@@ -31,19 +33,21 @@ func new(hParams identity.HandlerParams) func(p httprequest.Params, arg interfac
 	return func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
 		t := trace.New("identity.internal.v1", p.PathPattern)
 		ctx := trace.NewContext(p.Context, t)
-		ctx, close1 := hParams.Store.Context(p.Context)
+		ctx, span := tracing.StartHTTPSpan(ctx, p.Request, p.PathPattern)
+		ctx, close1 := hParams.Store.Context(ctx)
 		ctx, close2 := hParams.MeetingStore.Context(ctx)
 		hnd := &handler{
 			params: hParams,
 			trace:  t,
+			span:   span,
 			monReq: monitoring.NewRequest(&p),
 			close: func() {
 				close2()
 				close1()
 			},
 		}
-		op := opForRequest(arg)
-		logger.Debugf("opForRequest %#v -> %#v", arg, op)
+		op := OpForRequest(arg)
+		logger.Debugf("OpForRequest %#v -> %#v", arg, op)
 		if op.Entity == "" {
 			hnd.Close()
 			return nil, nil, params.ErrUnauthorized
@@ -70,6 +74,7 @@ type handler struct {
 	params identity.HandlerParams
 
 	trace  trace.Trace
+	span   oteltrace.Span
 	monReq monitoring.Request
 	close  func()
 }
@@ -86,6 +91,10 @@ func (h *handler) Close() error {
 		h.trace.Finish()
 		h.trace = nil
 	}
+	if h.span != nil {
+		h.span.End()
+		h.span = nil
+	}
 	return nil
 }
 
@@ -8,14 +8,17 @@ import (
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 
+	"github.com/CanonicalLtd/blues-identity/apiparams"
 	"github.com/CanonicalLtd/blues-identity/internal/auth"
 )
 
-// opForRequest returns the operation that will be performed
+// OpForRequest returns the operation that will be performed
 // by the API handler method which takes the given argument r.
 // See aclForOp in ../auth/auth.go for the mapping from
-// operation to ACLs.
-func opForRequest(r interface{}) bakery.Op {
+// operation to ACLs. Other front ends to the same operations, such
+// as the account pages, use this so that they are authorized in the
+// same way as the API.
+func OpForRequest(r interface{}) bakery.Op {
 	switch r := r.(type) {
 	case *params.QueryUsersRequest:
 		return auth.GlobalOp(auth.ActionRead)
@@ -60,6 +63,40 @@ func opForRequest(r interface{}) bakery.Op {
 		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
 	case *params.DischargeTokenForUserRequest:
 		return auth.GlobalOp(auth.ActionDischargeFor)
+	case *apiparams.SetPasswordRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
+	case *apiparams.ReloadRequest:
+		return auth.GlobalOp(auth.ActionReload)
+	case *apiparams.SSHCertRequest:
+		return auth.UserOp(r.Username, auth.ActionSignSSHCert)
+	case *apiparams.SSHCAKeyRequest:
+		return auth.GlobalOp(auth.ActionReadSSHCAKey)
+	case *apiparams.GroupSSHKeysRequest:
+		return auth.GlobalOp(auth.ActionReadGroupSSHKeys)
+	case *apiparams.AgentsRequest:
+		return auth.UserOp(r.Username, auth.ActionReadAgents)
+	case *apiparams.ModifyAgentPublicKeysRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAgent)
+	case *apiparams.SetAgentExpiryRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAgent)
+	case *apiparams.RemoveUserRequest:
+		return auth.UserOp(r.Username, auth.ActionDelete)
+	case *apiparams.TokensRequest:
+		return auth.UserOp(r.Username, auth.ActionReadTokens)
+	case *apiparams.CreateTokenRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteTokens)
+	case *apiparams.RevokeTokenRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteTokens)
+	case *apiparams.LinkIdentityRequest:
+		return auth.UserOp(r.Username, auth.ActionLinkIdentity)
+	case *apiparams.MergeUserRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
+	case *apiparams.RenameUserRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
+	case *apiparams.UserDisabledRequest:
+		return auth.UserOp(r.Username, auth.ActionReadAdmin)
+	case *apiparams.SetUserDisabledRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
 	default:
 		logger.Infof("unknown API argument type %#v", r)
 	}
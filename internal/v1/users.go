@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
@@ -22,7 +23,10 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	macaroon "gopkg.in/macaroon.v2"
 
+	"github.com/CanonicalLtd/blues-identity/apiparams"
+	"github.com/CanonicalLtd/blues-identity/idp"
 	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/sshca"
 	"github.com/CanonicalLtd/blues-identity/store"
 )
 
@@ -112,15 +116,11 @@ func (h *handler) CreateAgent(p httprequest.Params, u *params.CreateAgentRequest
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot find identity for authenticated user")
 	}
-	if owner.ProviderID.Provider() == "idm" && owner.ProviderInfo["owner"] != nil {
-		// The authenticated user is an agent, so we don't allow it to create other agents.
-		// TODO a nicer way to do this check might be to express it as a group
-		// permission - all non-agent users are in the "can create agents" group.
-		// TODO In the future, we might allow agents to create other agents, but
-		// we'll have to work out what to do about hierarchy - if agent A creates
-		// agent B, then A is removed from a group but its owner is still a member
-		// of that group, should B still have access to the group?
-		return nil, errgo.Newf("cannot create an agent using an agent account")
+	// Agents may create other agents, as long as the chain of
+	// ownership does not get too long. The groups of each agent are
+	// limited to those of every owner in the chain.
+	if err := h.params.Authorizer.CheckAgentDepth(ctx, owner); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrForbidden))
 	}
 	agentName, err := newAgentName()
 	if err != nil {
@@ -136,6 +136,9 @@ func (h *handler) CreateAgent(p httprequest.Params, u *params.CreateAgentRequest
 		Groups:     u.Groups,
 		PublicKeys: pks,
 	}
+	if err := h.checkNotAlias(ctx, identity.Username, identity); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrAlreadyExists))
+	}
 	// TODO add tags to Identity?
 	if err := h.params.Store.UpdateIdentity(p.Context, identity, store.Update{
 		store.Username:     store.Set,
@@ -151,6 +154,566 @@ func (h *handler) CreateAgent(p httprequest.Params, u *params.CreateAgentRequest
 	}, nil
 }
 
+// Agents returns the agents owned by the given user.
+func (h *handler) Agents(p httprequest.Params, r *apiparams.AgentsRequest) (*apiparams.AgentsResponse, error) {
+	owner := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &owner); err != nil {
+		return nil, translateStoreError(err)
+	}
+	identities, err := auth.FindAgents(p.Context, h.params.Store, owner.ProviderID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	agents := make([]apiparams.Agent, 0, len(identities))
+	for i := range identities {
+		agents = append(agents, agentFromIdentity(&identities[i]))
+	}
+	return &apiparams.AgentsResponse{
+		Agents: agents,
+	}, nil
+}
+
+// ModifyAgentPublicKeys adds public keys to, and removes public keys
+// from, the given agent.
+func (h *handler) ModifyAgentPublicKeys(p httprequest.Params, r *apiparams.ModifyAgentPublicKeysRequest) error {
+	add, err := publicKeys(r.Body.Add)
+	if err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "")
+	}
+	remove, err := publicKeys(r.Body.Remove)
+	if err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "")
+	}
+	id, err := h.agentIdentity(p.Context, r.Username)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	var pks []bakery.PublicKey
+	for _, pk := range append(id.PublicKeys, add...) {
+		if !containsPublicKey(pks, pk) && !containsPublicKey(remove, pk) {
+			pks = append(pks, pk)
+		}
+	}
+	if len(pks) == 0 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot remove all public keys from agent %q", r.Username)
+	}
+	err = h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+		ID:         id.ID,
+		PublicKeys: pks,
+	}, store.Update{
+		store.PublicKeys: store.Set,
+	})
+	return translateStoreError(err)
+}
+
+// SetAgentExpiry sets the time after which the given agent can no
+// longer log in.
+func (h *handler) SetAgentExpiry(p httprequest.Params, r *apiparams.SetAgentExpiryRequest) error {
+	id, err := h.agentIdentity(p.Context, r.Username)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	info, op := auth.AgentExpiryUpdate(r.Body.Expires)
+	err = h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+		ID:           id.ID,
+		ProviderInfo: info,
+	}, store.Update{
+		store.ProviderInfo: op,
+	})
+	return translateStoreError(err)
+}
+
+// RemoveUser removes the given user, and any agents that they own,
+// from the identity manager. Any personal access tokens owned by the
+// removed identities are revoked.
+func (h *handler) RemoveUser(p httprequest.Params, r *apiparams.RemoveUserRequest) error {
+	if r.Username == auth.AdminUsername {
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot remove the admin user")
+	}
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return translateStoreError(err)
+	}
+	// Agents are removed before their owners so that an agent is
+	// never left without an owner should the removal fail part way
+	// through.
+	removed := make(map[store.ProviderIdentity]bool)
+	var remove func(store.ProviderIdentity) error
+	remove = func(providerID store.ProviderIdentity) error {
+		if removed[providerID] {
+			return nil
+		}
+		removed[providerID] = true
+		agents, err := auth.FindAgents(p.Context, h.params.Store, providerID)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, agent := range agents {
+			if err := remove(agent.ProviderID); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		// Tokens are revoked rather than left to fail
+		// authentication, so that they cannot be used again
+		// should the same provider ID log in later.
+		if err := h.params.Authorizer.RevokeTokens(p.Context, providerID); err != nil {
+			return errgo.Notef(err, "cannot revoke tokens for %s", providerID)
+		}
+		err = h.params.Store.RemoveIdentity(p.Context, &store.Identity{
+			ProviderID: providerID,
+		})
+		if err != nil && errgo.Cause(err) != store.ErrNotFound {
+			return errgo.Notef(err, "cannot remove %s", providerID)
+		}
+		auth.Logger(p.Context, logger).Infof("removed user %s", providerID)
+		return nil
+	}
+	return errgo.Mask(remove(id.ProviderID))
+}
+
+// Tokens lists the personal access tokens owned by the given user.
+func (h *handler) Tokens(p httprequest.Params, r *apiparams.TokensRequest) (*apiparams.TokensResponse, error) {
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return nil, translateStoreError(err)
+	}
+	tokens, err := h.params.Authorizer.Tokens(p.Context, &id)
+	if err != nil {
+		return nil, translateTokenError(err)
+	}
+	resp := apiparams.TokensResponse{
+		Tokens: make([]apiparams.Token, len(tokens)),
+	}
+	for i, t := range tokens {
+		resp.Tokens[i] = tokenParams(t)
+	}
+	return &resp, nil
+}
+
+// CreateToken creates a new personal access token owned by the given
+// user.
+func (h *handler) CreateToken(p httprequest.Params, r *apiparams.CreateTokenRequest) (*apiparams.CreateTokenResponse, error) {
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return nil, translateStoreError(err)
+	}
+	var expires time.Time
+	if r.Body.Expires != nil {
+		expires = *r.Body.Expires
+	}
+	token, t, err := h.params.Authorizer.CreateToken(p.Context, &id, r.Body.Name, r.Body.Scopes, expires)
+	if err != nil {
+		return nil, translateTokenError(err)
+	}
+	auth.Logger(p.Context, logger).Infof("created token %s (%q) for %s", t.ID, t.Name, id.ProviderID)
+	return &apiparams.CreateTokenResponse{
+		Token: token,
+		Info:  tokenParams(t),
+	}, nil
+}
+
+// RevokeToken revokes a personal access token owned by the given user.
+func (h *handler) RevokeToken(p httprequest.Params, r *apiparams.RevokeTokenRequest) error {
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return translateStoreError(err)
+	}
+	if err := h.params.Authorizer.RevokeToken(p.Context, &id, r.ID); err != nil {
+		return translateTokenError(err)
+	}
+	auth.Logger(p.Context, logger).Infof("revoked token %s for %s", r.ID, id.ProviderID)
+	return nil
+}
+
+// RenameUser changes the username of the given user. The old username
+// is recorded as an alias of the user and any agents owned by the user
+// are updated with the new name.
+func (h *handler) RenameUser(p httprequest.Params, r *apiparams.RenameUserRequest) error {
+	newName := string(r.Body.Username)
+	switch {
+	case r.Username == auth.AdminUsername:
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot rename the admin user")
+	case newName == "":
+		return errgo.WithCausef(nil, params.ErrBadRequest, "no username specified")
+	case blacklistUsernames[r.Body.Username]:
+		return errgo.WithCausef(nil, params.ErrBadRequest, "username %q is reserved", newName)
+	case strings.HasSuffix(newName, "@idm"):
+		return errgo.WithCausef(nil, params.ErrBadRequest, "username %q is reserved for agents", newName)
+	}
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return translateStoreError(err)
+	}
+	if auth.IsAgent(&id) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot rename an agent")
+	}
+	if newName == id.Username {
+		return nil
+	}
+	// Declarations of an old username continue to identify the user
+	// that had it, so the name of any other user cannot be reused.
+	if err := h.checkNotAlias(p.Context, newName, &id); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrAlreadyExists))
+	}
+	// The alias is recorded first so that the user can always be
+	// found by its old name, even if the rename fails.
+	if err := h.params.Authorizer.AddAlias(p.Context, id.Username, id.ProviderID); err != nil {
+		if errgo.Cause(err) == auth.ErrAliasesNotSupported {
+			return errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return errgo.Mask(err)
+	}
+	err := h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+		ID:       id.ID,
+		Username: newName,
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	if err != nil {
+		return translateStoreError(err)
+	}
+	auth.Logger(p.Context, logger).Infof("renamed user %s to %s", id.Username, newName)
+	agents, err := auth.FindAgents(p.Context, h.params.Store, id.ProviderID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for i := range agents {
+		err := h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+			ID: agents[i].ID,
+			ProviderInfo: map[string][]string{
+				"owner": {string(id.ProviderID), newName},
+			},
+		}, store.Update{
+			store.ProviderInfo: store.Set,
+		})
+		if err != nil {
+			return errgo.Notef(err, "cannot update owner of agent %s", agents[i].Username)
+		}
+	}
+	return nil
+}
+
+// checkNotAlias checks that the given username is not an alias of
+// any identity other than id.
+func (h *handler) checkNotAlias(ctx context.Context, username string, id *store.Identity) error {
+	err := h.params.Authorizer.CheckUsername(ctx, username, id.ProviderID)
+	if errgo.Cause(err) == store.ErrDuplicateUsername {
+		return errgo.WithCausef(nil, params.ErrAlreadyExists, "username %q was previously used by another user", username)
+	}
+	return errgo.Mask(err)
+}
+
+// UserDisabled returns whether the given user has been disabled.
+func (h *handler) UserDisabled(p httprequest.Params, r *apiparams.UserDisabledRequest) (*apiparams.UserDisabledResponse, error) {
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return nil, translateStoreError(err)
+	}
+	disabled, err := h.params.Authorizer.IsDisabled(p.Context, id.ProviderID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &apiparams.UserDisabledResponse{
+		Disabled: disabled,
+	}, nil
+}
+
+// SetUserDisabled disables or re-enables the given user.
+func (h *handler) SetUserDisabled(p httprequest.Params, r *apiparams.SetUserDisabledRequest) error {
+	if r.Username == auth.AdminUsername {
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot disable the admin user")
+	}
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return translateStoreError(err)
+	}
+	if err := h.params.Authorizer.SetDisabled(p.Context, id.ProviderID, r.Body.Disabled); err != nil {
+		if errgo.Cause(err) == auth.ErrDisablingNotSupported {
+			return errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return errgo.Mask(err)
+	}
+	if r.Body.Disabled {
+		auth.Logger(p.Context, logger).Infof("disabled user %s", id.Username)
+	} else {
+		auth.Logger(p.Context, logger).Infof("enabled user %s", id.Username)
+	}
+	return nil
+}
+
+// LinkIdentity links the identity authenticated by the given macaroons
+// to the given user. The linked identity is merged into the user and
+// removed, after which logging in as it logs in as the user.
+func (h *handler) LinkIdentity(p httprequest.Params, r *apiparams.LinkIdentityRequest) (*apiparams.LinkedIdentitiesResponse, error) {
+	authInfo, err := h.params.Authorizer.Auth(p.Context, []macaroon.Slice{r.Body.Macaroons}, identchecker.LoginOp)
+	if err != nil || authInfo.Identity == nil {
+		return nil, errgo.WithCausef(err, params.ErrUnauthorized, "cannot authenticate identity to link")
+	}
+	dst := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &dst); err != nil {
+		return nil, translateStoreError(err)
+	}
+	src := store.Identity{
+		Username: authInfo.Identity.Id(),
+	}
+	if err := h.params.Store.Identity(p.Context, &src); err != nil {
+		return nil, translateStoreError(err)
+	}
+	return h.mergeIdentity(p.Context, &dst, &src)
+}
+
+// MergeUser merges the requested user into the given user.
+func (h *handler) MergeUser(p httprequest.Params, r *apiparams.MergeUserRequest) (*apiparams.LinkedIdentitiesResponse, error) {
+	dst := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &dst); err != nil {
+		return nil, translateStoreError(err)
+	}
+	src := store.Identity{
+		Username: string(r.Body.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &src); err != nil {
+		return nil, translateStoreError(err)
+	}
+	return h.mergeIdentity(p.Context, &dst, &src)
+}
+
+// mergeProviderInfoKeys holds the provider information keys that are
+// copied when one identity is merged into another. Provider information
+// holding credentials or login state, such as passwords and second
+// factor secrets, is never copied.
+var mergeProviderInfoKeys = map[string]bool{
+	"groups": true,
+}
+
+// mergeIdentity merges src into dst. The groups, public keys and extra
+// information of src are added to dst, as is any provider information
+// in mergeProviderInfoKeys that dst does not already have. Agents and
+// personal access tokens owned by src are transferred to dst, and dst
+// is disabled if src was. The username of src is reserved as an alias
+// of dst. Finally src is removed and its provider ID, and any provider
+// IDs linked to it, are linked to dst.
+func (h *handler) mergeIdentity(ctx context.Context, dst, src *store.Identity) (*apiparams.LinkedIdentitiesResponse, error) {
+	if src.ID == dst.ID {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "cannot link %s to itself", dst.Username)
+	}
+	if dst.Username == auth.AdminUsername || src.Username == auth.AdminUsername {
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "cannot link the admin user")
+	}
+	if auth.IsAgent(dst) || auth.IsAgent(src) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "cannot link an agent")
+	}
+	// The alias is recorded first so that the username of src can
+	// never be taken by another user, even if the merge fails.
+	if err := h.params.Authorizer.AddAlias(ctx, src.Username, src.ProviderID); err != nil {
+		if errgo.Cause(err) == auth.ErrAliasesNotSupported {
+			return nil, errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return nil, errgo.Mask(err)
+	}
+	providerInfo := make(map[string][]string)
+	for k, v := range src.ProviderInfo {
+		if !mergeProviderInfoKeys[k] {
+			continue
+		}
+		if _, ok := dst.ProviderInfo[k]; ok {
+			auth.Logger(ctx, logger).Infof("not merging provider info %q from %s into %s", k, src.ProviderID, dst.ProviderID)
+			continue
+		}
+		providerInfo[k] = v
+	}
+	// Everything that can be is written to dst before src is removed
+	// so that nothing is lost should the merge fail part way through.
+	err := h.params.Store.UpdateIdentity(ctx, &store.Identity{
+		ID:           dst.ID,
+		Groups:       src.Groups,
+		PublicKeys:   src.PublicKeys,
+		ExtraInfo:    src.ExtraInfo,
+		ProviderInfo: providerInfo,
+	}, store.Update{
+		store.Groups:       store.Push,
+		store.PublicKeys:   store.Push,
+		store.ExtraInfo:    store.Push,
+		store.ProviderInfo: store.Push,
+	})
+	if err != nil {
+		return nil, translateStoreError(err)
+	}
+	agents, err := auth.FindAgents(ctx, h.params.Store, src.ProviderID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for i := range agents {
+		err := h.params.Store.UpdateIdentity(ctx, &store.Identity{
+			ID: agents[i].ID,
+			ProviderInfo: map[string][]string{
+				"owner": {string(dst.ProviderID), dst.Username},
+			},
+		}, store.Update{
+			store.ProviderInfo: store.Set,
+		})
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot transfer agent %s", agents[i].Username)
+		}
+	}
+	if err := h.params.Authorizer.TransferTokens(ctx, src.ProviderID, dst.ProviderID); err != nil {
+		return nil, errgo.Notef(err, "cannot transfer tokens")
+	}
+	disabled, err := h.params.Authorizer.IsDisabled(ctx, src.ProviderID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if disabled {
+		if err := h.params.Authorizer.SetDisabled(ctx, dst.ProviderID, true); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		auth.Logger(ctx, logger).Infof("disabled %s as %s is disabled", dst.ProviderID, src.ProviderID)
+	}
+	// The source identity must be removed before its provider IDs
+	// can be linked to the destination.
+	if err := h.params.Store.RemoveIdentity(ctx, &store.Identity{ID: src.ID}); err != nil {
+		return nil, errgo.Notef(err, "cannot remove %s", src.Username)
+	}
+	err = h.params.Store.UpdateIdentity(ctx, &store.Identity{
+		ID:                dst.ID,
+		LinkedProviderIDs: append([]store.ProviderIdentity{src.ProviderID}, src.LinkedProviderIDs...),
+	}, store.Update{
+		store.LinkedProviderIDs: store.Push,
+	})
+	if err != nil {
+		auth.Logger(ctx, logger).Errorf("cannot link %s to %s after removing it: %s", src.ProviderID, dst.ProviderID, err)
+		return nil, translateStoreError(err)
+	}
+	auth.Logger(ctx, logger).Infof("linked %s to %s", src.ProviderID, dst.ProviderID)
+	if err := h.params.Store.Identity(ctx, dst); err != nil {
+		return nil, translateStoreError(err)
+	}
+	resp := apiparams.LinkedIdentitiesResponse{
+		LinkedIdentities: make([]string, len(dst.LinkedProviderIDs)),
+	}
+	for i, pid := range dst.LinkedProviderIDs {
+		resp.LinkedIdentities[i] = string(pid)
+	}
+	return &resp, nil
+}
+
+// translateTokenError translates errors returned by the token methods
+// of the authorizer into errors suitable for returning to the client.
+func translateTokenError(err error) error {
+	if errgo.Cause(err) == auth.ErrTokensNotSupported {
+		return errgo.WithCausef(err, params.ErrNotFound, "")
+	}
+	return errgo.Mask(err, errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrNotFound))
+}
+
+func tokenParams(t *auth.Token) apiparams.Token {
+	token := apiparams.Token{
+		ID:      t.ID,
+		Name:    t.Name,
+		Scopes:  t.Scopes,
+		Created: t.Created,
+	}
+	if !t.Expires.IsZero() {
+		expires := t.Expires
+		token.Expires = &expires
+	}
+	if !t.LastUsed.IsZero() {
+		lastUsed := t.LastUsed
+		token.LastUsed = &lastUsed
+	}
+	return token
+}
+
+// agentIdentity retrieves the identity of the given agent. If the user
+// is not an agent an error with a cause of params.ErrBadRequest is
+// returned.
+func (h *handler) agentIdentity(ctx context.Context, username params.Username) (*store.Identity, error) {
+	id := store.Identity{
+		Username: string(username),
+	}
+	if err := h.params.Store.Identity(ctx, &id); err != nil {
+		return nil, translateStoreError(err)
+	}
+	if _, ok := agentOwner(&id); !ok {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "%q is not an agent", username)
+	}
+	return &id, nil
+}
+
+// agentOwner returns the provider ID of the owner of the given
+// identity. If the identity is not an agent then false is returned.
+func agentOwner(id *store.Identity) (store.ProviderIdentity, bool) {
+	// The "owner" provider info will contain the owner's provider
+	// id in the first position and their username in the second.
+	if !auth.IsAgent(id) {
+		return "", false
+	}
+	return store.ProviderIdentity(id.ProviderInfo["owner"][0]), true
+}
+
+func agentFromIdentity(id *store.Identity) apiparams.Agent {
+	publicKeys := make([]*bakery.PublicKey, len(id.PublicKeys))
+	for i, key := range id.PublicKeys {
+		pk := key
+		publicKeys[i] = &pk
+	}
+	groups := id.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	agent := apiparams.Agent{
+		Username:   params.Username(id.Username),
+		FullName:   id.Name,
+		Groups:     groups,
+		PublicKeys: publicKeys,
+	}
+	if t := auth.AgentExpiry(id); !t.IsZero() {
+		agent.Expires = &t
+	}
+	if !id.LastLogin.IsZero() {
+		t := id.LastLogin
+		agent.LastLogin = &t
+	}
+	return agent
+}
+
+func containsPublicKey(pks []bakery.PublicKey, pk bakery.PublicKey) bool {
+	for _, pk1 := range pks {
+		if pk1.Key == pk.Key {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, s1 := range ss {
+		if s1 == s {
+			return true
+		}
+	}
+	return false
+}
+
 // SetUserDeprecated creates or updates the user with the given username. If the
 // user already exists then any IDPGroups or SSHKeys specified in the
 // request will be ignored. See SetUserGroups, ModifyUserGroups,
@@ -274,6 +837,161 @@ func (h *handler) DeleteSSHKeys(p httprequest.Params, r *params.DeleteSSHKeysReq
 	return translateStoreError(h.params.Store.UpdateIdentity(p.Context, &id, update))
 }
 
+// GroupSSHKeys returns the SSH keys stored for every member of the
+// given group that has not been disabled. Membership is determined from
+// the groups stored for each identity and any cached by its identity
+// provider, see auth.Authorizer.CachedGroups, so that every identity
+// server gives the same answer.
+func (h *handler) GroupSSHKeys(p httprequest.Params, r *apiparams.GroupSSHKeysRequest) (*apiparams.GroupSSHKeysResponse, error) {
+	ref := store.Identity{
+		Groups: []string{r.Group},
+	}
+	filter := store.Filter{
+		store.Groups: store.Equal,
+	}
+	if h.params.Authorizer.HasGroupCaches() {
+		// The groups cached by the identity providers are not in
+		// the store, so every identity has to be checked.
+		ref = store.Identity{}
+		filter = store.Filter{}
+	}
+	identities, err := h.params.Store.FindIdentities(p.Context, &ref, filter, []store.Sort{{Field: store.Username}}, 0, 0)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	keys := make(map[string][]string)
+	for i := range identities {
+		id := &identities[i]
+		if len(id.ExtraInfo["sshkeys"]) == 0 || !containsString(h.params.Authorizer.CachedGroups(p.Context, id), r.Group) {
+			continue
+		}
+		disabled, err := h.params.Authorizer.IsDisabled(p.Context, id.ProviderID)
+		if err != nil {
+			auth.Logger(p.Context, logger).Warningf("cannot check whether %q is disabled: %s", id.Username, err)
+			continue
+		}
+		if disabled {
+			continue
+		}
+		keys[id.Username] = id.ExtraInfo["sshkeys"]
+	}
+	return &apiparams.GroupSSHKeysResponse{
+		SSHKeys: keys,
+	}, nil
+}
+
+// SSHCert signs an OpenSSH user certificate for the given public key
+// that allows the given user to log in as their username, or as any
+// of the groups of which they are a member.
+func (h *handler) SSHCert(p httprequest.Params, r *apiparams.SSHCertRequest) (*apiparams.SSHCertResponse, error) {
+	if h.params.SSHCAKey == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "SSH certificates are not supported")
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.Body.PublicKey))
+	if err != nil {
+		return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid public key")
+	}
+	if _, ok := pk.(*ssh.Certificate); ok {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid public key: cannot certify a certificate")
+	}
+	if r.Body.Validity < 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid validity %d", r.Body.Validity)
+	}
+	validity := h.params.SSHCertValidity
+	if validity == 0 {
+		validity = sshca.DefaultValidity
+	}
+	if d := time.Duration(r.Body.Validity) * time.Second; d > 0 && d < validity {
+		validity = d
+	}
+	id, err := h.params.Authorizer.Identity(p.Context, string(r.Username))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	groups, err := id.Groups(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	principals := sshca.Principals(id.Id(), groups)
+	now := time.Now()
+	cert, err := sshca.Sign(h.params.SSHCAKey, sshca.Request{
+		PublicKey:   pk,
+		KeyID:       id.Id(),
+		Principals:  principals,
+		ValidAfter:  now.Add(-sshca.ClockSkew),
+		ValidBefore: now.Add(validity),
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	auth.Logger(p.Context, logger).Infof("issued SSH certificate %d to %s for %v", cert.Serial, id.Id(), principals)
+	return &apiparams.SSHCertResponse{
+		Certificate: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))),
+		Principals:  principals,
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0).UTC(),
+	}, nil
+}
+
+// SSHCAKey returns the public key of the SSH certificate authority
+// that signs the certificates returned by SSHCert.
+func (h *handler) SSHCAKey(p httprequest.Params, r *apiparams.SSHCAKeyRequest) (*apiparams.SSHCAKeyResponse, error) {
+	if h.params.SSHCAKey == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "SSH certificates are not supported")
+	}
+	return &apiparams.SSHCAKeyResponse{
+		PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(h.params.SSHCAKey.PublicKey()))),
+	}, nil
+}
+
+// Reload reloads the identity manager's identity providers from its
+// configuration.
+func (h *handler) Reload(p httprequest.Params, r *apiparams.ReloadRequest) error {
+	if h.params.Reload == nil {
+		return errgo.WithCausef(nil, params.ErrNotFound, "reloading is not supported")
+	}
+	if err := h.params.Reload(); err != nil {
+		return errgo.Notef(err, "cannot reload configuration")
+	}
+	return nil
+}
+
+// SetPassword sets the password for the given user. The user's
+// identity provider must store passwords in the identity manager. If
+// the user does not already exist then they are created in the
+// identity provider specified in the request.
+func (h *handler) SetPassword(p httprequest.Params, r *apiparams.SetPasswordRequest) error {
+	idpName := r.Body.IDP
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	err := h.params.Store.Identity(p.Context, &id)
+	switch errgo.Cause(err) {
+	case nil:
+		provider := id.ProviderID.Provider()
+		if idpName != "" && idpName != provider {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "user %q is not a user of identity provider %q", r.Username, idpName)
+		}
+		idpName = provider
+	case store.ErrNotFound:
+		if idpName == "" {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "identity provider must be specified when creating a user")
+		}
+	default:
+		return translateStoreError(err)
+	}
+	for _, ip := range h.params.IdentityProviders {
+		if ip.Name() != idpName {
+			continue
+		}
+		ps, ok := ip.(idp.PasswordSetter)
+		if !ok {
+			break
+		}
+		return errgo.Mask(ps.SetPassword(p.Context, string(r.Username), r.Body.Password), errgo.Is(params.ErrBadRequest))
+	}
+	return errgo.WithCausef(nil, params.ErrBadRequest, "identity provider %q does not support passwords", idpName)
+}
+
 // UserToken returns a token, in the form of a macaroon, identifying
 // the user. This token can only be generated by an administrator.
 func (h *handler) UserToken(p httprequest.Params, r *params.UserTokenRequest) (*bakery.Macaroon, error) {
@@ -493,7 +1211,7 @@ func translateStoreError(err error) error {
 	switch errgo.Cause(err) {
 	case store.ErrNotFound:
 		cause = params.ErrNotFound
-	case store.ErrDuplicateUsername:
+	case store.ErrDuplicateUsername, store.ErrDuplicateProviderID:
 		cause = params.ErrAlreadyExists
 	case nil:
 		return nil
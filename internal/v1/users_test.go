@@ -4,20 +4,27 @@
 package v1_test
 
 import (
+	"crypto/rand"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
 	jc "github.com/juju/testing/checkers"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/juju/idmclient.v1"
 	"gopkg.in/juju/idmclient.v1/params"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 	macaroon "gopkg.in/macaroon.v2"
 
+	"github.com/CanonicalLtd/blues-identity/apiparams"
 	"github.com/CanonicalLtd/blues-identity/idp"
+	"github.com/CanonicalLtd/blues-identity/idp/static"
 	testidp "github.com/CanonicalLtd/blues-identity/idp/test"
 	"github.com/CanonicalLtd/blues-identity/internal/auth"
 	"github.com/CanonicalLtd/blues-identity/internal/discharger"
@@ -34,7 +41,8 @@ var versions = map[string]identity.NewAPIHandlerFunc{
 
 type usersSuite struct {
 	idmtest.StoreServerSuite
-	adminClient *idmclient.Client
+	adminClient  *idmclient.Client
+	cachedGroups map[store.ProviderIdentity][]string
 }
 
 var _ = gc.Suite(&usersSuite{})
@@ -49,8 +57,16 @@ func (s *usersSuite) SetUpTest(c *gc.C) {
 			GetGroups: func(id *store.Identity) ([]string, error) {
 				return id.Groups, nil
 			},
+			CachedGroups: func(id *store.Identity) ([]string, bool) {
+				groups, ok := s.cachedGroups[id.ProviderID]
+				return groups, ok
+			},
 		}),
+		mustNewStaticIDP(static.Params{}),
 	}
+	s.cachedGroups = nil
+	s.Params.SSHCAKey = newSSHSigner(c)
+	s.Params.MaxAgentDepth = 2
 	s.Versions = versions
 	s.StoreServerSuite.SetUpTest(c)
 	s.adminClient = s.AdminIdentityClient(c)
@@ -249,99 +265,1060 @@ func (s *usersSuite) TestCreateAgent(c *gc.C) {
 			Client: httpbakery.NewHTTPClient(),
 			Key:    privKey1,
 		},
-		AgentUsername: string(resp.Username),
+		AgentUsername: string(resp.Username),
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	whoAmIResp, err := agentClient.WhoAmI(s.Ctx, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(whoAmIResp.User, gc.Equals, string(resp.Username))
+
+	groups, err := agentClient.UserGroups(s.Ctx, &params.UserGroupsRequest{
+		Username: resp.Username,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.HasLen, 0)
+}
+
+func (s *usersSuite) TestCreateAgentAsAgent(c *gc.C) {
+	client := s.IdentityClient(c, "testagent@idm", "testgroup")
+	resp, err := client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			FullName:   "my agent",
+			PublicKeys: []*bakery.PublicKey{&pk1},
+			Groups:     []string{"testgroup"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	u, err := s.adminClient.User(s.Ctx, &params.UserRequest{
+		Username: resp.Username,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(u.Owner, gc.Equals, params.Username("testagent@idm"))
+	c.Assert(u.IDPGroups, jc.DeepEquals, []string{"testgroup"})
+
+	// The new agent is at the maximum depth so it cannot create
+	// any more agents.
+	agentClient, err := idmclient.New(idmclient.NewParams{
+		BaseURL: s.URL,
+		Client: &httpbakery.Client{
+			Client: httpbakery.NewHTTPClient(),
+			Key:    privKey1,
+		},
+		AgentUsername: string(resp.Username),
+	})
+	c.Assert(err, gc.Equals, nil)
+	_, err = agentClient.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk2},
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `Post.*: cannot create an agent using an agent account: maximum agent depth \(2\) reached`)
+}
+
+func (s *usersSuite) TestSubAgentGroups(c *gc.C) {
+	client, _ := s.bobClient(c, "g1", "g2", "g3")
+	resp, err := client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk1},
+			Groups:     []string{"g1", "g2"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	agentClient, err := idmclient.New(idmclient.NewParams{
+		BaseURL: s.URL,
+		Client: &httpbakery.Client{
+			Client: httpbakery.NewHTTPClient(),
+			Key:    privKey1,
+		},
+		AgentUsername: string(resp.Username),
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	// A sub-agent can only be created in groups of which the agent
+	// is a member.
+	_, err = agentClient.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk2},
+			Groups:     []string{"g1", "g3"},
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `Post .*: cannot add agent to groups that you are not a member of`)
+	subResp, err := agentClient.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk2},
+			Groups:     []string{"g1", "g2"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	groups, err := s.adminClient.UserGroups(s.Ctx, &params.UserGroupsRequest{
+		Username: subResp.Username,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []string{"g1", "g2"})
+
+	// Removing a group from any owner in the chain removes it from
+	// the sub-agent.
+	err = s.Store.UpdateIdentity(s.Ctx, &store.Identity{
+		Username: "bob",
+		Groups:   []string{"g1", "g3"},
+	}, store.Update{
+		store.Groups: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	groups, err = s.adminClient.UserGroups(s.Ctx, &params.UserGroupsRequest{
+		Username: subResp.Username,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []string{"g1"})
+
+	err = s.Store.UpdateIdentity(s.Ctx, &store.Identity{
+		Username: string(resp.Username),
+		Groups:   []string{"g2"},
+	}, store.Update{
+		store.Groups: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	groups, err = s.adminClient.UserGroups(s.Ctx, &params.UserGroupsRequest{
+		Username: subResp.Username,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.HasLen, 0)
+
+	// The user at the top of the chain can manage the sub-agent.
+	_, cl := s.bobClient(c, "g1", "g3")
+	err = cl.Call(s.Ctx, &apiparams.RemoveUserRequest{Username: subResp.Username}, nil)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *usersSuite) TestRemoveUserRemovesAgents(c *gc.C) {
+	client, _ := s.bobClient(c)
+	resp, err := client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk1},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	agentClient, err := idmclient.New(idmclient.NewParams{
+		BaseURL: s.URL,
+		Client: &httpbakery.Client{
+			Client: httpbakery.NewHTTPClient(),
+			Key:    privKey1,
+		},
+		AgentUsername: string(resp.Username),
+	})
+	c.Assert(err, gc.Equals, nil)
+	subResp, err := agentClient.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk2},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	// An agent owned by someone else is not removed.
+	s.CreateAgent(c, "other@idm")
+
+	admin := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	err = admin.Call(s.Ctx, &apiparams.RemoveUserRequest{Username: "bob"}, nil)
+	c.Assert(err, gc.Equals, nil)
+	for _, u := range []params.Username{"bob", resp.Username, subResp.Username} {
+		_, err = s.adminClient.User(s.Ctx, &params.UserRequest{
+			Username: u,
+		})
+		c.Assert(err, gc.ErrorMatches, `Get .*: user .* not found`)
+	}
+	_, err = s.adminClient.User(s.Ctx, &params.UserRequest{
+		Username: "other@idm",
+	})
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *usersSuite) TestTokens(c *gc.C) {
+	_, cl := s.bobClient(c)
+	var created apiparams.CreateTokenResponse
+	err := cl.Call(s.Ctx, &apiparams.CreateTokenRequest{
+		Username: "bob",
+		Body: apiparams.CreateTokenBody{
+			Name:   "ssh-keys",
+			Scopes: []string{"read-ssh-keys"},
+		},
+	}, &created)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(created.Token, gc.Not(gc.Equals), "")
+	c.Assert(created.Info.Name, gc.Equals, "ssh-keys")
+	c.Assert(created.Info.Scopes, jc.DeepEquals, []string{"read-ssh-keys"})
+	c.Assert(created.Info.LastUsed, gc.IsNil)
+
+	tokenClient := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    bearerDoer(created.Token),
+	}
+	var keys params.SSHKeysResponse
+	err = tokenClient.Call(s.Ctx, &params.SSHKeysRequest{Username: "bob"}, &keys)
+	c.Assert(err, gc.Equals, nil)
+
+	// The token does not allow operations outside its scopes.
+	err = tokenClient.Call(s.Ctx, &params.UserRequest{Username: "bob"}, nil)
+	c.Assert(err, gc.ErrorMatches, `Get .*/v1/u/bob: token "ssh-keys" does not allow "read"`)
+	err = tokenClient.Call(s.Ctx, &params.WhoAmIRequest{}, nil)
+	c.Assert(err, gc.ErrorMatches, `Get .*/v1/whoami: token "ssh-keys" does not allow login`)
+
+	// The token does not allow access to other users.
+	err = tokenClient.Call(s.Ctx, &params.SSHKeysRequest{Username: "alice"}, nil)
+	c.Assert(err, gc.ErrorMatches, `Get .*/v1/u/alice/ssh-keys: permission denied`)
+
+	var tokens apiparams.TokensResponse
+	err = cl.Call(s.Ctx, &apiparams.TokensRequest{Username: "bob"}, &tokens)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tokens.Tokens, gc.HasLen, 1)
+	c.Assert(tokens.Tokens[0].ID, gc.Equals, created.Info.ID)
+	c.Assert(tokens.Tokens[0].LastUsed, gc.NotNil)
+
+	err = cl.Call(s.Ctx, &apiparams.RevokeTokenRequest{
+		Username: "bob",
+		ID:       created.Info.ID,
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+	err = tokenClient.Call(s.Ctx, &params.SSHKeysRequest{Username: "bob"}, nil)
+	c.Assert(err, gc.ErrorMatches, `Get .*/v1/u/bob/ssh-keys: invalid token`)
+
+	err = cl.Call(s.Ctx, &apiparams.TokensRequest{Username: "bob"}, &tokens)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tokens.Tokens, gc.HasLen, 0)
+}
+
+func (s *usersSuite) TestCreateTokenInvalidScope(c *gc.C) {
+	_, cl := s.bobClient(c)
+	err := cl.Call(s.Ctx, &apiparams.CreateTokenRequest{
+		Username: "bob",
+		Body: apiparams.CreateTokenBody{
+			Name:   "test",
+			Scopes: []string{"everything"},
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*/v1/u/bob/tokens: invalid scope "everything"`)
+}
+
+func (s *usersSuite) TestTokensUnauthorized(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	_, cl := s.bobClient(c)
+	err := cl.Call(s.Ctx, &apiparams.TokensRequest{Username: "jbloggs"}, nil)
+	c.Assert(err, gc.ErrorMatches, `Get .*/v1/u/jbloggs/tokens: permission denied`)
+}
+
+func (s *usersSuite) TestRenameUser(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	s.addUser(c, params.User{
+		Username:   "agent@idm",
+		ExternalID: "idm:agent",
+		Owner:      "jbloggs",
+	})
+	admin := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	err := admin.Call(s.Ctx, &apiparams.RenameUserRequest{
+		Username: "jbloggs",
+		Body: apiparams.RenameUserBody{
+			Username: "jsmith",
+		},
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	user, err := s.adminClient.User(s.Ctx, &params.UserRequest{
+		Username: "jsmith",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(user.ExternalID, gc.Equals, "test:http://example.com/jbloggs")
+
+	// Agents owned by the user are owned by the new name.
+	agent, err := s.adminClient.User(s.Ctx, &params.UserRequest{
+		Username: "agent@idm",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(agent.Owner, gc.Equals, params.Username("jsmith"))
+
+	// The old name still identifies the user.
+	m, err := s.adminClient.UserToken(s.Ctx, &params.UserTokenRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, gc.Equals, nil)
+	declared, err := s.adminClient.VerifyToken(s.Ctx, &params.VerifyTokenRequest{
+		Macaroons: macaroon.Slice{m.M()},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(declared["username"], gc.Equals, "jsmith")
+
+	// The old name cannot be given to another user.
+	s.addUser(c, params.User{
+		Username:   "fred",
+		ExternalID: "test:http://example.com/fred",
+	})
+	err = admin.Call(s.Ctx, &apiparams.RenameUserRequest{
+		Username: "fred",
+		Body: apiparams.RenameUserBody{
+			Username: "jbloggs",
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*/v1/u/fred/rename: username "jbloggs" was previously used by another user`)
+
+	// But it can be given back to the original user.
+	err = admin.Call(s.Ctx, &apiparams.RenameUserRequest{
+		Username: "jsmith",
+		Body: apiparams.RenameUserBody{
+			Username: "jbloggs",
+		},
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *usersSuite) TestRenameUserSurvivesLogin(c *gc.C) {
+	client, _ := s.bobClient(c)
+	whoami, err := client.WhoAmI(s.Ctx, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(whoami.User, gc.Equals, "bob")
+
+	admin := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	err = admin.Call(s.Ctx, &apiparams.RenameUserRequest{
+		Username: "bob",
+		Body: apiparams.RenameUserBody{
+			Username: "robert",
+		},
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	// Logging in again through the identity provider, which still
+	// calls the user bob, keeps the new name.
+	client, _ = s.bobClient(c)
+	whoami, err = client.WhoAmI(s.Ctx, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(whoami.User, gc.Equals, "robert")
+
+	user, err := s.adminClient.User(s.Ctx, &params.UserRequest{
+		Username: "robert",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(user.ExternalID, gc.Equals, "test:bob")
+}
+
+func (s *usersSuite) TestRenameUserErrors(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	s.addUser(c, params.User{
+		Username:   "fred",
+		ExternalID: "test:http://example.com/fred",
+	})
+	admin := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	tests := []struct {
+		username    params.Username
+		newUsername params.Username
+		expectError string
+	}{{
+		username:    auth.AdminUsername,
+		newUsername: "root",
+		expectError: `Post .*: cannot rename the admin user`,
+	}, {
+		username:    "jbloggs",
+		expectError: `Post .*: no username specified`,
+	}, {
+		username:    "jbloggs",
+		newUsername: "everyone",
+		expectError: `Post .*: username "everyone" is reserved`,
+	}, {
+		username:    "jbloggs",
+		newUsername: "jbloggs@idm",
+		expectError: `Post .*: username "jbloggs@idm" is reserved for agents`,
+	}, {
+		username:    "jbloggs",
+		newUsername: "fred",
+		expectError: `Post .*: username fred already in use`,
+	}, {
+		username:    "not-there",
+		newUsername: "jsmith",
+		expectError: `Post .*: user not-there not found`,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d. rename %q to %q", i, test.username, test.newUsername)
+		err := admin.Call(s.Ctx, &apiparams.RenameUserRequest{
+			Username: test.username,
+			Body: apiparams.RenameUserBody{
+				Username: test.newUsername,
+			},
+		}, nil)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+	}
+
+	_, cl := s.bobClient(c)
+	err := cl.Call(s.Ctx, &apiparams.RenameUserRequest{
+		Username: "bob",
+		Body: apiparams.RenameUserBody{
+			Username: "robert",
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*/v1/u/bob/rename: permission denied`)
+}
+
+func (s *usersSuite) TestSetUserDisabled(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	admin := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	var resp apiparams.UserDisabledResponse
+	err := admin.Call(s.Ctx, &apiparams.UserDisabledRequest{
+		Username: "jbloggs",
+	}, &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.Disabled, gc.Equals, false)
+
+	m, err := s.adminClient.UserToken(s.Ctx, &params.UserTokenRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	err = admin.Call(s.Ctx, &apiparams.SetUserDisabledRequest{
+		Username: "jbloggs",
+		Body: apiparams.SetUserDisabledBody{
+			Disabled: true,
+		},
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+	err = admin.Call(s.Ctx, &apiparams.UserDisabledRequest{
+		Username: "jbloggs",
+	}, &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.Disabled, gc.Equals, true)
+
+	// Macaroons issued before the user was disabled are no longer
+	// accepted.
+	_, err = s.adminClient.VerifyToken(s.Ctx, &params.VerifyTokenRequest{
+		Macaroons: macaroon.Slice{m.M()},
+	})
+	c.Assert(err, gc.ErrorMatches, `.*verification failure.*`)
+
+	err = admin.Call(s.Ctx, &apiparams.SetUserDisabledRequest{
+		Username: "jbloggs",
+		Body: apiparams.SetUserDisabledBody{
+			Disabled: false,
+		},
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+	declared, err := s.adminClient.VerifyToken(s.Ctx, &params.VerifyTokenRequest{
+		Macaroons: macaroon.Slice{m.M()},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(declared["username"], gc.Equals, "jbloggs")
+}
+
+func (s *usersSuite) TestSetUserDisabledErrors(c *gc.C) {
+	admin := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	err := admin.Call(s.Ctx, &apiparams.SetUserDisabledRequest{
+		Username: auth.AdminUsername,
+		Body: apiparams.SetUserDisabledBody{
+			Disabled: true,
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Put .*: cannot disable the admin user`)
+
+	err = admin.Call(s.Ctx, &apiparams.SetUserDisabledRequest{
+		Username: "not-there",
+		Body: apiparams.SetUserDisabledBody{
+			Disabled: true,
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Put .*: user not-there not found`)
+
+	_, cl := s.bobClient(c)
+	err = cl.Call(s.Ctx, &apiparams.SetUserDisabledRequest{
+		Username: "bob",
+		Body: apiparams.SetUserDisabledBody{
+			Disabled: true,
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Put .*/v1/u/bob/disabled: permission denied`)
+}
+
+func (s *usersSuite) TestLinkIdentity(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+		IDPGroups:  []string{"g2"},
+	})
+	m, err := s.adminClient.UserToken(s.Ctx, &params.UserTokenRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	_, cl := s.bobClient(c, "g1")
+	var resp apiparams.LinkedIdentitiesResponse
+	err = cl.Call(s.Ctx, &apiparams.LinkIdentityRequest{
+		Username: "bob",
+		Body: apiparams.LinkIdentityBody{
+			Macaroons: macaroon.Slice{m.M()},
+		},
+	}, &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.LinkedIdentities, jc.DeepEquals, []string{"test:http://example.com/jbloggs"})
+
+	// The linked user has been merged into bob.
+	_, err = s.adminClient.User(s.Ctx, &params.UserRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, gc.ErrorMatches, `Get .*: user jbloggs not found`)
+	groups, err := s.adminClient.UserGroups(s.Ctx, &params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.SameContents, []string{"g1", "g2"})
+
+	// Logging in as the linked identity logs in as bob.
+	client, err := idmclient.New(idmclient.NewParams{
+		BaseURL: s.URL,
+		Client: &httpbakery.Client{
+			Client: httpbakery.NewHTTPClient(),
+			InteractionMethods: []httpbakery.Interactor{testidp.Interactor{
+				User: &params.User{
+					Username:   "jbloggs",
+					ExternalID: "test:http://example.com/jbloggs",
+				},
+			}},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	whoami, err := client.WhoAmI(s.Ctx, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(whoami.User, gc.Equals, "bob")
+}
+
+func (s *usersSuite) TestLinkIdentityErrors(c *gc.C) {
+	_, cl := s.bobClient(c)
+	err := cl.Call(s.Ctx, &apiparams.LinkIdentityRequest{
+		Username: "bob",
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*/v1/u/bob/link: cannot authenticate identity to link: .*`)
+
+	m, err := s.adminClient.UserToken(s.Ctx, &params.UserTokenRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = cl.Call(s.Ctx, &apiparams.LinkIdentityRequest{
+		Username: "bob",
+		Body: apiparams.LinkIdentityBody{
+			Macaroons: macaroon.Slice{m.M()},
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*/v1/u/bob/link: cannot link bob to itself`)
+
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	err = cl.Call(s.Ctx, &apiparams.LinkIdentityRequest{
+		Username: "jbloggs",
+		Body: apiparams.LinkIdentityBody{
+			Macaroons: macaroon.Slice{m.M()},
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*/v1/u/jbloggs/link: permission denied`)
+}
+
+func (s *usersSuite) TestMergeUser(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+		IDPGroups:  []string{"g1"},
+	})
+	s.addUser(c, params.User{
+		Username:   "jbloggs2",
+		ExternalID: "other:http://example.com/jbloggs",
+		IDPGroups:  []string{"g2"},
+	})
+	s.addUser(c, params.User{
+		Username:   "agent@idm",
+		ExternalID: "idm:agent",
+		Owner:      "jbloggs2",
+	})
+	_, cl := s.bobClient(c)
+	err := cl.Call(s.Ctx, &apiparams.MergeUserRequest{
+		Username: "jbloggs",
+		Body: apiparams.MergeUserBody{
+			Username: "jbloggs2",
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*/v1/u/jbloggs/merge: permission denied`)
+
+	admin := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	var resp apiparams.LinkedIdentitiesResponse
+	err = admin.Call(s.Ctx, &apiparams.MergeUserRequest{
+		Username: "jbloggs",
+		Body: apiparams.MergeUserBody{
+			Username: "jbloggs2",
+		},
+	}, &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.LinkedIdentities, jc.DeepEquals, []string{"other:http://example.com/jbloggs"})
+
+	groups, err := s.adminClient.UserGroups(s.Ctx, &params.UserGroupsRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.SameContents, []string{"g1", "g2"})
+
+	// The merged user's agents are now owned by the remaining user.
+	agent, err := s.adminClient.User(s.Ctx, &params.UserRequest{
+		Username: "agent@idm",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(agent.Owner, gc.Equals, params.Username("jbloggs"))
+
+	// The admin user cannot be merged.
+	err = admin.Call(s.Ctx, &apiparams.MergeUserRequest{
+		Username: "jbloggs",
+		Body: apiparams.MergeUserBody{
+			Username: auth.AdminUsername,
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*/v1/u/jbloggs/merge: cannot link the admin user`)
+}
+
+func (s *usersSuite) TestMergeUserState(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	s.addUser(c, params.User{
+		Username:   "jbloggs2",
+		ExternalID: "other:http://example.com/jbloggs",
+	})
+	err := s.Store.UpdateIdentity(s.Ctx, &store.Identity{
+		Username: "jbloggs2",
+		ProviderInfo: map[string][]string{
+			"groups":      {"pg1"},
+			"password":    {"secret"},
+			"totp-secret": {"secret"},
+		},
+	}, store.Update{
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	admin := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	err = admin.Call(s.Ctx, &apiparams.SetUserDisabledRequest{
+		Username: "jbloggs2",
+		Body: apiparams.SetUserDisabledBody{
+			Disabled: true,
+		},
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	err = admin.Call(s.Ctx, &apiparams.MergeUserRequest{
+		Username: "jbloggs",
+		Body: apiparams.MergeUserBody{
+			Username: "jbloggs2",
+		},
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	// Only safe provider information is merged.
+	id := store.Identity{
+		Username: "jbloggs",
+	}
+	err = s.Store.Identity(s.Ctx, &id)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id.ProviderInfo, jc.DeepEquals, map[string][]string{
+		"groups": {"pg1"},
+	})
+
+	// The remaining user is disabled as the merged user was.
+	var resp apiparams.UserDisabledResponse
+	err = admin.Call(s.Ctx, &apiparams.UserDisabledRequest{
+		Username: "jbloggs",
+	}, &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.Disabled, gc.Equals, true)
+
+	// The merged user's name cannot be given to another user.
+	s.addUser(c, params.User{
+		Username:   "fred",
+		ExternalID: "test:http://example.com/fred",
+	})
+	err = admin.Call(s.Ctx, &apiparams.RenameUserRequest{
+		Username: "fred",
+		Body: apiparams.RenameUserBody{
+			Username: "jbloggs2",
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*/v1/u/fred/rename: username "jbloggs2" was previously used by another user`)
+}
+
+// bearerDoer is an httprequest.Doer that sends requests with the given
+// bearer token.
+type bearerDoer string
+
+func (d bearerDoer) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+string(d))
+	return http.DefaultClient.Do(req)
+}
+
+func (s *usersSuite) TestCreateAgentWithGroups(c *gc.C) {
+	client, err := idmclient.New(idmclient.NewParams{
+		BaseURL: s.URL,
+		Client: &httpbakery.Client{
+			Client: httpbakery.NewHTTPClient(),
+			InteractionMethods: []httpbakery.Interactor{testidp.Interactor{
+				User: &params.User{
+					Username:   "bob",
+					ExternalID: "test:bob",
+					IDPGroups:  []string{"g1", "g2", "g3"},
+				},
+			}},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	// We can't create agents in groups that aren't in the owner's
+	// group list.
+	resp, err := client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk1},
+			Groups:     []string{"g1", "other", "g2"},
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `Post .*: cannot add agent to groups that you are not a member of`)
+
+	// We can create agents in groups that are a subset of the
+	// owner's groups.
+	resp, err = client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk1},
+			Groups:     []string{"g1", "g3"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	// If the owner is removed from a group, the agent won't be
+	// in that group any more.
+	err = s.Store.UpdateIdentity(s.Ctx, &store.Identity{
+		Username: "bob",
+		Groups:   []string{"g3"},
+	}, store.Update{
+		store.Groups: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	groups, err := s.adminClient.UserGroups(s.Ctx, &params.UserGroupsRequest{
+		Username: resp.Username,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.DeepEquals, []string{"g3"})
+
+	// If the owner is added back to the group, the agent
+	// gets added back too.
+	err = s.Store.UpdateIdentity(s.Ctx, &store.Identity{
+		Username: "bob",
+		Groups:   []string{"g1", "g2", "g3", "g4"},
+	}, store.Update{
+		store.Groups: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	groups, err = s.adminClient.UserGroups(s.Ctx, &params.UserGroupsRequest{
+		Username: resp.Username,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.DeepEquals, []string{"g1", "g3"})
+}
+
+// bobClient returns a client that logs in as the user bob, who is a
+// member of the given groups.
+func (s *usersSuite) bobClient(c *gc.C, groups ...string) (*idmclient.Client, *httprequest.Client) {
+	bclient := &httpbakery.Client{
+		Client: httpbakery.NewHTTPClient(),
+		InteractionMethods: []httpbakery.Interactor{testidp.Interactor{
+			User: &params.User{
+				Username:   "bob",
+				ExternalID: "test:bob",
+				IDPGroups:  groups,
+			},
+		}},
+	}
+	client, err := idmclient.New(idmclient.NewParams{
+		BaseURL: s.URL,
+		Client:  bclient,
+	})
+	c.Assert(err, gc.Equals, nil)
+	return client, &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    bclient,
+	}
+}
+
+func (s *usersSuite) TestAgents(c *gc.C) {
+	client, cl := s.bobClient(c, "g1")
+	resp1, err := client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			FullName:   "agent 1",
+			PublicKeys: []*bakery.PublicKey{&pk1},
+			Groups:     []string{"g1"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	resp2, err := client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk2},
+		},
 	})
 	c.Assert(err, gc.Equals, nil)
+	// An agent belonging to another user is not included.
+	s.CreateAgent(c, "alice@idm")
 
-	whoAmIResp, err := agentClient.WhoAmI(s.Ctx, nil)
+	var resp apiparams.AgentsResponse
+	err = cl.Call(s.Ctx, &apiparams.AgentsRequest{Username: "bob"}, &resp)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(whoAmIResp.User, gc.Equals, string(resp.Username))
+	expect := []apiparams.Agent{{
+		Username:   resp1.Username,
+		FullName:   "agent 1",
+		Groups:     []string{"g1"},
+		PublicKeys: []*bakery.PublicKey{&pk1},
+	}, {
+		Username:   resp2.Username,
+		Groups:     []string{},
+		PublicKeys: []*bakery.PublicKey{&pk2},
+	}}
+	if expect[0].Username > expect[1].Username {
+		expect[0], expect[1] = expect[1], expect[0]
+	}
+	c.Assert(resp.Agents, jc.DeepEquals, expect)
+}
 
-	groups, err := agentClient.UserGroups(s.Ctx, &params.UserGroupsRequest{
-		Username: resp.Username,
+func (s *usersSuite) TestAgentsUnauthorized(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
 	})
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(groups, gc.HasLen, 0)
+	_, cl := s.bobClient(c)
+	err := cl.Call(s.Ctx, &apiparams.AgentsRequest{Username: "jbloggs"}, nil)
+	c.Assert(err, gc.ErrorMatches, `Get .*/v1/u/jbloggs/agents: permission denied`)
 }
 
-func (s *usersSuite) TestCreateAgentAsAgent(c *gc.C) {
-	client := s.IdentityClient(c, "testagent@idm", "testgroup")
-	_, err := client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+func (s *usersSuite) TestModifyAgentPublicKeys(c *gc.C) {
+	client, cl := s.bobClient(c)
+	resp, err := client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
 		CreateAgentBody: params.CreateAgentBody{
-			FullName:   "my agent",
 			PublicKeys: []*bakery.PublicKey{&pk1},
 		},
 	})
-	c.Assert(err, gc.ErrorMatches, `Post.*: cannot create an agent using an agent account`)
-}
+	c.Assert(err, gc.Equals, nil)
 
-func (s *usersSuite) TestCreateAgentWithGroups(c *gc.C) {
-	client, err := idmclient.New(idmclient.NewParams{
-		BaseURL: s.URL,
-		Client: &httpbakery.Client{
-			Client: httpbakery.NewHTTPClient(),
-			InteractionMethods: []httpbakery.Interactor{testidp.Interactor{
-				User: &params.User{
-					Username:   "bob",
-					ExternalID: "test:bob",
-					IDPGroups:  []string{"g1", "g2", "g3"},
-				},
-			}},
+	// Rotate the agent's key.
+	err = cl.Call(s.Ctx, &apiparams.ModifyAgentPublicKeysRequest{
+		Username: resp.Username,
+		Body: apiparams.ModifyAgentPublicKeysBody{
+			Add:    []*bakery.PublicKey{&pk2},
+			Remove: []*bakery.PublicKey{&pk1},
 		},
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+	u, err := s.adminClient.User(s.Ctx, &params.UserRequest{
+		Username: resp.Username,
 	})
 	c.Assert(err, gc.Equals, nil)
+	c.Assert(u.PublicKeys, jc.DeepEquals, []*bakery.PublicKey{&pk2})
+
+	// The agent can log in with the new key only.
+	for i, key := range []*bakery.KeyPair{privKey1, privKey2} {
+		agentClient, err := idmclient.New(idmclient.NewParams{
+			BaseURL: s.URL,
+			Client: &httpbakery.Client{
+				Client: httpbakery.NewHTTPClient(),
+				Key:    key,
+			},
+			AgentUsername: string(resp.Username),
+		})
+		c.Assert(err, gc.Equals, nil)
+		_, err = agentClient.WhoAmI(s.Ctx, nil)
+		if i == 0 {
+			c.Assert(err, gc.NotNil)
+		} else {
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
 
-	// We can't create agents in groups that aren't in the owner's
-	// group list.
-	resp, err := client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
-		CreateAgentBody: params.CreateAgentBody{
-			PublicKeys: []*bakery.PublicKey{&pk1},
-			Groups:     []string{"g1", "other", "g2"},
+	// The last key cannot be removed.
+	err = cl.Call(s.Ctx, &apiparams.ModifyAgentPublicKeysRequest{
+		Username: resp.Username,
+		Body: apiparams.ModifyAgentPublicKeysBody{
+			Remove: []*bakery.PublicKey{&pk2},
 		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*: cannot remove all public keys from agent "a-.*@idm"`)
+}
+
+func (s *usersSuite) TestModifyAgentPublicKeysNotAgent(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
 	})
-	c.Assert(err, gc.ErrorMatches, `Post .*: cannot add agent to groups that you are not a member of`)
+	cl := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	err := cl.Call(s.Ctx, &apiparams.ModifyAgentPublicKeysRequest{
+		Username: "jbloggs",
+		Body: apiparams.ModifyAgentPublicKeysBody{
+			Add: []*bakery.PublicKey{&pk1},
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*: "jbloggs" is not an agent`)
+}
 
-	// We can create agents in groups that are a subset of the
-	// owner's groups.
-	resp, err = client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+func (s *usersSuite) TestModifyAgentPublicKeysUnauthorized(c *gc.C) {
+	s.CreateAgent(c, "alice@idm")
+	_, cl := s.bobClient(c)
+	err := cl.Call(s.Ctx, &apiparams.ModifyAgentPublicKeysRequest{
+		Username: "alice@idm",
+		Body: apiparams.ModifyAgentPublicKeysBody{
+			Add: []*bakery.PublicKey{&pk1},
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*: permission denied`)
+}
+
+func (s *usersSuite) TestSetAgentExpiry(c *gc.C) {
+	client, cl := s.bobClient(c)
+	resp, err := client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
 		CreateAgentBody: params.CreateAgentBody{
 			PublicKeys: []*bakery.PublicKey{&pk1},
-			Groups:     []string{"g1", "g3"},
 		},
 	})
 	c.Assert(err, gc.Equals, nil)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	err = cl.Call(s.Ctx, &apiparams.SetAgentExpiryRequest{
+		Username: resp.Username,
+		Body: apiparams.SetAgentExpiryBody{
+			Expires: expires,
+		},
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+	var agents apiparams.AgentsResponse
+	err = cl.Call(s.Ctx, &apiparams.AgentsRequest{Username: "bob"}, &agents)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(agents.Agents, gc.HasLen, 1)
+	c.Assert(agents.Agents[0].Expires, gc.NotNil)
+	c.Assert(agents.Agents[0].Expires.Equal(expires), gc.Equals, true)
+
+	newAgentClient := func() *idmclient.Client {
+		agentClient, err := idmclient.New(idmclient.NewParams{
+			BaseURL: s.URL,
+			Client: &httpbakery.Client{
+				Client: httpbakery.NewHTTPClient(),
+				Key:    privKey1,
+			},
+			AgentUsername: string(resp.Username),
+		})
+		c.Assert(err, gc.Equals, nil)
+		return agentClient
+	}
+	agentClient := newAgentClient()
+	_, err = agentClient.WhoAmI(s.Ctx, nil)
+	c.Assert(err, gc.Equals, nil)
 
-	// If the owner is removed from a group, the agent won't be
-	// in that group any more.
-	err = s.Store.UpdateIdentity(s.Ctx, &store.Identity{
-		Username: "bob",
-		Groups:   []string{"g3"},
-	}, store.Update{
-		store.Groups: store.Set,
-	})
+	// Once the agent has expired it can no longer log in.
+	err = cl.Call(s.Ctx, &apiparams.SetAgentExpiryRequest{
+		Username: resp.Username,
+		Body: apiparams.SetAgentExpiryBody{
+			Expires: time.Now().Add(-time.Minute),
+		},
+	}, nil)
 	c.Assert(err, gc.Equals, nil)
+	_, err = newAgentClient().WhoAmI(s.Ctx, nil)
+	c.Assert(err, gc.ErrorMatches, `.*agent "a-.*@idm" has expired`)
 
-	groups, err := s.adminClient.UserGroups(s.Ctx, &params.UserGroupsRequest{
+	// Nor can it use a macaroon obtained before it expired.
+	_, err = agentClient.WhoAmI(s.Ctx, nil)
+	c.Assert(err, gc.ErrorMatches, `.*agent "a-.*@idm" has expired`)
+
+	// Clearing the expiry time allows the agent to log in again.
+	err = cl.Call(s.Ctx, &apiparams.SetAgentExpiryRequest{
 		Username: resp.Username,
-	})
+	}, nil)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(groups, gc.DeepEquals, []string{"g3"})
+	_, err = newAgentClient().WhoAmI(s.Ctx, nil)
+	c.Assert(err, gc.Equals, nil)
+	agents = apiparams.AgentsResponse{}
+	err = cl.Call(s.Ctx, &apiparams.AgentsRequest{Username: "bob"}, &agents)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(agents.Agents, gc.HasLen, 1)
+	c.Assert(agents.Agents[0].Expires, gc.IsNil)
+}
 
-	// If the owner is added back to the group, the agent
-	// gets added back too.
-	err = s.Store.UpdateIdentity(s.Ctx, &store.Identity{
-		Username: "bob",
-		Groups:   []string{"g1", "g2", "g3", "g4"},
-	}, store.Update{
-		store.Groups: store.Set,
+func (s *usersSuite) TestRemoveUser(c *gc.C) {
+	client, cl := s.bobClient(c)
+	resp, err := client.CreateAgent(s.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk1},
+		},
 	})
 	c.Assert(err, gc.Equals, nil)
 
-	groups, err = s.adminClient.UserGroups(s.Ctx, &params.UserGroupsRequest{
+	// The owner can remove their agent.
+	err = cl.Call(s.Ctx, &apiparams.RemoveUserRequest{Username: resp.Username}, nil)
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.adminClient.User(s.Ctx, &params.UserRequest{
 		Username: resp.Username,
 	})
+	c.Assert(err, gc.ErrorMatches, `Get .*: user a-.*@idm not found`)
+
+	// The owner cannot remove themselves, or other users.
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	for _, u := range []params.Username{"bob", "jbloggs"} {
+		err = cl.Call(s.Ctx, &apiparams.RemoveUserRequest{Username: u}, nil)
+		c.Assert(err, gc.ErrorMatches, `Delete .*: permission denied`)
+	}
+
+	// An administrator can remove any user.
+	admin := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	err = admin.Call(s.Ctx, &apiparams.RemoveUserRequest{Username: "jbloggs"}, nil)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(groups, gc.DeepEquals, []string{"g1", "g3"})
+	err = admin.Call(s.Ctx, &apiparams.RemoveUserRequest{Username: "jbloggs"}, nil)
+	c.Assert(err, gc.ErrorMatches, `Delete .*: user jbloggs not found`)
+
+	// Except the admin user.
+	err = admin.Call(s.Ctx, &apiparams.RemoveUserRequest{Username: auth.AdminUsername}, nil)
+	c.Assert(err, gc.ErrorMatches, `Delete .*: cannot remove the admin user`)
 }
 
 func (s *usersSuite) TestSetUser(c *gc.C) {
@@ -736,6 +1713,366 @@ func (s *usersSuite) TestDischargeToken(c *gc.C) {
 	})
 }
 
+func mustNewStaticIDP(p static.Params) idp.IdentityProvider {
+	i, err := static.NewIdentityProvider(p)
+	if err != nil {
+		panic(err)
+	}
+	return i
+}
+
+// setPassword calls the set password endpoint using the given client.
+func (s *usersSuite) setPassword(client httprequest.Doer, username params.Username, idpName, password string) error {
+	cl := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    client,
+	}
+	return cl.Call(s.Ctx, &apiparams.SetPasswordRequest{
+		Username: username,
+		Body: apiparams.SetPasswordBody{
+			IDP:      idpName,
+			Password: password,
+		},
+	}, nil)
+}
+
+func (s *usersSuite) TestSetPasswordCreatesUser(c *gc.C) {
+	err := s.setPassword(s.AdminClient(), "alice", "static", "alice's password")
+	c.Assert(err, gc.Equals, nil)
+	id := store.Identity{
+		Username: "alice",
+	}
+	err = s.Store.Identity(s.Ctx, &id)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id.ProviderID, gc.Equals, store.MakeProviderIdentity("static", "alice"))
+	c.Assert(id.ProviderInfo["password"], gc.HasLen, 1)
+}
+
+func (s *usersSuite) TestSetPasswordExistingUser(c *gc.C) {
+	err := s.setPassword(s.AdminClient(), "alice", "static", "alice's password")
+	c.Assert(err, gc.Equals, nil)
+	id := store.Identity{
+		Username: "alice",
+	}
+	err = s.Store.Identity(s.Ctx, &id)
+	c.Assert(err, gc.Equals, nil)
+
+	err = s.setPassword(s.AdminClient(), "alice", "", "alice's new password")
+	c.Assert(err, gc.Equals, nil)
+	id2 := store.Identity{
+		Username: "alice",
+	}
+	err = s.Store.Identity(s.Ctx, &id2)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id2.ID, gc.Equals, id.ID)
+	c.Assert(id2.ProviderInfo["password"], gc.Not(jc.DeepEquals), id.ProviderInfo["password"])
+}
+
+var setPasswordErrorTests = []struct {
+	about       string
+	username    params.Username
+	idp         string
+	password    string
+	expectError string
+}{{
+	about:       "new user without idp",
+	username:    "alice",
+	password:    "alice's password",
+	expectError: `Put .*/v1/u/alice/password: identity provider must be specified when creating a user`,
+}, {
+	about:       "unknown idp",
+	username:    "alice",
+	idp:         "nothere",
+	password:    "alice's password",
+	expectError: `Put .*/v1/u/alice/password: identity provider "nothere" does not support passwords`,
+}, {
+	about:       "idp without passwords",
+	username:    "jbloggs",
+	password:    "jbloggs' password",
+	expectError: `Put .*/v1/u/jbloggs/password: identity provider "test" does not support passwords`,
+}, {
+	about:       "wrong idp",
+	username:    "jbloggs",
+	idp:         "static",
+	password:    "jbloggs' password",
+	expectError: `Put .*/v1/u/jbloggs/password: user "jbloggs" is not a user of identity provider "static"`,
+}, {
+	about:       "short password",
+	username:    "alice",
+	idp:         "static",
+	password:    "secret",
+	expectError: `Put .*/v1/u/alice/password: password must be at least 8 characters`,
+}}
+
+func (s *usersSuite) TestSetPasswordErrors(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	for i, test := range setPasswordErrorTests {
+		c.Logf("test %d. %s", i, test.about)
+		err := s.setPassword(s.AdminClient(), test.username, test.idp, test.password)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+	}
+}
+
+func (s *usersSuite) TestSetPasswordUnauthorized(c *gc.C) {
+	key := s.CreateAgent(c, "bob@idm")
+	client := &httpbakery.Client{
+		Client: httpbakery.NewHTTPClient(),
+		Key:    key,
+	}
+	agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: key,
+		Agents: []agent.Agent{{
+			URL:      s.URL,
+			Username: "bob@idm",
+		}},
+	})
+	err := s.setPassword(client, "alice", "static", "alice's password")
+	c.Assert(err, gc.ErrorMatches, `Put .*/v1/u/alice/password: permission denied`)
+}
+
+func (s *usersSuite) TestGroupSSHKeys(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+		IDPGroups:  []string{"ops"},
+	})
+	s.addUser(c, params.User{
+		Username:   "jbloggs2",
+		ExternalID: "test:http://example.com/jbloggs2",
+		IDPGroups:  []string{"ops", "dev"},
+	})
+	s.addUser(c, params.User{
+		Username:   "jbloggs3",
+		ExternalID: "test:http://example.com/jbloggs3",
+		IDPGroups:  []string{"dev"},
+	})
+	for _, u := range []params.Username{"jbloggs", "jbloggs3"} {
+		err := s.adminClient.PutSSHKeys(s.Ctx, &params.PutSSHKeysRequest{
+			Username: u,
+			Body: params.PutSSHKeysBody{
+				SSHKeys: []string{"key-" + string(u)},
+			},
+		})
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	key := s.CreateAgent(c, "keys@idm", auth.SSHKeyGetterGroup)
+	client := &httpbakery.Client{
+		Client: httpbakery.NewHTTPClient(),
+		Key:    key,
+	}
+	agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: key,
+		Agents: []agent.Agent{{
+			URL:      s.URL,
+			Username: "keys@idm",
+		}},
+	})
+	cl := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    client,
+	}
+	var resp apiparams.GroupSSHKeysResponse
+	err := cl.Call(s.Ctx, &apiparams.GroupSSHKeysRequest{Group: "ops"}, &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.SSHKeys, jc.DeepEquals, map[string][]string{
+		"jbloggs": {"key-jbloggs"},
+	})
+
+	var resp2 apiparams.GroupSSHKeysResponse
+	err = cl.Call(s.Ctx, &apiparams.GroupSSHKeysRequest{Group: "nobody"}, &resp2)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp2.SSHKeys, jc.DeepEquals, map[string][]string{})
+}
+
+func (s *usersSuite) TestGroupSSHKeysDisabledUser(c *gc.C) {
+	for _, u := range []params.Username{"jbloggs", "jbloggs2"} {
+		s.addUser(c, params.User{
+			Username:   u,
+			ExternalID: "test:http://example.com/" + string(u),
+			IDPGroups:  []string{"ops"},
+		})
+		err := s.adminClient.PutSSHKeys(s.Ctx, &params.PutSSHKeysRequest{
+			Username: u,
+			Body: params.PutSSHKeysBody{
+				SSHKeys: []string{"key-" + string(u)},
+			},
+		})
+		c.Assert(err, gc.Equals, nil)
+	}
+	admin := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	err := admin.Call(s.Ctx, &apiparams.SetUserDisabledRequest{
+		Username: "jbloggs2",
+		Body: apiparams.SetUserDisabledBody{
+			Disabled: true,
+		},
+	}, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	var resp apiparams.GroupSSHKeysResponse
+	err = admin.Call(s.Ctx, &apiparams.GroupSSHKeysRequest{Group: "ops"}, &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.SSHKeys, jc.DeepEquals, map[string][]string{
+		"jbloggs": {"key-jbloggs"},
+	})
+}
+
+func (s *usersSuite) TestGroupSSHKeysCachedGroups(c *gc.C) {
+	for _, u := range []params.Username{"jbloggs", "jbloggs2"} {
+		s.addUser(c, params.User{
+			Username:   u,
+			ExternalID: "test:http://example.com/" + string(u),
+		})
+		err := s.adminClient.PutSSHKeys(s.Ctx, &params.PutSSHKeysRequest{
+			Username: u,
+			Body: params.PutSSHKeysBody{
+				SSHKeys: []string{"key-" + string(u)},
+			},
+		})
+		c.Assert(err, gc.Equals, nil)
+	}
+	s.cachedGroups = map[store.ProviderIdentity][]string{
+		"test:http://example.com/jbloggs2": {"ops"},
+	}
+	admin := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	var resp apiparams.GroupSSHKeysResponse
+	err := admin.Call(s.Ctx, &apiparams.GroupSSHKeysRequest{Group: "ops"}, &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.SSHKeys, jc.DeepEquals, map[string][]string{
+		"jbloggs2": {"key-jbloggs2"},
+	})
+}
+
+func (s *usersSuite) TestGroupSSHKeysUnauthorized(c *gc.C) {
+	key := s.CreateAgent(c, "bob@idm")
+	client := &httpbakery.Client{
+		Client: httpbakery.NewHTTPClient(),
+		Key:    key,
+	}
+	agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: key,
+		Agents: []agent.Agent{{
+			URL:      s.URL,
+			Username: "bob@idm",
+		}},
+	})
+	cl := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    client,
+	}
+	err := cl.Call(s.Ctx, &apiparams.GroupSSHKeysRequest{Group: "ops"}, nil)
+	c.Assert(err, gc.ErrorMatches, `Get .*/v1/g/ops/ssh-keys: permission denied`)
+}
+
+// sshCert calls the SSH certificate endpoint using the given client.
+func (s *usersSuite) sshCert(client httprequest.Doer, username params.Username, pk ssh.PublicKey, validity int) (*apiparams.SSHCertResponse, error) {
+	cl := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    client,
+	}
+	var resp apiparams.SSHCertResponse
+	err := cl.Call(s.Ctx, &apiparams.SSHCertRequest{
+		Username: username,
+		Body: apiparams.SSHCertBody{
+			PublicKey: string(ssh.MarshalAuthorizedKey(pk)),
+			Validity:  validity,
+		},
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (s *usersSuite) TestSSHCert(c *gc.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+		IDPGroups:  []string{"test2", "test1"},
+	})
+	key := newSSHSigner(c)
+	resp, err := s.sshCert(s.AdminClient(), "jbloggs", key.PublicKey(), 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.Principals, jc.DeepEquals, []string{"jbloggs", "group:test1", "group:test2"})
+	c.Assert(resp.ValidBefore.After(time.Now().Add(59*time.Minute)), gc.Equals, true)
+
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Certificate))
+	c.Assert(err, gc.Equals, nil)
+	cert, ok := pk.(*ssh.Certificate)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(cert.KeyId, gc.Equals, "jbloggs")
+	c.Assert(cert.Key.Marshal(), jc.DeepEquals, key.PublicKey().Marshal())
+	c.Assert(cert.SignatureKey.Marshal(), jc.DeepEquals, s.Params.SSHCAKey.PublicKey().Marshal())
+	c.Assert(cert.ValidPrincipals, jc.DeepEquals, resp.Principals)
+
+	// A shorter validity can be requested.
+	resp, err = s.sshCert(s.AdminClient(), "jbloggs", key.PublicKey(), 60)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.ValidBefore.Before(time.Now().Add(2*time.Minute)), gc.Equals, true)
+}
+
+func (s *usersSuite) TestSSHCertForSelf(c *gc.C) {
+	key := s.CreateAgent(c, "bob@idm")
+	client := &httpbakery.Client{
+		Client: httpbakery.NewHTTPClient(),
+		Key:    key,
+	}
+	agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: key,
+		Agents: []agent.Agent{{
+			URL:      s.URL,
+			Username: "bob@idm",
+		}},
+	})
+	resp, err := s.sshCert(client, "bob@idm", newSSHSigner(c).PublicKey(), 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.Principals[0], gc.Equals, "bob@idm")
+
+	_, err = s.sshCert(client, "alice", newSSHSigner(c).PublicKey(), 0)
+	c.Assert(err, gc.ErrorMatches, `Post .*/v1/u/alice/ssh-cert: permission denied`)
+}
+
+func (s *usersSuite) TestSSHCertInvalidPublicKey(c *gc.C) {
+	cl := &httprequest.Client{
+		BaseURL: s.URL,
+		Doer:    s.AdminClient(),
+	}
+	err := cl.Call(s.Ctx, &apiparams.SSHCertRequest{
+		Username: "admin@idm",
+		Body: apiparams.SSHCertBody{
+			PublicKey: "not a key",
+		},
+	}, nil)
+	c.Assert(err, gc.ErrorMatches, `Post .*/v1/u/admin@idm/ssh-cert: invalid public key: .*`)
+}
+
+func (s *usersSuite) TestSSHCAKey(c *gc.C) {
+	cl := &httprequest.Client{
+		BaseURL: s.URL,
+	}
+	var resp apiparams.SSHCAKeyResponse
+	err := cl.Call(s.Ctx, &apiparams.SSHCAKeyRequest{}, &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.PublicKey, gc.Equals, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.Params.SSHCAKey.PublicKey()))))
+}
+
+func newSSHSigner(c *gc.C) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.Equals, nil)
+	signer, err := ssh.NewSignerFromKey(key)
+	c.Assert(err, gc.Equals, nil)
+	return signer
+}
+
 var userGroupTests = []struct {
 	about        string
 	username     params.Username
@@ -0,0 +1,298 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package cbor implements the subset of CBOR (RFC 7049) that is needed
+// to process WebAuthn attestation objects and COSE keys.
+//
+// Only definite length items are supported. Values are decoded as
+// follows:
+//
+//	unsigned and negative integers: int64
+//	byte strings: []byte
+//	text strings: string
+//	arrays: []interface{}
+//	maps: map[interface{}]interface{}
+//	false, true: bool
+//	null: nil
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Major types.
+const (
+	majorUint   = 0
+	majorNegint = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+)
+
+// maxDepth is the maximum nesting of arrays and maps that will be
+// decoded.
+const maxDepth = 16
+
+// Decode decodes the first CBOR item in data. It returns the decoded
+// value and any data that remains after the item.
+func Decode(data []byte) (v interface{}, rest []byte, err error) {
+	d := decoder{data: data}
+	v, err = d.decode(0)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	return v, d.data, nil
+}
+
+type decoder struct {
+	data []byte
+}
+
+func (d *decoder) decode(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errgo.Newf("cbor: item nested too deeply")
+	}
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	switch major {
+	case majorUint:
+		if arg > math.MaxInt64 {
+			return nil, errgo.Newf("cbor: integer overflow")
+		}
+		return int64(arg), nil
+	case majorNegint:
+		if arg > math.MaxInt64 {
+			return nil, errgo.Newf("cbor: integer overflow")
+		}
+		return -1 - int64(arg), nil
+	case majorBytes, majorText:
+		b, err := d.next(arg)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if major == majorText {
+			return string(b), nil
+		}
+		return append([]byte(nil), b...), nil
+	case majorArray:
+		if arg > uint64(len(d.data)) {
+			return nil, errgo.Newf("cbor: unexpected end of data")
+		}
+		a := make([]interface{}, arg)
+		for i := range a {
+			a[i], err = d.decode(depth + 1)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		return a, nil
+	case majorMap:
+		if arg > uint64(len(d.data)) {
+			return nil, errgo.Newf("cbor: unexpected end of data")
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, errgo.Newf("cbor: unsupported map key type %T", k)
+			}
+			if _, ok := m[k]; ok {
+				return nil, errgo.Newf("cbor: duplicate map key %v", k)
+			}
+			m[k], err = d.decode(depth + 1)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		return m, nil
+	case majorSimple:
+		switch arg {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		}
+		return nil, errgo.Newf("cbor: unsupported simple value %d", arg)
+	}
+	return nil, errgo.Newf("cbor: unsupported major type %d", major)
+}
+
+// head decodes the initial byte, and any following argument, of an
+// item.
+func (d *decoder) head() (major byte, arg uint64, err error) {
+	if len(d.data) == 0 {
+		return 0, 0, errgo.Newf("cbor: unexpected end of data")
+	}
+	major = d.data[0] >> 5
+	info := d.data[0] & 0x1f
+	d.data = d.data[1:]
+	if major == majorSimple && info >= 25 && info <= 27 {
+		return 0, 0, errgo.Newf("cbor: floating point values not supported")
+	}
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		b, err := d.next(1)
+		if err != nil {
+			return 0, 0, errgo.Mask(err)
+		}
+		return major, uint64(b[0]), nil
+	case info == 25:
+		b, err := d.next(2)
+		if err != nil {
+			return 0, 0, errgo.Mask(err)
+		}
+		return major, uint64(binary.BigEndian.Uint16(b)), nil
+	case info == 26:
+		b, err := d.next(4)
+		if err != nil {
+			return 0, 0, errgo.Mask(err)
+		}
+		return major, uint64(binary.BigEndian.Uint32(b)), nil
+	case info == 27:
+		b, err := d.next(8)
+		if err != nil {
+			return 0, 0, errgo.Mask(err)
+		}
+		return major, binary.BigEndian.Uint64(b), nil
+	}
+	return 0, 0, errgo.Newf("cbor: indefinite length items not supported")
+}
+
+// next returns the next n bytes of data.
+func (d *decoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)) {
+		return nil, errgo.Newf("cbor: unexpected end of data")
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+// Encode encodes the given value as CBOR. The supported types are
+// those produced by Decode along with int. Maps are encoded using the
+// canonical key ordering defined in the CTAP2 specification.
+func Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, v); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case int:
+		encodeInt(buf, int64(v))
+	case int64:
+		encodeInt(buf, v)
+	case []byte:
+		encodeHead(buf, majorBytes, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		encodeHead(buf, majorText, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		encodeHead(buf, majorArray, uint64(len(v)))
+		for _, e := range v {
+			if err := encode(buf, e); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	case map[interface{}]interface{}:
+		type entry struct {
+			key, value []byte
+		}
+		entries := make([]entry, 0, len(v))
+		for k, e := range v {
+			switch k.(type) {
+			case int, int64, string:
+			default:
+				return errgo.Newf("cbor: unsupported map key type %T", k)
+			}
+			kb, err := Encode(k)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			eb, err := Encode(e)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			entries = append(entries, entry{kb, eb})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			ki, kj := entries[i].key, entries[j].key
+			if len(ki) != len(kj) {
+				return len(ki) < len(kj)
+			}
+			return bytes.Compare(ki, kj) < 0
+		})
+		encodeHead(buf, majorMap, uint64(len(entries)))
+		for _, e := range entries {
+			buf.Write(e.key)
+			buf.Write(e.value)
+		}
+	case bool:
+		if v {
+			buf.WriteByte(majorSimple<<5 | 21)
+		} else {
+			buf.WriteByte(majorSimple<<5 | 20)
+		}
+	case nil:
+		buf.WriteByte(majorSimple<<5 | 22)
+	default:
+		return errgo.Newf("cbor: unsupported type %T", v)
+	}
+	return nil
+}
+
+func encodeInt(buf *bytes.Buffer, n int64) {
+	if n >= 0 {
+		encodeHead(buf, majorUint, uint64(n))
+	} else {
+		encodeHead(buf, majorNegint, uint64(-1-n))
+	}
+}
+
+func encodeHead(buf *bytes.Buffer, major byte, arg uint64) {
+	var b [9]byte
+	switch {
+	case arg < 24:
+		buf.WriteByte(major<<5 | byte(arg))
+		return
+	case arg <= math.MaxUint8:
+		b[0] = major<<5 | 24
+		b[1] = byte(arg)
+		buf.Write(b[:2])
+	case arg <= math.MaxUint16:
+		b[0] = major<<5 | 25
+		binary.BigEndian.PutUint16(b[1:], uint16(arg))
+		buf.Write(b[:3])
+	case arg <= math.MaxUint32:
+		b[0] = major<<5 | 26
+		binary.BigEndian.PutUint32(b[1:], uint32(arg))
+		buf.Write(b[:5])
+	default:
+		b[0] = major<<5 | 27
+		binary.BigEndian.PutUint64(b[1:], arg)
+		buf.Write(b[:9])
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cbor_test
+
+import (
+	"encoding/hex"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn/cbor"
+)
+
+type cborSuite struct{}
+
+var _ = gc.Suite(&cborSuite{})
+
+// codecTests are taken from the examples in appendix A of RFC 7049.
+var codecTests = []struct {
+	about  string
+	hex    string
+	value  interface{}
+	encode interface{}
+}{{
+	about: "zero",
+	hex:   "00",
+	value: int64(0),
+}, {
+	about: "small integer",
+	hex:   "17",
+	value: int64(23),
+}, {
+	about: "one byte integer",
+	hex:   "1818",
+	value: int64(24),
+}, {
+	about: "two byte integer",
+	hex:   "1903e8",
+	value: int64(1000),
+}, {
+	about: "four byte integer",
+	hex:   "1a000f4240",
+	value: int64(1000000),
+}, {
+	about: "eight byte integer",
+	hex:   "1b000000e8d4a51000",
+	value: int64(1000000000000),
+}, {
+	about: "negative integer",
+	hex:   "20",
+	value: int64(-1),
+}, {
+	about: "large negative integer",
+	hex:   "3903e7",
+	value: int64(-1000),
+}, {
+	about:  "int",
+	hex:    "3863",
+	value:  int64(-100),
+	encode: -100,
+}, {
+	about: "byte string",
+	hex:   "4401020304",
+	value: []byte{1, 2, 3, 4},
+}, {
+	about: "text string",
+	hex:   "6449455446",
+	value: "IETF",
+}, {
+	about: "array",
+	hex:   "83010203",
+	value: []interface{}{int64(1), int64(2), int64(3)},
+}, {
+	about: "nested array",
+	hex:   "8301820203820405",
+	value: []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}},
+}, {
+	about: "map",
+	hex:   "a201020304",
+	value: map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)},
+}, {
+	about: "canonical map ordering",
+	hex:   "a3010220381a61616161",
+	value: map[interface{}]interface{}{"a": "a", int64(1): int64(2), int64(-1): int64(-27)},
+}, {
+	about: "simple values",
+	hex:   "83f4f5f6",
+	value: []interface{}{false, true, nil},
+}}
+
+func (s *cborSuite) TestDecode(c *gc.C) {
+	for i, test := range codecTests {
+		c.Logf("test %d. %s", i, test.about)
+		data, err := hex.DecodeString(test.hex)
+		c.Assert(err, gc.Equals, nil)
+		v, rest, err := cbor.Decode(append(data, 0xff))
+		c.Assert(err, gc.Equals, nil)
+		c.Check(v, jc.DeepEquals, test.value)
+		c.Check(rest, jc.DeepEquals, []byte{0xff})
+	}
+}
+
+func (s *cborSuite) TestEncode(c *gc.C) {
+	for i, test := range codecTests {
+		c.Logf("test %d. %s", i, test.about)
+		v := test.encode
+		if v == nil {
+			v = test.value
+		}
+		data, err := cbor.Encode(v)
+		c.Assert(err, gc.Equals, nil)
+		c.Check(hex.EncodeToString(data), gc.Equals, test.hex)
+	}
+}
+
+var decodeErrorTests = []struct {
+	about       string
+	hex         string
+	expectError string
+}{{
+	about:       "empty",
+	hex:         "",
+	expectError: `cbor: unexpected end of data`,
+}, {
+	about:       "short byte string",
+	hex:         "440102",
+	expectError: `cbor: unexpected end of data`,
+}, {
+	about:       "short array",
+	hex:         "8301",
+	expectError: `cbor: unexpected end of data`,
+}, {
+	about:       "indefinite length",
+	hex:         "5f42010243030405ff",
+	expectError: `cbor: indefinite length items not supported`,
+}, {
+	about:       "float",
+	hex:         "f93c00",
+	expectError: `cbor: floating point values not supported`,
+}, {
+	about:       "tag",
+	hex:         "c11a514b67b0",
+	expectError: `cbor: unsupported major type 6`,
+}, {
+	about:       "duplicate map key",
+	hex:         "a201020103",
+	expectError: `cbor: duplicate map key 1`,
+}, {
+	about:       "array map key",
+	hex:         "a1800102",
+	expectError: `cbor: unsupported map key type \[\]interface {}`,
+}, {
+	about:       "integer overflow",
+	hex:         "1bffffffffffffffff",
+	expectError: `cbor: integer overflow`,
+}}
+
+func (s *cborSuite) TestDecodeError(c *gc.C) {
+	for i, test := range decodeErrorTests {
+		c.Logf("test %d. %s", i, test.about)
+		data, err := hex.DecodeString(test.hex)
+		c.Assert(err, gc.Equals, nil)
+		_, _, err = cbor.Decode(data)
+		c.Check(err, gc.ErrorMatches, test.expectError)
+	}
+}
+
+func (s *cborSuite) TestEncodeUnsupportedType(c *gc.C) {
+	_, err := cbor.Encode(1.5)
+	c.Assert(err, gc.ErrorMatches, `cbor: unsupported type float64`)
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package webauthn
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/store"
+)
+
+// credentialKeyPrefix is the prefix of the ProviderInfo keys used to
+// store credentials on an identity. Each credential is stored under its
+// own key so that it can be updated independently.
+const credentialKeyPrefix = "webauthn-credential-"
+
+// Credentials returns the credentials registered for the given
+// identity, in the order in which they were registered.
+func Credentials(id *store.Identity) ([]Credential, error) {
+	var creds []Credential
+	for k, v := range id.ProviderInfo {
+		if !strings.HasPrefix(k, credentialKeyPrefix) || len(v) == 0 {
+			continue
+		}
+		var cred Credential
+		if err := json.Unmarshal([]byte(v[0]), &cred); err != nil {
+			return nil, errgo.Notef(err, "invalid credential %q", k)
+		}
+		creds = append(creds, cred)
+	}
+	sort.Slice(creds, func(i, j int) bool {
+		return creds[i].Created.Before(creds[j].Created)
+	})
+	return creds, nil
+}
+
+// FindCredential returns the credential with the given ID from creds,
+// or nil if there is no such credential.
+func FindCredential(creds []Credential, credID []byte) *Credential {
+	for i := range creds {
+		if bytes.Equal(creds[i].ID, credID) {
+			return &creds[i]
+		}
+	}
+	return nil
+}
+
+// PutCredential stores the given credential on the given identity,
+// replacing any existing credential with the same ID.
+func PutCredential(ctx context.Context, st store.Store, id *store.Identity, cred *Credential) error {
+	buf, err := json.Marshal(cred)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := st.UpdateIdentity(ctx, &store.Identity{
+		ID: id.ID,
+		ProviderInfo: map[string][]string{
+			credentialKey(cred.ID): {string(buf)},
+		},
+	}, store.Update{
+		store.ProviderInfo: store.Set,
+	}); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	return nil
+}
+
+// RemoveCredential removes the credential with the given ID from the
+// given identity.
+func RemoveCredential(ctx context.Context, st store.Store, id *store.Identity, credID []byte) error {
+	if err := st.UpdateIdentity(ctx, &store.Identity{
+		ID: id.ID,
+		ProviderInfo: map[string][]string{
+			credentialKey(credID): nil,
+		},
+	}, store.Update{
+		store.ProviderInfo: store.Clear,
+	}); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	return nil
+}
+
+func credentialKey(credID []byte) string {
+	return credentialKeyPrefix + base64.RawURLEncoding.EncodeToString(credID)
+}
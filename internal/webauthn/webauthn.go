@@ -0,0 +1,663 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package webauthn implements the relying party side of the W3C Web
+// Authentication specification. It generates the options that are
+// passed to navigator.credentials.create and navigator.credentials.get
+// in the browser and verifies the responses.
+//
+// Only ES256 credentials and the "none" and "packed" attestation
+// formats are supported.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn/cbor"
+)
+
+// AlgES256 is the COSE algorithm identifier for ECDSA using P-256 and
+// SHA-256.
+const AlgES256 = -7
+
+// Values for the userVerification option.
+const (
+	UserVerificationRequired    = "required"
+	UserVerificationPreferred   = "preferred"
+	UserVerificationDiscouraged = "discouraged"
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent   = 0x01
+	flagUserVerified  = 0x04
+	flagAttestedData  = 0x40
+	flagExtensionData = 0x80
+)
+
+const (
+	challengeLen   = 32
+	defaultTimeout = 5 * time.Minute
+)
+
+// ErrVerification is the cause of all errors returned when a response
+// from an authenticator fails verification.
+var ErrVerification = errgo.New("webauthn verification failed")
+
+func verificationErrorf(f string, a ...interface{}) error {
+	return errgo.WithCausef(nil, ErrVerification, f, a...)
+}
+
+// Config holds the configuration of a relying party.
+type Config struct {
+	// RPID holds the relying party identifier. This is a domain
+	// name, usually the host name of the server.
+	RPID string
+
+	// RPName holds a name for the relying party that may be shown
+	// to the user.
+	RPName string
+
+	// Origin holds the origin, in the form scheme://host[:port],
+	// that the browser must report in responses.
+	Origin string
+
+	// AttestationRoots holds the certificates that authenticators
+	// must have an attestation chain to when registering. If this is
+	// nil then any authenticator may be registered.
+	AttestationRoots *x509.CertPool
+
+	// Timeout holds the time that the user is given to complete an
+	// operation. If this is zero a default of five minutes is used.
+	Timeout time.Duration
+}
+
+// NewConfig creates a new Config for a relying party that is served
+// from the given location. If rpID is empty then the host name of
+// location is used.
+func NewConfig(location, rpID, rpName string) (*Config, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid location")
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errgo.Newf("invalid location %q", location)
+	}
+	if rpID == "" {
+		rpID = u.Hostname()
+	}
+	if u.Hostname() != rpID && !strings.HasSuffix(u.Hostname(), "."+rpID) {
+		return nil, errgo.Newf("relying party ID %q is not valid for %q", rpID, location)
+	}
+	if rpName == "" {
+		rpName = rpID
+	}
+	return &Config{
+		RPID:   rpID,
+		RPName: rpName,
+		Origin: u.Scheme + "://" + u.Host,
+	}, nil
+}
+
+// Bytes holds binary data that is encoded in JSON as unpadded base64url.
+type Bytes []byte
+
+// MarshalJSON implements json.Marshaler.
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errgo.Mask(err)
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	*b = buf
+	return nil
+}
+
+// RelyingParty holds the relying party information sent to the
+// authenticator.
+type RelyingParty struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+// User holds the user information sent to the authenticator when
+// creating a credential.
+type User struct {
+	// ID holds the user handle. This is returned by the authenticator
+	// when it is used without specifying a credential.
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// CredentialParameter specifies a type of credential that may be
+// created.
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// CredentialDescriptor identifies a credential.
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   Bytes  `json:"id"`
+}
+
+// AuthenticatorSelection holds the requirements for authenticators
+// that may be used to create a credential.
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey,omitempty"`
+	UserVerification string `json:"userVerification,omitempty"`
+}
+
+// CreationOptions holds the options passed to
+// navigator.credentials.create.
+type CreationOptions struct {
+	Challenge              Bytes                  `json:"challenge"`
+	RP                     RelyingParty           `json:"rp"`
+	User                   User                   `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation,omitempty"`
+}
+
+// RequestOptions holds the options passed to navigator.credentials.get.
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int64                  `json:"timeout,omitempty"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials,omitempty"`
+	UserVerification string                 `json:"userVerification,omitempty"`
+}
+
+// AttestationResponse holds the response from
+// navigator.credentials.create.
+type AttestationResponse struct {
+	ID                Bytes `json:"id"`
+	ClientDataJSON    Bytes `json:"clientDataJSON"`
+	AttestationObject Bytes `json:"attestationObject"`
+}
+
+// AssertionResponse holds the response from navigator.credentials.get.
+type AssertionResponse struct {
+	ID                Bytes `json:"id"`
+	ClientDataJSON    Bytes `json:"clientDataJSON"`
+	AuthenticatorData Bytes `json:"authenticatorData"`
+	Signature         Bytes `json:"signature"`
+	UserHandle        Bytes `json:"userHandle,omitempty"`
+}
+
+// Credential holds a registered credential.
+type Credential struct {
+	// ID holds the credential ID.
+	ID Bytes `json:"id"`
+
+	// PublicKey holds the COSE encoded public key of the
+	// credential.
+	PublicKey Bytes `json:"public-key"`
+
+	// SignCount holds the last signature counter value reported by
+	// the authenticator.
+	SignCount uint32 `json:"sign-count"`
+
+	// AAGUID holds the identifier of the authenticator model, if
+	// known.
+	AAGUID Bytes `json:"aaguid,omitempty"`
+
+	// Created holds the time that the credential was registered.
+	Created time.Time `json:"created"`
+}
+
+// NewCreationOptions creates the options used to register a new
+// credential for the given user. Any credentials in exclude will not be
+// registered again.
+func (c *Config) NewCreationOptions(user User, exclude []Credential) (*CreationOptions, error) {
+	challenge, err := newChallenge()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	opts := &CreationOptions{
+		Challenge: challenge,
+		RP: RelyingParty{
+			ID:   c.RPID,
+			Name: c.RPName,
+		},
+		User: user,
+		PubKeyCredParams: []CredentialParameter{{
+			Type: "public-key",
+			Alg:  AlgES256,
+		}},
+		Timeout:            c.timeout(),
+		ExcludeCredentials: descriptors(exclude),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: UserVerificationPreferred,
+		},
+		Attestation: "none",
+	}
+	if c.AttestationRoots != nil {
+		opts.Attestation = "direct"
+	}
+	return opts, nil
+}
+
+// NewRequestOptions creates the options used to authenticate with one
+// of the given credentials. If allow is empty then any credential
+// registered with the authenticator may be used. The userVerification
+// parameter holds one of the UserVerification constants.
+func (c *Config) NewRequestOptions(allow []Credential, userVerification string) (*RequestOptions, error) {
+	challenge, err := newChallenge()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          c.timeout(),
+		RPID:             c.RPID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: userVerification,
+	}, nil
+}
+
+func (c *Config) timeout() int64 {
+	if c.Timeout == 0 {
+		return int64(defaultTimeout / time.Millisecond)
+	}
+	return int64(c.Timeout / time.Millisecond)
+}
+
+// VerifyRegistration verifies the response to a request to create a
+// credential with the given options. If the response is valid the new
+// credential is returned. If the response fails verification an error
+// with a cause of ErrVerification is returned.
+func (c *Config) VerifyRegistration(opts *CreationOptions, resp *AttestationResponse) (*Credential, error) {
+	if err := c.checkClientData(resp.ClientDataJSON, "webauthn.create", opts.Challenge); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrVerification))
+	}
+	v, _, err := cbor.Decode(resp.AttestationObject)
+	if err != nil {
+		return nil, verificationErrorf("invalid attestation object: %s", err)
+	}
+	attObj, _ := v.(map[interface{}]interface{})
+	format, _ := attObj["fmt"].(string)
+	attStmt, ok := attObj["attStmt"].(map[interface{}]interface{})
+	if !ok {
+		return nil, verificationErrorf("invalid attestation object: missing attestation statement")
+	}
+	rawAuthData, ok := attObj["authData"].([]byte)
+	if !ok {
+		return nil, verificationErrorf("invalid attestation object: missing authenticator data")
+	}
+	authData, err := c.checkAuthenticatorData(rawAuthData, opts.AuthenticatorSelection.UserVerification)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrVerification))
+	}
+	if authData.credentialID == nil {
+		return nil, verificationErrorf("no attested credential data")
+	}
+	if !bytes.Equal(authData.credentialID, resp.ID) {
+		return nil, verificationErrorf("credential ID mismatch")
+	}
+	for _, cd := range opts.ExcludeCredentials {
+		if bytes.Equal(cd.ID, resp.ID) {
+			return nil, verificationErrorf("credential already registered")
+		}
+	}
+	pub, err := parsePublicKey(authData.publicKey)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrVerification))
+	}
+	signed := signedData(rawAuthData, resp.ClientDataJSON)
+	switch format {
+	case "none":
+		if len(attStmt) != 0 {
+			return nil, verificationErrorf("invalid attestation statement")
+		}
+		if c.AttestationRoots != nil {
+			return nil, verificationErrorf("authenticator attestation required")
+		}
+	case "packed":
+		if err := c.verifyPackedAttestation(attStmt, pub, signed); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(ErrVerification))
+		}
+	default:
+		return nil, verificationErrorf("unsupported attestation format %q", format)
+	}
+	return &Credential{
+		ID:        authData.credentialID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+		AAGUID:    authData.aaguid,
+		Created:   time.Now(),
+	}, nil
+}
+
+// verifyPackedAttestation verifies a "packed" format attestation
+// statement. See https://www.w3.org/TR/webauthn/#packed-attestation.
+func (c *Config) verifyPackedAttestation(attStmt map[interface{}]interface{}, pub *ecdsa.PublicKey, signed []byte) error {
+	if alg, _ := attStmt["alg"].(int64); alg != AlgES256 {
+		return verificationErrorf("unsupported attestation algorithm %v", attStmt["alg"])
+	}
+	sig, ok := attStmt["sig"].([]byte)
+	if !ok {
+		return verificationErrorf("invalid attestation statement: missing signature")
+	}
+	x5c, ok := attStmt["x5c"].([]interface{})
+	if !ok {
+		// Self attestation.
+		if c.AttestationRoots != nil {
+			return verificationErrorf("authenticator attestation required")
+		}
+		if !verifySignature(pub, signed, sig) {
+			return verificationErrorf("invalid attestation signature")
+		}
+		return nil
+	}
+	var certs []*x509.Certificate
+	for _, v := range x5c {
+		der, ok := v.([]byte)
+		if !ok {
+			return verificationErrorf("invalid attestation certificate")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return verificationErrorf("invalid attestation certificate: %s", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return verificationErrorf("invalid attestation statement: no certificates")
+	}
+	certPub, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok || !verifySignature(certPub, signed, sig) {
+		return verificationErrorf("invalid attestation signature")
+	}
+	if c.AttestationRoots == nil {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         c.AttestationRoots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return verificationErrorf("untrusted authenticator: %s", err)
+	}
+	return nil
+}
+
+// VerifyAssertion verifies the response to a request to authenticate
+// with the given options using the given credential. If the response is
+// valid the new signature counter value is returned, this should be
+// stored with the credential. If the response fails verification an
+// error with a cause of ErrVerification is returned.
+func (c *Config) VerifyAssertion(opts *RequestOptions, cred *Credential, resp *AssertionResponse) (uint32, error) {
+	if !bytes.Equal(cred.ID, resp.ID) {
+		return 0, verificationErrorf("credential ID mismatch")
+	}
+	if len(opts.AllowCredentials) > 0 {
+		allowed := false
+		for _, cd := range opts.AllowCredentials {
+			if bytes.Equal(cd.ID, resp.ID) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return 0, verificationErrorf("credential not allowed")
+		}
+	}
+	if err := c.checkClientData(resp.ClientDataJSON, "webauthn.get", opts.Challenge); err != nil {
+		return 0, errgo.Mask(err, errgo.Is(ErrVerification))
+	}
+	authData, err := c.checkAuthenticatorData(resp.AuthenticatorData, opts.UserVerification)
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Is(ErrVerification))
+	}
+	pub, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Is(ErrVerification))
+	}
+	if !verifySignature(pub, signedData(resp.AuthenticatorData, resp.ClientDataJSON), resp.Signature) {
+		return 0, verificationErrorf("invalid signature")
+	}
+	if (authData.signCount != 0 || cred.SignCount != 0) && authData.signCount <= cred.SignCount {
+		return 0, verificationErrorf("signature counter did not increase, the authenticator may have been cloned")
+	}
+	return authData.signCount, nil
+}
+
+// clientData holds the fields of the client data that are checked.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// checkClientData checks that the given client data JSON is for an
+// operation of the given type with the given challenge at the
+// configured origin.
+func (c *Config) checkClientData(data []byte, typ string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(data, &cd); err != nil {
+		return verificationErrorf("invalid client data: %s", err)
+	}
+	if cd.Type != typ {
+		return verificationErrorf("unexpected client data type %q", cd.Type)
+	}
+	ch, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cd.Challenge, "="))
+	if err != nil || subtle.ConstantTimeCompare(ch, challenge) != 1 {
+		return verificationErrorf("challenge mismatch")
+	}
+	if cd.Origin != c.Origin {
+		return verificationErrorf("unexpected origin %q", cd.Origin)
+	}
+	return nil
+}
+
+// authenticatorData holds parsed authenticator data. See
+// https://www.w3.org/TR/webauthn/#sec-authenticator-data.
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+// checkAuthenticatorData parses the given authenticator data and
+// checks it is for the configured relying party, that the user was
+// present and, if required, that the user was verified.
+func (c *Config) checkAuthenticatorData(data []byte, userVerification string) (*authenticatorData, error) {
+	authData, err := parseAuthenticatorData(data)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrVerification))
+	}
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return nil, verificationErrorf("relying party ID mismatch")
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return nil, verificationErrorf("user not present")
+	}
+	if userVerification == UserVerificationRequired && authData.flags&flagUserVerified == 0 {
+		return nil, verificationErrorf("user not verified")
+	}
+	return authData, nil
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, verificationErrorf("authenticator data too short")
+	}
+	authData := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+	if authData.flags&flagAttestedData != 0 {
+		if len(rest) < 18 {
+			return nil, verificationErrorf("attested credential data too short")
+		}
+		authData.aaguid = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n {
+			return nil, verificationErrorf("attested credential data too short")
+		}
+		authData.credentialID = rest[:n]
+		rest = rest[n:]
+		_, after, err := cbor.Decode(rest)
+		if err != nil {
+			return nil, verificationErrorf("invalid credential public key: %s", err)
+		}
+		authData.publicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+	if authData.flags&flagExtensionData != 0 {
+		v, after, err := cbor.Decode(rest)
+		if err != nil {
+			return nil, verificationErrorf("invalid extension data: %s", err)
+		}
+		if _, ok := v.(map[interface{}]interface{}); !ok {
+			return nil, verificationErrorf("invalid extension data")
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, verificationErrorf("unexpected data after authenticator data")
+	}
+	return authData, nil
+}
+
+// COSE key parameters. See https://tools.ietf.org/html/rfc8152#section-13.
+const (
+	coseKeyType   = 1
+	coseAlg       = 3
+	coseCurve     = -1
+	coseX         = -2
+	coseY         = -3
+	coseKeyTypeEC = 2
+	coseCurveP256 = 1
+)
+
+// parsePublicKey parses a COSE encoded ES256 public key.
+func parsePublicKey(data []byte) (*ecdsa.PublicKey, error) {
+	v, _, err := cbor.Decode(data)
+	if err != nil {
+		return nil, verificationErrorf("invalid public key: %s", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, verificationErrorf("invalid public key")
+	}
+	if kty, _ := m[int64(coseKeyType)].(int64); kty != coseKeyTypeEC {
+		return nil, verificationErrorf("unsupported public key type %v", m[int64(coseKeyType)])
+	}
+	if alg, _ := m[int64(coseAlg)].(int64); alg != AlgES256 {
+		return nil, verificationErrorf("unsupported public key algorithm %v", m[int64(coseAlg)])
+	}
+	if crv, _ := m[int64(coseCurve)].(int64); crv != coseCurveP256 {
+		return nil, verificationErrorf("unsupported curve %v", m[int64(coseCurve)])
+	}
+	x, _ := m[int64(coseX)].([]byte)
+	y, _ := m[int64(coseY)].([]byte)
+	if len(x) != 32 || len(y) != 32 {
+		return nil, verificationErrorf("invalid public key")
+	}
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, verificationErrorf("invalid public key")
+	}
+	return pub, nil
+}
+
+// MarshalPublicKey returns the COSE encoding of the given P-256 public
+// key.
+func MarshalPublicKey(pub *ecdsa.PublicKey) ([]byte, error) {
+	point := elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+	return cbor.Encode(map[interface{}]interface{}{
+		coseKeyType: coseKeyTypeEC,
+		coseAlg:     AlgES256,
+		coseCurve:   coseCurveP256,
+		coseX:       point[1:33],
+		coseY:       point[33:],
+	})
+}
+
+// signedData returns the data that is signed by an authenticator in
+// attestation and assertion signatures.
+func signedData(authData, clientDataJSON []byte) []byte {
+	h := sha256.Sum256(clientDataJSON)
+	data := make([]byte, 0, len(authData)+len(h))
+	data = append(data, authData...)
+	return append(data, h[:]...)
+}
+
+// verifySignature verifies an ASN.1 encoded ECDSA signature of the
+// SHA-256 hash of data.
+func verifySignature(pub *ecdsa.PublicKey, data, sig []byte) bool {
+	var esig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(sig, &esig)
+	if err != nil || len(rest) != 0 {
+		return false
+	}
+	h := sha256.Sum256(data)
+	return ecdsa.Verify(pub, h[:], esig.R, esig.S)
+}
+
+func descriptors(creds []Credential) []CredentialDescriptor {
+	var ds []CredentialDescriptor
+	for _, cred := range creds {
+		ds = append(ds, CredentialDescriptor{
+			Type: "public-key",
+			ID:   cred.ID,
+		})
+	}
+	return ds
+}
+
+func newChallenge() ([]byte, error) {
+	challenge := make([]byte, challengeLen)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return challenge, nil
+}
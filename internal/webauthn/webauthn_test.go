@@ -0,0 +1,340 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package webauthn_test
+
+import (
+	"encoding/json"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn"
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn/webauthntest"
+)
+
+type webauthnSuite struct {
+	testing.IsolationSuite
+
+	config        *webauthn.Config
+	authenticator *webauthntest.Authenticator
+}
+
+var _ = gc.Suite(&webauthnSuite{})
+
+var testUser = webauthn.User{
+	ID:          webauthn.Bytes("1234"),
+	Name:        "bob",
+	DisplayName: "Bob Robertson",
+}
+
+func (s *webauthnSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	var err error
+	s.config, err = webauthn.NewConfig("https://idm.example.com:8443/path", "", "Test")
+	c.Assert(err, gc.Equals, nil)
+	s.authenticator = webauthntest.NewAuthenticator("https://idm.example.com:8443")
+}
+
+func (s *webauthnSuite) register(c *gc.C) *webauthn.Credential {
+	opts, err := s.config.NewCreationOptions(testUser, nil)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Create(opts)
+	c.Assert(err, gc.Equals, nil)
+	cred, err := s.config.VerifyRegistration(opts, resp)
+	c.Assert(err, gc.Equals, nil)
+	return cred
+}
+
+var newConfigTests = []struct {
+	about        string
+	location     string
+	rpID         string
+	expectConfig *webauthn.Config
+	expectError  string
+}{{
+	about:    "default relying party ID",
+	location: "https://idm.example.com/v1",
+	expectConfig: &webauthn.Config{
+		RPID:   "idm.example.com",
+		RPName: "idm.example.com",
+		Origin: "https://idm.example.com",
+	},
+}, {
+	about:    "parent domain",
+	location: "http://idm.example.com:8080",
+	rpID:     "example.com",
+	expectConfig: &webauthn.Config{
+		RPID:   "example.com",
+		RPName: "example.com",
+		Origin: "http://idm.example.com:8080",
+	},
+}, {
+	about:       "unrelated domain",
+	location:    "https://idm.example.com",
+	rpID:        "example.org",
+	expectError: `relying party ID "example.org" is not valid for "https://idm.example.com"`,
+}, {
+	about:       "partial domain",
+	location:    "https://idm.example.com",
+	rpID:        "m.example.com",
+	expectError: `relying party ID "m.example.com" is not valid for "https://idm.example.com"`,
+}, {
+	about:       "relative location",
+	location:    "/v1",
+	expectError: `invalid location "/v1"`,
+}}
+
+func (s *webauthnSuite) TestNewConfig(c *gc.C) {
+	for i, test := range newConfigTests {
+		c.Logf("test %d. %s", i, test.about)
+		config, err := webauthn.NewConfig(test.location, test.rpID, "")
+		if test.expectError != "" {
+			c.Check(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Check(config, jc.DeepEquals, test.expectConfig)
+	}
+}
+
+func (s *webauthnSuite) TestCreationOptions(c *gc.C) {
+	opts, err := s.config.NewCreationOptions(testUser, []webauthn.Credential{{
+		ID: webauthn.Bytes("cred1"),
+	}})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(opts.Challenge, gc.HasLen, 32)
+	buf, err := json.Marshal(opts)
+	c.Assert(err, gc.Equals, nil)
+	var v map[string]interface{}
+	err = json.Unmarshal(buf, &v)
+	c.Assert(err, gc.Equals, nil)
+	delete(v, "challenge")
+	c.Assert(v, jc.DeepEquals, map[string]interface{}{
+		"rp": map[string]interface{}{
+			"id":   "idm.example.com",
+			"name": "Test",
+		},
+		"user": map[string]interface{}{
+			"id":          "MTIzNA",
+			"name":        "bob",
+			"displayName": "Bob Robertson",
+		},
+		"pubKeyCredParams": []interface{}{
+			map[string]interface{}{"type": "public-key", "alg": float64(-7)},
+		},
+		"timeout": float64(300000),
+		"excludeCredentials": []interface{}{
+			map[string]interface{}{"type": "public-key", "id": "Y3JlZDE"},
+		},
+		"authenticatorSelection": map[string]interface{}{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+		"attestation": "none",
+	})
+}
+
+func (s *webauthnSuite) TestRegister(c *gc.C) {
+	cred := s.register(c)
+	c.Assert(cred.ID, gc.HasLen, 32)
+	c.Assert(cred.AAGUID, gc.HasLen, 16)
+	c.Assert(cred.SignCount, gc.Equals, uint32(0))
+}
+
+func (s *webauthnSuite) TestRegisterSelfAttestation(c *gc.C) {
+	s.authenticator.SelfAttestation = true
+	s.register(c)
+}
+
+func (s *webauthnSuite) TestRegisterExcludedCredential(c *gc.C) {
+	cred := s.register(c)
+	opts, err := s.config.NewCreationOptions(testUser, nil)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Create(opts)
+	c.Assert(err, gc.Equals, nil)
+	// Simulate a browser that ignores the excluded credentials.
+	opts.ExcludeCredentials = []webauthn.CredentialDescriptor{{
+		Type: "public-key",
+		ID:   resp.ID,
+	}, {
+		Type: "public-key",
+		ID:   cred.ID,
+	}}
+	_, err = s.config.VerifyRegistration(opts, resp)
+	c.Assert(err, gc.ErrorMatches, `credential already registered`)
+	c.Assert(errgo.Cause(err), gc.Equals, webauthn.ErrVerification)
+}
+
+func (s *webauthnSuite) TestRegisterWithAttestation(c *gc.C) {
+	ca, err := webauthntest.NewCA()
+	c.Assert(err, gc.Equals, nil)
+	s.config.AttestationRoots = ca.CertPool()
+	s.authenticator, err = ca.NewAuthenticator(s.config.Origin)
+	c.Assert(err, gc.Equals, nil)
+	opts, err := s.config.NewCreationOptions(testUser, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(opts.Attestation, gc.Equals, "direct")
+	s.register(c)
+}
+
+func (s *webauthnSuite) TestRegisterUntrustedAttestation(c *gc.C) {
+	ca, err := webauthntest.NewCA()
+	c.Assert(err, gc.Equals, nil)
+	s.authenticator, err = ca.NewAuthenticator(s.config.Origin)
+	c.Assert(err, gc.Equals, nil)
+	ca2, err := webauthntest.NewCA()
+	c.Assert(err, gc.Equals, nil)
+	s.config.AttestationRoots = ca2.CertPool()
+	opts, err := s.config.NewCreationOptions(testUser, nil)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Create(opts)
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.config.VerifyRegistration(opts, resp)
+	c.Assert(err, gc.ErrorMatches, `untrusted authenticator: .*`)
+	c.Assert(errgo.Cause(err), gc.Equals, webauthn.ErrVerification)
+}
+
+func (s *webauthnSuite) TestRegisterAttestationRequired(c *gc.C) {
+	ca, err := webauthntest.NewCA()
+	c.Assert(err, gc.Equals, nil)
+	s.config.AttestationRoots = ca.CertPool()
+	for _, self := range []bool{false, true} {
+		s.authenticator.SelfAttestation = self
+		opts, err := s.config.NewCreationOptions(testUser, nil)
+		c.Assert(err, gc.Equals, nil)
+		resp, err := s.authenticator.Create(opts)
+		c.Assert(err, gc.Equals, nil)
+		_, err = s.config.VerifyRegistration(opts, resp)
+		c.Assert(err, gc.ErrorMatches, `authenticator attestation required`)
+	}
+}
+
+var registrationErrorTests = []struct {
+	about       string
+	modify      func(*webauthn.CreationOptions, *webauthnSuite)
+	expectError string
+}{{
+	about: "wrong challenge",
+	modify: func(opts *webauthn.CreationOptions, _ *webauthnSuite) {
+		opts.Challenge = webauthn.Bytes("bad challenge")
+	},
+	expectError: `challenge mismatch`,
+}, {
+	about: "wrong origin",
+	modify: func(_ *webauthn.CreationOptions, s *webauthnSuite) {
+		s.authenticator.Origin = "https://evil.example.com"
+	},
+	expectError: `unexpected origin "https://evil.example.com"`,
+}, {
+	about: "wrong relying party",
+	modify: func(opts *webauthn.CreationOptions, _ *webauthnSuite) {
+		opts.RP.ID = "example.com"
+	},
+	expectError: `relying party ID mismatch`,
+}}
+
+func (s *webauthnSuite) TestRegistrationErrors(c *gc.C) {
+	for i, test := range registrationErrorTests {
+		c.Logf("test %d. %s", i, test.about)
+		s.authenticator = webauthntest.NewAuthenticator(s.config.Origin)
+		opts, err := s.config.NewCreationOptions(testUser, nil)
+		c.Assert(err, gc.Equals, nil)
+		orig := *opts
+		test.modify(opts, s)
+		resp, err := s.authenticator.Create(opts)
+		c.Assert(err, gc.Equals, nil)
+		_, err = s.config.VerifyRegistration(&orig, resp)
+		c.Check(err, gc.ErrorMatches, test.expectError)
+		c.Check(errgo.Cause(err), gc.Equals, webauthn.ErrVerification)
+	}
+}
+
+func (s *webauthnSuite) TestAssertion(c *gc.C) {
+	cred := s.register(c)
+	for i := 0; i < 2; i++ {
+		opts, err := s.config.NewRequestOptions([]webauthn.Credential{*cred}, webauthn.UserVerificationDiscouraged)
+		c.Assert(err, gc.Equals, nil)
+		resp, err := s.authenticator.Get(opts)
+		c.Assert(err, gc.Equals, nil)
+		n, err := s.config.VerifyAssertion(opts, cred, resp)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(n, gc.Equals, uint32(i+1))
+		cred.SignCount = n
+	}
+}
+
+func (s *webauthnSuite) TestDiscoverableAssertion(c *gc.C) {
+	cred := s.register(c)
+	opts, err := s.config.NewRequestOptions(nil, webauthn.UserVerificationRequired)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Get(opts)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert([]byte(resp.UserHandle), jc.DeepEquals, []byte("1234"))
+	_, err = s.config.VerifyAssertion(opts, cred, resp)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *webauthnSuite) TestAssertionUserNotVerified(c *gc.C) {
+	cred := s.register(c)
+	s.authenticator.NoUserVerification = true
+	opts, err := s.config.NewRequestOptions(nil, webauthn.UserVerificationRequired)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Get(opts)
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.config.VerifyAssertion(opts, cred, resp)
+	c.Assert(err, gc.ErrorMatches, `user not verified`)
+}
+
+func (s *webauthnSuite) TestAssertionClonedAuthenticator(c *gc.C) {
+	cred := s.register(c)
+	cred.SignCount = 10
+	opts, err := s.config.NewRequestOptions([]webauthn.Credential{*cred}, webauthn.UserVerificationDiscouraged)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Get(opts)
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.config.VerifyAssertion(opts, cred, resp)
+	c.Assert(err, gc.ErrorMatches, `signature counter did not increase, the authenticator may have been cloned`)
+}
+
+func (s *webauthnSuite) TestAssertionWrongCredential(c *gc.C) {
+	cred1 := s.register(c)
+	cred2 := s.register(c)
+	opts, err := s.config.NewRequestOptions([]webauthn.Credential{*cred1}, webauthn.UserVerificationDiscouraged)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Get(opts)
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.config.VerifyAssertion(opts, cred2, resp)
+	c.Assert(err, gc.ErrorMatches, `credential ID mismatch`)
+
+	// A response signed by a different key is rejected.
+	cred2.ID = cred1.ID
+	_, err = s.config.VerifyAssertion(opts, cred2, resp)
+	c.Assert(err, gc.ErrorMatches, `invalid signature`)
+}
+
+func (s *webauthnSuite) TestAssertionWrongChallenge(c *gc.C) {
+	cred := s.register(c)
+	opts, err := s.config.NewRequestOptions(nil, webauthn.UserVerificationDiscouraged)
+	c.Assert(err, gc.Equals, nil)
+	resp, err := s.authenticator.Get(opts)
+	c.Assert(err, gc.Equals, nil)
+	opts2, err := s.config.NewRequestOptions(nil, webauthn.UserVerificationDiscouraged)
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.config.VerifyAssertion(opts2, cred, resp)
+	c.Assert(err, gc.ErrorMatches, `challenge mismatch`)
+}
+
+func (s *webauthnSuite) TestBytesJSON(c *gc.C) {
+	var v struct {
+		B webauthn.Bytes
+	}
+	err := json.Unmarshal([]byte(`{"B": "aGVsbG8="}`), &v)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(v.B), gc.Equals, "hello")
+	buf, err := json.Marshal(v)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(buf), gc.Equals, `{"B":"aGVsbG8"}`)
+}
@@ -0,0 +1,312 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package webauthntest provides a software WebAuthn authenticator that
+// can be used in place of a hardware security key in tests.
+package webauthntest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn"
+	"github.com/CanonicalLtd/blues-identity/internal/webauthn/cbor"
+)
+
+// An Authenticator is a software WebAuthn authenticator. It behaves as
+// a browser and a security key combined, producing the responses that
+// navigator.credentials.create and navigator.credentials.get would
+// return.
+type Authenticator struct {
+	// Origin holds the origin that the authenticator reports in
+	// client data.
+	Origin string
+
+	// AAGUID holds the authenticator model identifier.
+	AAGUID []byte
+
+	// NoUserVerification causes the authenticator to report that the
+	// user was not verified.
+	NoUserVerification bool
+
+	// SelfAttestation causes the authenticator to produce "packed"
+	// self attestation statements rather than "none" attestation
+	// when it has no attestation certificate.
+	SelfAttestation bool
+
+	attestationCert []byte
+	attestationKey  *ecdsa.PrivateKey
+
+	mu          sync.Mutex
+	credentials []*credential
+}
+
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+// NewAuthenticator returns a new authenticator that reports the given
+// origin. The authenticator does not have an attestation certificate.
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{
+		Origin: origin,
+		AAGUID: make([]byte, 16),
+	}
+}
+
+// Create creates a new credential using the given options and returns
+// the attestation response.
+func (a *Authenticator) Create(opts *webauthn.CreationOptions) (*webauthn.AttestationResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, cd := range opts.ExcludeCredentials {
+		if a.find(opts.RP.ID, cd.ID) != nil {
+			return nil, errgo.Newf("credential already registered")
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	cred := &credential{
+		id:         make([]byte, 32),
+		rpID:       opts.RP.ID,
+		userHandle: opts.User.ID,
+		key:        key,
+	}
+	if _, err := rand.Read(cred.id); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	pub, err := webauthn.MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var attested bytes.Buffer
+	attested.Write(a.AAGUID)
+	binary.Write(&attested, binary.BigEndian, uint16(len(cred.id)))
+	attested.Write(cred.id)
+	attested.Write(pub)
+	authData := a.authenticatorData(cred, attested.Bytes())
+	clientData, err := a.clientData("webauthn.create", opts.Challenge)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	format := "none"
+	attStmt := map[interface{}]interface{}{}
+	switch {
+	case a.attestationKey != nil:
+		sig, err := sign(a.attestationKey, authData, clientData)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		format = "packed"
+		attStmt = map[interface{}]interface{}{
+			"alg": webauthn.AlgES256,
+			"sig": sig,
+			"x5c": []interface{}{a.attestationCert},
+		}
+	case a.SelfAttestation:
+		sig, err := sign(key, authData, clientData)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		format = "packed"
+		attStmt = map[interface{}]interface{}{
+			"alg": webauthn.AlgES256,
+			"sig": sig,
+		}
+	}
+	attObj, err := cbor.Encode(map[interface{}]interface{}{
+		"fmt":      format,
+		"attStmt":  attStmt,
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	a.credentials = append(a.credentials, cred)
+	return &webauthn.AttestationResponse{
+		ID:                cred.id,
+		ClientDataJSON:    clientData,
+		AttestationObject: attObj,
+	}, nil
+}
+
+// Get authenticates using the given options and returns the assertion
+// response. If the options do not specify any allowed credentials then
+// the most recently created credential for the relying party is used.
+func (a *Authenticator) Get(opts *webauthn.RequestOptions) (*webauthn.AssertionResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var cred *credential
+	if len(opts.AllowCredentials) == 0 {
+		for _, c := range a.credentials {
+			if c.rpID == opts.RPID {
+				cred = c
+			}
+		}
+	}
+	for _, cd := range opts.AllowCredentials {
+		if cred = a.find(opts.RPID, cd.ID); cred != nil {
+			break
+		}
+	}
+	if cred == nil {
+		return nil, errgo.Newf("no credential found")
+	}
+	cred.signCount++
+	authData := a.authenticatorData(cred, nil)
+	clientData, err := a.clientData("webauthn.get", opts.Challenge)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	sig, err := sign(cred.key, authData, clientData)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &webauthn.AssertionResponse{
+		ID:                cred.id,
+		ClientDataJSON:    clientData,
+		AuthenticatorData: authData,
+		Signature:         sig,
+		UserHandle:        cred.userHandle,
+	}, nil
+}
+
+func (a *Authenticator) find(rpID string, id []byte) *credential {
+	for _, c := range a.credentials {
+		if c.rpID == rpID && bytes.Equal(c.id, id) {
+			return c
+		}
+	}
+	return nil
+}
+
+// authenticatorData creates the authenticator data for the given
+// credential. If attested is not nil it is included as the attested
+// credential data.
+func (a *Authenticator) authenticatorData(cred *credential, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(cred.rpID))
+	flags := byte(0x01)
+	if !a.NoUserVerification {
+		flags |= 0x04
+	}
+	if attested != nil {
+		flags |= 0x40
+	}
+	var buf bytes.Buffer
+	buf.Write(rpIDHash[:])
+	buf.WriteByte(flags)
+	binary.Write(&buf, binary.BigEndian, cred.signCount)
+	buf.Write(attested)
+	return buf.Bytes()
+}
+
+func (a *Authenticator) clientData(typ string, challenge []byte) ([]byte, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":        typ,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	return data, errgo.Mask(err)
+}
+
+func sign(key *ecdsa.PrivateKey, authData, clientData []byte) ([]byte, error) {
+	ch := sha256.Sum256(clientData)
+	h := sha256.New()
+	h.Write(authData)
+	h.Write(ch[:])
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), nil)
+	return sig, errgo.Mask(err)
+}
+
+// A CA is a certificate authority that issues attestation certificates
+// to software authenticators. It can be used to test the enforcement of
+// attestation requirements.
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// NewCA creates a new CA with a self-signed root certificate.
+func NewCA() (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Attestation CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &CA{
+		cert: cert,
+		key:  key,
+	}, nil
+}
+
+// CertPool returns a certificate pool containing the CA's root
+// certificate.
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// NewAuthenticator returns a new authenticator for the given origin
+// that has an attestation certificate issued by the CA.
+func (ca *CA) NewAuthenticator(origin string) (*Authenticator, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{
+			CommonName:         "Test Authenticator",
+			Organization:       []string{"Test"},
+			OrganizationalUnit: []string{"Authenticator Attestation"},
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	a := NewAuthenticator(origin)
+	a.attestationCert = der
+	a.attestationKey = key
+	return a, nil
+}
@@ -21,3 +21,9 @@ func (c *client) Wait(ctx context.Context, p *waitRequest) (*waitData, error) {
 	err := c.Client.Call(ctx, p, &r)
 	return r, err
 }
+
+func (c *client) Status(ctx context.Context, p *statusRequest) (*statusData, error) {
+	var r *statusData
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
@@ -14,3 +14,12 @@ var (
 	ReallyOldExpiryDuration = &reallyOldExpiryDuration
 	RunGC                   = (*Place).runGC
 )
+
+// PubSubWaitCount reports the number of wait requests from other places
+// that are being handled by a Place that uses a PubSub.
+func PubSubWaitCount(p *Place) int {
+	t := p.transport.(*pubsubTransport)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.waiting)
+}
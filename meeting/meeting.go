@@ -6,23 +6,18 @@
 package meeting
 
 import (
-	"net"
-	"net/http"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/juju/loggo"
 	"github.com/juju/utils"
 	"github.com/juju/utils/clock"
-	"github.com/julienschmidt/httprouter"
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
-	"gopkg.in/httprequest.v1"
 	"gopkg.in/tomb.v2"
 )
 
-//go:generate httprequest-generate-client . handler client
-
 var logger = loggo.GetLogger("meeting")
 
 var (
@@ -53,6 +48,46 @@ var (
 	Clock clock.Clock = clock.WallClock
 )
 
+// ErrNotFound is the error cause returned by Store.Get when there is no
+// entry with the requested id.
+var ErrNotFound = errgo.New("rendezvous not found")
+
+// ErrAlreadyDone is the error cause returned by Place.Done when the
+// rendezvous has already been completed.
+var ErrAlreadyDone = errgo.New("rendezvous already done")
+
+// Status holds the status of a rendezvous.
+type Status int
+
+const (
+	// StatusPending indicates that the rendezvous is waiting for
+	// Done to be called.
+	StatusPending Status = iota
+
+	// StatusDone indicates that Done has been called on the
+	// rendezvous but the data has not yet been collected by Wait.
+	StatusDone
+
+	// StatusExpired indicates that the rendezvous no longer exists,
+	// either because it has expired or because Wait has already
+	// returned its data.
+	StatusExpired
+)
+
+var statusNames = map[Status]string{
+	StatusPending: "pending",
+	StatusDone:    "done",
+	StatusExpired: "expired",
+}
+
+// String implements fmt.Stringer.
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
 // Store defines the backing store required by the
 // participants in the rendezvous.
 // Entries created in the store should be visible
@@ -72,7 +107,8 @@ type Store interface {
 	Put(ctx context.Context, id, address string) error
 
 	// Get returns the address associated with the given id
-	// and removes the association.
+	// and removes the association. If there is no such id
+	// the returned error should have a cause of ErrNotFound.
 	Get(ctx context.Context, id string) (address string, err error)
 
 	// Remove removes the entry with the given id.
@@ -92,8 +128,7 @@ type Place struct {
 	tomb           tomb.Tomb
 	store          Store
 	localAddr      string
-	listener       net.Listener
-	handler        *handler
+	transport      transport
 	metrics        Metrics
 	waitTimeout    time.Duration
 	expiryDuration time.Duration
@@ -136,8 +171,17 @@ type Params struct {
 	// should not have a port number.
 	// Note that ListenAddr must also be sufficient for other
 	// servers to use to contact this one.
+	//
+	// ListenAddr is not used when PubSub is set.
 	ListenAddr string
 
+	// PubSub holds a publish/subscribe message bus that is shared
+	// by all the places using Store. If this is set the places
+	// exchange wait and done requests through the bus instead of
+	// contacting each other over HTTP, so the places need not be
+	// able to reach one another.
+	PubSub PubSub
+
 	// DisableGC holds whether the garbage collector is disabled.
 	DisableGC bool
 
@@ -155,10 +199,6 @@ type Params struct {
 // NewServer returns a new rendezvous place using the given
 // parameters.
 func NewPlace(params Params) (*Place, error) {
-	listener, err := net.Listen("tcp", net.JoinHostPort(params.ListenAddr, "0"))
-	if err != nil {
-		return nil, errgo.Notef(err, "cannot start listener")
-	}
 	if params.Metrics == nil {
 		params.Metrics = noMetrics{}
 	}
@@ -170,33 +210,29 @@ func NewPlace(params Params) (*Place, error) {
 	}
 	p := &Place{
 		store:          params.Store,
-		listener:       listener,
-		localAddr:      listener.Addr().String(),
 		items:          make(map[string]*item),
 		metrics:        params.Metrics,
 		waitTimeout:    params.WaitTimeout,
 		expiryDuration: params.ExpiryDuration,
 	}
-	p.handler = &handler{
-		place: p,
+	var err error
+	if params.PubSub != nil {
+		p.transport, p.localAddr, err = newPubSubTransport(p, params.PubSub)
+	} else {
+		p.transport, p.localAddr, err = newHTTPTransport(p, params.ListenAddr)
 	}
-	router := httprouter.New()
-	for _, h := range reqServer.Handlers(p.newHandler) {
-		router.Handle(h.Method, h.Path, h.Handle)
+	if err != nil {
+		return nil, errgo.Mask(err)
 	}
 	if !params.DisableGC {
 		p.tomb.Go(p.gc)
 	}
-	p.tomb.Go(func() error {
-		http.Serve(p.listener, router)
-		return nil
-	})
 	return p, nil
 }
 
 // Close shuts down the rendezvous place.
 func (p *Place) Close() {
-	p.listener.Close()
+	p.transport.close()
 	p.tomb.Kill(nil)
 	p.tomb.Wait()
 }
@@ -321,11 +357,11 @@ func (p *Place) localDone(id string, data []byte) error {
 	item := p.items[id]
 
 	if item == nil {
-		return errgo.Newf("rendezvous %q not found", id)
+		return errgo.WithCausef(nil, ErrNotFound, "rendezvous %q not found", id)
 	}
 	select {
 	case <-item.c:
-		return errgo.Newf("rendezvous %q done twice", id)
+		return errgo.WithCausef(nil, ErrAlreadyDone, "rendezvous %q done twice", id)
 	default:
 		item.data1 = data
 		close(item.c)
@@ -333,22 +369,31 @@ func (p *Place) localDone(id string, data []byte) error {
 	return nil
 }
 
-func (p *Place) isLocal(id string) bool {
+// localStatus is the internal version of Place.Status.
+// It only works if the given id is stored locally.
+func (p *Place) localStatus(id string) (Status, []byte) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	return p.items[id] != nil
-}
-
-func (p *Place) newHandler(params httprequest.Params) (*handler, context.Context, error) {
-	return p.handler, params.Context, nil
+	item := p.items[id]
+	if item == nil {
+		return StatusExpired, nil
+	}
+	select {
+	case <-item.c:
+		return StatusDone, item.data1
+	default:
+	}
+	// The rendezvous might not have been garbage collected yet.
+	if Clock.Now().After(item.created.Add(p.expiryDuration)) {
+		return StatusExpired, nil
+	}
+	return StatusPending, nil
 }
 
-var reqServer = httprequest.Server{
-	ErrorMapper: func(ctx context.Context, err error) (httpStatus int, errorBody interface{}) {
-		return http.StatusInternalServerError, &httprequest.RemoteError{
-			Message: err.Error(),
-		}
-	},
+func (p *Place) isLocal(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.items[id] != nil
 }
 
 // NewRendezvous creates a new rendezvous holding
@@ -379,51 +424,57 @@ func (p *Place) Wait(ctx context.Context, id string) (data0, data1 []byte, err e
 		return p.localWait(ctx, id)
 	}
 	logger.Infof("not local wait")
-	client, err := p.clientForId(ctx, id)
+	addr, err := p.store.Get(ctx, id)
 	if err != nil {
 		return nil, nil, errgo.Mask(err)
 	}
-	resp, err := client.Wait(ctx, &waitRequest{
-		Id: id,
-	})
+	data0, data1, err = p.transport.wait(ctx, addr, id)
 	if err != nil {
 		return nil, nil, errgo.Mask(err)
 	}
-	return resp.Data0, resp.Data1, nil
+	return data0, data1, nil
 }
 
 // Done marks the rendezvous with the given id as complete,
 // and provides it with the given data which will be
-// returned from Wait.
+// returned from Wait. Checking that the rendezvous is still pending and
+// completing it is a single operation; if the rendezvous has already
+// been completed an error with a cause of ErrAlreadyDone is returned,
+// and if it cannot be found the cause is ErrNotFound.
 func (p *Place) Done(ctx context.Context, id string, data []byte) error {
 	if p.isLocal(id) {
-		return p.localDone(id, data)
+		return errgo.Mask(p.localDone(id, data), errgo.Is(ErrNotFound), errgo.Is(ErrAlreadyDone))
 	}
-	client, err := p.clientForId(ctx, id)
+	addr, err := p.store.Get(ctx, id)
 	if err != nil {
-		return errgo.Mask(err)
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
 	}
-	if err := client.Done(ctx, &doneRequest{
-		Id: id,
-		Body: doneData{
-			Data1: data,
-		},
-	}); err != nil {
-		return errgo.Mask(err)
+	if err := p.transport.done(ctx, addr, id, data); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotFound), errgo.Is(ErrAlreadyDone))
 	}
 	return nil
 }
 
-func (p *Place) clientForId(ctx context.Context, id string) (*client, error) {
+// Status returns the current status of the rendezvous with the given
+// id without waiting for it. If the status is StatusDone the data
+// provided to Done is also returned.
+func (p *Place) Status(ctx context.Context, id string) (Status, []byte, error) {
+	if p.isLocal(id) {
+		status, data1 := p.localStatus(id)
+		return status, data1, nil
+	}
 	addr, err := p.store.Get(ctx, id)
+	if errgo.Cause(err) == ErrNotFound {
+		return StatusExpired, nil, nil
+	}
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return 0, nil, errgo.Mask(err)
+	}
+	status, data1, err := p.transport.status(ctx, addr, id)
+	if err != nil {
+		return 0, nil, errgo.Mask(err)
 	}
-	return &client{
-		Client: httprequest.Client{
-			BaseURL: "http://" + addr,
-		},
-	}, nil
+	return status, data1, nil
 }
 
 // noMetrics implements Metrics by doing nothing.
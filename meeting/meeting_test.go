@@ -118,6 +118,7 @@ func (s *suite) TestRendezvousDoneBeforeWait(c *gc.C) {
 
 	err = p.Done(ctx, id, []byte("other second data"))
 	c.Assert(err, gc.ErrorMatches, `.*rendezvous ".*" done twice`)
+	c.Assert(errgo.Cause(err), gc.Equals, meeting.ErrAlreadyDone)
 
 	data0, data1, err := p.Wait(ctx, id)
 	c.Assert(err, gc.IsNil)
@@ -196,6 +197,278 @@ func (s *suite) TestRendezvousDifferentPlaces(c *gc.C) {
 	c.Assert(count, gc.Equals, int32(0))
 }
 
+func (s *suite) TestRendezvousDifferentPlacesPubSub(c *gc.C) {
+	s.PatchValue(&meeting.Clock, s.clock)
+	count := int32(0)
+	store := newFakeStore(&count, s.clock)
+	ps := meeting.NewMemPubSub()
+	var places []*meeting.Place
+	for i := 0; i < 3; i++ {
+		m, err := meeting.NewPlace(meeting.Params{
+			Store:  store,
+			PubSub: ps,
+		})
+		c.Assert(err, gc.IsNil)
+		defer m.Close()
+		places = append(places, m)
+	}
+
+	ctx := context.Background()
+
+	// Create the rendezvous in the first place.
+	id, err := newId()
+	c.Assert(err, gc.IsNil)
+	err = places[0].NewRendezvous(ctx, id, []byte("first data"))
+	c.Assert(err, gc.IsNil)
+
+	// Wait for the rendezvous in the second.
+	waitDone := make(chan struct{})
+	go func() {
+		data0, data1, err := places[1].Wait(ctx, id)
+		c.Check(err, gc.IsNil)
+		c.Check(string(data0), gc.Equals, "first data")
+		c.Check(string(data1), gc.Equals, "second data")
+
+		close(waitDone)
+	}()
+	s.clock.Advance(10 * time.Millisecond)
+	err = places[2].Done(ctx, id, []byte("second data"))
+	c.Assert(err, gc.IsNil)
+
+	select {
+	case <-waitDone:
+	case <-time.After(2 * time.Second):
+		c.Errorf("timed out waiting for rendezvous")
+	}
+
+	// Check that item has now been deleted.
+	_, _, err = places[2].Wait(ctx, id)
+	c.Assert(err, gc.ErrorMatches, `rendezvous ".*" not found`)
+
+	c.Assert(count, gc.Equals, int32(0))
+}
+
+func (s *suite) TestPubSubDoneTwice(c *gc.C) {
+	store := newFakeStore(nil, s.clock)
+	ps := meeting.NewMemPubSub()
+	m1, err := meeting.NewPlace(meeting.Params{
+		Store:     store,
+		PubSub:    ps,
+		DisableGC: true,
+	})
+	c.Assert(err, gc.IsNil)
+	defer m1.Close()
+	m2, err := meeting.NewPlace(meeting.Params{
+		Store:     store,
+		PubSub:    ps,
+		DisableGC: true,
+	})
+	c.Assert(err, gc.IsNil)
+	defer m2.Close()
+
+	ctx := context.Background()
+	id, err := newId()
+	c.Assert(err, gc.IsNil)
+	err = m1.NewRendezvous(ctx, id, []byte("first data"))
+	c.Assert(err, gc.IsNil)
+	err = m2.Done(ctx, id, []byte("second data"))
+	c.Assert(err, gc.IsNil)
+	err = m2.Done(ctx, id, []byte("other second data"))
+	c.Assert(err, gc.ErrorMatches, `rendezvous ".*" done twice`)
+	c.Assert(errgo.Cause(err), gc.Equals, meeting.ErrAlreadyDone)
+}
+
+func (s *suite) TestMemPubSub(c *gc.C) {
+	ps := meeting.NewMemPubSub()
+	ctx := context.Background()
+	sub1, err := ps.Subscribe("a")
+	c.Assert(err, gc.IsNil)
+	sub2, err := ps.Subscribe("a")
+	c.Assert(err, gc.IsNil)
+	sub3, err := ps.Subscribe("b")
+	c.Assert(err, gc.IsNil)
+	defer sub3.Close()
+
+	err = ps.Publish(ctx, "a", []byte("message 1"))
+	c.Assert(err, gc.IsNil)
+	err = ps.Publish(ctx, "a", []byte("message 2"))
+	c.Assert(err, gc.IsNil)
+	for _, sub := range []meeting.Subscription{sub1, sub2} {
+		for _, expect := range []string{"message 1", "message 2"} {
+			select {
+			case msg := <-sub.Messages():
+				c.Assert(string(msg), gc.Equals, expect)
+			case <-time.After(time.Second):
+				c.Fatalf("timed out waiting for message")
+			}
+		}
+	}
+	select {
+	case msg := <-sub3.Messages():
+		c.Fatalf("unexpected message %q", msg)
+	default:
+	}
+
+	err = sub1.Close()
+	c.Assert(err, gc.IsNil)
+	select {
+	case _, ok := <-sub1.Messages():
+		c.Assert(ok, gc.Equals, false)
+	case <-time.After(time.Second):
+		c.Fatalf("timed out waiting for subscription to close")
+	}
+	sub2.Close()
+}
+
+var statusTransportTests = []struct {
+	about  string
+	params meeting.Params
+}{{
+	about: "http",
+	params: meeting.Params{
+		ListenAddr: "localhost",
+	},
+}, {
+	about: "pubsub",
+	params: meeting.Params{
+		PubSub: meeting.NewMemPubSub(),
+	},
+}}
+
+func (s *suite) TestStatus(c *gc.C) {
+	s.PatchValue(&meeting.Clock, s.clock)
+	for i, test := range statusTransportTests {
+		c.Logf("test %d: %s", i, test.about)
+		store := newFakeStore(nil, s.clock)
+		params := test.params
+		params.Store = store
+		params.DisableGC = true
+		m1, err := meeting.NewPlace(params)
+		c.Assert(err, gc.IsNil)
+		defer m1.Close()
+		m2, err := meeting.NewPlace(params)
+		c.Assert(err, gc.IsNil)
+		defer m2.Close()
+
+		ctx := context.Background()
+		id, err := newId()
+		c.Assert(err, gc.IsNil)
+		err = m1.NewRendezvous(ctx, id, []byte("first data"))
+		c.Assert(err, gc.IsNil)
+
+		for _, m := range []*meeting.Place{m1, m2} {
+			status, data1, err := m.Status(ctx, id)
+			c.Assert(err, gc.IsNil)
+			c.Assert(status, gc.Equals, meeting.StatusPending)
+			c.Assert(data1, gc.IsNil)
+		}
+
+		err = m2.Done(ctx, id, []byte("second data"))
+		c.Assert(err, gc.IsNil)
+
+		for _, m := range []*meeting.Place{m1, m2} {
+			status, data1, err := m.Status(ctx, id)
+			c.Assert(err, gc.IsNil)
+			c.Assert(status, gc.Equals, meeting.StatusDone)
+			c.Assert(string(data1), gc.Equals, "second data")
+		}
+
+		_, _, err = m2.Wait(ctx, id)
+		c.Assert(err, gc.IsNil)
+
+		for _, m := range []*meeting.Place{m1, m2} {
+			status, data1, err := m.Status(ctx, id)
+			c.Assert(err, gc.IsNil)
+			c.Assert(status, gc.Equals, meeting.StatusExpired)
+			c.Assert(data1, gc.IsNil)
+		}
+	}
+}
+
+func (s *suite) TestStatusExpiredBeforeGC(c *gc.C) {
+	s.PatchValue(&meeting.Clock, s.clock)
+	store := newFakeStore(nil, s.clock)
+	m, err := meeting.NewPlace(meeting.Params{
+		Store:          store,
+		ListenAddr:     "localhost",
+		DisableGC:      true,
+		ExpiryDuration: time.Minute,
+	})
+	c.Assert(err, gc.IsNil)
+	defer m.Close()
+
+	ctx := context.Background()
+	id, err := newId()
+	c.Assert(err, gc.IsNil)
+	err = m.NewRendezvous(ctx, id, []byte("first data"))
+	c.Assert(err, gc.IsNil)
+
+	s.clock.Advance(2 * time.Minute)
+	status, _, err := m.Status(ctx, id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(status, gc.Equals, meeting.StatusExpired)
+}
+
+func (s *suite) TestPubSubWaitCancelled(c *gc.C) {
+	s.PatchValue(&meeting.Clock, s.clock)
+	store := newFakeStore(nil, s.clock)
+	params := meeting.Params{
+		Store:       store,
+		PubSub:      meeting.NewMemPubSub(),
+		DisableGC:   true,
+		WaitTimeout: time.Minute,
+	}
+	m1, err := meeting.NewPlace(params)
+	c.Assert(err, gc.IsNil)
+	defer m1.Close()
+	m2, err := meeting.NewPlace(params)
+	c.Assert(err, gc.IsNil)
+	defer m2.Close()
+
+	id, err := newId()
+	c.Assert(err, gc.IsNil)
+	err = m1.NewRendezvous(context.Background(), id, []byte("first data"))
+	c.Assert(err, gc.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := m2.Wait(ctx, id)
+		done <- err
+	}()
+	// Wait for both the requester and the remote wait to start.
+	err = s.clock.WaitAdvance(0, time.Second, 2)
+	c.Assert(err, gc.IsNil)
+	cancel()
+	select {
+	case err := <-done:
+		c.Assert(err, gc.ErrorMatches, "no response from rendezvous: context canceled")
+	case <-time.After(time.Second):
+		c.Fatalf("timed out waiting for Wait to return")
+	}
+	for i := 0; meeting.PubSubWaitCount(m1) > 0; i++ {
+		if i > 100 {
+			c.Fatalf("remote wait not cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The cancelled wait must not have acquired the rendezvous.
+	err = m1.Done(context.Background(), id, []byte("second data"))
+	c.Assert(err, gc.IsNil)
+	data0, data1, err := m2.Wait(context.Background(), id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data0), gc.Equals, "first data")
+	c.Assert(string(data1), gc.Equals, "second data")
+}
+
+func (s *suite) TestStatusString(c *gc.C) {
+	c.Assert(meeting.StatusPending.String(), gc.Equals, "pending")
+	c.Assert(meeting.StatusDone.String(), gc.Equals, "done")
+	c.Assert(meeting.StatusExpired.String(), gc.Equals, "expired")
+	c.Assert(meeting.Status(99).String(), gc.Equals, "Status(99)")
+}
+
 func (s *suite) TestEntriesRemovedOnClose(c *gc.C) {
 	s.PatchValue(&meeting.Clock, s.clock)
 	store := newFakeStore(nil, s.clock)
@@ -614,7 +887,7 @@ func (s *fakeStore) Get(_ context.Context, id string) (address string, err error
 	if entry := s.entries[id]; entry != nil {
 		return entry.addr, nil
 	}
-	return "", errgo.Newf("rendezvous %q not found", id)
+	return "", errgo.WithCausef(nil, meeting.ErrNotFound, "rendezvous %q not found", id)
 }
 
 // Remove implements Store.Remove.
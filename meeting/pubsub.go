@@ -0,0 +1,472 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package meeting
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/juju/utils"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+)
+
+// doneTimeout holds the maximum length of time to wait for the
+// response to a done request sent through a PubSub.
+var doneTimeout = 30 * time.Second
+
+// PubSub is a publish/subscribe message bus. Messages published on a
+// channel are delivered to all the current subscribers of that channel
+// and are otherwise discarded. A PubSub must be safe to call
+// concurrently.
+type PubSub interface {
+	// Publish sends the given message to the subscribers of the
+	// given channel.
+	Publish(ctx context.Context, channel string, msg []byte) error
+
+	// Subscribe subscribes to the given channel.
+	Subscribe(channel string) (Subscription, error)
+}
+
+// A Subscription receives the messages published on a PubSub channel.
+type Subscription interface {
+	// Messages returns the channel on which the messages are
+	// delivered. The channel is closed when the subscription is
+	// closed.
+	Messages() <-chan []byte
+
+	// Close closes the subscription.
+	Close() error
+}
+
+// pubsubMessage holds a message sent between places using a PubSub.
+// Each place subscribes to a channel named with its address. Exactly
+// one of Request or Response is set.
+type pubsubMessage struct {
+	Request  *pubsubRequest  `json:"request,omitempty"`
+	Response *pubsubResponse `json:"response,omitempty"`
+}
+
+// pubsubRequest holds a wait or done request.
+type pubsubRequest struct {
+	// ReplyTo holds the address of the place to send the response
+	// to.
+	ReplyTo string `json:"reply-to"`
+
+	// Seq holds the sequence number of the request, this is
+	// returned in the response.
+	Seq uint64 `json:"seq"`
+
+	// Done holds whether this is a done request, rather than a wait
+	// request.
+	Done bool `json:"done,omitempty"`
+
+	// Status holds whether this is a status request.
+	Status bool `json:"status,omitempty"`
+
+	// Cancel holds whether this is a request to cancel the wait
+	// request with the same ReplyTo and Seq, sent when the
+	// requester stops waiting for the response.
+	Cancel bool `json:"cancel,omitempty"`
+
+	// Timeout holds the length of time for which the requester will
+	// wait for the response to a wait request. If it is zero only the
+	// place's own timeouts apply.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// ID holds the ID of the rendezvous.
+	ID string `json:"id"`
+
+	// Data holds the data for a done request.
+	Data []byte `json:"data,omitempty"`
+}
+
+// pubsubResponse holds the response to a pubsubRequest.
+type pubsubResponse struct {
+	Seq    uint64 `json:"seq"`
+	Data0  []byte `json:"data0,omitempty"`
+	Data1  []byte `json:"data1,omitempty"`
+	Status Status `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// ErrorCause holds the name of the cause of Error if it is one
+	// that the requester needs to distinguish.
+	ErrorCause string `json:"error-cause,omitempty"`
+}
+
+// pubsubTransport is a transport that exchanges requests with other
+// places using a PubSub.
+type pubsubTransport struct {
+	place  *Place
+	pubsub PubSub
+	sub    Subscription
+	addr   string
+
+	// mu protects the fields below it.
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]chan *pubsubResponse
+
+	// waiting holds the functions that cancel the wait requests
+	// currently being handled.
+	waiting map[waitKey]func()
+}
+
+// waitKey identifies a wait request being handled by a
+// pubsubTransport.
+type waitKey struct {
+	replyTo string
+	seq     uint64
+}
+
+// newPubSubTransport creates a new pubsubTransport that receives
+// requests for the given place. It returns the transport and the
+// address of the place.
+func newPubSubTransport(p *Place, ps PubSub) (*pubsubTransport, string, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	addr := "meeting_" + hex.EncodeToString(buf[:])
+	sub, err := ps.Subscribe(addr)
+	if err != nil {
+		return nil, "", errgo.Notef(err, "cannot subscribe")
+	}
+	t := &pubsubTransport{
+		place:   p,
+		pubsub:  ps,
+		sub:     sub,
+		addr:    addr,
+		pending: make(map[uint64]chan *pubsubResponse),
+		waiting: make(map[waitKey]func()),
+	}
+	p.tomb.Go(t.run)
+	return t, addr, nil
+}
+
+// run handles the messages received on the transport's subscription
+// until it is closed.
+func (t *pubsubTransport) run() error {
+	for buf := range t.sub.Messages() {
+		var m pubsubMessage
+		if err := json.Unmarshal(buf, &m); err != nil {
+			logger.Errorf("invalid meeting message: %v", err)
+			continue
+		}
+		switch {
+		case m.Request != nil && m.Request.Cancel:
+			t.cancelWait(m.Request)
+		case m.Request != nil:
+			// Wait requests can block for a long time, so handle
+			// each request in its own goroutine. The wait is
+			// registered first so that a cancel message that
+			// follows it is never missed.
+			ctx, cancel := t.startWait(m.Request)
+			go t.handleRequest(ctx, cancel, m.Request)
+		case m.Response != nil:
+			t.mu.Lock()
+			c := t.pending[m.Response.Seq]
+			delete(t.pending, m.Response.Seq)
+			t.mu.Unlock()
+			if c != nil {
+				c <- m.Response
+			}
+		}
+	}
+	return nil
+}
+
+// startWait returns the context to use when handling the given request
+// and a function that must be called when it is complete. The context
+// of a wait request is cancelled when a cancel message for it is
+// received or when its requester's timeout has passed, so that a wait
+// that nobody will receive the response to does not acquire the
+// rendezvous.
+func (t *pubsubTransport) startWait(req *pubsubRequest) (context.Context, func()) {
+	if req.Done || req.Status {
+		return context.Background(), func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if req.Timeout > 0 {
+		var cancelTimeout func()
+		ctx, cancelTimeout = utils.ContextWithTimeout(ctx, Clock, req.Timeout)
+		cancelParent := cancel
+		cancel = func() {
+			cancelTimeout()
+			cancelParent()
+		}
+	}
+	key := waitKey{req.ReplyTo, req.Seq}
+	t.mu.Lock()
+	t.waiting[key] = cancel
+	t.mu.Unlock()
+	return ctx, func() {
+		t.mu.Lock()
+		delete(t.waiting, key)
+		t.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancelWait cancels the wait request identified by the given cancel
+// request, if it is still being handled.
+func (t *pubsubTransport) cancelWait(req *pubsubRequest) {
+	t.mu.Lock()
+	cancel := t.waiting[waitKey{req.ReplyTo, req.Seq}]
+	t.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// handleRequest performs the given request on the local place using
+// the given context and publishes the response. The done function is
+// called once the request has been performed.
+func (t *pubsubTransport) handleRequest(ctx context.Context, done func(), req *pubsubRequest) {
+	defer done()
+	resp := &pubsubResponse{
+		Seq: req.Seq,
+	}
+	var err error
+	switch {
+	case req.Done:
+		err = t.place.localDone(req.ID, req.Data)
+	case req.Status:
+		resp.Status, resp.Data1 = t.place.localStatus(req.ID)
+	default:
+		resp.Data0, resp.Data1, err = t.place.localWait(ctx, req.ID)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		resp.ErrorCause = errorCauseName(err)
+	}
+	if err := t.publish(context.Background(), req.ReplyTo, &pubsubMessage{Response: resp}); err != nil {
+		logger.Errorf("cannot send meeting response to %s: %v", req.ReplyTo, err)
+	}
+}
+
+// call sends the given request to the place with the given address and
+// waits for the response.
+func (t *pubsubTransport) call(ctx context.Context, addr string, req *pubsubRequest, timeout time.Duration) (*pubsubResponse, error) {
+	c := make(chan *pubsubResponse, 1)
+	t.mu.Lock()
+	t.seq++
+	req.Seq = t.seq
+	req.ReplyTo = t.addr
+	t.pending[req.Seq] = c
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, req.Seq)
+		t.mu.Unlock()
+	}()
+	if err := t.publish(ctx, addr, &pubsubMessage{Request: req}); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// The place holding the rendezvous applies its own timeouts, this
+	// one only guards against that place having gone away.
+	ctx, cancel := utils.ContextWithTimeout(ctx, Clock, timeout)
+	defer cancel()
+	select {
+	case resp := <-c:
+		if resp.Error != "" {
+			return nil, errorWithCauseName(resp.ErrorCause, resp.Error)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		if !req.Done && !req.Status {
+			// Stop the remote wait so that it leaves the
+			// rendezvous for a later wait to acquire.
+			t.sendCancel(addr, req)
+		}
+		return nil, errgo.Notef(ctx.Err(), "no response from rendezvous")
+	}
+}
+
+// sendCancel tells the place with the given address that the response
+// to the given wait request is no longer wanted.
+func (t *pubsubTransport) sendCancel(addr string, req *pubsubRequest) {
+	ctx, cancel := utils.ContextWithTimeout(context.Background(), Clock, doneTimeout)
+	defer cancel()
+	if err := t.publish(ctx, addr, &pubsubMessage{
+		Request: &pubsubRequest{
+			ReplyTo: req.ReplyTo,
+			Seq:     req.Seq,
+			Cancel:  true,
+			ID:      req.ID,
+		},
+	}); err != nil {
+		logger.Errorf("cannot cancel meeting wait on %s: %v", addr, err)
+	}
+}
+
+func (t *pubsubTransport) publish(ctx context.Context, channel string, m *pubsubMessage) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := t.pubsub.Publish(ctx, channel, buf); err != nil {
+		return errgo.Notef(err, "cannot publish message")
+	}
+	return nil
+}
+
+// wait implements transport.wait.
+func (t *pubsubTransport) wait(ctx context.Context, addr, id string) (data0, data1 []byte, err error) {
+	req := &pubsubRequest{
+		ID: id,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Timeout = time.Until(deadline)
+		if req.Timeout <= 0 {
+			return nil, nil, errgo.Notef(context.DeadlineExceeded, "rendezvous wait timed out")
+		}
+	}
+	resp, err := t.call(ctx, addr, req, t.place.waitTimeout+doneTimeout)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	return resp.Data0, resp.Data1, nil
+}
+
+// done implements transport.done.
+func (t *pubsubTransport) done(ctx context.Context, addr, id string, data []byte) error {
+	_, err := t.call(ctx, addr, &pubsubRequest{
+		Done: true,
+		ID:   id,
+		Data: data,
+	}, doneTimeout)
+	return errgo.Mask(err)
+}
+
+// status implements transport.status.
+func (t *pubsubTransport) status(ctx context.Context, addr, id string) (Status, []byte, error) {
+	resp, err := t.call(ctx, addr, &pubsubRequest{
+		Status: true,
+		ID:     id,
+	}, doneTimeout)
+	if err != nil {
+		return 0, nil, errgo.Mask(err)
+	}
+	return resp.Status, resp.Data1, nil
+}
+
+// close implements transport.close.
+func (t *pubsubTransport) close() {
+	if err := t.sub.Close(); err != nil {
+		logger.Errorf("cannot close meeting subscription: %v", err)
+	}
+}
+
+// NewMemPubSub returns a PubSub that delivers messages within the
+// current process. It is useful for testing and for running several
+// places in a single process.
+func NewMemPubSub() PubSub {
+	return &memPubSub{
+		subs: make(map[string]map[*memSubscription]bool),
+	}
+}
+
+type memPubSub struct {
+	mu   sync.Mutex
+	subs map[string]map[*memSubscription]bool
+}
+
+// Publish implements PubSub.Publish.
+func (ps *memPubSub) Publish(_ context.Context, channel string, msg []byte) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for sub := range ps.subs[channel] {
+		sub.send(msg)
+	}
+	return nil
+}
+
+// Subscribe implements PubSub.Subscribe.
+func (ps *memPubSub) Subscribe(channel string) (Subscription, error) {
+	sub := &memSubscription{
+		pubsub:  ps,
+		channel: channel,
+		c:       make(chan []byte),
+		closed:  make(chan struct{}),
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.subs[channel] == nil {
+		ps.subs[channel] = make(map[*memSubscription]bool)
+	}
+	ps.subs[channel][sub] = true
+	go sub.run()
+	return sub, nil
+}
+
+type memSubscription struct {
+	pubsub  *memPubSub
+	channel string
+	c       chan []byte
+	closed  chan struct{}
+
+	// mu protects the fields below it.
+	mu     sync.Mutex
+	queue  [][]byte
+	notify chan struct{}
+}
+
+// send queues the given message for delivery. It never blocks.
+func (s *memSubscription) send(msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, append([]byte(nil), msg...))
+	if s.notify != nil {
+		close(s.notify)
+		s.notify = nil
+	}
+}
+
+// run delivers queued messages until the subscription is closed.
+func (s *memSubscription) run() {
+	defer close(s.c)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			notify := make(chan struct{})
+			s.notify = notify
+			s.mu.Unlock()
+			select {
+			case <-notify:
+				continue
+			case <-s.closed:
+				return
+			}
+		}
+		msg := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		select {
+		case s.c <- msg:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// Messages implements Subscription.Messages.
+func (s *memSubscription) Messages() <-chan []byte {
+	return s.c
+}
+
+// Close implements Subscription.Close.
+func (s *memSubscription) Close() error {
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+	if !s.pubsub.subs[s.channel][s] {
+		return nil
+	}
+	delete(s.pubsub.subs[s.channel], s)
+	close(s.closed)
+	return nil
+}
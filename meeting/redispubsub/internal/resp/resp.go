@@ -0,0 +1,148 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package resp implements the subset of the Redis serialization
+// protocol (RESP) needed to use Redis publish/subscribe.
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+
+	"gopkg.in/errgo.v1"
+)
+
+// maxBulkLen holds the maximum length of a bulk string that will be
+// read.
+const maxBulkLen = 512 * 1024 * 1024
+
+// Error is a RESP error value.
+type Error string
+
+// Error implements error.Error.
+func (e Error) Error() string {
+	return string(e)
+}
+
+// WriteCommand writes a command with the given arguments to w, encoded
+// as an array of bulk strings.
+func WriteCommand(w io.Writer, args ...[]byte) error {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(arg))...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := w.Write(buf)
+	return errgo.Mask(err)
+}
+
+// WriteValue writes the given value to w. The value must be one of the
+// types returned by ReadValue.
+func WriteValue(w io.Writer, v interface{}) error {
+	var buf []byte
+	buf = appendValue(buf, v)
+	_, err := w.Write(buf)
+	return errgo.Mask(err)
+}
+
+func appendValue(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, "$-1\r\n"...)
+	case string:
+		return append(append(append(buf, '+'), v...), "\r\n"...)
+	case Error:
+		return append(append(append(buf, '-'), v...), "\r\n"...)
+	case int64:
+		return append(strconv.AppendInt(append(buf, ':'), v, 10), "\r\n"...)
+	case []byte:
+		buf = append(strconv.AppendInt(append(buf, '$'), int64(len(v)), 10), "\r\n"...)
+		return append(append(buf, v...), "\r\n"...)
+	case []interface{}:
+		buf = append(strconv.AppendInt(append(buf, '*'), int64(len(v)), 10), "\r\n"...)
+		for _, e := range v {
+			buf = appendValue(buf, e)
+		}
+		return buf
+	}
+	panic(fmt.Sprintf("unexpected RESP value type %T", v))
+}
+
+// ReadValue reads a single value from r. Simple strings are returned as
+// string, errors as Error, integers as int64, bulk strings as []byte
+// and arrays as []interface{}. Null bulk strings and arrays are
+// returned as nil.
+func ReadValue(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(io.EOF))
+	}
+	if len(line) == 0 {
+		return nil, errgo.New("invalid RESP value: empty line")
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid RESP integer")
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || n < -1 || n > maxBulkLen {
+			return nil, errgo.Newf("invalid RESP bulk string length %q", line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, errgo.New("invalid RESP bulk string terminator")
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || n < -1 {
+			return nil, errgo.Newf("invalid RESP array length %q", line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		vs := make([]interface{}, 0, n)
+		for i := int64(0); i < n; i++ {
+			v, err := ReadValue(r)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			vs = append(vs, v)
+		}
+		return vs, nil
+	}
+	return nil, errgo.Newf("invalid RESP value type %q", line[0])
+}
+
+// readLine reads a CRLF terminated line from r and returns it without
+// the terminator.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) == 0 {
+			return nil, io.EOF
+		}
+		return nil, errgo.Mask(err)
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errgo.New("invalid RESP line terminator")
+	}
+	return line[:len(line)-2], nil
+}
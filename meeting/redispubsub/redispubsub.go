@@ -0,0 +1,289 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package redispubsub provides an implementation of meeting.PubSub that
+// uses Redis publish/subscribe.
+package redispubsub
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/meeting"
+	"github.com/CanonicalLtd/blues-identity/meeting/redispubsub/internal/resp"
+)
+
+var logger = loggo.GetLogger("identity.meeting.redispubsub")
+
+var (
+	// dialTimeout holds the maximum length of time to wait when
+	// connecting to the Redis server.
+	dialTimeout = 10 * time.Second
+
+	// redialInterval holds the time to wait before reconnecting a
+	// subscription whose connection has failed.
+	redialInterval = time.Second
+)
+
+// Params holds the parameters for New.
+type Params struct {
+	// Addr holds the host:port address of the Redis server.
+	Addr string
+
+	// Password holds the password used to authenticate to the Redis
+	// server. If this is empty no authentication is performed.
+	Password string
+}
+
+// New returns a new meeting.PubSub that uses the Redis server with the
+// given parameters. No connection is made until the PubSub is used.
+func New(p Params) *PubSub {
+	return &PubSub{
+		params: p,
+	}
+}
+
+// PubSub implements meeting.PubSub using Redis.
+type PubSub struct {
+	params Params
+
+	// mu protects the fields below it.
+	mu   sync.Mutex
+	conn *conn
+}
+
+var _ meeting.PubSub = (*PubSub)(nil)
+
+// Publish implements meeting.PubSub.Publish.
+func (ps *PubSub) Publish(ctx context.Context, channel string, msg []byte) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	// Retry once in case the connection has been closed since it
+	// was last used.
+	var err error
+	for i := 0; i < 2; i++ {
+		if ps.conn == nil {
+			ps.conn, err = dial(ctx, ps.params)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		var v interface{}
+		v, err = ps.conn.do([]byte("PUBLISH"), []byte(channel), msg)
+		if err == nil {
+			if rerr, ok := v.(resp.Error); ok {
+				return errgo.Notef(rerr, "cannot publish")
+			}
+			return nil
+		}
+		ps.conn.Close()
+		ps.conn = nil
+	}
+	return errgo.Notef(err, "cannot publish")
+}
+
+// Subscribe implements meeting.PubSub.Subscribe.
+func (ps *PubSub) Subscribe(channel string) (meeting.Subscription, error) {
+	c, err := subscribe(context.Background(), ps.params, channel)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	sub := &subscription{
+		params:  ps.params,
+		channel: channel,
+		c:       make(chan []byte),
+		closed:  make(chan struct{}),
+		conn:    c,
+	}
+	go sub.run()
+	return sub, nil
+}
+
+// Close closes the connection used to publish messages. Subscriptions
+// must be closed separately.
+func (ps *PubSub) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.conn == nil {
+		return nil
+	}
+	err := ps.conn.Close()
+	ps.conn = nil
+	return errgo.Mask(err)
+}
+
+type subscription struct {
+	params  Params
+	channel string
+	c       chan []byte
+	closed  chan struct{}
+
+	// mu protects the fields below it.
+	mu       sync.Mutex
+	conn     *conn
+	isClosed bool
+}
+
+// run reads messages from the subscription's connection and delivers
+// them, reconnecting if the connection fails, until the subscription
+// is closed.
+func (s *subscription) run() {
+	defer close(s.c)
+	for {
+		s.mu.Lock()
+		c := s.conn
+		s.mu.Unlock()
+		if c != nil {
+			err := s.read(c)
+			c.Close()
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			logger.Errorf("redis subscription to %q failed: %v", s.channel, err)
+		}
+		select {
+		case <-time.After(redialInterval):
+		case <-s.closed:
+			return
+		}
+		c, err := subscribe(context.Background(), s.params, s.channel)
+		if err != nil {
+			logger.Errorf("cannot resubscribe to %q: %v", s.channel, err)
+			c = nil
+		}
+		s.mu.Lock()
+		if s.isClosed {
+			s.mu.Unlock()
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		s.conn = c
+		s.mu.Unlock()
+	}
+}
+
+// read delivers the messages received on the given connection until an
+// error occurs.
+func (s *subscription) read(c *conn) error {
+	for {
+		v, err := resp.ReadValue(c.r)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		vs, ok := v.([]interface{})
+		if !ok || len(vs) != 3 {
+			return errgo.Newf("unexpected response %q", v)
+		}
+		if kind, _ := vs[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		msg, _ := vs[2].([]byte)
+		select {
+		case s.c <- msg:
+		case <-s.closed:
+			return nil
+		}
+	}
+}
+
+// Messages implements meeting.Subscription.Messages.
+func (s *subscription) Messages() <-chan []byte {
+	return s.c
+}
+
+// Close implements meeting.Subscription.Close.
+func (s *subscription) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed {
+		return nil
+	}
+	s.isClosed = true
+	close(s.closed)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return nil
+}
+
+// conn is a connection to a Redis server.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dial connects to the Redis server with the given parameters.
+func dial(ctx context.Context, p Params) (*conn, error) {
+	d := net.Dialer{
+		Timeout: dialTimeout,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		d.Deadline = deadline
+	}
+	nc, err := d.Dial("tcp", p.Addr)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot connect to redis")
+	}
+	c := &conn{
+		Conn: nc,
+		r:    bufio.NewReader(nc),
+	}
+	if p.Password == "" {
+		return c, nil
+	}
+	v, err := c.do([]byte("AUTH"), []byte(p.Password))
+	if err == nil {
+		if rerr, ok := v.(resp.Error); ok {
+			err = rerr
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, errgo.Notef(err, "cannot authenticate to redis")
+	}
+	return c, nil
+}
+
+// subscribe connects to the Redis server with the given parameters and
+// subscribes to the given channel.
+func subscribe(ctx context.Context, p Params, channel string) (*conn, error) {
+	c, err := dial(ctx, p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	v, err := c.do([]byte("SUBSCRIBE"), []byte(channel))
+	if err == nil {
+		if rerr, ok := v.(resp.Error); ok {
+			err = rerr
+		} else if vs, ok := v.([]interface{}); !ok || len(vs) != 3 {
+			err = errgo.Newf("unexpected response %q", v)
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, errgo.Notef(err, "cannot subscribe to %q", channel)
+	}
+	return c, nil
+}
+
+// do sends the given command and returns the response.
+func (c *conn) do(args ...[]byte) (interface{}, error) {
+	if err := resp.WriteCommand(c, args...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	v, err := resp.ReadValue(c.r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return v, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package redispubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/testing"
+	"golang.org/x/net/context"
+	gc "gopkg.in/check.v1"
+
+	"github.com/CanonicalLtd/blues-identity/meeting"
+	"github.com/CanonicalLtd/blues-identity/meeting/redispubsub"
+	"github.com/CanonicalLtd/blues-identity/meeting/redispubsub/redistest"
+	"github.com/CanonicalLtd/blues-identity/memstore"
+)
+
+type redisSuite struct {
+	testing.IsolationSuite
+
+	server *redistest.Server
+}
+
+var _ = gc.Suite(&redisSuite{})
+
+func (s *redisSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	var err error
+	s.server, err = redistest.NewServer("")
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *redisSuite) TearDownTest(c *gc.C) {
+	s.server.Close()
+	s.IsolationSuite.TearDownTest(c)
+}
+
+func receive(c *gc.C, sub meeting.Subscription) string {
+	select {
+	case msg, ok := <-sub.Messages():
+		c.Assert(ok, gc.Equals, true)
+		return string(msg)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for message")
+	}
+	panic("unreachable")
+}
+
+func (s *redisSuite) TestPublishSubscribe(c *gc.C) {
+	ps := redispubsub.New(redispubsub.Params{
+		Addr: s.server.Addr(),
+	})
+	defer ps.Close()
+	ctx := context.Background()
+
+	sub1, err := ps.Subscribe("a")
+	c.Assert(err, gc.Equals, nil)
+	defer sub1.Close()
+	sub2, err := ps.Subscribe("b")
+	c.Assert(err, gc.Equals, nil)
+	defer sub2.Close()
+
+	err = ps.Publish(ctx, "a", []byte("message 1"))
+	c.Assert(err, gc.Equals, nil)
+	err = ps.Publish(ctx, "b", []byte("message\r\n2"))
+	c.Assert(err, gc.Equals, nil)
+	err = ps.Publish(ctx, "a", []byte("message 3"))
+	c.Assert(err, gc.Equals, nil)
+
+	c.Assert(receive(c, sub1), gc.Equals, "message 1")
+	c.Assert(receive(c, sub1), gc.Equals, "message 3")
+	c.Assert(receive(c, sub2), gc.Equals, "message\r\n2")
+}
+
+func (s *redisSuite) TestSubscriptionClose(c *gc.C) {
+	ps := redispubsub.New(redispubsub.Params{
+		Addr: s.server.Addr(),
+	})
+	defer ps.Close()
+	sub, err := ps.Subscribe("a")
+	c.Assert(err, gc.Equals, nil)
+	err = sub.Close()
+	c.Assert(err, gc.Equals, nil)
+	select {
+	case _, ok := <-sub.Messages():
+		c.Assert(ok, gc.Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for subscription to close")
+	}
+}
+
+func (s *redisSuite) TestReconnect(c *gc.C) {
+	s.PatchValue(redispubsub.RedialInterval, time.Millisecond)
+	ps := redispubsub.New(redispubsub.Params{
+		Addr: s.server.Addr(),
+	})
+	defer ps.Close()
+	ctx := context.Background()
+	sub, err := ps.Subscribe("a")
+	c.Assert(err, gc.Equals, nil)
+	defer sub.Close()
+
+	err = ps.Publish(ctx, "a", []byte("message 1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(receive(c, sub), gc.Equals, "message 1")
+
+	s.server.CloseConnections()
+
+	// Keep publishing until the subscription has reconnected.
+	for i := 0; ; i++ {
+		err = ps.Publish(ctx, "a", []byte("message 2"))
+		c.Assert(err, gc.Equals, nil)
+		select {
+		case msg := <-sub.Messages():
+			c.Assert(string(msg), gc.Equals, "message 2")
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if i > 500 {
+			c.Fatalf("subscription did not reconnect")
+		}
+	}
+}
+
+func (s *redisSuite) TestAuth(c *gc.C) {
+	srv, err := redistest.NewServer("secret")
+	c.Assert(err, gc.Equals, nil)
+	defer srv.Close()
+
+	ps := redispubsub.New(redispubsub.Params{
+		Addr:     srv.Addr(),
+		Password: "secret",
+	})
+	defer ps.Close()
+	sub, err := ps.Subscribe("a")
+	c.Assert(err, gc.Equals, nil)
+	defer sub.Close()
+	err = ps.Publish(context.Background(), "a", []byte("message"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(receive(c, sub), gc.Equals, "message")
+
+	ps2 := redispubsub.New(redispubsub.Params{
+		Addr:     srv.Addr(),
+		Password: "wrong",
+	})
+	defer ps2.Close()
+	err = ps2.Publish(context.Background(), "a", []byte("message"))
+	c.Assert(err, gc.ErrorMatches, `cannot authenticate to redis: ERR invalid password`)
+	_, err = ps2.Subscribe("a")
+	c.Assert(err, gc.ErrorMatches, `cannot authenticate to redis: ERR invalid password`)
+}
+
+func (s *redisSuite) TestMeetingPlace(c *gc.C) {
+	store := memstore.NewMeetingStore()
+	var places []*meeting.Place
+	for i := 0; i < 2; i++ {
+		ps := redispubsub.New(redispubsub.Params{
+			Addr: s.server.Addr(),
+		})
+		defer ps.Close()
+		p, err := meeting.NewPlace(meeting.Params{
+			Store:     store,
+			PubSub:    ps,
+			DisableGC: true,
+		})
+		c.Assert(err, gc.Equals, nil)
+		defer p.Close()
+		places = append(places, p)
+	}
+	ctx := context.Background()
+	err := places[0].NewRendezvous(ctx, "1234", []byte("first data"))
+	c.Assert(err, gc.Equals, nil)
+	err = places[1].Done(ctx, "1234", []byte("second data"))
+	c.Assert(err, gc.Equals, nil)
+	data0, data1, err := places[1].Wait(ctx, "1234")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data0), gc.Equals, "first data")
+	c.Assert(string(data1), gc.Equals, "second data")
+}
@@ -0,0 +1,208 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package redistest provides an in-process stand-in for a Redis server
+// that supports the publish/subscribe commands, for use in tests.
+package redistest
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/meeting/redispubsub/internal/resp"
+)
+
+// Server is an in-process server that implements the PING, AUTH,
+// PUBLISH, SUBSCRIBE and UNSUBSCRIBE Redis commands.
+type Server struct {
+	listener net.Listener
+	password string
+	wg       sync.WaitGroup
+
+	// mu protects the fields below it.
+	mu    sync.Mutex
+	conns map[*serverConn]bool
+}
+
+// NewServer starts a new Server listening on a local address. If
+// password is not empty clients must authenticate with it before
+// issuing any other commands.
+func NewServer(password string) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	srv := &Server{
+		listener: l,
+		password: password,
+		conns:    make(map[*serverConn]bool),
+	}
+	srv.wg.Add(1)
+	go srv.serve()
+	return srv, nil
+}
+
+// Addr returns the address on which the server is listening.
+func (srv *Server) Addr() string {
+	return srv.listener.Addr().String()
+}
+
+// CloseConnections closes all the current client connections, which
+// can be used to test client reconnection.
+func (srv *Server) CloseConnections() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.conns {
+		c.conn.Close()
+	}
+}
+
+// Close stops the server and closes all client connections.
+func (srv *Server) Close() {
+	srv.listener.Close()
+	srv.CloseConnections()
+	srv.wg.Wait()
+}
+
+func (srv *Server) serve() {
+	defer srv.wg.Done()
+	for {
+		nc, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &serverConn{
+			srv:           srv,
+			conn:          nc,
+			authenticated: srv.password == "",
+			channels:      make(map[string]bool),
+		}
+		srv.mu.Lock()
+		srv.conns[c] = true
+		srv.mu.Unlock()
+		srv.wg.Add(1)
+		go c.serve()
+	}
+}
+
+// publish sends the given message to all the connections subscribed to
+// the given channel and returns the number of subscribers.
+func (srv *Server) publish(channel string, msg []byte) int64 {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var n int64
+	for c := range srv.conns {
+		if c.subscribed(channel) {
+			c.write([]interface{}{[]byte("message"), []byte(channel), msg})
+			n++
+		}
+	}
+	return n
+}
+
+type serverConn struct {
+	srv           *Server
+	conn          net.Conn
+	authenticated bool
+
+	// mu protects the fields below it and writes to conn.
+	mu       sync.Mutex
+	channels map[string]bool
+}
+
+func (c *serverConn) serve() {
+	defer c.srv.wg.Done()
+	defer func() {
+		c.srv.mu.Lock()
+		delete(c.srv.conns, c)
+		c.srv.mu.Unlock()
+		c.conn.Close()
+	}()
+	r := bufio.NewReader(c.conn)
+	for {
+		v, err := resp.ReadValue(r)
+		if err != nil {
+			return
+		}
+		args, ok := v.([]interface{})
+		if !ok || len(args) == 0 {
+			c.write(resp.Error("ERR invalid command"))
+			continue
+		}
+		c.handle(args)
+	}
+}
+
+func (c *serverConn) handle(args []interface{}) {
+	bargs := make([][]byte, len(args))
+	for i, a := range args {
+		b, ok := a.([]byte)
+		if !ok {
+			c.write(resp.Error("ERR invalid command"))
+			return
+		}
+		bargs[i] = b
+	}
+	cmd := strings.ToUpper(string(bargs[0]))
+	if !c.authenticated && cmd != "AUTH" {
+		c.write(resp.Error("NOAUTH Authentication required."))
+		return
+	}
+	switch cmd {
+	case "PING":
+		c.write("PONG")
+	case "AUTH":
+		if len(bargs) != 2 {
+			c.write(resp.Error("ERR wrong number of arguments for 'auth' command"))
+			return
+		}
+		if string(bargs[1]) != c.srv.password {
+			c.write(resp.Error("ERR invalid password"))
+			return
+		}
+		c.authenticated = true
+		c.write("OK")
+	case "PUBLISH":
+		if len(bargs) != 3 {
+			c.write(resp.Error("ERR wrong number of arguments for 'publish' command"))
+			return
+		}
+		c.write(c.srv.publish(string(bargs[1]), bargs[2]))
+	case "SUBSCRIBE":
+		for _, ch := range bargs[1:] {
+			c.mu.Lock()
+			c.channels[string(ch)] = true
+			n := int64(len(c.channels))
+			c.mu.Unlock()
+			c.write([]interface{}{[]byte("subscribe"), ch, n})
+		}
+	case "UNSUBSCRIBE":
+		for _, ch := range bargs[1:] {
+			c.mu.Lock()
+			delete(c.channels, string(ch))
+			n := int64(len(c.channels))
+			c.mu.Unlock()
+			c.write([]interface{}{[]byte("unsubscribe"), ch, n})
+		}
+	default:
+		c.write(resp.Error("ERR unknown command '" + strings.ToLower(cmd) + "'"))
+	}
+}
+
+func (c *serverConn) subscribed(channel string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.channels[channel]
+}
+
+func (c *serverConn) write(v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := resp.WriteValue(c.conn, v); err != nil {
+		c.conn.Close()
+	}
+}
@@ -45,7 +45,25 @@ type doneRequest struct {
 
 func (h *handler) Done(req *doneRequest) error {
 	if err := h.place.localDone(req.Id, req.Body.Data1); err != nil {
-		return errgo.Mask(err)
+		return errgo.Mask(err, errgo.Is(ErrNotFound), errgo.Is(ErrAlreadyDone))
 	}
 	return nil
 }
+
+type statusRequest struct {
+	httprequest.Route `httprequest:"GET /:Id/status"`
+	Id                string `httprequest:",path"`
+}
+
+type statusData struct {
+	Status Status
+	Data1  []byte
+}
+
+func (h *handler) Status(req *statusRequest) (*statusData, error) {
+	status, data1 := h.place.localStatus(req.Id)
+	return &statusData{
+		Status: status,
+		Data1:  data1,
+	}, nil
+}
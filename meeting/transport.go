@@ -0,0 +1,154 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package meeting
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+//go:generate httprequest-generate-client . handler client
+
+// transport is used by a Place to pass wait and done requests to the
+// Place that holds a rendezvous.
+type transport interface {
+	// wait waits for the rendezvous with the given id held by the
+	// place with the given address.
+	wait(ctx context.Context, addr, id string) (data0, data1 []byte, err error)
+
+	// done completes the rendezvous with the given id held by the
+	// place with the given address.
+	done(ctx context.Context, addr, id string, data []byte) error
+
+	// status returns the status of the rendezvous with the given id
+	// held by the place with the given address.
+	status(ctx context.Context, addr, id string) (Status, []byte, error)
+
+	// close stops the transport from receiving any more requests.
+	close()
+}
+
+// httpTransport is a transport that sends requests to other places
+// over HTTP. Each place listens on its own address, which must be
+// reachable from every other place.
+type httpTransport struct {
+	listener net.Listener
+}
+
+// newHTTPTransport creates a new httpTransport that serves requests for
+// the given place on the given host. It returns the transport and the
+// address that other places must use to contact it.
+func newHTTPTransport(p *Place, host string) (*httpTransport, string, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, "", errgo.Notef(err, "cannot start listener")
+	}
+	h := &handler{
+		place: p,
+	}
+	router := httprouter.New()
+	for _, hnd := range reqServer.Handlers(func(params httprequest.Params) (*handler, context.Context, error) {
+		return h, params.Context, nil
+	}) {
+		router.Handle(hnd.Method, hnd.Path, hnd.Handle)
+	}
+	p.tomb.Go(func() error {
+		http.Serve(listener, router)
+		return nil
+	})
+	return &httpTransport{
+		listener: listener,
+	}, listener.Addr().String(), nil
+}
+
+var reqServer = httprequest.Server{
+	ErrorMapper: func(ctx context.Context, err error) (httpStatus int, errorBody interface{}) {
+		return http.StatusInternalServerError, &httprequest.RemoteError{
+			Message: err.Error(),
+			Code:    errorCauseName(err),
+		}
+	},
+}
+
+// errorCauses holds the error causes that are passed between places,
+// indexed by the name used to send them.
+var errorCauses = map[string]error{
+	"not found":    ErrNotFound,
+	"already done": ErrAlreadyDone,
+}
+
+// errorCauseName returns the name used to send the cause of the given
+// error to another place, or "" if the cause is not one that is sent.
+func errorCauseName(err error) string {
+	cause := errgo.Cause(err)
+	for name, c := range errorCauses {
+		if c == cause {
+			return name
+		}
+	}
+	return ""
+}
+
+// errorWithCauseName returns an error with the given message and the
+// cause with the given name, as returned by errorCauseName.
+func errorWithCauseName(name, msg string) error {
+	if cause := errorCauses[name]; cause != nil {
+		return errgo.WithCausef(nil, cause, "%s", msg)
+	}
+	return errgo.New(msg)
+}
+
+// wait implements transport.wait.
+func (t *httpTransport) wait(ctx context.Context, addr, id string) (data0, data1 []byte, err error) {
+	resp, err := clientForAddr(addr).Wait(ctx, &waitRequest{
+		Id: id,
+	})
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	return resp.Data0, resp.Data1, nil
+}
+
+// done implements transport.done.
+func (t *httpTransport) done(ctx context.Context, addr, id string, data []byte) error {
+	err := clientForAddr(addr).Done(ctx, &doneRequest{
+		Id: id,
+		Body: doneData{
+			Data1: data,
+		},
+	})
+	if rerr, ok := errgo.Cause(err).(*httprequest.RemoteError); ok && rerr.Code != "" {
+		return errorWithCauseName(rerr.Code, rerr.Message)
+	}
+	return errgo.Mask(err)
+}
+
+// status implements transport.status.
+func (t *httpTransport) status(ctx context.Context, addr, id string) (Status, []byte, error) {
+	resp, err := clientForAddr(addr).Status(ctx, &statusRequest{
+		Id: id,
+	})
+	if err != nil {
+		return 0, nil, errgo.Mask(err)
+	}
+	return resp.Status, resp.Data1, nil
+}
+
+// close implements transport.close.
+func (t *httpTransport) close() {
+	t.listener.Close()
+}
+
+func clientForAddr(addr string) *client {
+	return &client{
+		Client: httprequest.Client{
+			BaseURL: "http://" + addr,
+		},
+	}
+}
@@ -60,7 +60,7 @@ func (s *meetingStore) Get(_ context.Context, id string) (address string, _ erro
 	if e, ok := s.data[id]; ok {
 		return e.address, nil
 	}
-	return "", errgo.New("rendezvous not found, probably expired")
+	return "", errgo.WithCausef(nil, meeting.ErrNotFound, "rendezvous not found, probably expired")
 }
 
 // Remove implements meeting.Store.Remove.
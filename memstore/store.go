@@ -21,7 +21,10 @@ import (
 )
 
 type memStore struct {
-	mu         sync.Mutex
+	mu sync.Mutex
+
+	// identities holds all the identities in the store, indexed by
+	// ID. The entries for removed identities are nil.
 	identities []*store.Identity
 }
 
@@ -48,7 +51,7 @@ func (s *memStore) RemoveAll() {
 	defer s.mu.Unlock()
 	var identities []*store.Identity
 	for _, identity := range s.identities {
-		if identity.ProviderID == adminID {
+		if identity != nil && identity.ProviderID == adminID {
 			identities = append(identities, identity)
 		}
 	}
@@ -63,7 +66,7 @@ func (s *memStore) Identity(_ context.Context, identity *store.Identity) error {
 	switch {
 	case identity.ID != "":
 		n, err := strconv.Atoi(identity.ID)
-		if err != nil || n >= len(s.identities) {
+		if err != nil || n >= len(s.identities) || s.identities[n] == nil {
 			return store.NotFoundError(identity.ID, "", "")
 		}
 		id = s.identities[n]
@@ -85,10 +88,11 @@ func (s *memStore) Identity(_ context.Context, identity *store.Identity) error {
 }
 
 // identityFromProviderID performs a linear search to find an identitty
-// with the given providerID.
+// with the given providerID, either as its own provider ID or as one of
+// its linked provider IDs.
 func (s *memStore) identityFromProviderID(providerID store.ProviderIdentity) *store.Identity {
 	for _, id := range s.identities {
-		if id.ProviderID == providerID {
+		if id != nil && (id.ProviderID == providerID || containsProviderID(id.LinkedProviderIDs, providerID)) {
 			return id
 		}
 	}
@@ -99,7 +103,7 @@ func (s *memStore) identityFromProviderID(providerID store.ProviderIdentity) *st
 // with the given username.
 func (s *memStore) identityFromUsername(username string) *store.Identity {
 	for _, id := range s.identities {
-		if id.Username == username {
+		if id != nil && id.Username == username {
 			return id
 		}
 	}
@@ -112,7 +116,7 @@ func (s *memStore) FindIdentities(ctx context.Context, ref *store.Identity, filt
 	defer s.mu.Unlock()
 	identities := make([]store.Identity, 0, len(s.identities))
 	for _, identity := range s.identities {
-		if !matchIdentity(identity, ref, filter) {
+		if identity == nil || !matchIdentity(identity, ref, filter) {
 			continue
 		}
 		var identity1 store.Identity
@@ -154,6 +158,22 @@ func matchIdentity(a, b *store.Identity, filter store.Filter) bool {
 			r = cmpTime(a.LastLogin, b.LastLogin)
 		case store.LastDischarge:
 			r = cmpTime(a.LastDischarge, b.LastDischarge)
+		case store.ProviderInfo:
+			if c != store.Equal {
+				panic("unsupported provider info comparison")
+			}
+			if !hasInfo(a.ProviderInfo, b.ProviderInfo) {
+				return false
+			}
+			continue
+		case store.Groups:
+			if c != store.Equal {
+				panic("unsupported groups comparison")
+			}
+			if !hasAll(a.Groups, b.Groups) {
+				return false
+			}
+			continue
 		default:
 			panic("unsupported filter field")
 		}
@@ -164,6 +184,34 @@ func matchIdentity(a, b *store.Identity, filter store.Filter) bool {
 	return true
 }
 
+// hasInfo reports whether info contains every value of every key in
+// ref.
+func hasInfo(info, ref map[string][]string) bool {
+	for k, refValues := range ref {
+		if !hasAll(info[k], refValues) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasAll reports whether values contains every value in ref.
+func hasAll(values, ref []string) bool {
+	for _, rv := range ref {
+		found := false
+		for _, v := range values {
+			if v == rv {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 // matchCmp determines whether the given value n which is a result of a
 // "cmp" function such as strings.Compare indicates that the compared
 // values have the relationship specified by the given store.Comparison.
@@ -249,20 +297,28 @@ func (s identitySort) cmp(a, b *store.Identity, f store.Field, desc bool) int {
 
 // UpdateIdentity implements store.Store.UpdateIdentity.
 func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, update store.Update) error {
+	// The update is copied so that any changes made to it below are
+	// never seen by the caller.
+	upd := update
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	var id *store.Identity
 	switch {
 	case identity.ID != "":
 		n, err := strconv.Atoi(identity.ID)
-		if err != nil || n >= len(s.identities) {
+		if err != nil || n >= len(s.identities) || s.identities[n] == nil {
 			return store.NotFoundError(identity.ID, "", "")
 		}
 		id = s.identities[n]
 	case identity.ProviderID != "":
 		id = s.identityFromProviderID(identity.ProviderID)
+		if id != nil && id.ProviderID != identity.ProviderID {
+			// The identity has been found using a linked
+			// provider ID, don't rename it.
+			upd[store.Username] = store.NoUpdate
+		}
 		if id == nil {
-			if identity.Username == "" || update[store.Username] == store.NoUpdate {
+			if identity.Username == "" || upd[store.Username] == store.NoUpdate {
 				return store.NotFoundError("", identity.ProviderID, "")
 			}
 			n := len(s.identities)
@@ -272,8 +328,8 @@ func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, u
 				ProviderInfo: make(map[string][]string),
 				ExtraInfo:    make(map[string][]string),
 			}
-			if err := s.updateIdentity(id, identity, update); err != nil {
-				return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername))
+			if err := s.updateIdentity(id, identity, upd); err != nil {
+				return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrDuplicateProviderID))
 			}
 			s.identities = append(s.identities, id)
 			identity.ID = id.ID
@@ -287,13 +343,55 @@ func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, u
 	default:
 		return store.NotFoundError("", "", "")
 	}
-	return errgo.Mask(s.updateIdentity(id, identity, update), errgo.Is(store.ErrDuplicateUsername))
+	return errgo.Mask(s.updateIdentity(id, identity, upd), errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrDuplicateProviderID))
+}
+
+// RemoveIdentity implements store.Store.RemoveIdentity.
+func (s *memStore) RemoveIdentity(_ context.Context, identity *store.Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var id *store.Identity
+	switch {
+	case identity.ID != "":
+		n, err := strconv.Atoi(identity.ID)
+		if err != nil || n >= len(s.identities) || s.identities[n] == nil {
+			return store.NotFoundError(identity.ID, "", "")
+		}
+		id = s.identities[n]
+	case identity.ProviderID != "":
+		id = s.identityFromProviderID(identity.ProviderID)
+		if id == nil {
+			return store.NotFoundError("", identity.ProviderID, "")
+		}
+	case identity.Username != "":
+		id = s.identityFromUsername(identity.Username)
+		if id == nil {
+			return store.NotFoundError("", "", identity.Username)
+		}
+	default:
+		return store.NotFoundError("", "", "")
+	}
+	// IDs are allocated by position, so the entry is cleared rather
+	// than removed to preserve the IDs of other identities.
+	for i := range s.identities {
+		if s.identities[i] == id {
+			s.identities[i] = nil
+		}
+	}
+	return nil
 }
 
 func (s *memStore) updateIdentity(dst, src *store.Identity, update store.Update) error {
 	if update[store.ProviderID] != store.NoUpdate {
 		panic(errgo.Newf("unsupported operation %v requested on ProviderID field", update[store.ProviderID]))
 	}
+	linked := updateProviderIDs(dst.LinkedProviderIDs, src.LinkedProviderIDs, update[store.LinkedProviderIDs])
+	for _, pid := range linked {
+		id := s.identityFromProviderID(pid)
+		if pid == dst.ProviderID || (id != nil && id != dst) {
+			return store.DuplicateProviderIDError(pid)
+		}
+	}
 	switch update[store.Username] {
 	case store.NoUpdate:
 	case store.Set:
@@ -313,6 +411,7 @@ func (s *memStore) updateIdentity(dst, src *store.Identity, update store.Update)
 	dst.LastLogin = updateTime(dst.LastLogin, src.LastLogin, update[store.LastLogin])
 	dst.ProviderInfo = updateMap(dst.ProviderInfo, src.ProviderInfo, update[store.ProviderInfo])
 	dst.ExtraInfo = updateMap(dst.ExtraInfo, src.ExtraInfo, update[store.ExtraInfo])
+	dst.LinkedProviderIDs = linked
 	return nil
 }
 
@@ -379,6 +478,38 @@ func containsString(ss []string, s string) bool {
 	return false
 }
 
+func updateProviderIDs(dst, src []store.ProviderIdentity, op store.Operation) []store.ProviderIdentity {
+	ss := updateStrings(providerIDStrings(dst), providerIDStrings(src), op)
+	if len(ss) == 0 {
+		return nil
+	}
+	pids := make([]store.ProviderIdentity, len(ss))
+	for i, s := range ss {
+		pids[i] = store.ProviderIdentity(s)
+	}
+	return pids
+}
+
+func providerIDStrings(pids []store.ProviderIdentity) []string {
+	if len(pids) == 0 {
+		return nil
+	}
+	ss := make([]string, len(pids))
+	for i, pid := range pids {
+		ss[i] = string(pid)
+	}
+	return ss
+}
+
+func containsProviderID(pids []store.ProviderIdentity, pid store.ProviderIdentity) bool {
+	for _, p := range pids {
+		if p == pid {
+			return true
+		}
+	}
+	return false
+}
+
 func updateKeys(dst, src []bakery.PublicKey, op store.Operation) []bakery.PublicKey {
 	switch op {
 	case store.NoUpdate:
@@ -434,4 +565,5 @@ func copyIdentity(dst, src *store.Identity) {
 	dst.PublicKeys = updateKeys(nil, src.PublicKeys, store.Set)
 	dst.ProviderInfo = updateMap(make(map[string][]string), src.ProviderInfo, store.Set)
 	dst.ExtraInfo = updateMap(make(map[string][]string), src.ExtraInfo, store.Set)
+	dst.LinkedProviderIDs = updateProviderIDs(nil, src.LinkedProviderIDs, store.Set)
 }
@@ -18,16 +18,17 @@ var logger = loggo.GetLogger("identity.store.mgostore")
 // fieldNames provides the name used in the mongo documents for each
 // field.
 var fieldNames = []string{
-	store.ProviderID:    "providerid",
-	store.Username:      "username",
-	store.Name:          "name",
-	store.Email:         "email",
-	store.Groups:        "groups",
-	store.PublicKeys:    "publickeys",
-	store.LastLogin:     "lastlogin",
-	store.LastDischarge: "lastdischarge",
-	store.ProviderInfo:  "providerinfo",
-	store.ExtraInfo:     "extrainfo",
+	store.ProviderID:        "providerid",
+	store.Username:          "username",
+	store.Name:              "name",
+	store.Email:             "email",
+	store.Groups:            "groups",
+	store.PublicKeys:        "publickeys",
+	store.LastLogin:         "lastlogin",
+	store.LastDischarge:     "lastdischarge",
+	store.ProviderInfo:      "providerinfo",
+	store.ExtraInfo:         "extrainfo",
+	store.LinkedProviderIDs: "linkedproviderids",
 }
 
 // identityDocument holds the in-database representation of a user in the identities
@@ -68,6 +69,10 @@ type identityDocument struct {
 	// ExtraInfo holds additional information about the user that is
 	// required by other parts of the system.
 	ExtraInfo map[string][]string
+
+	// LinkedProviderIDs holds the identity provider specific ids of
+	// other identities that have been linked to this one.
+	LinkedProviderIDs_ []string `bson:"linkedproviderids,omitempty"`
 }
 
 // PublicKeys converts the stored public keys into the format used by the
@@ -87,6 +92,19 @@ func (d identityDocument) PublicKeys() []bakery.PublicKey {
 	return pks[:i]
 }
 
+// LinkedProviderIDs converts the stored linked provider IDs into the
+// format used by the store.
+func (d identityDocument) LinkedProviderIDs() []store.ProviderIdentity {
+	if len(d.LinkedProviderIDs_) == 0 {
+		return nil
+	}
+	pids := make([]store.ProviderIdentity, len(d.LinkedProviderIDs_))
+	for i, pid := range d.LinkedProviderIDs_ {
+		pids[i] = store.ProviderIdentity(pid)
+	}
+	return pids
+}
+
 type updateDocument struct {
 	Set      bson.D `bson:"$set,omitempty"`
 	Unset    bson.D `bson:"$unset,omitempty"`
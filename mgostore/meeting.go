@@ -12,6 +12,8 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+
+	"github.com/CanonicalLtd/blues-identity/meeting"
 )
 
 type doc struct {
@@ -63,10 +65,10 @@ func (s *meetingStore) Get(ctx context.Context, id string) (address string, err
 	var entry doc
 	err = coll.FindId(id).One(&entry)
 	if err == mgo.ErrNotFound {
-		err = errgo.Newf("rendezvous not found, probably expired")
+		err = errgo.WithCausef(nil, meeting.ErrNotFound, "rendezvous not found, probably expired")
 	}
 	if err != nil {
-		return "", errgo.Mask(err)
+		return "", errgo.Mask(err, errgo.Is(meeting.ErrNotFound))
 	}
 	return entry.Addr, nil
 }
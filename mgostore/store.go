@@ -5,6 +5,8 @@ package mgostore
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"golang.org/x/net/context"
 	errgo "gopkg.in/errgo.v1"
@@ -17,6 +19,10 @@ import (
 
 const identitiesCollection = "identities"
 
+// linkedProviderIDsIndex is the name of the index that ensures that
+// each linked provider ID is linked to at most one identity.
+const linkedProviderIDsIndex = "linkedproviderids_unique"
+
 // identityStore is a store.Store implementation that uses a mongodb database to
 // store the data.
 type identityStore struct {
@@ -52,6 +58,7 @@ func (s *identityStore) Identity(ctx context.Context, identity *store.Identity)
 	identity.LastDischarge = doc.LastDischarge
 	identity.ProviderInfo = doc.ProviderInfo
 	identity.ExtraInfo = doc.ExtraInfo
+	identity.LinkedProviderIDs = doc.LinkedProviderIDs()
 	return nil
 }
 
@@ -63,7 +70,10 @@ func identityQuery(identity *store.Identity) bson.D {
 		}
 		return bson.D{{"_id", bson.ObjectIdHex(identity.ID)}}
 	case identity.ProviderID != "":
-		return bson.D{{"providerid", identity.ProviderID}}
+		return bson.D{{"$or", []bson.D{
+			{{"providerid", identity.ProviderID}},
+			{{"linkedproviderids", identity.ProviderID}},
+		}}}
 	case identity.Username != "":
 		return bson.D{{"username", identity.Username}}
 	default:
@@ -103,17 +113,18 @@ func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity,
 	var doc identityDocument
 	for it.Next(&doc) {
 		identities = append(identities, store.Identity{
-			ID:            doc.ID.Hex(),
-			ProviderID:    store.ProviderIdentity(doc.ProviderID),
-			Username:      doc.Username,
-			Email:         doc.Email,
-			Name:          doc.Name,
-			Groups:        doc.Groups,
-			PublicKeys:    doc.PublicKeys(),
-			LastLogin:     doc.LastLogin,
-			LastDischarge: doc.LastDischarge,
-			ProviderInfo:  doc.ProviderInfo,
-			ExtraInfo:     doc.ExtraInfo,
+			ID:                doc.ID.Hex(),
+			ProviderID:        store.ProviderIdentity(doc.ProviderID),
+			Username:          doc.Username,
+			Email:             doc.Email,
+			Name:              doc.Name,
+			Groups:            doc.Groups,
+			PublicKeys:        doc.PublicKeys(),
+			LastLogin:         doc.LastLogin,
+			LastDischarge:     doc.LastDischarge,
+			ProviderInfo:      doc.ProviderInfo,
+			ExtraInfo:         doc.ExtraInfo,
+			LinkedProviderIDs: doc.LinkedProviderIDs(),
 		})
 	}
 	if err := it.Err(); err != nil {
@@ -130,6 +141,22 @@ func makeQuery(ref *store.Identity, filter store.Filter) bson.D {
 	query = appendComparison(query, fieldNames[store.Email], filter[store.Email], ref.Email)
 	query = appendComparison(query, fieldNames[store.LastLogin], filter[store.LastLogin], ref.LastLogin)
 	query = appendComparison(query, fieldNames[store.LastDischarge], filter[store.LastDischarge], ref.LastDischarge)
+	if filter[store.ProviderInfo] == store.Equal {
+		keys := make([]string, 0, len(ref.ProviderInfo))
+		for k := range ref.ProviderInfo {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if len(ref.ProviderInfo[k]) == 0 {
+				continue
+			}
+			query = append(query, bson.DocElem{fieldNames[store.ProviderInfo] + "." + k, bson.D{{"$all", ref.ProviderInfo[k]}}})
+		}
+	}
+	if filter[store.Groups] == store.Equal && len(ref.Groups) > 0 {
+		query = append(query, bson.DocElem{fieldNames[store.Groups], bson.D{{"$all", ref.Groups}}})
+	}
 	return query
 }
 
@@ -158,13 +185,30 @@ var comparisonOps = []string{
 // identity update to the mongodb database. The given context must have a
 // mgo.Session added using ContextWithSession.
 func (s *identityStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	// The update is copied so that any changes made to it below are
+	// never seen by the caller.
+	upd := update
 	coll := s.db.c(ctx, identitiesCollection)
 	defer coll.Database.Session.Close()
 
-	if identity.ID == "" && identity.ProviderID != "" && identity.Username != "" && update[store.Username] == store.Set {
-		return errgo.Mask(s.upsertIdentity(coll, identity, update), errgo.Is(store.ErrDuplicateUsername))
+	if identity.ID == "" && identity.ProviderID != "" {
+		n, err := coll.Find(bson.D{{"linkedproviderids", identity.ProviderID}}).Count()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if n > 0 {
+			// The identity has been found using a linked
+			// provider ID, don't rename it.
+			upd[store.Username] = store.NoUpdate
+		}
 	}
-	updateDoc := identityUpdate(identity, update)
+	if err := checkLinkedProviderIDs(coll, identity, upd[store.LinkedProviderIDs]); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrDuplicateProviderID))
+	}
+	if identity.ID == "" && identity.ProviderID != "" && identity.Username != "" && upd[store.Username] == store.Set {
+		return errgo.Mask(s.upsertIdentity(coll, identity, upd), errgo.Is(store.ErrDuplicateUsername))
+	}
+	updateDoc := identityUpdate(identity, upd)
 	if updateDoc.IsZero() {
 		identity := store.Identity{
 			ID:         identity.ID,
@@ -180,15 +224,83 @@ func (s *identityStore) UpdateIdentity(ctx context.Context, identity *store.Iden
 	if err == mgo.ErrNotFound {
 		return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
 	}
+	if isDupLinkedProviderID(err) {
+		return duplicateLinkedProviderIDError(coll, identity)
+	}
 	if mgo.IsDup(err) {
 		return store.DuplicateUsernameError(identity.Username)
 	}
 	return errgo.Mask(err)
 }
 
+// RemoveIdentity implements store.Store.RemoveIdentity by removing the
+// specified identity from the mongodb database. The given context must
+// have a mgo.Session added using ContextWithSession.
+func (s *identityStore) RemoveIdentity(ctx context.Context, identity *store.Identity) error {
+	coll := s.db.c(ctx, identitiesCollection)
+	defer coll.Database.Session.Close()
+
+	if err := coll.Remove(identityQuery(identity)); err != nil {
+		if errgo.Cause(err) == mgo.ErrNotFound {
+			return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+		}
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// checkLinkedProviderIDs checks that the linked provider IDs that would
+// be added to the given identity by the given operation are not in use
+// by any other identity, or as the identity's own provider ID. This
+// check is not atomic with the update that follows it; the unique
+// linked provider ID index catches any identity that links the same
+// provider ID concurrently.
+func checkLinkedProviderIDs(coll *mgo.Collection, identity *store.Identity, op store.Operation) error {
+	if op != store.Set && op != store.Push || len(identity.LinkedProviderIDs) == 0 {
+		return nil
+	}
+	var target identityDocument
+	if err := coll.Find(identityQuery(identity)).Select(bson.D{{"_id", 1}}).One(&target); err != nil && err != mgo.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	pids := make([]string, len(identity.LinkedProviderIDs))
+	for i, pid := range identity.LinkedProviderIDs {
+		pids[i] = string(pid)
+	}
+	it := coll.Find(bson.D{{"$or", []bson.D{
+		{{"providerid", bson.D{{"$in", pids}}}},
+		{{"linkedproviderids", bson.D{{"$in", pids}}}},
+	}}}).Iter()
+	for {
+		var doc identityDocument
+		if !it.Next(&doc) {
+			break
+		}
+		for _, pid := range identity.LinkedProviderIDs {
+			if doc.ProviderID == string(pid) {
+				return store.DuplicateProviderIDError(pid)
+			}
+			if doc.ID == target.ID {
+				// Linking an ID that is already linked to
+				// the identity makes no change.
+				continue
+			}
+			for _, lpid := range doc.LinkedProviderIDs_ {
+				if lpid == string(pid) {
+					return store.DuplicateProviderIDError(pid)
+				}
+			}
+		}
+	}
+	return errgo.Mask(it.Close())
+}
+
 func (s *identityStore) upsertIdentity(coll *mgo.Collection, identity *store.Identity, update store.Update) error {
 	changeInfo, err := coll.Upsert(bson.D{{"providerid", identity.ProviderID}}, identityUpdate(identity, update))
 	if err != nil {
+		if isDupLinkedProviderID(err) {
+			return duplicateLinkedProviderIDError(coll, identity)
+		}
 		if mgo.IsDup(err) {
 			return store.DuplicateUsernameError(identity.Username)
 		}
@@ -201,6 +313,25 @@ func (s *identityStore) upsertIdentity(coll *mgo.Collection, identity *store.Ide
 	return nil
 }
 
+// isDupLinkedProviderID reports whether the given error was caused by
+// a write that would have linked a provider ID to more than one
+// identity.
+func isDupLinkedProviderID(err error) bool {
+	return mgo.IsDup(err) && strings.Contains(err.Error(), linkedProviderIDsIndex)
+}
+
+// duplicateLinkedProviderIDError returns the error for an update of the
+// given identity that was rejected by the unique linked provider ID
+// index.
+func duplicateLinkedProviderIDError(coll *mgo.Collection, identity *store.Identity) error {
+	// The update has not been made, so checking again finds the
+	// provider ID that is in use.
+	if err := checkLinkedProviderIDs(coll, identity, store.Push); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrDuplicateProviderID))
+	}
+	return errgo.WithCausef(nil, store.ErrDuplicateProviderID, "linked provider id already in use")
+}
+
 func identityUpdate(identity *store.Identity, update store.Update) updateDocument {
 	var doc updateDocument
 	doc.addUpdate(update[store.Username], fieldNames[store.Username], identity.Username)
@@ -216,6 +347,11 @@ func identityUpdate(identity *store.Identity, update store.Update) updateDocumen
 	for k, v := range identity.ExtraInfo {
 		doc.addUpdate(update[store.ExtraInfo], fieldNames[store.ExtraInfo]+"."+k, v)
 	}
+	pids := make([]string, len(identity.LinkedProviderIDs))
+	for i, pid := range identity.LinkedProviderIDs {
+		pids[i] = string(pid)
+	}
+	doc.addUpdate(update[store.LinkedProviderIDs], fieldNames[store.LinkedProviderIDs], pids)
 	return doc
 }
 
@@ -236,6 +372,19 @@ func ensureIdentityIndexes(db *mgo.Database) error {
 	}, {
 		Key:    []string{"providerid"},
 		Unique: true,
+	}, {
+		// Identities without linked provider IDs are left out
+		// of the index, as a missing field or an empty array
+		// would not be unique.
+		Name:   linkedProviderIDsIndex,
+		Key:    []string{"linkedproviderids"},
+		Unique: true,
+		PartialFilter: bson.M{
+			"linkedproviderids.0": bson.M{"$exists": true},
+		},
+	}, {
+		// Agents are found by their owner.
+		Key: []string{"providerinfo.owner"},
 	}}
 	for _, index := range indexes {
 		if err := coll.EnsureIndex(index); err != nil {
@@ -4,17 +4,21 @@
 package identity
 
 import (
+	"crypto/x509"
 	"html/template"
+	"net"
 	"net/http"
 	"sort"
 	"time"
 
 	"github.com/juju/utils/debugstatus"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 
 	"github.com/CanonicalLtd/blues-identity/idp"
 	"github.com/CanonicalLtd/blues-identity/idp/agent"
+	"github.com/CanonicalLtd/blues-identity/internal/admin"
 	"github.com/CanonicalLtd/blues-identity/internal/debug"
 	"github.com/CanonicalLtd/blues-identity/internal/discharger"
 	"github.com/CanonicalLtd/blues-identity/internal/identity"
@@ -25,12 +29,14 @@ import (
 
 // Versions of the API that can be served.
 const (
+	Admin      = "admin"
 	Debug      = "debug"
 	Discharger = "discharger"
 	V1         = "v1"
 )
 
 var versions = map[string]identity.NewAPIHandlerFunc{
+	Admin:      admin.NewAPIHandler,
 	Debug:      debug.NewAPIHandler,
 	Discharger: discharger.NewAPIHandler,
 	V1:         v1.NewAPIHandler,
@@ -52,6 +58,11 @@ type ServerParams struct {
 	// rendezvous information.
 	MeetingStore meeting.Store
 
+	// MeetingPubSub holds the PubSub that will be used to pass
+	// rendezvous requests between identity servers. If this is nil,
+	// requests are sent directly to the server's PrivateAddr.
+	MeetingPubSub meeting.PubSub
+
 	// ProviderDataStore holds the storeage that can be used by
 	// identity providers to store data that is not associated with
 	// an individual identity.
@@ -64,12 +75,23 @@ type ServerParams struct {
 	// Store holds the identities store for the identity server.
 	Store store.Store
 
-	// AuthUsername holds the username for admin login.
+	// AuthUsername holds the username for admin login. If this is
+	// empty admin login with basic authentication is disabled, and
+	// admin access is only available to the admin agent and members
+	// of AdminGroups.
 	AuthUsername string
 
 	// AuthPassword holds the password for admin login.
 	AuthPassword string
 
+	// AuthPasswordHash holds a bcrypt hash of the password for admin
+	// login. If this is set it is used instead of AuthPassword.
+	AuthPasswordHash string
+
+	// AdminGroups holds the groups whose members have full
+	// administrative access to the identity server.
+	AdminGroups []string
+
 	// Key holds the keypair to use with the bakery service.
 	Key *bakery.KeyPair
 
@@ -108,21 +130,96 @@ type ServerParams struct {
 	// WaitTimeout holds the time after which an interactive discharge wait
 	// request will timeout.
 	WaitTimeout time.Duration
+
+	// TOTPKey holds the key used to encrypt the TOTP secrets of
+	// identities. If this is nil TOTP two-factor authentication is
+	// disabled.
+	TOTPKey *[32]byte
+
+	// TOTPIssuer holds the issuer name that is shown in users'
+	// authenticator applications.
+	TOTPIssuer string
+
+	// TOTPRequiredGroups holds the groups whose members must enrol
+	// in, and use, TOTP two-factor authentication when logging in.
+	TOTPRequiredGroups []string
+
+	// WebAuthnRPID holds the WebAuthn relying party ID used for
+	// security keys. If this is empty security keys cannot be used
+	// as a second authentication factor.
+	WebAuthnRPID string
+
+	// WebAuthnAttestationRoots holds the root certificates of the
+	// authenticator manufacturers that are trusted. If this is set
+	// then only security keys that attest to having been made by
+	// one of those manufacturers can be registered.
+	WebAuthnAttestationRoots *x509.CertPool
+
+	// WebAuthnRequiredGroups holds the groups whose members must
+	// register, and use, a security key when logging in.
+	WebAuthnRequiredGroups []string
+
+	// IPRateLimit holds the average number of authentication
+	// requests per second allowed from a single IP address. If this
+	// is zero requests are not limited by IP address.
+	IPRateLimit float64
+
+	// IPRateBurst holds the number of authentication requests that
+	// may be made from a single IP address in quick succession.
+	IPRateBurst int
+
+	// UserRateLimit holds the average number of authentication
+	// requests per second allowed for a single username. If this is
+	// zero requests are not limited by username.
+	UserRateLimit float64
+
+	// UserRateBurst holds the number of authentication requests that
+	// may be made for a single username in quick succession.
+	UserRateBurst int
+
+	// MaxFailedLogins holds the number of consecutive failed password
+	// logins after which a username is locked out. If this is zero
+	// usernames are never locked out.
+	MaxFailedLogins int
+
+	// FailedLoginLockout holds the length of time for which a
+	// username is locked out after too many failed logins.
+	FailedLoginLockout time.Duration
+
+	// TrustedProxies holds the networks of the proxies that are
+	// trusted to report the address of the client in the
+	// X-Forwarded-For header of a request. The address reported by
+	// a trusted proxy is used for rate limiting.
+	TrustedProxies []*net.IPNet
+
+	// SSHCAKey holds the key of the SSH certificate authority used
+	// to sign SSH user certificates. If this is nil SSH certificates
+	// cannot be issued.
+	SSHCAKey ssh.Signer
+
+	// SSHCertValidity holds the maximum length of time for which
+	// issued SSH certificates are valid. If this is zero
+	// certificates are valid for one hour.
+	SSHCertValidity time.Duration
+
+	// MaxAgentDepth holds the maximum length of a chain of agents,
+	// each created by the previous one. An agent created by a user
+	// that is not an agent has a depth of one. If this is zero agents
+	// cannot create other agents.
+	MaxAgentDepth int
+
+	// Reload, if set, is called when an administrator requests that
+	// the server reload its configuration using the /v1/reload
+	// endpoint. It will usually read the configuration and call
+	// ReloadIdentityProviders on the server.
+	Reload func() error
 }
 
 // NewServer returns a new handler that handles identity service requests and
 // stores its data in the given database. The handler will serve the specified
 // versions of the API.
 func NewServer(params ServerParams, serveVersions ...string) (HandlerCloser, error) {
-	// Remove the agent identity provider if it is specified as it is no longer used.
-	idps := make([]idp.IdentityProvider, 0, len(params.IdentityProviders))
-	for _, idp := range params.IdentityProviders {
-		if idp == agent.IdentityProvider {
-			continue
-		}
-		idps = append(idps, idp)
-	}
-	params.IdentityProviders = idps
+	params.IdentityProviders = removeAgentIDP(params.IdentityProviders)
 	newAPIs := make(map[string]identity.NewAPIHandlerFunc)
 	for _, vers := range serveVersions {
 		newAPI := versions[vers]
@@ -131,10 +228,42 @@ func NewServer(params ServerParams, serveVersions ...string) (HandlerCloser, err
 		}
 		newAPIs[vers] = newAPI
 	}
-	return identity.New(identity.ServerParams(params), newAPIs)
+	srv, err := identity.New(identity.ServerParams(params), newAPIs)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return server{srv}, nil
+}
+
+// removeAgentIDP removes the agent identity provider from the given
+// identity providers if it is specified as it is no longer used.
+func removeAgentIDP(idps []idp.IdentityProvider) []idp.IdentityProvider {
+	filtered := make([]idp.IdentityProvider, 0, len(idps))
+	for _, idp := range idps {
+		if idp == agent.IdentityProvider {
+			continue
+		}
+		filtered = append(filtered, idp)
+	}
+	return filtered
 }
 
 type HandlerCloser interface {
 	http.Handler
 	Close()
+
+	// ReloadIdentityProviders replaces the identity providers used
+	// by the server with the given ones, which should not have been
+	// initialised. If any identity provider cannot be initialised an
+	// error is returned and the server continues to use the old ones.
+	ReloadIdentityProviders(idps []idp.IdentityProvider) error
+}
+
+type server struct {
+	*identity.Server
+}
+
+// ReloadIdentityProviders implements HandlerCloser.ReloadIdentityProviders.
+func (s server) ReloadIdentityProviders(idps []idp.IdentityProvider) error {
+	return errgo.Mask(s.Server.ReloadIdentityProviders(removeAgentIDP(idps)))
 }
@@ -87,6 +87,8 @@ const (
 	tmplClearIdentitySet
 	tmplPushIdentitySet
 	tmplPullIdentitySet
+	tmplRemoveIdentity
+	tmplLinkedIdentityID
 	tmplGetProviderData
 	tmplInsertProviderData
 	tmplGetMeeting
@@ -9,6 +9,8 @@ import (
 
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/meeting"
 )
 
 // meetingStore is an implementation of meeting.Store that uses an sql
@@ -63,7 +65,7 @@ func (s *meetingStore) Get(_ context.Context, id string) (string, error) {
 	}
 	err = row.Scan(&address, &created)
 	if errgo.Cause(err) == sql.ErrNoRows {
-		return "", errgo.Newf("rendezvous not found, probably expired")
+		return "", errgo.WithCausef(nil, meeting.ErrNotFound, "rendezvous not found, probably expired")
 	}
 	return address, errgo.Mask(err)
 }
@@ -38,6 +38,8 @@ CREATE TABLE IF NOT EXISTS identity_providerinfo (
 	UNIQUE (identity, key, value)
 );
 
+CREATE INDEX IF NOT EXISTS identity_providerinfo_key_value ON identity_providerinfo (key, value);
+
 CREATE TABLE IF NOT EXISTS identity_extrainfo ( 
 	identity INTEGER REFERENCES identities NOT NULL,
 	key TEXT NOT NULL,
@@ -45,6 +47,12 @@ CREATE TABLE IF NOT EXISTS identity_extrainfo (
 	UNIQUE (identity, key, value)
 );
 
+CREATE TABLE IF NOT EXISTS identity_linkedproviderids ( 
+	identity INTEGER REFERENCES identities NOT NULL,
+	value TEXT UNIQUE NOT NULL,
+	UNIQUE (identity, value)
+);
+
 CREATE TABLE IF NOT EXISTS provider_data ( 
 	provider TEXT NOT NULL,
 	key TEXT NOT NULL,
@@ -85,7 +93,7 @@ var postgresTmpls = [numTmpl]string{
 		WHERE identity={{.Identity | .Arg}}`,
 	tmplFindIdentities: `
 		SELECT id, providerid, username, name, email, lastlogin, lastdischarge FROM identities
-		{{if .Where}}WHERE{{range $i, $w := .Where}}{{if gt $i 0}} AND{{end}} {{$w.Column}}{{$w.Comparison}}{{$w.Value | $.Arg}}{{end}}{{end}}
+		{{if or .Where .Info .Groups}}WHERE{{range $i, $w := .Where}}{{if gt $i 0}} AND{{end}} {{$w.Column}}{{$w.Comparison}}{{$w.Value | $.Arg}}{{end}}{{range $i, $v := .Info}}{{if or (gt $i 0) $.Where}} AND{{end}} id IN (SELECT identity FROM identity_providerinfo WHERE key={{$v.Key | $.Arg}} AND value={{$v.Value | $.Arg}}){{end}}{{range $i, $g := .Groups}}{{if or (gt $i 0) $.Where $.Info}} AND{{end}} id IN (SELECT identity FROM identity_groups WHERE value={{$g | $.Arg}}){{end}}{{end}}
 		{{if .Sort}}ORDER BY {{join .Sort ", "}}{{end}}
 		{{if gt .Limit 0}}LIMIT {{.Limit}}{{end}}
 		{{if gt .Skip 0}}OFFSET {{.Skip}}{{end}}`,
@@ -115,6 +123,12 @@ var postgresTmpls = [numTmpl]string{
 		DELETE FROM {{.Table}}
 		WHERE identity={{.ID | $.Arg}}{{if .Key}} AND key={{.Key | $.Arg}}{{end}}
 		AND value IN ({{range $i, $v := .Values}}{{if gt $i 0}}, {{end}}{{$v | $.Arg}}{{end}})`,
+	tmplRemoveIdentity: `
+		DELETE FROM identities
+		WHERE id={{.ID | .Arg}}`,
+	tmplLinkedIdentityID: `
+		SELECT identity FROM identity_linkedproviderids
+		WHERE value={{.Identity | .Arg}}`,
 	tmplGetProviderData: `
 		SELECT value FROM provider_data
 		WHERE provider={{.Provider | .Arg}} AND key={{.Key | .Arg}} AND (expire IS NULL OR expire > now())`,
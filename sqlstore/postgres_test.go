@@ -1,11 +1,14 @@
 package sqlstore_test
 
 import (
+	"time"
+
 	"github.com/juju/postgrestest"
 	"golang.org/x/net/context"
 	gc "gopkg.in/check.v1"
 	errgo "gopkg.in/errgo.v1"
 
+	"github.com/CanonicalLtd/blues-identity/meeting"
 	"github.com/CanonicalLtd/blues-identity/sqlstore"
 	"github.com/CanonicalLtd/blues-identity/store"
 	storetesting "github.com/CanonicalLtd/blues-identity/store/testing"
@@ -164,3 +167,104 @@ func (s *postgresMeetingSuite) TearDownTest(c *gc.C) {
 		s.pg.Close()
 	}
 }
+
+type postgresPubSubSuite struct {
+	db     *sqlstore.Database
+	pg     *postgrestest.DB
+	pubsub meeting.PubSub
+}
+
+var _ = gc.Suite(&postgresPubSubSuite{})
+
+func (s *postgresPubSubSuite) SetUpTest(c *gc.C) {
+	var err error
+	s.pg, err = postgrestest.New()
+	if errgo.Cause(err) == postgrestest.ErrDisabled {
+		c.Skip(err.Error())
+		return
+	}
+	c.Assert(err, gc.Equals, nil)
+	s.db, err = sqlstore.NewDatabase("postgres", s.pg.DB)
+	c.Assert(err, gc.Equals, nil)
+	// The remaining connection parameters are taken from the
+	// environment, as they are by postgrestest.
+	var dbName string
+	err = s.pg.DB.QueryRow("SELECT current_database()").Scan(&dbName)
+	c.Assert(err, gc.Equals, nil)
+	s.pubsub = s.db.MeetingPubSub("dbname=" + dbName)
+}
+
+func (s *postgresPubSubSuite) TearDownTest(c *gc.C) {
+	if s.db != nil {
+		s.db.Close()
+	}
+	if s.pg != nil {
+		s.pg.Close()
+	}
+}
+
+func (s *postgresPubSubSuite) receive(c *gc.C, sub meeting.Subscription) string {
+	select {
+	case msg, ok := <-sub.Messages():
+		c.Assert(ok, gc.Equals, true)
+		return string(msg)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for notification")
+	}
+	panic("unreachable")
+}
+
+func (s *postgresPubSubSuite) TestPublishSubscribe(c *gc.C) {
+	ctx := context.Background()
+	sub1, err := s.pubsub.Subscribe("meeting_a")
+	c.Assert(err, gc.Equals, nil)
+	defer sub1.Close()
+	sub2, err := s.pubsub.Subscribe("meeting_b")
+	c.Assert(err, gc.Equals, nil)
+	defer sub2.Close()
+
+	err = s.pubsub.Publish(ctx, "meeting_a", []byte("message 1"))
+	c.Assert(err, gc.Equals, nil)
+	err = s.pubsub.Publish(ctx, "meeting_b", []byte{0, 1, 2})
+	c.Assert(err, gc.Equals, nil)
+
+	c.Assert(s.receive(c, sub1), gc.Equals, "message 1")
+	c.Assert(s.receive(c, sub2), gc.Equals, "\x00\x01\x02")
+
+	err = sub1.Close()
+	c.Assert(err, gc.Equals, nil)
+	select {
+	case _, ok := <-sub1.Messages():
+		c.Assert(ok, gc.Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for subscription to close")
+	}
+}
+
+func (s *postgresPubSubSuite) TestPublishTooLarge(c *gc.C) {
+	err := s.pubsub.Publish(context.Background(), "meeting_a", make([]byte, 6000))
+	c.Assert(err, gc.ErrorMatches, `message of 6000 bytes too large to publish, the limit is 5997 bytes`)
+}
+
+func (s *postgresPubSubSuite) TestMeetingPlace(c *gc.C) {
+	var places []*meeting.Place
+	for i := 0; i < 2; i++ {
+		p, err := meeting.NewPlace(meeting.Params{
+			Store:     s.db.MeetingStore(),
+			PubSub:    s.pubsub,
+			DisableGC: true,
+		})
+		c.Assert(err, gc.Equals, nil)
+		defer p.Close()
+		places = append(places, p)
+	}
+	ctx := context.Background()
+	err := places[0].NewRendezvous(ctx, "1234", []byte("first data"))
+	c.Assert(err, gc.Equals, nil)
+	err = places[1].Done(ctx, "1234", []byte("second data"))
+	c.Assert(err, gc.Equals, nil)
+	data0, data1, err := places[1].Wait(ctx, "1234")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data0), gc.Equals, "first data")
+	c.Assert(string(data1), gc.Equals, "second data")
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/blues-identity/meeting"
+)
+
+const (
+	// maxNotifyPayload holds the largest notification payload that
+	// PostgreSQL accepts.
+	maxNotifyPayload = 7999
+
+	// minListenerReconnect and maxListenerReconnect hold the bounds
+	// of the interval between attempts to reconnect a failed
+	// listener connection.
+	minListenerReconnect = 100 * time.Millisecond
+	maxListenerReconnect = 30 * time.Second
+)
+
+// MeetingPubSub returns a new meeting.PubSub implementation that uses
+// PostgreSQL LISTEN and NOTIFY. Messages are published using this
+// database, each subscription opens a new connection using the given
+// connection string, which should refer to the same database.
+//
+// PostgreSQL limits notification payloads to 8000 bytes, messages are
+// base64 encoded so the largest message that can be published is 5997
+// bytes. Meeting messages themselves hold the rendezvous data base64
+// encoded within JSON, which leaves room for roughly 4400 bytes of
+// data; Publish returns an error for anything larger.
+func (d *Database) MeetingPubSub(connStr string) meeting.PubSub {
+	return &pubSub{
+		Database: d,
+		connStr:  connStr,
+	}
+}
+
+// pubSub is an implementation of meeting.PubSub that uses PostgreSQL
+// notifications.
+type pubSub struct {
+	*Database
+	connStr string
+}
+
+// Publish implements meeting.PubSub.Publish. Messages that would
+// exceed the PostgreSQL notification payload limit once encoded are
+// refused.
+func (ps *pubSub) Publish(_ context.Context, channel string, msg []byte) error {
+	payload := base64.StdEncoding.EncodeToString(msg)
+	if len(payload) > maxNotifyPayload {
+		return errgo.Newf("message of %d bytes too large to publish, the limit is %d bytes", len(msg), base64.StdEncoding.DecodedLen(maxNotifyPayload))
+	}
+	_, err := ps.db.Exec("SELECT pg_notify($1, $2)", channel, payload)
+	return errgo.Mask(err)
+}
+
+// Subscribe implements meeting.PubSub.Subscribe.
+func (ps *pubSub) Subscribe(channel string) (meeting.Subscription, error) {
+	l := pq.NewListener(ps.connStr, minListenerReconnect, maxListenerReconnect, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Errorf("listener for %q: %v", channel, err)
+		}
+	})
+	if err := l.Listen(channel); err != nil {
+		l.Close()
+		return nil, errgo.Notef(err, "cannot listen on %q", channel)
+	}
+	sub := &subscription{
+		listener: l,
+		c:        make(chan []byte),
+		closed:   make(chan struct{}),
+	}
+	go sub.run()
+	return sub, nil
+}
+
+// subscription is an implementation of meeting.Subscription that
+// receives PostgreSQL notifications.
+type subscription struct {
+	listener  *pq.Listener
+	c         chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// run delivers the notifications received by the listener until the
+// subscription is closed.
+func (s *subscription) run() {
+	defer close(s.c)
+	for {
+		select {
+		case n, ok := <-s.listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				// The connection has been re-established,
+				// any notifications sent while it was down
+				// have been lost.
+				continue
+			}
+			msg, err := base64.StdEncoding.DecodeString(n.Extra)
+			if err != nil {
+				logger.Errorf("invalid notification on %q: %v", n.Channel, err)
+				continue
+			}
+			select {
+			case s.c <- msg:
+			case <-s.closed:
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// Messages implements meeting.Subscription.Messages.
+func (s *subscription) Messages() <-chan []byte {
+	return s.c
+}
+
+// Close implements meeting.Subscription.Close.
+func (s *subscription) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.listener.Close()
+	})
+	return errgo.Mask(err)
+}
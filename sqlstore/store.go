@@ -57,6 +57,15 @@ func (s *identityStore) identity(tx *sql.Tx, identity *store.Identity) error {
 		params.Column = "id"
 		params.Identity = identity.ID
 	case identity.ProviderID != "":
+		id, err := s.linkedIdentityID(tx, identity.ProviderID)
+		if err != nil {
+			return errgo.Notef(err, "cannot get identity")
+		}
+		if id != "" {
+			params.Column = "id"
+			params.Identity = id
+			break
+		}
 		params.Column = "providerid"
 		params.Identity = identity.ProviderID
 	case identity.Username != "":
@@ -82,6 +91,28 @@ func (s *identityStore) identity(tx *sql.Tx, identity *store.Identity) error {
 	return nil
 }
 
+// linkedIdentityID returns the ID of the identity that has the given
+// provider ID as one of its linked provider IDs. If there is no such
+// identity then an empty string is returned.
+func (s *identityStore) linkedIdentityID(tx *sql.Tx, providerID store.ProviderIdentity) (string, error) {
+	params := &identityFromParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Identity:   string(providerID),
+	}
+	row, err := s.driver.queryRow(tx, tmplLinkedIdentityID, params)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	var id string
+	if err := row.Scan(&id); err != nil {
+		if errgo.Cause(err) == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", errgo.Mask(err)
+	}
+	return id, nil
+}
+
 // FindIdentities implements store.FindIdentities.
 func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
 	var identities []store.Identity
@@ -102,12 +133,21 @@ type where struct {
 	Value      interface{}
 }
 
+// infoValue holds a provider info value that an identity must have to
+// be found.
+type infoValue struct {
+	Key   string
+	Value string
+}
+
 type findIdentitiesParams struct {
 	argBuilder
-	Where []where
-	Sort  []string
-	Limit int
-	Skip  int
+	Where  []where
+	Info   []infoValue
+	Groups []string
+	Sort   []string
+	Limit  int
+	Skip   int
 }
 
 func (s *identityStore) findIdentities(tx *sql.Tx, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
@@ -121,6 +161,19 @@ func (s *identityStore) findIdentities(tx *sql.Tx, ref *store.Identity, filter s
 
 		wheres = append(wheres, where{col, cond, fieldValue(store.Field(f), ref)})
 	}
+	var infos []infoValue
+	if filter[store.ProviderInfo] == store.Equal {
+		for k, vs := range ref.ProviderInfo {
+			for _, v := range vs {
+				infos = append(infos, infoValue{k, v})
+			}
+		}
+	}
+
+	var groups []string
+	if filter[store.Groups] == store.Equal {
+		groups = ref.Groups
+	}
 
 	sorts := make([]string, 0, len(sort))
 	for _, s := range sort {
@@ -137,6 +190,8 @@ func (s *identityStore) findIdentities(tx *sql.Tx, ref *store.Identity, filter s
 	params := &findIdentitiesParams{
 		argBuilder: s.driver.argBuilderFunc(),
 		Where:      wheres,
+		Info:       infos,
+		Groups:     groups,
 		Sort:       sorts,
 		Limit:      limit,
 		Skip:       skip,
@@ -201,6 +256,10 @@ func (s *identityStore) completeIdentity(tx *sql.Tx, identity *store.Identity) e
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	identity.LinkedProviderIDs, err = s.getLinkedProviderIDs(tx, identity.ID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
 	return nil
 }
 
@@ -234,6 +293,28 @@ func (s *identityStore) getGroups(tx *sql.Tx, id string) ([]string, error) {
 	return groups, errgo.Mask(rows.Err())
 }
 
+func (s *identityStore) getLinkedProviderIDs(tx *sql.Tx, id string) ([]store.ProviderIdentity, error) {
+	params := selectIdentitySetParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Table:      "identity_linkedproviderids",
+		Identity:   id,
+	}
+	rows, err := s.driver.query(tx, tmplSelectIdentitySet, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+	var pids []store.ProviderIdentity
+	for rows.Next() {
+		var pid store.ProviderIdentity
+		if err := rows.Scan(&pid); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, errgo.Mask(rows.Err())
+}
+
 func (s *identityStore) getPublicKeys(tx *sql.Tx, id string) ([]bakery.PublicKey, error) {
 	params := selectIdentitySetParams{
 		argBuilder: s.driver.argBuilderFunc(),
@@ -288,7 +369,7 @@ func (s *identityStore) getInfoMap(tx *sql.Tx, table string, id string) (map[str
 func (s *identityStore) UpdateIdentity(_ context.Context, identity *store.Identity, update store.Update) (err error) {
 	return errgo.Mask(s.withTx(func(tx *sql.Tx) error {
 		return s.updateIdentity(tx, identity, update)
-	}), errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrNotFound))
+	}), errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrDuplicateProviderID), errgo.Is(store.ErrNotFound))
 }
 
 type update struct {
@@ -328,6 +409,18 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 		params.Column = "id"
 		params.Identity = identity.ID
 	case identity.ProviderID != "":
+		id, err := s.linkedIdentityID(tx, identity.ProviderID)
+		if err != nil {
+			return errgo.Notef(err, "cannot update identity")
+		}
+		if id != "" {
+			// The identity has been found using a linked
+			// provider ID, don't rename it.
+			upd[store.Username] = store.NoUpdate
+			params.Column = "id"
+			params.Identity = id
+			break
+		}
 		if upd[store.Username] == store.Set {
 			tmpl = tmplUpsertIdentity
 		}
@@ -393,10 +486,91 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 			return errgo.Notef(err, "cannot update identity")
 		}
 	}
+	if err := s.updateLinkedProviderIDs(tx, identity, upd[store.LinkedProviderIDs]); err != nil {
+		return errgo.NoteMask(err, "cannot update identity", errgo.Is(store.ErrDuplicateProviderID))
+	}
 
 	return nil
 }
 
+// identitySetTables contains the tables holding the multi-valued
+// fields of an identity.
+var identitySetTables = []string{
+	"identity_groups",
+	"identity_publickeys",
+	"identity_providerinfo",
+	"identity_extrainfo",
+	"identity_linkedproviderids",
+}
+
+// RemoveIdentity implements store.Store.RemoveIdentity.
+func (s *identityStore) RemoveIdentity(_ context.Context, identity *store.Identity) error {
+	return errgo.Mask(s.withTx(func(tx *sql.Tx) error {
+		return s.removeIdentity(tx, identity)
+	}), errgo.Is(store.ErrNotFound))
+}
+
+func (s *identityStore) removeIdentity(tx *sql.Tx, identity *store.Identity) error {
+	params := updateIdentityParams{
+		argBuilder: s.driver.argBuilderFunc(),
+	}
+	switch {
+	case identity.ID != "":
+		if _, err := strconv.Atoi(identity.ID); err != nil {
+			// By definition if id isn't numeric it won't exist.
+			return store.NotFoundError(identity.ID, "", "")
+		}
+		params.Column = "id"
+		params.Identity = identity.ID
+	case identity.ProviderID != "":
+		id, err := s.linkedIdentityID(tx, identity.ProviderID)
+		if err != nil {
+			return errgo.Notef(err, "cannot remove identity")
+		}
+		if id != "" {
+			params.Column = "id"
+			params.Identity = id
+			break
+		}
+		params.Column = "providerid"
+		params.Identity = string(identity.ProviderID)
+	case identity.Username != "":
+		params.Column = "username"
+		params.Identity = identity.Username
+	default:
+		return store.NotFoundError("", "", "")
+	}
+	row, err := s.driver.queryRow(tx, tmplIdentityID, params)
+	if err != nil {
+		return errgo.Notef(err, "cannot remove identity")
+	}
+	var id string
+	if err := row.Scan(&id); err != nil {
+		if errgo.Cause(err) == sql.ErrNoRows {
+			return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+		}
+		return errgo.Notef(err, "cannot remove identity")
+	}
+	for _, table := range identitySetTables {
+		_, err := s.driver.exec(tx, tmplClearIdentitySet, &updateSetParams{
+			argBuilder: s.driver.argBuilderFunc(),
+			Table:      table,
+			ID:         id,
+		})
+		if err != nil {
+			return errgo.Notef(err, "cannot remove identity")
+		}
+	}
+	_, err = s.driver.exec(tx, tmplRemoveIdentity, &updateSetParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		ID:         id,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot remove identity")
+	}
+	return nil
+}
+
 type updateSetParams struct {
 	argBuilder
 	Table  string
@@ -478,6 +652,54 @@ func (s *identityStore) updateExtraInfo(tx *sql.Tx, id, key string, op store.Ope
 	return errgo.Mask(s.updateSet(tx, "identity_extrainfo", id, key, op, vals))
 }
 
+// updateLinkedProviderIDs applies the given operation to the linked
+// provider IDs of the given identity. Any provider ID that is added must
+// not be in use by another identity.
+func (s *identityStore) updateLinkedProviderIDs(tx *sql.Tx, identity *store.Identity, op store.Operation) error {
+	if op == store.Set || op == store.Push {
+		for _, pid := range identity.LinkedProviderIDs {
+			if err := s.checkProviderIDUnused(tx, identity.ID, pid); err != nil {
+				return errgo.Mask(err, errgo.Is(store.ErrDuplicateProviderID))
+			}
+		}
+	}
+	values := make([]interface{}, len(identity.LinkedProviderIDs))
+	for i, pid := range identity.LinkedProviderIDs {
+		values[i] = string(pid)
+	}
+	return errgo.Mask(s.updateSet(tx, "identity_linkedproviderids", identity.ID, "", op, values))
+}
+
+// checkProviderIDUnused checks that the given provider ID is not used by
+// any identity other than the one with the given ID.
+func (s *identityStore) checkProviderIDUnused(tx *sql.Tx, id string, pid store.ProviderIdentity) error {
+	params := updateIdentityParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Column:     "providerid",
+		Identity:   string(pid),
+	}
+	row, err := s.driver.queryRow(tx, tmplIdentityID, params)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var id1 string
+	err = row.Scan(&id1)
+	if err == nil {
+		return store.DuplicateProviderIDError(pid)
+	}
+	if errgo.Cause(err) != sql.ErrNoRows {
+		return errgo.Mask(err)
+	}
+	id1, err = s.linkedIdentityID(tx, pid)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if id1 != "" && id1 != id {
+		return store.DuplicateProviderIDError(pid)
+	}
+	return nil
+}
+
 type nullTime struct {
 	Time  time.Time
 	Valid bool
@@ -0,0 +1,86 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Helper functions for using security keys through the WebAuthn API.
+// Binary values are exchanged with the identity server as unpadded
+// base64url encoded strings.
+
+function webauthnDecode(s) {
+    s = s.replace(/-/g, '+').replace(/_/g, '/');
+    while (s.length % 4) {
+        s += '=';
+    }
+    var bin = atob(s);
+    var buf = new Uint8Array(bin.length);
+    for (var i = 0; i < bin.length; i++) {
+        buf[i] = bin.charCodeAt(i);
+    }
+    return buf.buffer;
+}
+
+function webauthnEncode(buf) {
+    if (!buf) {
+        return null;
+    }
+    var bytes = new Uint8Array(buf);
+    var bin = '';
+    for (var i = 0; i < bytes.length; i++) {
+        bin += String.fromCharCode(bytes[i]);
+    }
+    return btoa(bin).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function webauthnDecodeCredentials(creds) {
+    return (creds || []).map(function(c) {
+        return {type: c.type, id: webauthnDecode(c.id)};
+    });
+}
+
+// webauthnSubmit posts the given response in the given form.
+function webauthnSubmit(form, response) {
+    form.elements['response'].value = JSON.stringify(response);
+    form.submit();
+}
+
+function webauthnError(form, err) {
+    var msg = form.querySelector('.webauthn-error');
+    if (msg) {
+        msg.textContent = 'Security key operation failed: ' + err.message;
+        msg.style.display = '';
+    }
+}
+
+// webauthnCreate registers a new security key using the given creation
+// options and posts the result in the given form.
+function webauthnCreate(form, options) {
+    options.challenge = webauthnDecode(options.challenge);
+    options.user.id = webauthnDecode(options.user.id);
+    options.excludeCredentials = webauthnDecodeCredentials(options.excludeCredentials);
+    navigator.credentials.create({publicKey: options}).then(function(cred) {
+        webauthnSubmit(form, {
+            id: webauthnEncode(cred.rawId),
+            clientDataJSON: webauthnEncode(cred.response.clientDataJSON),
+            attestationObject: webauthnEncode(cred.response.attestationObject)
+        });
+    }).catch(function(err) {
+        webauthnError(form, err);
+    });
+}
+
+// webauthnGet authenticates with a security key using the given request
+// options and posts the result in the given form.
+function webauthnGet(form, options) {
+    options.challenge = webauthnDecode(options.challenge);
+    options.allowCredentials = webauthnDecodeCredentials(options.allowCredentials);
+    navigator.credentials.get({publicKey: options}).then(function(cred) {
+        webauthnSubmit(form, {
+            id: webauthnEncode(cred.rawId),
+            clientDataJSON: webauthnEncode(cred.response.clientDataJSON),
+            authenticatorData: webauthnEncode(cred.response.authenticatorData),
+            signature: webauthnEncode(cred.response.signature),
+            userHandle: webauthnEncode(cred.response.userHandle)
+        });
+    }).catch(function(err) {
+        webauthnError(form, err);
+    });
+}
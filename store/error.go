@@ -18,6 +18,11 @@ var (
 	// attempts to set a username that is already in use.
 	ErrDuplicateUsername = errgo.New("duplicate username")
 
+	// ErrDuplicateProviderID is the error cause used when an update
+	// attempts to link a provider ID that is already in use by
+	// another identity.
+	ErrDuplicateProviderID = errgo.New("duplicate provider id")
+
 	// ErrDuplicateKey is the error cause used when trying to set a
 	// new key in a KeyValueStore where the key already exists.
 	ErrDuplicateKey = errgo.New("duplicate key")
@@ -48,6 +53,14 @@ func DuplicateUsernameError(username string) error {
 	return err
 }
 
+// DuplicateProviderIDError creates a new error with a cause of
+// ErrDuplicateProviderID and an appropriate message.
+func DuplicateProviderIDError(providerID ProviderIdentity) error {
+	err := errgo.WithCausef(nil, ErrDuplicateProviderID, "provider id %s already in use", providerID)
+	err.(*errgo.Err).SetLocation(1)
+	return err
+}
+
 // KeyNotFoundError creates a new error with a cause of ErrNotFound and
 // an appropriate message.
 func KeyNotFoundError(key string) error {
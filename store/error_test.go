@@ -35,6 +35,12 @@ func (*errorSuite) TestDuplicateUsernameError(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, `username test-user already in use`)
 }
 
+func (*errorSuite) TestDuplicateProviderIDError(c *gc.C) {
+	err := store.DuplicateProviderIDError(store.MakeProviderIdentity("test", "test-user"))
+	c.Assert(errgo.Cause(err), gc.Equals, store.ErrDuplicateProviderID)
+	c.Assert(err, gc.ErrorMatches, `provider id test:test-user already in use`)
+}
+
 func (*errorSuite) TestDuplicateKeyError(c *gc.C) {
 	err := store.DuplicateKeyError("test-key")
 	c.Assert(errgo.Cause(err), gc.Equals, store.ErrDuplicateKey)
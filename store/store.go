@@ -27,6 +27,7 @@ const (
 	LastDischarge
 	ProviderInfo
 	ExtraInfo
+	LinkedProviderIDs
 	NumFields
 )
 
@@ -86,6 +87,14 @@ const (
 
 // A Filter is used in a Store.FindEntities call to specify how the
 // identities should be filtered.
+//
+// The only comparison supported for ProviderInfo is Equal, which
+// matches identities that have every value given in the reference
+// identity's ProviderInfo for each of its keys. Similarly the only
+// comparison supported for Groups is Equal, which matches identities
+// that are members of every group in the reference identity's Groups.
+// Filtering on PublicKeys, ExtraInfo and LinkedProviderIDs is not
+// supported.
 type Filter [NumFields]Comparison
 
 // A Sort specifies the sort order of returned identities in a call to
@@ -112,8 +121,10 @@ type Store interface {
 	// Identity reads the given identity from persistant storage and
 	// completes all the fields. The given identity will be matched
 	// using the first non-zero value of ID, ProviderID or Username.
-	// If no match can found for the given identity then an error
-	// with the cause ErrNotFound will be returned.
+	// A ProviderID matches either the ProviderID of an identity or
+	// any of its LinkedProviderIDs. If no match can found for the
+	// given identity then an error with the cause ErrNotFound will
+	// be returned.
 	Identity(ctx context.Context, identity *Identity) error
 
 	// FindIdentities searches for all identities that match the
@@ -140,7 +151,23 @@ type Store interface {
 	// perform. If the update would result in a duplicate username
 	// being used then an error with the cause ErrDuplicateUsername
 	// will be returned.
+	//
+	// As with Identity, a ProviderID also matches the
+	// LinkedProviderIDs of an identity. When an identity is matched
+	// by one of its linked provider IDs any update to the Username
+	// field is ignored, so that logging in through a linked identity
+	// provider does not rename the identity. If the update would
+	// result in a provider ID being used by more than one identity
+	// then an error with the cause ErrDuplicateProviderID will be
+	// returned.
 	UpdateIdentity(ctx context.Context, identity *Identity, update Update) error
+
+	// RemoveIdentity removes the given identity from persistent
+	// storage. The identity that is removed will be the one matching
+	// the first non-zero value of ID, ProviderID or Username. If
+	// there is no matching identity then an error with a cause of
+	// ErrNotFound will be returned.
+	RemoveIdentity(ctx context.Context, identity *Identity) error
 }
 
 // A ProviderIdentity is a provider-specific unique identity.
@@ -225,4 +252,10 @@ type Identity struct {
 	// stored with the identity, but is not directly required by the
 	// identity manager.
 	ExtraInfo map[string][]string
+
+	// LinkedProviderIDs contains the provider specific IDs of any
+	// other identities that have been linked to this one. Logging in
+	// as any of these identities results in this identity. A
+	// provider ID can be used by at most one identity.
+	LinkedProviderIDs []ProviderIdentity
 }
@@ -10,6 +10,7 @@ import (
 
 	"golang.org/x/net/context"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 
 	"github.com/CanonicalLtd/blues-identity/meeting"
 )
@@ -60,6 +61,7 @@ func (s *MeetingSuite) TestPutGetRemove(c *gc.C) {
 
 	addr, err = s.Store.Get(s.ctx, "y")
 	c.Assert(err, gc.ErrorMatches, "rendezvous not found, probably expired")
+	c.Assert(errgo.Cause(err), gc.Equals, meeting.ErrNotFound)
 
 	addr, err = s.Store.Get(s.ctx, "x")
 	c.Assert(err, gc.Equals, nil)
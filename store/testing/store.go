@@ -982,6 +982,226 @@ func (s *StoreSuite) TestIdentityNotFoundBadID(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, `identity "1234" not found`)
 }
 
+func (s *StoreSuite) TestRemoveIdentity(c *gc.C) {
+	for i, key := range []store.Identity{{
+		Username: "bob",
+	}, {
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	}} {
+		c.Logf("test %d. %#v", i, key)
+		identity := store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", "bob"),
+			Username:   "bob",
+			Groups:     []string{"g1"},
+			PublicKeys: []bakery.PublicKey{pk1},
+			ProviderInfo: map[string][]string{
+				"pf1": {"pf1v1"},
+			},
+			ExtraInfo: map[string][]string{
+				"ef1": {"ef1v1"},
+			},
+		}
+		err := s.Store.UpdateIdentity(s.ctx, &identity, store.Update{
+			store.Username:     store.Set,
+			store.Groups:       store.Set,
+			store.PublicKeys:   store.Set,
+			store.ProviderInfo: store.Set,
+			store.ExtraInfo:    store.Set,
+		})
+		c.Assert(err, gc.Equals, nil)
+
+		key := key
+		err = s.Store.RemoveIdentity(s.ctx, &key)
+		c.Assert(err, gc.Equals, nil)
+
+		err = s.Store.Identity(s.ctx, &store.Identity{Username: "bob"})
+		c.Assert(errgo.Cause(err), gc.Equals, store.ErrNotFound)
+		err = s.Store.Identity(s.ctx, &store.Identity{ID: identity.ID})
+		c.Assert(errgo.Cause(err), gc.Equals, store.ErrNotFound)
+	}
+}
+
+func (s *StoreSuite) TestRemoveIdentityByID(c *gc.C) {
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}
+	err := s.Store.UpdateIdentity(s.ctx, &identity, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	identity2 := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+	}
+	err = s.Store.UpdateIdentity(s.ctx, &identity2, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	err = s.Store.RemoveIdentity(s.ctx, &store.Identity{ID: identity.ID})
+	c.Assert(err, gc.Equals, nil)
+
+	// Other identities are unaffected.
+	id := store.Identity{ID: identity2.ID}
+	err = s.Store.Identity(s.ctx, &id)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id.Username, gc.Equals, "alice")
+	identities, err := s.Store.FindIdentities(s.ctx, &store.Identity{}, store.Filter{}, nil, 0, 0)
+	c.Assert(err, gc.Equals, nil)
+	for _, id := range identities {
+		c.Assert(id.Username, gc.Not(gc.Equals), "bob")
+	}
+
+	// A new identity can reuse the username.
+	identity3 := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob2"),
+		Username:   "bob",
+	}
+	err = s.Store.UpdateIdentity(s.ctx, &identity3, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *StoreSuite) TestRemoveIdentityNotFound(c *gc.C) {
+	err := s.Store.RemoveIdentity(s.ctx, &store.Identity{
+		Username: "no-such-user",
+	})
+	c.Assert(errgo.Cause(err), gc.Equals, store.ErrNotFound)
+	c.Assert(err, gc.ErrorMatches, `user no-such-user not found`)
+
+	err = s.Store.RemoveIdentity(s.ctx, &store.Identity{})
+	c.Assert(errgo.Cause(err), gc.Equals, store.ErrNotFound)
+}
+
+func (s *StoreSuite) TestLinkedProviderIDs(c *gc.C) {
+	bob := store.MakeProviderIdentity("test", "bob")
+	bob2 := store.MakeProviderIdentity("test2", "bob")
+	bob3 := store.MakeProviderIdentity("test3", "bob")
+	identity := store.Identity{
+		ProviderID:        bob,
+		Username:          "bob",
+		LinkedProviderIDs: []store.ProviderIdentity{bob2},
+	}
+	err := s.Store.UpdateIdentity(s.ctx, &identity, store.Update{
+		store.Username:          store.Set,
+		store.LinkedProviderIDs: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID:        bob,
+		LinkedProviderIDs: []store.ProviderIdentity{bob3},
+	}, store.Update{
+		store.LinkedProviderIDs: store.Push,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	// The identity can be found using any of its provider IDs.
+	for _, pid := range []store.ProviderIdentity{bob, bob2, bob3} {
+		obtained := store.Identity{
+			ProviderID: pid,
+		}
+		err = s.Store.Identity(s.ctx, &obtained)
+		c.Assert(err, gc.Equals, nil)
+		idmtest.AssertEqualIdentity(c, &obtained, &store.Identity{
+			ProviderID:        bob,
+			Username:          "bob",
+			LinkedProviderIDs: []store.ProviderIdentity{bob2, bob3},
+		})
+	}
+
+	// Updating the identity using a linked provider ID does not
+	// rename it or create a new identity.
+	update := store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	}
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID: bob2,
+		Username:   "bob2",
+		Name:       "Bob",
+	}, update)
+	c.Assert(err, gc.Equals, nil)
+	obtained := store.Identity{
+		Username: "bob",
+	}
+	err = s.Store.Identity(s.ctx, &obtained)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(obtained.Name, gc.Equals, "Bob")
+	err = s.Store.Identity(s.ctx, &store.Identity{Username: "bob2"})
+	c.Assert(errgo.Cause(err), gc.Equals, store.ErrNotFound)
+
+	// The caller's update is unchanged, so it can be used again to
+	// create a new identity.
+	c.Assert(update[store.Username], gc.Equals, store.Set)
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+		Name:       "Alice",
+	}, update)
+	c.Assert(err, gc.Equals, nil)
+	err = s.Store.Identity(s.ctx, &store.Identity{Username: "alice"})
+	c.Assert(err, gc.Equals, nil)
+
+	// Unlinking a provider ID means it no longer finds the identity.
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID:        bob,
+		LinkedProviderIDs: []store.ProviderIdentity{bob3},
+	}, store.Update{
+		store.LinkedProviderIDs: store.Pull,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = s.Store.Identity(s.ctx, &store.Identity{ProviderID: bob3})
+	c.Assert(errgo.Cause(err), gc.Equals, store.ErrNotFound)
+
+	// The identity can be removed using a linked provider ID.
+	err = s.Store.RemoveIdentity(s.ctx, &store.Identity{ProviderID: bob2})
+	c.Assert(err, gc.Equals, nil)
+	err = s.Store.Identity(s.ctx, &store.Identity{Username: "bob"})
+	c.Assert(errgo.Cause(err), gc.Equals, store.ErrNotFound)
+}
+
+func (s *StoreSuite) TestLinkedProviderIDDuplicate(c *gc.C) {
+	bob := store.MakeProviderIdentity("test", "bob")
+	alice := store.MakeProviderIdentity("test", "alice")
+	alice2 := store.MakeProviderIdentity("test2", "alice")
+	err := s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID: bob,
+		Username:   "bob",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID:        alice,
+		Username:          "alice",
+		LinkedProviderIDs: []store.ProviderIdentity{alice2},
+	}, store.Update{
+		store.Username:          store.Set,
+		store.LinkedProviderIDs: store.Set,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	for i, pid := range []store.ProviderIdentity{bob, alice, alice2} {
+		c.Logf("test %d. %s", i, pid)
+		err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+			Username:          "bob",
+			LinkedProviderIDs: []store.ProviderIdentity{pid},
+		}, store.Update{
+			store.LinkedProviderIDs: store.Push,
+		})
+		c.Assert(errgo.Cause(err), gc.Equals, store.ErrDuplicateProviderID)
+		c.Assert(err, gc.ErrorMatches, fmt.Sprintf(`.*provider id %s already in use`, pid))
+	}
+	id := store.Identity{
+		Username: "bob",
+	}
+	err = s.Store.Identity(s.ctx, &id)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(id.LinkedProviderIDs, gc.HasLen, 0)
+}
+
 var testIdentities = []store.Identity{{
 	ProviderID:    store.MakeProviderIdentity("test", "test1"),
 	Username:      "test1",
@@ -1002,6 +1222,7 @@ var testIdentities = []store.Identity{{
 	Username:      "test2",
 	Name:          "Test User 2",
 	Email:         "test2@example.com",
+	Groups:        []string{"g2", "g3"},
 	LastLogin:     time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC),
 	LastDischarge: time.Date(2017, 2, 8, 0, 0, 0, 0, time.UTC),
 }, {
@@ -1311,6 +1532,75 @@ var findIdentitiesTests = []struct {
 		store.Username: store.GreaterThanOrEqual,
 	},
 	expect: []int{6, 7, 8},
+}, {
+	about: "provider info equal",
+	ref: store.Identity{
+		ProviderInfo: map[string][]string{
+			"pf1": {"pf1v2"},
+		},
+	},
+	filter: store.Filter{
+		store.ProviderInfo: store.Equal,
+	},
+	expect: []int{0},
+}, {
+	about: "provider info equal - all values",
+	ref: store.Identity{
+		ProviderInfo: map[string][]string{
+			"pf1": {"pf1v2", "pf1v1"},
+		},
+	},
+	filter: store.Filter{
+		store.ProviderInfo: store.Equal,
+	},
+	expect: []int{0},
+}, {
+	about: "provider info equal - missing value",
+	ref: store.Identity{
+		ProviderInfo: map[string][]string{
+			"pf1": {"pf1v1", "pf1v3"},
+		},
+	},
+	filter: store.Filter{
+		store.ProviderInfo: store.Equal,
+	},
+}, {
+	about: "provider info equal - value in other key",
+	ref: store.Identity{
+		ProviderInfo: map[string][]string{
+			"pf2": {"pf1v1"},
+		},
+	},
+	filter: store.Filter{
+		store.ProviderInfo: store.Equal,
+	},
+}, {
+	about: "groups equal",
+	ref: store.Identity{
+		Groups: []string{"g2"},
+	},
+	filter: store.Filter{
+		store.Groups: store.Equal,
+	},
+	sort:   []store.Sort{{Field: store.Username}},
+	expect: []int{0, 1},
+}, {
+	about: "groups equal - all values",
+	ref: store.Identity{
+		Groups: []string{"g2", "g1"},
+	},
+	filter: store.Filter{
+		store.Groups: store.Equal,
+	},
+	expect: []int{0},
+}, {
+	about: "groups equal - missing value",
+	ref: store.Identity{
+		Groups: []string{"g1", "g3"},
+	},
+	filter: store.Filter{
+		store.Groups: store.Equal,
+	},
 }, {
 	about: "match not equal to",
 	ref: store.Identity{